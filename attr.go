@@ -28,6 +28,7 @@ func (n *AttributeDecl) SetTreeDoc(doc *Document) {
 
 func newAttribute(name string, ns *Namespace) *Attribute {
 	attr := &Attribute{}
+	attr.etype = AttributeNode
 	attr.name = name
 	attr.ns = ns
 	return attr
@@ -75,10 +76,24 @@ func (n Attribute) Value() string {
 	return string(n.Content())
 }
 
+// Name returns the qualified name of the attribute
+func (n Attribute) Name() string {
+	if ns := n.ns; ns != nil && ns.Prefix() != "" {
+		return ns.Prefix() + ":" + n.name
+	}
+	return n.name
+}
+
 func (n Attribute) Prefix() string {
-	return n.ns.Prefix()
+	if ns := n.ns; ns != nil {
+		return ns.Prefix()
+	}
+	return ""
 }
 
 func (n Attribute) URI() string {
-	return n.ns.URI()
+	if ns := n.ns; ns != nil {
+		return ns.URI()
+	}
+	return ""
 }
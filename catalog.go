@@ -0,0 +1,698 @@
+package helium
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/lestrrat/helium/internal/debug"
+)
+
+// CatalogNamespace is the namespace of OASIS XML catalog documents
+const CatalogNamespace = "urn:oasis:names:tc:entity:xmlns:xml:catalog"
+
+// maxCatalogDepth limits the chain of nextCatalog and delegate
+// entries that are followed, like libxml2's MAX_CATAL_DEPTH
+const maxCatalogDepth = 50
+
+type catalogEntryType int
+
+const (
+	catalogPublic catalogEntryType = iota
+	catalogSystem
+	catalogRewriteSystem
+	catalogSystemSuffix
+	catalogDelegatePublic
+	catalogDelegateSystem
+	catalogURI
+	catalogRewriteURI
+	catalogURISuffix
+	catalogDelegateURI
+	catalogNextCatalog
+)
+
+var catalogEntryTypes = map[string]catalogEntryType{
+	"public":         catalogPublic,
+	"system":         catalogSystem,
+	"rewriteSystem":  catalogRewriteSystem,
+	"systemSuffix":   catalogSystemSuffix,
+	"delegatePublic": catalogDelegatePublic,
+	"delegateSystem": catalogDelegateSystem,
+	"uri":            catalogURI,
+	"rewriteURI":     catalogRewriteURI,
+	"uriSuffix":      catalogURISuffix,
+	"delegateURI":    catalogDelegateURI,
+	"nextCatalog":    catalogNextCatalog,
+}
+
+// the attributes that hold the identifier, and the replacement of
+// each type of entry in an XML catalog
+var catalogEntryAttrs = map[catalogEntryType][2]string{
+	catalogPublic:         {"publicId", "uri"},
+	catalogSystem:         {"systemId", "uri"},
+	catalogRewriteSystem:  {"systemIdStartString", "rewritePrefix"},
+	catalogSystemSuffix:   {"systemIdSuffix", "uri"},
+	catalogDelegatePublic: {"publicIdStartString", "catalog"},
+	catalogDelegateSystem: {"systemIdStartString", "catalog"},
+	catalogURI:            {"name", "uri"},
+	catalogRewriteURI:     {"uriStartString", "rewritePrefix"},
+	catalogURISuffix:      {"uriSuffix", "uri"},
+	catalogDelegateURI:    {"uriStartString", "catalog"},
+	catalogNextCatalog:    {"", "catalog"},
+}
+
+type catalogEntry struct {
+	etype        catalogEntryType
+	name         string // the identifier, prefix or suffix to match
+	value        string // the replacement, or the location of a catalog
+	preferPublic bool
+
+	// catalog referred to by nextCatalog and delegate entries,
+	// which is loaded the first time it is needed
+	mu      sync.Mutex
+	catalog *Catalog
+}
+
+// catalogLoader loads the catalog located at uri, which is referred to
+// by a nextCatalog or delegate entry
+type catalogLoader func(uri string) (*Catalog, error)
+
+// Catalog maps public identifiers, system identifiers and URIs to
+// other (usually local) resources, like libxml2's xmlCatalog. Both
+// OASIS XML catalogs and SGML catalogs are supported.
+type Catalog struct {
+	mu      sync.RWMutex
+	entries []*catalogEntry
+}
+
+var (
+	defaultCatalogMutex sync.RWMutex
+	defaultCatalog      *Catalog
+)
+
+// SetDefaultCatalog sets the catalog that is consulted by parsers
+// that do not have their own (see Parser.SetCatalog). Passing nil
+// disables the default catalog.
+func SetDefaultCatalog(c *Catalog) {
+	defaultCatalogMutex.Lock()
+	defaultCatalog = c
+	defaultCatalogMutex.Unlock()
+}
+
+// DefaultCatalog returns the package-wide catalog, if any
+func DefaultCatalog() *Catalog {
+	defaultCatalogMutex.RLock()
+	defer defaultCatalogMutex.RUnlock()
+	return defaultCatalog
+}
+
+// NewCatalog creates an empty catalog
+func NewCatalog() *Catalog {
+	return &Catalog{}
+}
+
+// LoadCatalog loads the XML or SGML catalog located at uri. The
+// format is detected from the content: XML catalogs start with '<'.
+func LoadCatalog(uri string) (*Catalog, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START LoadCatalog '%s'", uri)
+		defer g.IRelease("END LoadCatalog")
+	}
+
+	return loadCatalog(DefaultEntityLoader, uri)
+}
+
+// loadCatalog loads the catalog located at uri with the EntityLoader l
+func loadCatalog(l EntityLoader, uri string) (*Catalog, error) {
+	in, err := l(uri, "")
+	if err != nil {
+		return nil, err
+	}
+	if in == nil || in.Reader == nil {
+		return nil, errors.New("failed to load catalog '" + uri + "'")
+	}
+	defer closeInput(in)
+	if in.URI == "" {
+		in.URI = uri
+	}
+
+	b, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NewCatalog()
+	content := bytes.TrimLeftFunc(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf")), unicode.IsSpace)
+	if len(content) > 0 && content[0] == '<' {
+		err = c.parseXML(b, in.URI)
+	} else {
+		err = c.parseSGML(string(content), in.URI)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load catalog '%s': %s", uri, err)
+	}
+	return c, nil
+}
+
+// AddCatalog appends a reference to the catalog located at uri, which
+// is consulted when this catalog does not resolve an identifier. The
+// catalog is not loaded until it is needed.
+func (c *Catalog) AddCatalog(uri string) {
+	c.add(&catalogEntry{etype: catalogNextCatalog, value: uri})
+}
+
+// Add adds an entry to the catalog, like xmlACatalogAdd. typ is the name
+// of an OASIS catalog entry ("public", "system", "rewriteSystem",
+// "systemSuffix", "delegatePublic", "delegateSystem", "uri", "rewriteURI",
+// "uriSuffix", "delegateURI" or "nextCatalog"), orig is the identifier
+// it matches, and replace is the replacement URI or catalog location.
+func (c *Catalog) Add(typ, orig, replace string) error {
+	etype, ok := catalogEntryTypes[typ]
+	if !ok {
+		return errors.New("unknown catalog entry type '" + typ + "'")
+	}
+	if etype == catalogPublic || etype == catalogDelegatePublic {
+		orig = normalizePublicID(orig)
+	}
+	c.add(&catalogEntry{etype: etype, name: orig, value: replace, preferPublic: true})
+	return nil
+}
+
+func (c *Catalog) add(e *catalogEntry) {
+	c.mu.Lock()
+	c.entries = append(c.entries, e)
+	c.mu.Unlock()
+}
+
+func (c *Catalog) list() []*catalogEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.entries
+}
+
+// Resolve resolves an external identifier. It returns the empty string
+// if neither publicID nor systemID are found in the catalog.
+func (c *Catalog) Resolve(publicID, systemID string) string {
+	if debug.Enabled {
+		g := debug.IPrintf("START Catalog.Resolve '%s' '%s'", publicID, systemID)
+		defer g.IRelease("END Catalog.Resolve")
+	}
+
+	return c.resolve(publicID, systemID, LoadCatalog)
+}
+
+// resolve resolves an external identifier, loading the catalogs that
+// are referred to with load
+func (c *Catalog) resolve(publicID, systemID string, load catalogLoader) string {
+	publicID, systemID = unwrapExternalID(publicID, systemID)
+	if publicID == "" && systemID == "" {
+		return ""
+	}
+	s, _ := c.resolveExternalID(publicID, systemID, load, 0)
+	return s
+}
+
+// ResolvePublic resolves a public identifier
+func (c *Catalog) ResolvePublic(publicID string) string {
+	return c.Resolve(publicID, "")
+}
+
+// ResolveSystem resolves a system identifier
+func (c *Catalog) ResolveSystem(systemID string) string {
+	return c.Resolve("", systemID)
+}
+
+// ResolveURI resolves a URI reference using the uri, rewriteURI,
+// uriSuffix and delegateURI entries
+func (c *Catalog) ResolveURI(uri string) string {
+	if uri == "" {
+		return ""
+	}
+	s, _ := c.resolveURI(uri, LoadCatalog, 0)
+	return s
+}
+
+// resolveExternalID implements the resolution of external identifiers
+// as described in section 7.1.2 of the OASIS XML catalogs specification.
+// The boolean return value reports if the search should stop, which is
+// the case when a match was found, or when delegation failed.
+func (c *Catalog) resolveExternalID(publicID, systemID string, load catalogLoader, depth int) (string, bool) {
+	if depth > maxCatalogDepth {
+		return "", true
+	}
+
+	entries := c.list()
+	if systemID != "" {
+		if e := matchEntry(entries, catalogSystem, systemID, false); e != nil {
+			return e.value, true
+		}
+		if e := matchEntry(entries, catalogRewriteSystem, systemID, true); e != nil {
+			return e.value + systemID[len(e.name):], true
+		}
+		if e := matchSuffixEntry(entries, catalogSystemSuffix, systemID); e != nil {
+			return e.value, true
+		}
+		if delegates := matchDelegates(entries, catalogDelegateSystem, systemID, true, load); len(delegates) > 0 {
+			for _, d := range delegates {
+				if s, _ := d.resolveExternalID("", systemID, load, depth+1); s != "" {
+					return s, true
+				}
+			}
+			return "", true
+		}
+	}
+
+	if publicID != "" {
+		for _, e := range entries {
+			if e.etype == catalogPublic && e.name == publicID && (systemID == "" || e.preferPublic) {
+				return e.value, true
+			}
+		}
+		if delegates := matchDelegates(entries, catalogDelegatePublic, publicID, systemID == "", load); len(delegates) > 0 {
+			for _, d := range delegates {
+				if s, _ := d.resolveExternalID(publicID, "", load, depth+1); s != "" {
+					return s, true
+				}
+			}
+			return "", true
+		}
+	}
+
+	for _, e := range entries {
+		if e.etype != catalogNextCatalog {
+			continue
+		}
+		if next := e.load(load); next != nil {
+			if s, done := next.resolveExternalID(publicID, systemID, load, depth+1); done {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (c *Catalog) resolveURI(uri string, load catalogLoader, depth int) (string, bool) {
+	if depth > maxCatalogDepth {
+		return "", true
+	}
+
+	entries := c.list()
+	if e := matchEntry(entries, catalogURI, uri, false); e != nil {
+		return e.value, true
+	}
+	if e := matchEntry(entries, catalogRewriteURI, uri, true); e != nil {
+		return e.value + uri[len(e.name):], true
+	}
+	if e := matchSuffixEntry(entries, catalogURISuffix, uri); e != nil {
+		return e.value, true
+	}
+	if delegates := matchDelegates(entries, catalogDelegateURI, uri, true, load); len(delegates) > 0 {
+		for _, d := range delegates {
+			if s, _ := d.resolveURI(uri, load, depth+1); s != "" {
+				return s, true
+			}
+		}
+		return "", true
+	}
+
+	for _, e := range entries {
+		if e.etype != catalogNextCatalog {
+			continue
+		}
+		if next := e.load(load); next != nil {
+			if s, done := next.resolveURI(uri, load, depth+1); done {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
+
+// matchEntry returns the entry of type etype that matches id exactly,
+// or when prefix is true, the one with the longest matching prefix
+func matchEntry(entries []*catalogEntry, etype catalogEntryType, id string, prefix bool) *catalogEntry {
+	var found *catalogEntry
+	for _, e := range entries {
+		if e.etype != etype {
+			continue
+		}
+		if !prefix {
+			if e.name == id {
+				return e
+			}
+			continue
+		}
+		if strings.HasPrefix(id, e.name) && (found == nil || len(e.name) > len(found.name)) {
+			found = e
+		}
+	}
+	return found
+}
+
+// matchSuffixEntry returns the entry of type etype with the longest
+// suffix of id
+func matchSuffixEntry(entries []*catalogEntry, etype catalogEntryType, id string) *catalogEntry {
+	var found *catalogEntry
+	for _, e := range entries {
+		if e.etype == etype && strings.HasSuffix(id, e.name) && (found == nil || len(e.name) > len(found.name)) {
+			found = e
+		}
+	}
+	return found
+}
+
+// matchDelegates returns the catalogs of the delegate entries whose
+// prefix matches id, longest prefix first. Entries that do not prefer
+// public identifiers are skipped unless usePublic is true. The catalogs
+// are loaded with load.
+func matchDelegates(entries []*catalogEntry, etype catalogEntryType, id string, usePublic bool, load catalogLoader) []*Catalog {
+	var matches []*catalogEntry
+	for _, e := range entries {
+		if e.etype == etype && strings.HasPrefix(id, e.name) && (usePublic || e.preferPublic) {
+			matches = append(matches, e)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return len(matches[i].name) > len(matches[j].name)
+	})
+
+	var catalogs []*Catalog
+	seen := map[string]struct{}{}
+	for _, e := range matches {
+		if _, ok := seen[e.value]; ok {
+			continue
+		}
+		seen[e.value] = struct{}{}
+		if d := e.load(load); d != nil {
+			catalogs = append(catalogs, d)
+		}
+	}
+	return catalogs
+}
+
+// load loads the catalog that the entry refers to with load. Catalogs
+// that cannot be loaded are ignored, as libxml2 does. The failures are
+// not remembered, as the catalog may be loaded by a later parse whose
+// EntityLoader or options allow it.
+func (e *catalogEntry) load(load catalogLoader) *Catalog {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.catalog == nil {
+		c, err := load(e.value)
+		if err != nil {
+			if debug.Enabled {
+				debug.Printf("failed to load catalog: %s", err)
+			}
+			return nil
+		}
+		e.catalog = c
+	}
+	return e.catalog
+}
+
+// normalizePublicID normalizes the white space in a public identifier
+func normalizePublicID(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+const urnPublicIDPrefix = "urn:publicid:"
+
+// unwrapExternalID normalizes the public identifier, and unwraps
+// public identifiers that were given as urn:publicid: URNs
+func unwrapExternalID(publicID, systemID string) (string, string) {
+	if strings.HasPrefix(publicID, urnPublicIDPrefix) {
+		publicID = unwrapURN(publicID)
+	}
+	if strings.HasPrefix(systemID, urnPublicIDPrefix) {
+		if s := unwrapURN(systemID); publicID == "" {
+			publicID = s
+		}
+		systemID = ""
+	}
+	return normalizePublicID(publicID), systemID
+}
+
+// unwrapURN transcribes a urn:publicid: URN back to a public
+// identifier, as described in RFC 3151
+func unwrapURN(urn string) string {
+	var buf strings.Builder
+	s := urn[len(urnPublicIDPrefix):]
+	for len(s) > 0 {
+		switch {
+		case s[0] == '+':
+			buf.WriteByte(' ')
+		case s[0] == ':':
+			buf.WriteString("//")
+		case s[0] == ';':
+			buf.WriteString("::")
+		case s[0] == '%' && len(s) >= 3:
+			if v, err := url.PathUnescape(s[:3]); err == nil {
+				buf.WriteString(v)
+				s = s[3:]
+				continue
+			}
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte(s[0])
+		}
+		s = s[1:]
+	}
+	return buf.String()
+}
+
+// parseXML reads the entries of an OASIS XML catalog
+func (c *Catalog) parseXML(b []byte, uri string) error {
+	doc, err := NewParser().parse(bytes.NewReader(b), uri)
+	if err != nil {
+		return err
+	}
+
+	var root *Element
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		if e, ok := n.(*Element); ok {
+			root = e
+			break
+		}
+	}
+	if root == nil || root.LocalName() != "catalog" || root.URI() != CatalogNamespace {
+		return errors.New("root element is not an OASIS XML catalog")
+	}
+
+	c.parseXMLEntries(root, uri, true)
+	return nil
+}
+
+func (c *Catalog) parseXMLEntries(parent *Element, base string, preferPublic bool) {
+	base, preferPublic = catalogScope(parent, base, preferPublic)
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		e, ok := n.(*Element)
+		if !ok || e.URI() != CatalogNamespace {
+			continue
+		}
+
+		if e.LocalName() == "group" {
+			c.parseXMLEntries(e, base, preferPublic)
+			continue
+		}
+
+		etype, ok := catalogEntryTypes[e.LocalName()]
+		if !ok {
+			continue
+		}
+
+		ebase, eprefer := catalogScope(e, base, preferPublic)
+		attrs := catalogEntryAttrs[etype]
+		var name string
+		if attrs[0] != "" {
+			if name, ok = catalogAttribute(e, attrs[0]); !ok {
+				continue
+			}
+		}
+		value, ok := catalogAttribute(e, attrs[1])
+		if !ok {
+			continue
+		}
+		if etype == catalogPublic || etype == catalogDelegatePublic {
+			name = normalizePublicID(name)
+		}
+
+		c.add(&catalogEntry{
+			etype:        etype,
+			name:         name,
+			value:        buildURI(value, ebase),
+			preferPublic: eprefer,
+		})
+	}
+}
+
+// catalogScope applies the xml:base and prefer attributes of e
+func catalogScope(e *Element, base string, preferPublic bool) (string, bool) {
+	for _, attr := range e.Attributes() {
+		switch {
+		case attr.Name() == "xml:base" || (attr.LocalName() == "base" && attr.ns != nil && attr.ns.URI() == XMLNamespace):
+			base = buildURI(attr.Value(), base)
+		case attr.LocalName() == "prefer" && attr.ns == nil:
+			preferPublic = attr.Value() != "system"
+		}
+	}
+	return base, preferPublic
+}
+
+func catalogAttribute(e *Element, name string) (string, bool) {
+	for _, attr := range e.Attributes() {
+		if attr.LocalName() == name && attr.ns == nil {
+			return attr.Value(), true
+		}
+	}
+	return "", false
+}
+
+// parseSGML reads the entries of an SGML catalog, like
+// xmlParseSGMLCatalog. Entries that have no XML equivalent are skipped.
+func (c *Catalog) parseSGML(s, uri string) error {
+	base := uri
+	preferPublic := true
+
+	tokens, err := sgmlCatalogTokens(s)
+	if err != nil {
+		return err
+	}
+
+	args := func(n int) ([]string, error) {
+		if len(tokens) < n {
+			return nil, errors.New("missing arguments in SGML catalog")
+		}
+		ret := tokens[:n]
+		tokens = tokens[n:]
+		return ret, nil
+	}
+
+	for len(tokens) > 0 {
+		keyword := strings.ToUpper(tokens[0])
+		tokens = tokens[1:]
+
+		var nargs int
+		switch keyword {
+		case "PUBLIC", "SYSTEM", "DELEGATE", "DOCTYPE", "ENTITY", "LINKTYPE", "NOTATION":
+			nargs = 2
+		case "CATALOG", "BASE", "OVERRIDE", "SGMLDECL", "DOCUMENT", "DTDDECL":
+			nargs = 1
+		default:
+			return errors.New("unknown SGML catalog entry '" + keyword + "'")
+		}
+
+		v, err := args(nargs)
+		if err != nil {
+			return err
+		}
+
+		switch keyword {
+		case "PUBLIC":
+			c.add(&catalogEntry{etype: catalogPublic, name: normalizePublicID(v[0]), value: buildURI(v[1], base), preferPublic: preferPublic})
+		case "SYSTEM":
+			c.add(&catalogEntry{etype: catalogSystem, name: v[0], value: buildURI(v[1], base)})
+		case "DELEGATE":
+			c.add(&catalogEntry{etype: catalogDelegatePublic, name: normalizePublicID(v[0]), value: buildURI(v[1], base), preferPublic: preferPublic})
+		case "CATALOG":
+			c.add(&catalogEntry{etype: catalogNextCatalog, value: buildURI(v[0], base)})
+		case "BASE":
+			base = buildURI(v[0], base)
+		case "OVERRIDE":
+			preferPublic = strings.EqualFold(v[0], "yes")
+		}
+	}
+	return nil
+}
+
+// sgmlCatalogTokens splits an SGML catalog in to names and quoted
+// literals, dropping "--" comments
+func sgmlCatalogTokens(s string) ([]string, error) {
+	var tokens []string
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		switch {
+		case s == "":
+			return tokens, nil
+		case strings.HasPrefix(s, "--"):
+			i := strings.Index(s[2:], "--")
+			if i < 0 {
+				return nil, errors.New("unterminated comment in SGML catalog")
+			}
+			s = s[i+4:]
+		case s[0] == '"' || s[0] == '\'':
+			i := strings.IndexByte(s[1:], s[0])
+			if i < 0 {
+				return nil, errors.New("unterminated literal in SGML catalog")
+			}
+			tokens = append(tokens, s[1:i+1])
+			s = s[i+2:]
+		default:
+			i := strings.IndexFunc(s, unicode.IsSpace)
+			if i < 0 {
+				i = len(s)
+			}
+			tokens = append(tokens, s[:i])
+			s = s[i:]
+		}
+	}
+}
+
+// SetCatalog sets the catalog that is consulted by this parser before
+// loading external entities, instead of the package-wide one
+func (p *Parser) SetCatalog(c *Catalog) {
+	p.catalog = c
+}
+
+// currentCatalog returns the catalog of the parser, or the default
+// catalog
+func (ctx *parserCtx) currentCatalog() *Catalog {
+	if c := ctx.catalog; c != nil {
+		return c
+	}
+	return DefaultCatalog()
+}
+
+// resolveCatalog maps the external identifier through the catalog
+// of the parser, or the default catalog. It returns uri unchanged if
+// there is no match.
+func (ctx *parserCtx) resolveCatalog(uri, publicID string) string {
+	c := ctx.currentCatalog()
+	if c == nil {
+		return uri
+	}
+	if s := c.resolve(publicID, uri, ctx.loadCatalog); s != "" {
+		return s
+	}
+	return uri
+}
+
+// resolveCatalogURI maps a URI reference, such as the href of an
+// xi:include element, through the uri entries of the catalog of the
+// parser, or of the default catalog. It returns uri unchanged if there
+// is no match.
+func (ctx *parserCtx) resolveCatalogURI(uri string) string {
+	c := ctx.currentCatalog()
+	if c == nil || uri == "" {
+		return uri
+	}
+	if s, _ := c.resolveURI(uri, ctx.loadCatalog, 0); s != "" {
+		return s
+	}
+	return uri
+}
+
+// loadCatalog loads a catalog that is referred to by another one with
+// the EntityLoader of this parse. With ParseNoNet, only local catalogs
+// may be loaded.
+func (ctx *parserCtx) loadCatalog(uri string) (*Catalog, error) {
+	if ctx.options.IsSet(ParseNoNet) && !isLocalURI(uri) {
+		return nil, fmt.Errorf("failed to load catalog '%s': network access is forbidden", uri)
+	}
+	return loadCatalog(ctx.entityLoader(), uri)
+}
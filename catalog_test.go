@@ -0,0 +1,181 @@
+package helium
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat/helium/sax"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalogResolve(t *testing.T) {
+	c, err := LoadCatalog(filepath.Join("test", "catalog", "catalog.xml"))
+	if !assert.NoError(t, err, "LoadCatalog should succeed") {
+		return
+	}
+
+	dtd := func(name string) string {
+		return filepath.Join("test", "catalog", "dtd", name)
+	}
+
+	tests := []struct {
+		name     string
+		publicID string
+		systemID string
+		expected string
+	}{
+		{"public", "-//EXAMPLE//DTD Doc//EN", "", dtd("doc.dtd")},
+		{"public as URN", "urn:publicid:-:EXAMPLE:DTD+Doc:EN", "", dtd("doc.dtd")},
+		{"system", "", "http://example.com/doc.dtd", dtd("doc.dtd")},
+		{"rewriteSystem", "", "http://example.com/dtds/sgml.dtd", dtd("sgml.dtd")},
+		{"delegatePublic", "-//DELEGATED//DTD Doc//EN", "", dtd("delegated.dtd")},
+		{"failed delegation", "-//DELEGATED//DTD Unknown//EN", "", ""},
+		{"prefer system without system ID", "-//EXAMPLE//DTD System Preferred//EN", "", dtd("preferred.dtd")},
+		{"prefer system with system ID", "-//EXAMPLE//DTD System Preferred//EN", "unknown.dtd", ""},
+		{"SGML catalog public", "-//EXAMPLE//DTD SGML//EN", "", dtd("sgml.dtd")},
+		{"SGML catalog system", "", "http://example.com/sgml.dtd", dtd("sgml.dtd")},
+		{"no match", "-//EXAMPLE//DTD Unknown//EN", "http://example.com/unknown.dtd", ""},
+	}
+
+	for _, test := range tests {
+		if !assert.Equal(t, test.expected, c.Resolve(test.publicID, test.systemID), test.name) {
+			return
+		}
+	}
+}
+
+func TestCatalogAdd(t *testing.T) {
+	c := NewCatalog()
+	if !assert.NoError(t, c.Add("uri", "http://example.com/a.xsl", "/local/a.xsl"), "Add should succeed") ||
+		!assert.NoError(t, c.Add("rewriteURI", "http://example.com/lib/", "/local/lib/"), "Add should succeed") {
+		return
+	}
+	if !assert.Error(t, c.Add("bogus", "a", "b"), "Add should fail for unknown entry types") {
+		return
+	}
+
+	if !assert.Equal(t, "/local/a.xsl", c.ResolveURI("http://example.com/a.xsl"), "uri matches") ||
+		!assert.Equal(t, "/local/lib/x/b.xsl", c.ResolveURI("http://example.com/lib/x/b.xsl"), "rewriteURI matches") ||
+		!assert.Equal(t, "", c.ResolveURI("http://example.org/"), "unknown URIs are not resolved") {
+		return
+	}
+}
+
+func TestParseWithCatalog(t *testing.T) {
+	c, err := LoadCatalog(filepath.Join("test", "catalog", "catalog.xml"))
+	if !assert.NoError(t, err, "LoadCatalog should succeed") {
+		return
+	}
+
+	var requested []string
+	loader := func(uri, publicID string) (*sax.ParseInput, error) {
+		requested = append(requested, uri)
+		return DefaultEntityLoader(uri, publicID)
+	}
+
+	const input = `<!DOCTYPE doc PUBLIC "-//EXAMPLE//DTD Doc//EN" "http://example.com/doc.dtd"><doc>&greeting;</doc>`
+
+	p := NewParser()
+	p.SetCatalog(c)
+	p.SetEntityLoader(loader)
+	if !assert.NoError(t, p.SetOption(ParseNoEnt|ParseNoNet), "SetOption should succeed") {
+		return
+	}
+
+	doc, err := p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Equal(t, "hello from the catalog", string(doc.FirstChild().NextSibling().Content()), "DTD is loaded from the catalog") {
+		return
+	}
+	if !assert.Equal(t, []string{filepath.Join("test", "catalog", "dtd", "doc.dtd")}, requested, "loader receives the resolved URI") {
+		return
+	}
+
+	// Without a catalog entry, ParseNoNet does not let the loader
+	// fetch the DTD over the network
+	requested = nil
+	p.SetCatalog(NewCatalog())
+	doc, err = p.Parse([]byte(`<!DOCTYPE doc SYSTEM "http://example.com/unknown.dtd"><doc/>`))
+	if !assert.NoError(t, err, "a DTD that cannot be loaded is not fatal") {
+		return
+	}
+	if !assert.Nil(t, doc.ExtSubset(), "external subset is not loaded") ||
+		!assert.Empty(t, requested, "loader is not called for network URIs") {
+		return
+	}
+}
+
+func TestParseWithNextCatalog(t *testing.T) {
+	var requested []string
+	loader := func(uri, publicID string) (*sax.ParseInput, error) {
+		requested = append(requested, uri)
+		return DefaultEntityLoader(uri, publicID)
+	}
+
+	// the catalogs that are referred to are loaded with the loader of
+	// the parser
+	c := NewCatalog()
+	c.AddCatalog(filepath.Join("test", "catalog", "catalog.xml"))
+
+	p := NewParser()
+	p.SetCatalog(c)
+	p.SetEntityLoader(loader)
+	if !assert.NoError(t, p.SetOption(ParseNoEnt|ParseNoNet), "SetOption should succeed") {
+		return
+	}
+
+	doc, err := p.Parse([]byte(`<!DOCTYPE doc SYSTEM "http://example.com/doc.dtd"><doc>&greeting;</doc>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Equal(t, "hello from the catalog", string(doc.FirstChild().NextSibling().Content()), "DTD is loaded from the next catalog") {
+		return
+	}
+	expected := []string{
+		filepath.Join("test", "catalog", "catalog.xml"),
+		filepath.Join("test", "catalog", "dtd", "doc.dtd"),
+	}
+	if !assert.Equal(t, expected, requested, "loader receives the next catalog") {
+		return
+	}
+
+	// ParseNoNet does not let the loader fetch a catalog over the network
+	requested = nil
+	c = NewCatalog()
+	c.AddCatalog("http://example.com/catalog.xml")
+	p.SetCatalog(c)
+	if _, err := p.Parse([]byte(`<!DOCTYPE doc SYSTEM "doc.dtd"><doc/>`)); !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Equal(t, []string{"doc.dtd"}, requested, "loader is not called for network catalogs") {
+		return
+	}
+}
+
+func TestXIncludeWithCatalog(t *testing.T) {
+	const href = "http://example.com/greeting.txt"
+	c := NewCatalog()
+	if !assert.NoError(t, c.Add("system", href, "missing.txt"), "Add should succeed") ||
+		!assert.NoError(t, c.Add("uri", href, filepath.Join("test", "catalog", "dtd", "doc.dtd")), "Add should succeed") {
+		return
+	}
+
+	doc, err := Parse([]byte(`<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="` + href + `" parse="text"/></doc>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	p := NewParser()
+	p.SetCatalog(c)
+	if !assert.NoError(t, p.SetOption(ParseNoNet), "SetOption should succeed") {
+		return
+	}
+	if !assert.NoError(t, p.ProcessXInclude(doc), "ProcessXInclude should succeed") {
+		return
+	}
+	if !assert.Contains(t, string(doc.DocumentElement().Content()), "hello from the catalog", "href is resolved with the uri entries") {
+		return
+	}
+}
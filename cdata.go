@@ -0,0 +1,44 @@
+package helium
+
+func newCDATASection(b []byte) *CDATASection {
+	t := CDATASection{}
+	t.etype = CDATASectionNode
+	t.content = make([]byte, len(b))
+	copy(t.content, b)
+	t.name = "#cdata-section"
+	return &t
+}
+
+func (n *CDATASection) AddChild(cur Node) error {
+	var t CDATASection
+	switch cur.(type) {
+	case *CDATASection:
+		t = *(cur.(*CDATASection))
+	default:
+		return ErrInvalidOperation
+	}
+
+	return n.AddContent(t.content)
+}
+
+func (n *CDATASection) AddContent(b []byte) error {
+	n.content = append(n.content, b...)
+	return nil
+}
+
+// AddSibling adds a new sibling to the end of the sibling nodes.
+func (n *CDATASection) AddSibling(cur Node) error {
+	return addSibling(n, cur)
+}
+
+func (n CDATASection) Content() []byte {
+	return n.content
+}
+
+func (n *CDATASection) Replace(cur Node) {
+	replaceNode(n, cur)
+}
+
+func (n *CDATASection) SetTreeDoc(doc *Document) {
+	setTreeDoc(n, doc)
+}
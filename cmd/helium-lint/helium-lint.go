@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 
 	"github.com/jessevdk/go-flags"
@@ -13,6 +12,7 @@ import (
 
 type cmdopts struct {
 	Format  bool `long:"format"`
+	Recover bool `long:"recover"`
 	Version bool `long:"version"`
 }
 
@@ -28,6 +28,7 @@ func showUsage() {
 	fmt.Printf(`Usage : helium-lint [options] XMLfiles ...
 	Parse the XML files and output the result of the parsing
 	--version : display the version of the XML library used
+	--recover : output what was parsable on broken XML documents
 `)
 }
 
@@ -53,7 +54,7 @@ func _main() int {
 			for _, f := range args {
 				fh, err := os.Open(f)
 				if err != nil {
-					errCh <-err
+					errCh <- err
 					return
 				}
 				inputCh <- fh
@@ -70,16 +71,25 @@ func _main() int {
 	}
 
 	p := helium.NewParser()
-	for in := range inputCh {
-		buf, err := ioutil.ReadAll(in)
-		if err != nil {
+	if opts.Recover {
+		if err := p.SetOption(helium.ParseRecover); err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err)
 			return 1
 		}
-		doc, err := p.Parse(buf)
+	}
+
+	status := 0
+	for in := range inputCh {
+		doc, err := p.ParseReader(in)
+		if c, ok := in.(io.Closer); ok && in != os.Stdin {
+			c.Close()
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s\n", err)
-			return 1
+			if doc == nil {
+				return 1
+			}
+			status = 1
 		}
 
 		d := helium.Dumper{}
@@ -93,5 +103,5 @@ func _main() int {
 	default:
 	}
 
-	return 0
+	return status
 }
@@ -25,6 +25,35 @@ func NewDocument(version, encoding string, standalone DocumentStandaloneType) *D
 	return doc
 }
 
+// Copy returns a deep copy of the document, leaving out the nodes for
+// which skip, unless it is nil, returns true along with their
+// descendants. The copy shares the DTDs of d.
+func (d *Document) Copy(skip func(Node) bool) (*Document, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START Document.Copy '%s'", d.url)
+		defer g.IRelease("END Document.Copy")
+	}
+
+	ret := NewDocument(d.version, d.encoding, d.standalone)
+	ret.url = d.url
+	ret.inputEncoding = d.inputEncoding
+	ret.intSubset = d.intSubset
+	ret.extSubset = d.extSubset
+	ret.idAttrs = d.idAttrs
+	for c := d.FirstChild(); c != nil; c = c.NextSibling() {
+		copies, err := copyNode(c, ret, skip)
+		if err != nil {
+			return nil, err
+		}
+		for _, cc := range copies {
+			if err := ret.AddChild(cc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ret, nil
+}
+
 func (d Document) XMLString() (string, error) {
 	out := bytes.Buffer{}
 	if err := d.XML(&out); err != nil {
@@ -53,10 +82,15 @@ func (d *Document) SetTreeDoc(doc *Document) {
 	setTreeDoc(d, doc)
 }
 
+// Encoding returns the encoding that the document was parsed with,
+// which is the declared one unless it was overridden, or not trusted
 func (d *Document) Encoding() string {
 	// In order to differentiate between a document with explicit
 	// encoding in the XML declaration and one without, the XML dump
 	// routine must check for d.encoding == "", and not Encoding()
+	if enc := d.inputEncoding; enc != "" {
+		return enc
+	}
 	if enc := d.encoding; enc != "" {
 		return d.encoding
 	}
@@ -79,6 +113,11 @@ func (d *Document) ExtSubset() *DTD {
 	return d.extSubset
 }
 
+// URL returns the URI of the document, if it is known
+func (d *Document) URL() string {
+	return d.url
+}
+
 func (d *Document) Replace(n Node) {
 	panic("d.Replace does not make sense")
 }
@@ -109,6 +148,16 @@ func (d *Document) SetDocumentElement(root Node) error {
 	return nil
 }
 
+// DocumentElement returns the root element of the document, or nil
+func (d *Document) DocumentElement() *Element {
+	for n := d.firstChild; n != nil; n = n.NextSibling() {
+		if e, ok := n.(*Element); ok {
+			return e
+		}
+	}
+	return nil
+}
+
 func (d *Document) CreateReference(name string) (*EntityRef, error) {
 	if debug.Enabled {
 		g := debug.IPrintf("START document.CreateReference '%s'", name)
@@ -139,10 +188,20 @@ func (d *Document) CreateAttribute(name, value string, ns *Namespace) (attr *Att
 			g.IRelease("END document.CreateAttribute (attr.Value = '%s')", attr.Value())
 		}()
 	}
+	return d.createAttribute(name, value, ns, nil)
+}
+
+// createAttribute creates an attribute like CreateAttribute. The
+// entities that value references are charged to st, or to stats of
+// their own if it is nil.
+func (d *Document) createAttribute(name, value string, ns *Namespace, st *entityStats) (attr *Attribute, err error) {
 	var n Node
 	attr = newAttribute(name, ns)
 	if value != "" {
-		n, err = d.stringToNodeList(value)
+		if st == nil {
+			st = newValueEntityStats(value)
+		}
+		n, err = d.stringToNodeList(value, st)
 		if err != nil {
 			attr = nil
 			return
@@ -168,10 +227,14 @@ func (d *Document) CreateNamespace(prefix, uri string) (*Namespace, error) {
 }
 
 func (d *Document) CreatePI(target, data string) (*ProcessingInstruction, error) {
-	return &ProcessingInstruction{
+	pi := &ProcessingInstruction{
 		target: target,
 		data:   data,
-	}, nil
+	}
+	pi.name = target
+	pi.etype = ProcessingInstructionNode
+	pi.doc = d
+	return pi, nil
 }
 
 func (d *Document) CreateDTD() (*DTD, error) {
@@ -180,6 +243,34 @@ func (d *Document) CreateDTD() (*DTD, error) {
 	return dtd, nil
 }
 
+// CreateInternalSubset creates the internal subset of the document,
+// which is a DOCTYPE declaration for the document element name, and
+// inserts it before the other children of the document
+func (d *Document) CreateInternalSubset(name, externalID, systemID string) (*DTD, error) {
+	if d.intSubset != nil {
+		return nil, errors.New("document already has an internal subset")
+	}
+
+	dtd, err := d.CreateDTD()
+	if err != nil {
+		return nil, err
+	}
+	dtd.name = name
+	dtd.externalID = externalID
+	dtd.systemID = systemID
+
+	dtd.parent = d
+	if first := d.firstChild; first != nil {
+		dtd.next = first
+		first.SetPrevSibling(dtd)
+	} else {
+		d.lastChild = dtd
+	}
+	d.firstChild = dtd
+	d.intSubset = dtd
+	return dtd, nil
+}
+
 func (d *Document) CreateElement(name string) (*Element, error) {
 	e := newElement(name)
 	e.doc = d
@@ -192,6 +283,12 @@ func (d *Document) CreateText(value []byte) (*Text, error) {
 	return e, nil
 }
 
+func (d *Document) CreateCDATASection(value []byte) (*CDATASection, error) {
+	e := newCDATASection(value)
+	e.doc = d
+	return e, nil
+}
+
 func (d *Document) CreateComment(value []byte) (*Comment, error) {
 	e := newComment(value)
 	e.doc = d
@@ -221,8 +318,9 @@ func (d *Document) GetEntity(name string) (ent *Entity, found bool) {
 		if debug.Enabled {
 			debug.Printf("Looking into internal subset...")
 		}
-		ent, found = ints.LookupEntity(name)
-		return
+		if ent, found = ints.LookupEntity(name); found {
+			return
+		}
 	}
 
 	if exts := d.extSubset; exts != nil {
@@ -238,7 +336,9 @@ func (d *Document) GetEntity(name string) (ent *Entity, found bool) {
 
 func (d *Document) GetParameterEntity(name string) (*Entity, bool) {
 	if ints := d.intSubset; ints != nil {
-		return ints.LookupParameterEntity(name)
+		if ent, ok := ints.LookupParameterEntity(name); ok {
+			return ent, true
+		}
 	}
 
 	if exts := d.extSubset; exts != nil {
@@ -249,11 +349,14 @@ func (d *Document) GetParameterEntity(name string) (*Entity, bool) {
 }
 
 func (d *Document) IsMixedElement(name string) (bool, error) {
-	if d.intSubset == nil {
-		return false, errors.New("element declaration not found")
+	var edecl *ElementDecl
+	var ok bool
+	if d.intSubset != nil {
+		edecl, ok = d.intSubset.GetElementDesc(name)
+	}
+	if !ok && d.extSubset != nil {
+		edecl, ok = d.extSubset.GetElementDesc(name)
 	}
-
-	edecl, ok := d.intSubset.GetElementDesc(name)
 	if !ok {
 		return false, errors.New("element declaration not found")
 	}
@@ -281,7 +384,16 @@ func (d *Document) IsMixedElement(name string) (bool, error) {
  * produce a flat tree with only TEXTs and ENTITY_REFs.
  * Returns a pointer to the first child
  */
-func (d *Document) stringToNodeList(value string) (ret Node, err error) {
+func (d *Document) stringToNodeList(value string, st *entityStats) (Node, error) {
+	return d.stringToNodeListInternal(value, st, 0)
+}
+
+func (d *Document) stringToNodeListInternal(value string, st *entityStats, depth int) (ret Node, err error) {
+	// entities that refer to each other would recurse forever
+	if depth > maxHugeEntityDepth {
+		return nil, ErrEntityLoop
+	}
+
 	if debug.Enabled {
 		g := debug.IPrintf("START document.stringToNodeList '%s'", value)
 		defer func() {
@@ -393,6 +505,13 @@ func (d *Document) stringToNodeList(value string) (ret Node, err error) {
 					}
 				}
 
+				// the reference gets a copy of the entity content
+				if ok {
+					if err = st.charge(len(ent.content)); err != nil {
+						return
+					}
+				}
+
 				// create a new REFERENCE_REF node
 				var node Node
 				node, err = d.CreateReference(val)
@@ -404,7 +523,7 @@ func (d *Document) stringToNodeList(value string) (ret Node, err error) {
 				if ok && ent.FirstChild() == nil {
 					// XXX WTF am I doing here...?
 					var refchildren Node
-					refchildren, err = d.stringToNodeList(string(node.Content()))
+					refchildren, err = d.stringToNodeListInternal(string(ent.Content()), st, depth+1)
 					if err != nil {
 						return
 					}
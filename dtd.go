@@ -13,6 +13,7 @@ func newDTD() *DTD {
 		elements:   map[string]*ElementDecl{},
 		entities:   map[string]*Entity{},
 		pentities:  map[string]*Entity{},
+		notations:  map[string]*Notation{},
 	}
 	dtd.etype = DTDNode
 	return dtd
@@ -160,6 +161,44 @@ func (dtd *DTD) LookupParameterEntity(name string) (*Entity, bool) {
 	return ret, ok
 }
 
+// AddNotation registers a notation declaration
+func (dtd *DTD) AddNotation(name, publicID, systemID string) (*Notation, error) {
+	if name == "" {
+		return nil, errors.New("notation name is required")
+	}
+	if publicID == "" && systemID == "" {
+		return nil, errors.New("notation requires a public or system ID")
+	}
+	if _, ok := dtd.notations[name]; ok {
+		return nil, errors.New("redefinition of notation " + name)
+	}
+
+	n := &Notation{
+		name:     name,
+		publicID: publicID,
+		systemID: systemID,
+	}
+	dtd.notations[name] = n
+	return n, nil
+}
+
+func (dtd *DTD) LookupNotation(name string) (*Notation, bool) {
+	ret, ok := dtd.notations[name]
+	return ret, ok
+}
+
+func (n *Notation) Name() string {
+	return n.name
+}
+
+func (n *Notation) PublicID() string {
+	return n.publicID
+}
+
+func (n *Notation) SystemID() string {
+	return n.systemID
+}
+
 func (dtd *DTD) GetElementDesc(name string) (*ElementDecl, bool) {
 	ret, ok := dtd.elements[name]
 	return ret, ok
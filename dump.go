@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"unicode/utf8"
 
@@ -193,7 +194,32 @@ func escapeText(w io.Writer, s []byte, escapeNewline bool) error {
 	return nil
 }
 
-type Dumper struct{}
+// Dumper serializes nodes as XML
+type Dumper struct {
+	// OmitDefaultAttributes skips the attributes that were not
+	// specified in the document, but defaulted from the DTD
+	// (see ParseDTDAttr)
+	OmitDefaultAttributes bool
+	// OmitXMLDeclaration skips the XML declaration of documents
+	OmitXMLDeclaration bool
+	// Format indents the elements whose children are all elements,
+	// like libxml2's xmlSaveFormatFile
+	Format bool
+	// HTML writes elements the way the html output method of XSLT
+	// does: empty elements get an end tag, unless they are one of the
+	// void elements of HTML which have none, and the content of script
+	// and style elements is not escaped
+	HTML bool
+
+	level int // depth of the element being dumped, when formatting
+}
+
+// htmlVoidElements are the elements of HTML that have no end tag
+var htmlVoidElements = map[string]struct{}{
+	"area": {}, "base": {}, "basefont": {}, "br": {}, "col": {}, "frame": {},
+	"hr": {}, "img": {}, "input": {}, "isindex": {}, "link": {}, "meta": {},
+	"param": {},
+}
 
 func (d *Dumper) writeString(out io.Writer, content string) error {
 	// punt all the magic for now
@@ -207,11 +233,17 @@ func (d *Dumper) DumpDoc(out io.Writer, doc *Document) error {
 		defer g.IRelease("END Dumper.DumpDoc")
 	}
 
-	if err := d.DumpNode(out, doc); err != nil {
-		return err
+	if !d.OmitXMLDeclaration {
+		if err := d.DumpNode(out, doc); err != nil {
+			return err
+		}
 	}
 
 	for e := doc.FirstChild(); e != nil; e = e.NextSibling() {
+		switch e.Type() {
+		case XIncludeStartNode, XIncludeEndNode:
+			continue
+		}
 		if err := d.DumpNode(out, e); err != nil {
 			return err
 		}
@@ -252,25 +284,25 @@ func (d *Dumper) dumpDTD(out io.Writer, n Node) error {
 	dtd := n.(*DTD)
 	io.WriteString(out, "<!DOCTYPE ")
 	io.WriteString(out, dtd.Name())
-	io.WriteString(out, " ")
 
 	if dtd.externalID != "" {
 		io.WriteString(out, " PUBLIC ")
-		io.WriteString(out, dtd.externalID)
-		io.WriteString(out, " ")
+		dumpQuotedString(out, dtd.externalID)
+		if dtd.systemID != "" {
+			io.WriteString(out, " ")
+			dumpQuotedString(out, dtd.systemID)
+		}
 	} else if dtd.systemID != "" {
 		io.WriteString(out, " SYSTEM ")
-		io.WriteString(out, dtd.systemID)
-		io.WriteString(out, " ")
+		dumpQuotedString(out, dtd.systemID)
 	}
 
-	if len(dtd.entities) == 0 && len(dtd.elements) == 0 && len(dtd.pentities) == 0 && len(dtd.attributes) == 0 {
-		/* (dtd.notations == NULL) && */
+	if len(dtd.entities) == 0 && len(dtd.elements) == 0 && len(dtd.pentities) == 0 && len(dtd.attributes) == 0 && len(dtd.notations) == 0 {
 		io.WriteString(out, ">")
 		return nil
 	}
 
-	io.WriteString(out, "[\n")
+	io.WriteString(out, " [\n")
 
 	for e := dtd.FirstChild(); e != nil; e = e.NextSibling() {
 		if err := d.DumpNode(out, e); err != nil {
@@ -278,10 +310,36 @@ func (d *Dumper) dumpDTD(out io.Writer, n Node) error {
 		}
 	}
 
+	names := make([]string, 0, len(dtd.notations))
+	for name := range dtd.notations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dumpNotation(out, dtd.notations[name])
+	}
+
 	io.WriteString(out, "]>")
 	return nil
 }
 
+func dumpNotation(out io.Writer, n *Notation) {
+	io.WriteString(out, "<!NOTATION ")
+	io.WriteString(out, n.name)
+	if n.publicID != "" {
+		io.WriteString(out, " PUBLIC ")
+		dumpQuotedString(out, n.publicID)
+		if n.systemID != "" {
+			io.WriteString(out, " ")
+			dumpQuotedString(out, n.systemID)
+		}
+	} else {
+		io.WriteString(out, " SYSTEM ")
+		dumpQuotedString(out, n.systemID)
+	}
+	io.WriteString(out, " >\n")
+}
+
 func (d *Dumper) dumpEnumeration(out io.Writer, n Enumeration) error {
 	l := len(n)
 	for i, v := range n {
@@ -449,7 +507,7 @@ func (d *Dumper) dumpEntityDecl(out io.Writer, ent *Entity) error {
 	case ExternalGeneralParsedEntity, ExternalGeneralUnparsedEntity:
 		io.WriteString(out, "<!ENTITY ")
 		io.WriteString(out, ent.name)
-		if ent.externalID == "" {
+		if ent.externalID != "" {
 			io.WriteString(out, " PUBLIC ")
 			dumpQuotedString(out, ent.externalID)
 			io.WriteString(out, " ")
@@ -492,6 +550,7 @@ func (d *Dumper) dumpEntityDecl(out io.Writer, ent *Entity) error {
 			io.WriteString(out, " SYSTEM ")
 			dumpQuotedString(out, ent.systemID)
 		}
+		io.WriteString(out, ">\n")
 	default:
 		return errors.New("invalid entity type")
 	}
@@ -588,8 +647,8 @@ func (d *Dumper) dumpNsList(out io.Writer, nslist []*Namespace) error {
 }
 
 func (d *Dumper) dumpNs(out io.Writer, ns *Namespace) error {
-	if ns.href == "" {
-		// no op
+	if ns.href == "" && ns.prefix != "" {
+		// prefixes cannot be undeclared in XML 1.0
 		return nil
 	}
 
@@ -629,6 +688,16 @@ func (d *Dumper) DumpNode(out io.Writer, n Node) error {
 		out.Write(n.Content())
 		io.WriteString(out, "-->")
 		return nil
+	case ProcessingInstructionNode:
+		pi := n.(*ProcessingInstruction)
+		io.WriteString(out, "<?")
+		io.WriteString(out, pi.target)
+		if pi.data != "" {
+			io.WriteString(out, " ")
+			io.WriteString(out, pi.data)
+		}
+		io.WriteString(out, "?>")
+		return nil
 	case EntityRefNode:
 		io.WriteString(out, "&")
 		io.WriteString(out, n.Name())
@@ -657,6 +726,16 @@ func (d *Dumper) DumpNode(out io.Writer, n Node) error {
 			return err
 		}
 		return nil
+	case CDATASectionNode:
+		// "]]>" cannot appear in a CDATA section, so it is split
+		// across two sections
+		io.WriteString(out, "<![CDATA[")
+		io.WriteString(out, strings.Replace(string(n.Content()), "]]>", "]]]]><![CDATA[>", -1))
+		io.WriteString(out, "]]>")
+		return nil
+	case XIncludeStartNode, XIncludeEndNode:
+		// markers only, the included nodes are their siblings
+		return nil
 	}
 
 	if err != nil {
@@ -693,11 +772,15 @@ func (d *Dumper) DumpNode(out io.Writer, n Node) error {
 
 	if e, ok := n.(*Element); ok {
 		for attr := e.properties; attr != nil; {
-				g := debug.IPrintf("START DumpNode(fallthrough->attribute(%s))", attr.Name())
+			if d.OmitDefaultAttributes && attr.IsDefault() {
+				attr = attr.NextAttribute()
+				continue
+			}
+			g := debug.IPrintf("START DumpNode(fallthrough->attribute(%s))", attr.Name())
 			io.WriteString(out, " "+attr.Name()+`="`)
-		count := 0
+			count := 0
 			for achld := attr.FirstChild(); achld != nil; achld = achld.NextSibling() {
-			count++
+				count++
 				if achld.Type() == TextNode {
 					escapeAttrValue(out, achld.Content())
 				} else {
@@ -714,24 +797,66 @@ func (d *Dumper) DumpNode(out io.Writer, n Node) error {
 		}
 
 		if child := e.FirstChild(); child == nil {
-			io.WriteString(out, "/>")
-			return nil
+			if !d.HTML || e.URI() != "" {
+				io.WriteString(out, "/>")
+				return nil
+			}
+			if _, ok := htmlVoidElements[strings.ToLower(name)]; ok {
+				io.WriteString(out, ">")
+				return nil
+			}
 		}
 	}
 
 	io.WriteString(out, ">")
 
-	if child := n.FirstChild(); child != nil {
-		for ; child != nil; child = child.NextSibling() {
-			if err := d.DumpNode(out, child); err != nil {
-				return err
-			}
+	// the content of script and style is not escaped in HTML
+	raw := false
+	if d.HTML {
+		switch strings.ToLower(name) {
+		case "script", "style":
+			raw = true
 		}
 	}
 
+	format := d.Format
+	for child := n.FirstChild(); child != nil && format; child = child.NextSibling() {
+		switch child.Type() {
+		case TextNode, CDATASectionNode, EntityRefNode:
+			format = false
+		}
+	}
+	if format && n.FirstChild() != nil {
+		io.WriteString(out, "\n")
+	}
+
+	d.level++
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		switch child.Type() {
+		case XIncludeStartNode, XIncludeEndNode:
+			continue
+		}
+		if format {
+			io.WriteString(out, strings.Repeat("  ", d.level))
+		}
+		if raw && child.Type() == TextNode {
+			out.Write(child.Content())
+		} else if err := d.DumpNode(out, child); err != nil {
+			d.level--
+			return err
+		}
+		if format {
+			io.WriteString(out, "\n")
+		}
+	}
+	d.level--
+	if format && n.FirstChild() != nil {
+		io.WriteString(out, strings.Repeat("  ", d.level))
+	}
+
 	io.WriteString(out, "</")
 	io.WriteString(out, name)
 	io.WriteString(out, ">")
 
 	return nil
-}
\ No newline at end of file
+}
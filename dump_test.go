@@ -96,3 +96,24 @@ func TestDOMToXMLString(t *testing.T) {
 
 	t.Logf("%s", str)
 }
+
+func TestDumpCDATASection(t *testing.T) {
+	doc := helium.CreateDocument()
+	root, err := doc.CreateElement("a")
+	if !assert.NoError(t, err, "CreateElement should succeed") {
+		return
+	}
+	c, err := doc.CreateCDATASection([]byte("a]]>b"))
+	if !assert.NoError(t, err, "CreateCDATASection should succeed") {
+		return
+	}
+	root.AddChild(c)
+
+	str, err := root.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+	if !assert.Equal(t, "<a><![CDATA[a]]]]><![CDATA[>b]]></a>", str, "']]>' is split across sections") {
+		return
+	}
+}
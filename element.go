@@ -96,32 +96,122 @@ func (n *Element) SetAttribute(name, value string) error {
 		defer g.IRelease("END Element.SetAttribute")
 	}
 
-	attr, err := n.doc.CreateAttribute(name, value, nil)
+	return n.setAttribute(name, value, nil)
+}
+
+// setAttribute is SetAttribute, charging the entities that value
+// references to st
+func (n *Element) setAttribute(name, value string, st *entityStats) error {
+	attr, err := n.doc.createAttribute(name, value, nil, st)
 	if err != nil {
 		return err
 	}
+	return n.appendAttribute(attr)
+}
 
-	p := n.properties
-	if p == nil {
-		n.properties = attr
-		return nil
+// SetAttributeNS sets the attribute local, in the namespace ns unless
+// it is nil, to value. Unlike SetAttribute, value is used as is, and an
+// attribute with the same name replaces the existing one.
+func (n *Element) SetAttributeNS(local, value string, ns *Namespace) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START Element.SetAttributeNS '%s' (%s)", local, value)
+		defer g.IRelease("END Element.SetAttributeNS")
+	}
+
+	attr := newAttribute(local, ns)
+	if value != "" {
+		t, err := n.doc.CreateText([]byte(value))
+		if err != nil {
+			return err
+		}
+		if err := attr.AddChild(t); err != nil {
+			return err
+		}
 	}
 
+	for p := n.properties; p != nil; p = p.NextAttribute() {
+		if p.Name() == attr.Name() || ns != nil && p.LocalName() == local && p.URI() == ns.URI() {
+			n.RemoveAttribute(p.Name())
+			break
+		}
+	}
+	return n.appendAttribute(attr)
+}
+
+// appendAttribute adds attr after the existing attributes of n
+func (n *Element) appendAttribute(attr *Attribute) error {
 	var last *Attribute
-	for ; p != nil; p = p.NextAttribute() {
-		if p.Name() == name {
+	for p := n.properties; p != nil; p = p.NextAttribute() {
+		if p.Name() == attr.Name() {
 			return ErrDuplicateAttribute
 		}
 
 		last = p
 	}
 
-	last.SetNextSibling(attr)
-	attr.SetPrevSibling(last)
+	if last == nil {
+		n.properties = attr
+	} else {
+		last.SetNextSibling(attr)
+		attr.SetPrevSibling(last)
+	}
+	attr.SetParent(n)
+	attr.doc = n.doc
+
+	if doc := n.doc; doc != nil {
+		doc.indexAttribute(n, attr)
+	}
+
+	return nil
+}
+
+// RemoveAttribute removes the attribute with the given name, and
+// reports if it was found
+func (n *Element) RemoveAttribute(name string) bool {
+	for p := n.properties; p != nil; p = p.NextAttribute() {
+		if p.Name() != name {
+			continue
+		}
+
+		if prev := p.PrevSibling(); prev != nil {
+			prev.SetNextSibling(p.NextSibling())
+		} else {
+			n.properties = p.NextAttribute()
+		}
+		if next := p.NextSibling(); next != nil {
+			next.SetPrevSibling(p.PrevSibling())
+		}
+		p.SetParent(nil)
+		p.SetPrevSibling(nil)
+		p.SetNextSibling(nil)
+		return true
+	}
+	return false
+}
 
+// setDefaultAttribute adds an attribute whose value was defaulted
+// from the DTD, instead of being specified in the document
+func (n *Element) setDefaultAttribute(name, value string, st *entityStats) error {
+	if err := n.setAttribute(name, value, st); err != nil {
+		return err
+	}
+
+	n.lastAttribute().SetDefault(true)
 	return nil
 }
 
+// lastAttribute returns the last attribute of n, or nil
+func (n *Element) lastAttribute() *Attribute {
+	attr := n.properties
+	if attr == nil {
+		return nil
+	}
+	for next := attr.NextAttribute(); next != nil; next = attr.NextAttribute() {
+		attr = next
+	}
+	return attr
+}
+
 func (n Element) Attributes() []*Attribute {
 	attrs := []*Attribute{}
 	for attr := n.properties; attr != nil; {
@@ -134,4 +224,4 @@ func (n Element) Attributes() []*Attribute {
 	}
 
 	return attrs
-}
\ No newline at end of file
+}
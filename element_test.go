@@ -1,6 +1,7 @@
 package helium
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -105,4 +106,53 @@ func TestElementContent(t *testing.T) {
 		return
 	}
 
-}
\ No newline at end of file
+}
+
+func TestDefaultNamespaceIsNotAttribute(t *testing.T) {
+	doc, err := Parse([]byte(`<root xmlns="urn:x" a="1"/>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	root, ok := doc.FirstChild().(*Element)
+	if !assert.True(t, ok, "first child is the root element") {
+		return
+	}
+	if !assert.Equal(t, "urn:x", root.Namespace().URI(), "root is in the default namespace") {
+		return
+	}
+
+	attrs := root.Attributes()
+	if !assert.Len(t, attrs, 1, "xmlns is not an attribute") {
+		return
+	}
+	if !assert.Equal(t, "a", attrs[0].Name(), "attribute name matches") {
+		return
+	}
+}
+
+func TestCreatePI(t *testing.T) {
+	doc := CreateDocument()
+	pi, err := doc.CreatePI("target", "data")
+	if !assert.NoError(t, err, "CreatePI should succeed") {
+		return
+	}
+	if !assert.Equal(t, ProcessingInstructionNode, pi.Type(), "node type matches") {
+		return
+	}
+	if !assert.Equal(t, "target", pi.Name(), "name is the target") {
+		return
+	}
+	if !assert.Equal(t, doc, pi.OwnerDocument(), "owner document matches") {
+		return
+	}
+
+	var buf bytes.Buffer
+	d := Dumper{}
+	if !assert.NoError(t, d.DumpNode(&buf, pi), "DumpNode should succeed") {
+		return
+	}
+	if !assert.Equal(t, "<?target data?>", buf.String(), "DumpNode output matches") {
+		return
+	}
+}
@@ -33,7 +33,7 @@ func newEntity(name string, typ EntityType, publicID, systemID, notation, orig s
 }
 
 func (e *Entity) Checked() bool {
-	return e.checked & 1 == 1
+	return e.checked&1 == 1
 }
 
 func (e *Entity) MarkChecked() {
@@ -48,6 +48,15 @@ func (e *Entity) EntityType() int {
 	return int(e.entityType)
 }
 
+// URI returns the absolute URI of an external entity, which is its
+// system ID resolved against the document that declared it
+func (e *Entity) URI() string {
+	if e.uri != "" {
+		return e.uri
+	}
+	return e.systemID
+}
+
 func (e *Entity) Content() []byte {
 	return []byte(e.content)
 }
@@ -1,6 +1,49 @@
 package helium
 
-import "fmt"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+func (e *Error) Error() string {
+	var buf bytes.Buffer
+	if e.Level == ErrorLevelWarning {
+		buf.WriteString("warning: ")
+	}
+	if e.File != "" {
+		buf.WriteString(e.File)
+		buf.WriteString(": ")
+	}
+	buf.WriteString(e.Err.Error())
+	if e.Line > 0 {
+		fmt.Fprintf(&buf, " at line %d, column %d", e.Line, e.Column)
+	}
+	if e.Context != "" {
+		fmt.Fprintf(&buf, "\n -> '%s' <-- around here", e.Context)
+	}
+	return buf.String()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// As converts e to an ErrParseError, for the code that still expects it
+func (e *Error) As(target interface{}) bool {
+	p, ok := target.(*ErrParseError)
+	if !ok {
+		return false
+	}
+	*p = ErrParseError{
+		Column:     e.Column,
+		Err:        e.Err,
+		Line:       e.Context,
+		LineNumber: e.Line,
+	}
+	return true
+}
 
 func (e ErrParseError) Error() string {
 	return fmt.Sprintf(
@@ -12,6 +55,88 @@ func (e ErrParseError) Error() string {
 	)
 }
 
+// Unwrap returns the underlying error
+func (e ErrParseError) Unwrap() error {
+	return e.Err
+}
+
+// errorCodes classifies the sentinel errors
+var errorCodes = []struct {
+	err    error
+	domain ErrorDomain
+	code   ErrorCode
+}{
+	{ErrAttrListNotFinished, DomainParser, CodeAttlistNotFinished},
+	{ErrAttrListNotStarted, DomainParser, CodeAttlistNotStarted},
+	{ErrAttributeNameRequired, DomainParser, CodeNameRequired},
+	{ErrDocTypeNameRequired, DomainParser, CodeNameRequired},
+	{ErrDocTypeNotFinished, DomainParser, CodeDocTypeNotFinished},
+	{ErrDocumentEnd, DomainParser, CodeDocumentEnd},
+	{ErrElementContentNotFinished, DomainParser, CodeElemContentNotFinished},
+	{ErrEmptyDocument, DomainParser, CodeDocumentEmpty},
+	{ErrEntityAmplification, DomainParser, CodeEntityLoop},
+	{ErrEntityLoop, DomainParser, CodeEntityLoop},
+	{ErrEntityNotFound, DomainParser, CodeUndeclaredEntity},
+	{ErrEqualSignRequired, DomainParser, CodeEqualRequired},
+	{ErrGtRequired, DomainParser, CodeGtRequired},
+	{ErrHyphenInComment, DomainParser, CodeHyphenInComment},
+	{ErrInvalidChar, DomainParser, CodeInvalidChar},
+	{ErrInvalidComment, DomainParser, CodeCommentNotFinished},
+	{ErrInvalidCDSect, DomainParser, CodeCDATANotFinished},
+	{ErrInvalidEncodingName, DomainParser, CodeEncodingName},
+	{ErrInvalidName, DomainParser, CodeNameRequired},
+	{ErrInvalidProcessingInstruction, DomainParser, CodePINotFinished},
+	{ErrInvalidVersionNum, DomainParser, CodeUnknownVersion},
+	{ErrInvalidXMLDecl, DomainParser, CodeXMLDeclNotFinished},
+	{ErrLtSlashRequired, DomainParser, CodeLtSlashRequired},
+	{ErrMisplacedCDATAEnd, DomainParser, CodeMisplacedCDATAEnd},
+	{ErrMismatchedEndTag, DomainParser, CodeTagNameMismatch},
+	{ErrMixedNotStarted, DomainParser, CodeMixedNotStarted},
+	{ErrNameTooLong, DomainParser, CodeNameTooLong},
+	{ErrNameRequired, DomainParser, CodeNameRequired},
+	{ErrNamespaceRedeclared, DomainNamespace, CodeNsDeclError},
+	{ErrNmtokenRequired, DomainParser, CodeNmtokenRequired},
+	{ErrNotationNameRequired, DomainParser, CodeNameRequired},
+	{ErrNotationNotFinished, DomainParser, CodeNotationNotFinished},
+	{ErrNotationNotStarted, DomainParser, CodeNotationNotStarted},
+	{ErrOpenParenRequired, DomainParser, CodeElemContentNotStarted},
+	{ErrPCDATARequired, DomainParser, CodePCDATARequired},
+	{ErrSemicolonRequired, DomainParser, CodeEntityRefSemicolMissing},
+	{ErrSpaceRequired, DomainParser, CodeSpaceRequired},
+	{ErrStartTagRequired, DomainParser, CodeDocumentEmpty},
+	{ErrUndeclaredEntity, DomainParser, CodeUndeclaredEntity},
+	{ErrValueRequired, DomainParser, CodeValueRequired},
+	{ErrXIncludeRecursion, DomainXInclude, CodeXIncludeRecursion},
+}
+
+// newError creates the structured error for err, at the given level.
+// The domain and code are derived from the underlying error.
+func newError(err error, level ErrorLevel) *Error {
+	e := &Error{Domain: DomainParser, Level: level, Err: err}
+
+	var verr ErrValidation
+	var xerr ErrXInclude
+	switch {
+	case errors.As(err, &verr):
+		e.Domain = DomainValid
+		e.Node = verr.Node
+		e.Line = verr.LineNumber
+	case errors.As(err, &xerr):
+		e.Domain = DomainXInclude
+		e.Node = xerr.Node
+		e.Line = xerr.LineNumber
+	}
+
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			e.Domain = c.domain
+			e.Code = c.code
+			break
+		}
+	}
+	return e
+}
+
 func (e ErrUnimplemented) Error() string {
 	return "unimplemented method: '" + e.target + "'"
 }
@@ -19,3 +144,54 @@ func (e ErrUnimplemented) Error() string {
 func (e ErrDTDDupToken) Error() string {
 	return "standlone: attribute enumeration value token " + e.Name + " duplicated"
 }
+
+func (e ErrParseErrors) Error() string {
+	var buf bytes.Buffer
+	for i, err := range e {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(err.Error())
+	}
+	return buf.String()
+}
+
+// Unwrap returns the errors that were recovered from
+func (e ErrParseErrors) Unwrap() []error {
+	return e
+}
+
+func (e ErrValidation) Error() string {
+	if e.LineNumber > 0 {
+		return fmt.Sprintf("%s at line %d", e.Message, e.LineNumber)
+	}
+	return e.Message
+}
+
+func (e ErrXInclude) Error() string {
+	if e.LineNumber > 0 {
+		return fmt.Sprintf("XInclude: %s at line %d", e.Err, e.LineNumber)
+	}
+	return "XInclude: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e ErrXInclude) Unwrap() error {
+	return e.Err
+}
+
+func (e ErrValidationErrors) Error() string {
+	var buf bytes.Buffer
+	for i, err := range e {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(err.Error())
+	}
+	return buf.String()
+}
+
+// Unwrap returns the individual violations
+func (e ErrValidationErrors) Unwrap() []error {
+	return e
+}
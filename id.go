@@ -0,0 +1,245 @@
+package helium
+
+import (
+	"strings"
+
+	"github.com/lestrrat/helium/internal/debug"
+)
+
+// The ID index of a document maps the values of ID attributes to the
+// attributes, and the values of IDREF/IDREFS attributes to the attributes
+// that reference them. Attributes are indexed when they are set on an
+// element of the document, and again whenever their element is attached
+// to the document. Entries that went stale because the attribute or one
+// of its ancestors was removed are detected, and dropped, when they are
+// looked up.
+
+// GetElementByID returns the element that carries the ID attribute
+// with the value id, or nil if there is no such element in the document
+func (d *Document) GetElementByID(id string) *Element {
+	if debug.Enabled {
+		g := debug.IPrintf("START Document.GetElementByID '%s'", id)
+		defer g.IRelease("END Document.GetElementByID")
+	}
+
+	if attr, ok := d.ids[id]; ok {
+		if e := d.idElement(attr, id); e != nil {
+			return e
+		}
+		delete(d.ids, id)
+
+		// another element may carry the same ID, which was not
+		// indexed as the first one wins
+		d.reindexID(id)
+		if attr, ok := d.ids[id]; ok {
+			return attr.parent.(*Element)
+		}
+	}
+	return nil
+}
+
+// IDRefs returns the IDREF and IDREFS attributes that reference id
+func (d *Document) IDRefs(id string) []*Attribute {
+	var ret []*Attribute
+	for _, attr := range d.refs[id] {
+		if d.isIndexed(attr) && hasToken(normalizeAttributeValue(attr.Value()), id) {
+			ret = append(ret, attr)
+		}
+	}
+
+	if len(ret) == 0 {
+		delete(d.refs, id)
+	} else {
+		d.refs[id] = ret
+	}
+	return ret
+}
+
+// SetIDAttributes sets the names of additional attributes that are
+// treated as IDs, on any element, regardless of the DTD. The document
+// is reindexed.
+func (d *Document) SetIDAttributes(names ...string) {
+	d.idAttrs = names
+	d.ids = nil
+	d.refs = nil
+	if root := d.DocumentElement(); root != nil {
+		d.indexTree(root)
+	}
+}
+
+// SetIDAttributes sets the names of additional attributes that are
+// treated as IDs in the documents that are parsed, on top of those
+// declared in the DTD and xml:id
+func (p *Parser) SetIDAttributes(names ...string) {
+	p.idAttrs = names
+}
+
+// attributeType returns the type of the attribute, as far as the
+// index is concerned
+func (d *Document) attributeType(e *Element, name string) AttributeType {
+	if name == "xml:id" {
+		return AttrID
+	}
+	for _, n := range d.idAttrs {
+		if n == name {
+			return AttrID
+		}
+	}
+
+	var prefix string
+	local := name
+	if i := strings.IndexByte(name, ':'); i > -1 {
+		prefix = name[:i]
+		local = name[i+1:]
+	}
+	for _, dtd := range []*DTD{d.intSubset, d.extSubset} {
+		if dtd == nil {
+			continue
+		}
+		if decl, ok := dtd.LookupAttribute(local, prefix, e.Name()); ok {
+			return decl.atype
+		}
+	}
+	return AttrInvalid
+}
+
+// indexAttribute adds attr, which is set on e, to the index if it is
+// an ID or a reference to one
+func (d *Document) indexAttribute(e *Element, attr *Attribute) {
+	switch d.attributeType(e, attr.Name()) {
+	case AttrID:
+		id := normalizeAttributeValue(attr.Value())
+		if id == "" {
+			return
+		}
+		// the first one wins, unless it's gone
+		if old, ok := d.ids[id]; ok && d.idElement(old, id) != nil {
+			return
+		}
+		if d.ids == nil {
+			d.ids = map[string]*Attribute{}
+		}
+		d.ids[id] = attr
+	case AttrIDRef, AttrIDRefs:
+		if d.refs == nil {
+			d.refs = map[string][]*Attribute{}
+		}
+		for _, id := range strings.Fields(attr.Value()) {
+			d.refs[id] = append(d.refs[id], attr)
+		}
+	}
+}
+
+// indexTree indexes the attributes of e and its descendants
+func (d *Document) indexTree(e *Element) {
+	for attr := e.properties; attr != nil; attr = attr.NextAttribute() {
+		d.indexAttribute(e, attr)
+	}
+	for c := e.FirstChild(); c != nil; c = c.NextSibling() {
+		if child, ok := c.(*Element); ok {
+			d.indexTree(child)
+		}
+	}
+}
+
+// reindexTree indexes e and its descendants again, when they are
+// attached to the document that they already belong to
+func (d *Document) reindexTree(e *Element) {
+	for attr := e.properties; attr != nil; attr = attr.NextAttribute() {
+		switch d.attributeType(e, attr.Name()) {
+		case AttrIDRef, AttrIDRefs:
+			// references that are still indexed must not be added twice
+			for _, id := range strings.Fields(attr.Value()) {
+				if !containsAttribute(d.refs[id], attr) {
+					if d.refs == nil {
+						d.refs = map[string][]*Attribute{}
+					}
+					d.refs[id] = append(d.refs[id], attr)
+				}
+			}
+		default:
+			d.indexAttribute(e, attr)
+		}
+	}
+	for c := e.FirstChild(); c != nil; c = c.NextSibling() {
+		if child, ok := c.(*Element); ok {
+			d.reindexTree(child)
+		}
+	}
+}
+
+// reindexID looks for an element that carries the ID id in the whole document
+func (d *Document) reindexID(id string) {
+	var found *Attribute
+	Walk(d, func(n Node) error {
+		e, ok := n.(*Element)
+		if !ok || found != nil {
+			return nil
+		}
+		for attr := e.properties; attr != nil; attr = attr.NextAttribute() {
+			if d.attributeType(e, attr.Name()) == AttrID && normalizeAttributeValue(attr.Value()) == id {
+				found = attr
+				return nil
+			}
+		}
+		return nil
+	})
+	if found != nil {
+		d.ids[id] = found
+	}
+}
+
+// idElement returns the element that carries attr, as long as attr is
+// still part of the document and still has the value id
+func (d *Document) idElement(attr *Attribute, id string) *Element {
+	if !d.isIndexed(attr) || normalizeAttributeValue(attr.Value()) != id {
+		return nil
+	}
+	return attr.parent.(*Element)
+}
+
+// isIndexed reports if attr is still set on an element that is part
+// of the document
+func (d *Document) isIndexed(attr *Attribute) bool {
+	e, ok := attr.parent.(*Element)
+	if !ok {
+		return false
+	}
+
+	found := false
+	for p := e.properties; p != nil; p = p.NextAttribute() {
+		if p == attr {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	var n Node = e
+	for ; n != nil; n = n.Parent() {
+		if n == Node(d) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAttribute(attrs []*Attribute, attr *Attribute) bool {
+	for _, a := range attrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+func hasToken(s, tok string) bool {
+	for _, t := range strings.Split(s, " ") {
+		if t == tok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package helium
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetElementByID(t *testing.T) {
+	const input = `<!DOCTYPE doc [
+<!ATTLIST item key ID #IMPLIED ref IDREF #IMPLIED refs IDREFS #IMPLIED>
+]>
+<doc>
+  <item key="a"/>
+  <item xml:id="b" ref="a"/>
+  <item name="c" refs="a b"/>
+</doc>`
+
+	p := NewParser()
+	p.SetIDAttributes("name")
+	doc, err := p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if !assert.NotNil(t, doc.GetElementByID(id), "element with ID %s is found", id) {
+			return
+		}
+	}
+	if !assert.Nil(t, doc.GetElementByID("d"), "unknown IDs are not found") {
+		return
+	}
+
+	refs := doc.IDRefs("a")
+	if !assert.Len(t, refs, 2, "IDREF and IDREFS attributes are indexed") ||
+		!assert.Equal(t, "ref", refs[0].Name(), "IDREF attribute is found") ||
+		!assert.Equal(t, "refs", refs[1].Name(), "IDREFS attribute is found") {
+		return
+	}
+
+	// attributes that are removed are no longer found
+	a := doc.GetElementByID("a")
+	if !assert.True(t, a.RemoveAttribute("key"), "RemoveAttribute should succeed") ||
+		!assert.Nil(t, doc.GetElementByID("a"), "removed ID is not found") {
+		return
+	}
+
+	// attributes that are added are found
+	if !assert.NoError(t, a.SetAttribute("xml:id", "z"), "SetAttribute should succeed") ||
+		!assert.Equal(t, a, doc.GetElementByID("z"), "added ID is found") {
+		return
+	}
+
+	// elements that are detached and attached again are found, even
+	// if they were looked up in between
+	b := doc.GetElementByID("b")
+	parent := b.Parent()
+	unlinkNode(b)
+	if !assert.Nil(t, doc.GetElementByID("b"), "detached ID is not found") ||
+		!assert.Len(t, doc.IDRefs("a"), 1, "IDREF of a detached element is not found") {
+		return
+	}
+	if !assert.NoError(t, parent.AddChild(b), "AddChild should succeed") ||
+		!assert.Equal(t, b, doc.GetElementByID("b"), "attached ID is found") ||
+		!assert.Len(t, doc.IDRefs("a"), 2, "IDREF of an attached element is found") {
+		return
+	}
+	unlinkNode(b)
+	if !assert.NoError(t, parent.AddChild(b), "AddChild should succeed") ||
+		!assert.Len(t, doc.IDRefs("a"), 2, "IDREF is indexed once") {
+		return
+	}
+
+	// elements that are moved to another document follow
+	other := CreateDocument()
+	root, err := other.CreateElement("root")
+	if !assert.NoError(t, err, "CreateElement should succeed") {
+		return
+	}
+	if !assert.NoError(t, other.SetDocumentElement(root), "SetDocumentElement should succeed") {
+		return
+	}
+	doc.DocumentElement().Replace(root)
+	if !assert.Nil(t, doc.GetElementByID("z"), "IDs of replaced elements are not found") {
+		return
+	}
+
+	moved := CreateDocument()
+	if !assert.NoError(t, moved.SetDocumentElement(a), "SetDocumentElement should succeed") {
+		return
+	}
+	if !assert.Equal(t, a, moved.GetElementByID("z"), "IDs are indexed in the new document") {
+		return
+	}
+}
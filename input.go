@@ -0,0 +1,331 @@
+package helium
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/lestrrat/go-strcursor"
+	"github.com/lestrrat/helium/encoding"
+	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/sax"
+)
+
+// parserInput is one of the sources that the parser reads from: the
+// document itself, or the replacement text of a parameter entity
+type parserInput struct {
+	cur *strcursor.RuneCursor
+	uri string // base URI used to resolve relative system IDs
+}
+
+// inputStack is the cursor that the parser reads XML content from.
+// Like libxml2's input stack, parameter entities are pushed on top of
+// the current input when they are referenced, and are popped as soon
+// as their content has been consumed.
+type inputStack struct {
+	inputs []parserInput
+}
+
+func newInputStack(cur *strcursor.RuneCursor, uri string) *inputStack {
+	return &inputStack{
+		inputs: []parserInput{{cur: cur, uri: uri}},
+	}
+}
+
+func (s *inputStack) Push(cur *strcursor.RuneCursor, uri string) {
+	s.inputs = append(s.inputs, parserInput{cur: cur, uri: uri})
+}
+
+// Len returns the number of inputs that have not been consumed yet
+func (s *inputStack) Len() int {
+	s.current()
+	return len(s.inputs)
+}
+
+// URI returns the base URI of the innermost input that has one
+func (s *inputStack) URI() string {
+	for i := len(s.inputs) - 1; i >= 0; i-- {
+		if u := s.inputs[i].uri; u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// current pops the inputs that have been consumed, and returns
+// the cursor that should be read from
+func (s *inputStack) current() *strcursor.RuneCursor {
+	for len(s.inputs) > 1 && s.inputs[len(s.inputs)-1].cur.Done() {
+		s.inputs = s.inputs[:len(s.inputs)-1]
+	}
+	return s.inputs[len(s.inputs)-1].cur
+}
+
+func (s *inputStack) top() *strcursor.RuneCursor {
+	return s.inputs[len(s.inputs)-1].cur
+}
+
+func (s *inputStack) Done() bool {
+	return s.current().Done()
+}
+
+func (s *inputStack) Peek() rune {
+	return s.current().Peek()
+}
+
+func (s *inputStack) PeekN(n int) rune {
+	return s.current().PeekN(n)
+}
+
+func (s *inputStack) Advance(n int) {
+	s.current().Advance(n)
+}
+
+func (s *inputStack) HasPrefix(prefix string) bool {
+	return s.current().HasPrefix(prefix)
+}
+
+func (s *inputStack) Consume(prefix string) bool {
+	return s.current().Consume(prefix)
+}
+
+func (s *inputStack) Column() int {
+	return s.top().Column()
+}
+
+func (s *inputStack) LineNumber() int {
+	return s.top().LineNumber()
+}
+
+func (s *inputStack) Line() string {
+	return s.top().Line()
+}
+
+// buildURI resolves uri against base, like xmlBuildURI. base may
+// either be a URI, or a path in the local filesystem.
+func buildURI(uri, base string) string {
+	if uri == "" || base == "" {
+		return uri
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || u.IsAbs() || filepath.IsAbs(uri) {
+		return uri
+	}
+
+	b, err := url.Parse(base)
+	if err != nil || len(b.Scheme) < 2 {
+		// a plain path (or a windows drive letter). Join drops the
+		// trailing slash, which is needed to resolve against a directory
+		ret := filepath.Join(filepath.Dir(base), filepath.FromSlash(uri))
+		if strings.HasSuffix(uri, "/") {
+			ret += string(filepath.Separator)
+		}
+		return ret
+	}
+	return b.ResolveReference(u).String()
+}
+
+// decodeExternal detects the encoding of an external entity, consumes
+// its text declaration if there is one, and returns a reader that
+// produces UTF-8. The encoding specified by the input, if any, takes
+// precedence over the one that is detected.
+func (ctx *parserCtx) decodeExternal(in *sax.ParseInput) (io.Reader, error) {
+	bcur := strcursor.NewByteCursor(in.Reader)
+
+	oldcur, oldenc := ctx.bytecursor, ctx.encoding
+	ctx.bytecursor = bcur
+	ctx.encoding = ""
+	defer func() {
+		ctx.bytecursor = oldcur
+		ctx.encoding = oldenc
+	}()
+
+	encName, err := ctx.detectEncoding()
+	if err != nil {
+		encName = encUTF8
+	}
+
+	if bcur.HasPrefix(xmlDeclHint) && isBlankCh(rune(bcur.PeekN(len(xmlDeclHint)+1))) {
+		if err := ctx.parseTextDecl(); err != nil {
+			return nil, err
+		}
+		if ctx.encoding != "" && !ctx.options.IsSet(ParseIgnoreEnc) {
+			encName = ctx.encoding
+		}
+	}
+	if in.Encoding != "" {
+		encName = in.Encoding
+	}
+
+	enc := encoding.Load(encName)
+	if enc == nil {
+		return nil, errors.New("encoding '" + encName + "' not supported")
+	}
+	return enc.NewDecoder().Reader(bcur), nil
+}
+
+/*
+ * parse an XML declaration header for external entities
+ *
+ * [77] TextDecl ::= '<?xml' VersionInfo? EncodingDecl S? '?>'
+ */
+func (ctx *parserCtx) parseTextDecl() error {
+	if debug.Enabled {
+		g := debug.IPrintf("START parseTextDecl")
+		defer g.IRelease("END parseTextDecl")
+	}
+
+	cur := ctx.bytecursor
+	if !cur.Consume(xmlDeclHint) {
+		return ctx.error(ErrInvalidXMLDecl)
+	}
+
+	if !skipBlankBytes(cur) {
+		return ctx.error(ErrSpaceRequired)
+	}
+
+	if cur.HasPrefix(versionBytes) {
+		if _, err := ctx.parseVersionInfo(); err != nil {
+			return ctx.error(err)
+		}
+		if !skipBlankBytes(cur) {
+			return ctx.error(ErrSpaceRequired)
+		}
+	}
+
+	enc, err := ctx.parseEncodingDecl()
+	if err != nil {
+		return ctx.error(errors.New("missing encoding in text declaration"))
+	}
+	ctx.encoding = enc
+
+	skipBlankBytes(cur)
+	if !cur.Consume([]byte{'?', '>'}) {
+		return ctx.error(errors.New("text declaration not closed"))
+	}
+	return nil
+}
+
+// loadDTD reports if external DTD content (the external subset, and
+// external parameter entities) should be loaded
+func (ctx *parserCtx) loadDTD() bool {
+	return ctx.loadsubset != 0 || ctx.options.IsSet(ParseNoEnt|ParseDTDAttr|ParseDTDValid)
+}
+
+// loadEntityContent reads the replacement text of an external parsed
+// entity, and stores it in the entity
+func (ctx *parserCtx) loadEntityContent(ent *Entity) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START loadEntityContent '%s'", ent.name)
+		defer g.IRelease("END loadEntityContent")
+	}
+
+	if ent.content != "" {
+		return nil
+	}
+
+	uri := ent.uri
+	if uri == "" {
+		uri = ent.systemID
+	}
+	in, err := ctx.loadExternalEntity(ent.externalID, uri, "")
+	if err != nil {
+		return err
+	}
+	defer closeInput(in)
+
+	r, err := ctx.decodeExternal(in)
+	if err != nil {
+		return err
+	}
+
+	var buf strings.Builder
+	if _, err := io.Copy(&buf, r); err != nil {
+		return err
+	}
+	ent.content = buf.String()
+	ent.uri = in.URI
+	ctx.entities.external += int64(buf.Len())
+	return nil
+}
+
+// pushEntity pushes the replacement text of the parameter entity
+// on the input stack. As required by the specification, the text is
+// enlarged by one leading and one trailing space, so that it can only
+// contain an integral number of grammatical tokens.
+func (ctx *parserCtx) pushEntity(ent sax.Entity) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START pushEntity '%s'", ent.Name())
+		defer g.IRelease("END pushEntity")
+	}
+
+	var uri string
+	if e, ok := ent.(*Entity); ok {
+		uri = e.uri
+	}
+
+	if ctx.cursor.Len() > ctx.entities.maxDepth() {
+		return ErrEntityLoop
+	}
+	if err := ctx.entityCheck(ent); err != nil {
+		return err
+	}
+
+	content := " " + string(ent.Content()) + " "
+	ctx.cursor.Push(strcursor.NewRuneCursor(strings.NewReader(content)), uri)
+	return nil
+}
+
+// loadExternalSubset loads the external subset of the document
+// identified by externalID and systemID, and parses it in to the
+// document's external subset
+func (ctx *parserCtx) loadExternalSubset(name, externalID, systemID, base string) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START loadExternalSubset '%s' '%s'", externalID, systemID)
+		defer g.IRelease("END loadExternalSubset")
+	}
+
+	in, err := ctx.loadExternalEntity(externalID, systemID, base)
+	if err != nil {
+		// failing to load the external subset is not fatal
+		ctx.warning(err)
+		return nil
+	}
+	defer closeInput(in)
+
+	r, err := ctx.decodeExternal(in)
+	if err != nil {
+		return ctx.error(err)
+	}
+
+	doc := ctx.doc
+	if doc.extSubset == nil {
+		dtd, err := doc.CreateDTD()
+		if err != nil {
+			return err
+		}
+		dtd.name = name
+		dtd.externalID = externalID
+		dtd.systemID = systemID
+		doc.extSubset = dtd
+	}
+
+	oldcur := ctx.cursor
+	oldinSubset := ctx.inSubset
+	oldexternal := ctx.external
+	oldpublicID := ctx.publicID
+	ctx.cursor = newInputStack(strcursor.NewRuneCursor(r), in.URI)
+	ctx.inSubset = 2
+	ctx.publicID = externalID
+	defer func() {
+		ctx.cursor = oldcur
+		ctx.inSubset = oldinSubset
+		ctx.external = oldexternal
+		ctx.publicID = oldpublicID
+	}()
+
+	return ctx.parseExternalSubset()
+}
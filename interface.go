@@ -7,12 +7,15 @@ const (
 	XMLNsPrefix  = "xmlns"
 	XMLPrefix    = "xml"
 	XMLTextNoEnc = "textnoenc"
+
+	XIncludeNamespace    = "http://www.w3.org/2001/XInclude"
+	XIncludeOldNamespace = "http://www.w3.org/2003/XInclude"
 )
 
 type LoadSubsetOption int
 
 const (
-	DetectIDs LoadSubsetOption = 1<<iota+1
+	DetectIDs LoadSubsetOption = 1 << (iota + 1)
 	CompleteAttrs
 	SkipIDs
 )
@@ -25,25 +28,25 @@ const (
 	ParseNoEnt                             /* substitute entities */
 	ParseDTDLoad                           /* load the external subset */
 	ParseDTDAttr                           /* default DTD attributes */
-	ParseDTDValid                          /* validate with the DTD */
+	ParseDTDValid                          /* validate with the DTD, which needs a tree */
 	ParseNoError                           /* suppress error reports */
 	ParseNoWarning                         /* suppress warning reports */
 	ParsePedantic                          /* pedantic error reporting */
 	ParseNoBlanks                          /* remove blank nodes */
 	// gap here: ParseSAX1 is not implemented
-	ParseXInclude   ParseOption = 1<<iota + 10 /* Implement XInclude substitition  */
-	ParseNoNet                                 /* Forbid network access */
-	ParseNoDict                                /* Do not reuse the context dictionnary */
-	ParseNsClean                               /* remove redundant namespaces declarations */
-	ParseNoCDATA                               /* merge CDATA as text nodes */
-	ParseNoXIncNode                            /* do not generate XINCLUDE START/END nodes */
-	ParseCompact                               /* compact small text nodes; no modification of the tree allowed afterwards (will possibly crash if you try to modify the tree) */
+	ParseXInclude   ParseOption = 1 << (iota + 1) /* Implement XInclude substitition  */
+	ParseNoNet                                    /* Forbid network access */
+	ParseNoDict                                   /* Do not reuse the context dictionnary */
+	ParseNsClean                                  /* remove redundant namespaces declarations */
+	ParseNoCDATA                                  /* merge CDATA as text nodes */
+	ParseNoXIncNode                               /* do not generate XINCLUDE START/END nodes */
+	ParseCompact                                  /* compact small text nodes; no modification of the tree allowed afterwards (will possibly crash if you try to modify the tree) */
 	// ParseOld10 is not implemented
-	ParseNoBaseFix /* do not fixup XINCLUDE xml:base uris */
-	ParseHuge      /* relax any hardcoded limit from the parser */
+	ParseNoBaseFix ParseOption = 1 << (iota + 2) /* do not fixup XINCLUDE xml:base uris */
+	ParseHuge                                    /* relax any hardcoded limit from the parser */
 	// ParseOldSAX is not implemented
-	ParseIgnoreEnc ParseOption = 1<<iota + 21 /* ignore internal document encoding hint */
-	ParseBigLines  ParseOption = 1 << 22      /* Store big lines numbers in text PSVI field */
+	ParseIgnoreEnc ParseOption = 1 << 21 /* ignore internal document encoding hint */
+	ParseBigLines  ParseOption = 1 << 22 /* Store big lines numbers in text PSVI field */
 )
 
 type AttributeType int
@@ -118,6 +121,15 @@ type docnode struct {
 	next       Node
 	prev       Node
 	doc        *Document
+	line       int // line where the node starts, if parsed
+	column     int // column where the node starts, if parsed
+}
+
+// Positioned is implemented by the nodes, which know where they start
+// in the document that they were parsed from. Both are 0 when unknown.
+type Positioned interface {
+	Line() int
+	Column() int
 }
 
 // node represents a node in a XML tree.
@@ -145,9 +157,16 @@ type Document struct {
 	version    string
 	encoding   string
 	standalone DocumentStandaloneType
+	url        string
+
+	inputEncoding string // encoding that the input was decoded with
 
 	intSubset *DTD
 	extSubset *DTD
+
+	ids     map[string]*Attribute   // ID attributes, by value
+	refs    map[string][]*Attribute // IDREF(S) attributes, by referenced ID
+	idAttrs []string                // names of additional ID attributes
 }
 
 type ProcessingInstruction struct {
@@ -162,10 +181,18 @@ type DTD struct {
 	elements   map[string]*ElementDecl
 	entities   map[string]*Entity
 	pentities  map[string]*Entity
+	notations  map[string]*Notation
 	externalID string
 	systemID   string
 }
 
+// Notation is a notation declared in a DTD
+type Notation struct {
+	name     string
+	publicID string
+	systemID string
+}
+
 type Namespace struct {
 	etype   ElementType
 	href    string
@@ -228,12 +255,33 @@ type Comment struct {
 	node
 }
 
+// CDATASection is the content of a CDATA section, which is kept apart
+// from the surrounding text unless ParseNoCDATA is used
+type CDATASection struct {
+	node
+}
+
 // Element is just a wrapper around Node so that we can
 // use Go-ish type checks
 type Element struct {
 	node
 }
 
+// NamespaceDecl is a namespace in scope on an element, seen as a node
+// whose parent is the element, like the namespace nodes of XPath. See
+// Element.NamespaceNodes.
+type NamespaceDecl struct {
+	docnode
+	ns *Namespace
+}
+
+// XIncludeNode marks the start or the end of the nodes that replaced
+// an xi:include element (see ParseNoXIncNode). The start marker keeps
+// the name, namespace and attributes of the xi:include element.
+type XIncludeNode struct {
+	node
+}
+
 // Nemaspacer is an interface for things that has a namespace
 // prefix and uri
 type Namespacer interface {
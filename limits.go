@@ -0,0 +1,144 @@
+package helium
+
+import (
+	"fmt"
+	"io"
+)
+
+// ParserLimits are the hard limits that the parser enforces, to protect
+// against documents that would consume an unreasonable amount of
+// resources. A zero value for a field selects the default for that
+// limit, and a negative value disables it.
+type ParserLimits struct {
+	// MaxDepth is the maximum nesting of elements
+	MaxDepth int
+	// MaxAttributes is the maximum number of attributes (including
+	// namespace declarations) on a single element
+	MaxAttributes int
+	// MaxNameLength is the maximum length of names, in characters
+	MaxNameLength int
+	// MaxTextLength is the maximum size in bytes of a single run of
+	// text, CDATA section, comment or processing instruction
+	MaxTextLength int
+	// MaxAttrValueLength is the maximum size in bytes of an attribute value
+	MaxAttrValueLength int
+	// MaxInputSize is the maximum number of bytes read from the input
+	MaxInputSize int64
+}
+
+// DefaultParserLimits returns the limits that are used by default
+func DefaultParserLimits() ParserLimits {
+	return ParserLimits{
+		MaxDepth:           256,
+		MaxAttributes:      1024,
+		MaxNameLength:      MaxNameLength,
+		MaxTextLength:      10000000,
+		MaxAttrValueLength: 10000000,
+		MaxInputSize:       -1,
+	}
+}
+
+// HugeParserLimits returns the relaxed limits that are used by default
+// when ParseHuge is set
+func HugeParserLimits() ParserLimits {
+	return ParserLimits{
+		MaxDepth:           2048,
+		MaxAttributes:      100000,
+		MaxNameLength:      MaxHugeLength,
+		MaxTextLength:      1000000000,
+		MaxAttrValueLength: 1000000000,
+		MaxInputSize:       -1,
+	}
+}
+
+// SetLimits sets the limits that are enforced by the parser. Fields that
+// are left zero use the defaults, which depend on ParseHuge.
+func (p *Parser) SetLimits(l ParserLimits) {
+	p.limits = l
+}
+
+// withDefaults fills in the unset fields of l from def
+func (l ParserLimits) withDefaults(def ParserLimits) ParserLimits {
+	if l.MaxDepth == 0 {
+		l.MaxDepth = def.MaxDepth
+	}
+	if l.MaxAttributes == 0 {
+		l.MaxAttributes = def.MaxAttributes
+	}
+	if l.MaxNameLength == 0 {
+		l.MaxNameLength = def.MaxNameLength
+	}
+	if l.MaxTextLength == 0 {
+		l.MaxTextLength = def.MaxTextLength
+	}
+	if l.MaxAttrValueLength == 0 {
+		l.MaxAttrValueLength = def.MaxAttrValueLength
+	}
+	if l.MaxInputSize == 0 {
+		l.MaxInputSize = def.MaxInputSize
+	}
+	return l
+}
+
+// ErrLimitExceeded is returned when the document exceeds one of the
+// ParserLimits. Limit is the name of the ParserLimits field. The parser
+// returns it wrapped in an *Error, whose message gives the location.
+type ErrLimitExceeded struct {
+	Limit      string
+	Max        int64
+	LineNumber int
+	Column     int
+}
+
+func (e ErrLimitExceeded) Error() string {
+	return fmt.Sprintf("%s (%d) exceeded", e.Limit, e.Max)
+}
+
+// Is reports names that are too long as ErrNameTooLong, which was
+// returned before limits were configurable
+func (e ErrLimitExceeded) Is(target error) bool {
+	return target == ErrNameTooLong && e.Limit == "MaxNameLength"
+}
+
+// exceeds reports if n is over max, which is disabled when negative
+func exceeds(n, max int) bool {
+	return max >= 0 && n > max
+}
+
+// limitError creates the error for the limit that was exceeded at
+// the current location
+func (ctx *parserCtx) limitError(limit string, max int64) error {
+	e := ErrLimitExceeded{Limit: limit, Max: max}
+	if cur := ctx.cursor; cur != nil {
+		e.LineNumber = cur.LineNumber()
+		e.Column = cur.Column()
+	}
+	return ctx.error(e)
+}
+
+// countingReader counts the bytes read from the input, and stops
+// reading once max (unless negative) is exceeded
+type countingReader struct {
+	r        io.Reader
+	n        int64
+	max      int64
+	exceeded bool
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.max >= 0 && r.n > r.max {
+		r.exceeded = true
+		n -= int(r.n - r.max)
+		if n < 0 {
+			n = 0
+		}
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,221 @@
+package helium
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/sax"
+)
+
+// EntityLoader loads the external entity (an external subset, or an
+// external parsed entity) located at uri. publicID is the public
+// identifier of the entity, if it has one. It is the equivalent of
+// libxml2's xmlExternalEntityLoader.
+type EntityLoader func(uri, publicID string) (*sax.ParseInput, error)
+
+var (
+	entityLoaderMutex sync.RWMutex
+	entityLoader      EntityLoader = DefaultEntityLoader
+)
+
+// SetExternalEntityLoader changes the EntityLoader that is used by
+// parsers that do not have their own (see Parser.SetEntityLoader).
+// Passing nil restores DefaultEntityLoader.
+func SetExternalEntityLoader(l EntityLoader) {
+	if l == nil {
+		l = DefaultEntityLoader
+	}
+	entityLoaderMutex.Lock()
+	entityLoader = l
+	entityLoaderMutex.Unlock()
+}
+
+// ExternalEntityLoader returns the package-wide EntityLoader
+func ExternalEntityLoader() EntityLoader {
+	entityLoaderMutex.RLock()
+	defer entityLoaderMutex.RUnlock()
+	return entityLoader
+}
+
+// DefaultHTTPTimeout is the time that DefaultEntityLoader allows for
+// fetching an http or https URI, including reading the response
+const DefaultHTTPTimeout = 30 * time.Second
+
+var defaultHTTPClient = &http.Client{Timeout: DefaultHTTPTimeout}
+
+// DefaultEntityLoader reads entities from the local filesystem, and
+// fetches http and https URIs, giving up after DefaultHTTPTimeout.
+func DefaultEntityLoader(uri, publicID string) (*sax.ParseInput, error) {
+	return loadEntity(defaultHTTPClient, uri, publicID)
+}
+
+// HTTPEntityLoader returns an EntityLoader that works like
+// DefaultEntityLoader, but fetches http and https URIs with client,
+// for example to use another timeout or transport.
+func HTTPEntityLoader(client *http.Client) EntityLoader {
+	return func(uri, publicID string) (*sax.ParseInput, error) {
+		return loadEntity(client, uri, publicID)
+	}
+}
+
+func loadEntity(client *http.Client, uri, publicID string) (*sax.ParseInput, error) {
+	if uri == "" {
+		return nil, fmt.Errorf("failed to load external entity (public ID '%s'): no system ID", publicID)
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || len(u.Scheme) < 2 {
+		// a plain path (or a windows drive letter)
+		return openEntityFile(uri, uri)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return openEntityFile(filepath.FromSlash(u.Path), uri)
+	case "http", "https":
+		res, err := client.Get(uri)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load external entity '%s': %s", uri, err)
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("failed to load external entity '%s': %s", uri, res.Status)
+		}
+		return &sax.ParseInput{Reader: res.Body, URI: res.Request.URL.String()}, nil
+	}
+	return nil, fmt.Errorf("failed to load external entity '%s': unsupported scheme '%s'", uri, u.Scheme)
+}
+
+func openEntityFile(fn, uri string) (*sax.ParseInput, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load external entity '%s': %s", uri, err)
+	}
+	return &sax.ParseInput{Reader: f, URI: uri}, nil
+}
+
+// FSEntityLoader returns an EntityLoader that reads entities from
+// fsys, for example an embed.FS. Relative and file URIs are looked
+// up as paths in fsys, and everything else is denied.
+func FSEntityLoader(fsys fs.FS) EntityLoader {
+	return func(uri, publicID string) (*sax.ParseInput, error) {
+		name := uri
+		if u, err := url.Parse(uri); err == nil && len(u.Scheme) > 1 {
+			if u.Scheme != "file" {
+				return nil, fmt.Errorf("failed to load external entity '%s': unsupported scheme '%s'", uri, u.Scheme)
+			}
+			name = u.Path
+		}
+		name = strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load external entity '%s': %s", uri, err)
+		}
+		return &sax.ParseInput{Reader: f, URI: uri}, nil
+	}
+}
+
+// SetEntityLoader sets the EntityLoader that is used by this parser,
+// instead of the package-wide one. Passing nil restores the use of
+// the package-wide EntityLoader.
+func (p *Parser) SetEntityLoader(l EntityLoader) {
+	p.loader = l
+}
+
+// entityLoader returns the EntityLoader for this parse
+func (ctx *parserCtx) entityLoader() EntityLoader {
+	if l := ctx.loader; l != nil {
+		return l
+	}
+	return ExternalEntityLoader()
+}
+
+// openEntity resolves the external identifier through the catalogs,
+// and loads the result with the EntityLoader. With ParseNoNet, only
+// local files may be loaded.
+func (ctx *parserCtx) openEntity(uri, publicID string) (*sax.ParseInput, error) {
+	return ctx.openResolved(ctx.resolveCatalog(uri, publicID), publicID)
+}
+
+// openResource resolves the URI reference uri through the uri entries
+// of the catalogs, and loads the result like openEntity
+func (ctx *parserCtx) openResource(uri string) (*sax.ParseInput, error) {
+	return ctx.openResolved(ctx.resolveCatalogURI(uri), "")
+}
+
+func (ctx *parserCtx) openResolved(resolved, publicID string) (*sax.ParseInput, error) {
+	if ctx.options.IsSet(ParseNoNet) && !isLocalURI(resolved) {
+		return nil, fmt.Errorf("failed to load external entity '%s': network access is forbidden", resolved)
+	}
+
+	in, err := ctx.entityLoader()(resolved, publicID)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil && in.URI == "" {
+		in.URI = resolved
+	}
+	return in, nil
+}
+
+// isLocalURI reports if uri refers to the local filesystem
+func isLocalURI(uri string) bool {
+	if uri == "" {
+		return false
+	}
+	u, err := url.Parse(uri)
+	return err != nil || len(u.Scheme) < 2 || u.Scheme == "file"
+}
+
+// loadExternalEntity opens the external entity identified by publicID
+// and systemID, after resolving systemID against base. The SAX handler
+// is given the first chance to provide the content through
+// ResolveEntity, and the catalogs and the EntityLoader are used otherwise.
+func (ctx *parserCtx) loadExternalEntity(publicID, systemID, base string) (*sax.ParseInput, error) {
+	uri := buildURI(systemID, base)
+	if debug.Enabled {
+		g := debug.IPrintf("START loadExternalEntity '%s' '%s'", publicID, uri)
+		defer g.IRelease("END loadExternalEntity")
+	}
+
+	var in *sax.ParseInput
+	var err error
+	if s := ctx.sax; s != nil {
+		in, err = s.ResolveEntity(ctx.userData, publicID, uri)
+	} else {
+		err = sax.ErrHandlerUnspecified
+	}
+	if err == sax.ErrHandlerUnspecified {
+		in, err = ctx.openEntity(uri, publicID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if in == nil || in.Reader == nil {
+		return nil, errors.New("failed to load external entity '" + uri + "'")
+	}
+
+	if in.URI == "" {
+		in.URI = uri
+	}
+	return in, nil
+}
+
+// closeInput closes the reader of the input, if it needs to be closed
+func closeInput(in *sax.ParseInput) {
+	if c, ok := in.Reader.(io.Closer); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,146 @@
+package helium
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/lestrrat/helium/sax"
+	"github.com/stretchr/testify/assert"
+)
+
+func mapEntityLoader(m map[string]string) EntityLoader {
+	return func(uri, publicID string) (*sax.ParseInput, error) {
+		s, ok := m[uri]
+		if !ok {
+			return nil, errors.New("access to '" + uri + "' denied")
+		}
+		return &sax.ParseInput{Reader: strings.NewReader(s)}, nil
+	}
+}
+
+func TestParserEntityLoader(t *testing.T) {
+	const input = `<!DOCTYPE doc SYSTEM "http://example.com/doc.dtd"><doc>&greeting;</doc>`
+
+	p := NewParser()
+	p.SetEntityLoader(mapEntityLoader(map[string]string{
+		"http://example.com/doc.dtd":   `<!ENTITY % mod SYSTEM "mod.ent">%mod;`,
+		"http://example.com/mod.ent":   `<!ENTITY greeting SYSTEM "hello.txt">`,
+		"http://example.com/hello.txt": `Hello`,
+	}))
+	if !assert.NoError(t, p.SetOption(ParseNoEnt), "SetOption should succeed") {
+		return
+	}
+
+	doc, err := p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, "Hello", string(doc.FirstChild().NextSibling().Content()), "external entities are resolved against the URI of the entity") {
+		return
+	}
+}
+
+func TestFSEntityLoader(t *testing.T) {
+	fsys := fstest.MapFS{
+		"dtd/doc.dtd": &fstest.MapFile{Data: []byte(`<!ENTITY greeting "hi">`)},
+	}
+
+	const input = `<!DOCTYPE doc SYSTEM "dtd/doc.dtd"><doc>&greeting;</doc>`
+
+	p := NewParser()
+	p.SetEntityLoader(FSEntityLoader(fsys))
+	if !assert.NoError(t, p.SetOption(ParseNoEnt), "SetOption should succeed") {
+		return
+	}
+
+	doc, err := p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Equal(t, "hi", string(doc.FirstChild().NextSibling().Content()), "entity is loaded from the filesystem") {
+		return
+	}
+
+	if _, err := FSEntityLoader(fsys)("http://example.com/doc.dtd", ""); !assert.Error(t, err, "non-file URIs are denied") {
+		return
+	}
+}
+
+func TestSetExternalEntityLoader(t *testing.T) {
+	var requested []string
+	SetExternalEntityLoader(func(uri, publicID string) (*sax.ParseInput, error) {
+		requested = append(requested, uri)
+		return nil, errors.New("access denied")
+	})
+	defer SetExternalEntityLoader(nil)
+
+	const input = `<!DOCTYPE doc SYSTEM "test/dtd/doc.dtd"><doc/>`
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseDTDLoad), "SetOption should succeed") {
+		return
+	}
+
+	doc, err := p.Parse([]byte(input))
+	if !assert.NoError(t, err, "a denied external subset is not fatal") {
+		return
+	}
+	if !assert.Nil(t, doc.ExtSubset(), "external subset is not loaded") {
+		return
+	}
+	if !assert.Equal(t, []string{"test/dtd/doc.dtd"}, requested, "package-wide loader is used") {
+		return
+	}
+}
+
+func TestEntityLoaderEncoding(t *testing.T) {
+	const input = `<!DOCTYPE doc SYSTEM "doc.dtd"><doc>&e;</doc>`
+
+	p := NewParser()
+	p.SetEntityLoader(func(uri, publicID string) (*sax.ParseInput, error) {
+		return &sax.ParseInput{
+			Reader:   strings.NewReader("<!ENTITY e \"caf\xe9\">"),
+			Encoding: "iso-8859-1",
+		}, nil
+	})
+	if !assert.NoError(t, p.SetOption(ParseNoEnt), "SetOption should succeed") {
+		return
+	}
+
+	doc, err := p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Equal(t, "café", string(doc.FirstChild().NextSibling().Content()), "input is decoded using the given encoding") {
+		return
+	}
+}
+
+func TestHTTPEntityLoaderTimeout(t *testing.T) {
+	if !assert.True(t, defaultHTTPClient.Timeout > 0, "DefaultEntityLoader has a timeout") {
+		return
+	}
+
+	stalled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer srv.Close()
+	defer close(stalled)
+
+	l := HTTPEntityLoader(&http.Client{Timeout: 100 * time.Millisecond})
+	start := time.Now()
+	_, err := l(srv.URL+"/root.dtd", "")
+	if !assert.Error(t, err, "loading should fail when the server stalls") {
+		return
+	}
+	if !assert.True(t, time.Since(start) < 5*time.Second, "loading should give up after the timeout") {
+		return
+	}
+}
@@ -0,0 +1,59 @@
+package helium
+
+// documentLocator is the sax.DocumentLocator that the parser hands to
+// SetDocumentLocator. It reads the position from the context that is
+// currently parsing, which changes while the content of an entity
+// is being parsed.
+type documentLocator struct {
+	ctx *parserCtx
+}
+
+// position is where the parser was when a SAX event was emitted
+type position struct {
+	line       int
+	column     int
+	nodeLine   int
+	nodeColumn int
+	publicID   string
+	systemID   string
+}
+
+// currentPosition returns the position that the locator reports. When
+// the events of an entity are replayed, it is the position they were
+// recorded at.
+func (ctx *parserCtx) currentPosition() position {
+	if p := ctx.replayed; p != nil {
+		return *p
+	}
+
+	pos := position{
+		nodeLine:   ctx.nodeLine,
+		nodeColumn: ctx.nodeColumn,
+		publicID:   ctx.publicID,
+		systemID:   ctx.baseURI,
+	}
+	if cur := ctx.cursor; cur != nil {
+		pos.line = cur.LineNumber()
+		pos.column = cur.Column()
+		if uri := cur.URI(); uri != "" {
+			pos.systemID = uri
+		}
+	}
+	return pos
+}
+
+func (l *documentLocator) LineNumber() int {
+	return l.ctx.currentPosition().line
+}
+
+func (l *documentLocator) ColumnNumber() int {
+	return l.ctx.currentPosition().column
+}
+
+func (l *documentLocator) PublicID() string {
+	return l.ctx.currentPosition().publicID
+}
+
+func (l *documentLocator) SystemID() string {
+	return l.ctx.currentPosition().systemID
+}
@@ -0,0 +1,60 @@
+package helium
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/helium/sax"
+	"github.com/stretchr/testify/assert"
+)
+
+// locatorRecorder builds the tree, and records where the locator
+// says the parser is whenever an element starts
+type locatorRecorder struct {
+	*TreeBuilder
+	loc       sax.DocumentLocator
+	positions []string
+}
+
+func (r *locatorRecorder) SetDocumentLocator(_ sax.Context, loc sax.DocumentLocator) error {
+	r.loc = loc
+	return nil
+}
+
+func (r *locatorRecorder) StartElementNS(ctxif sax.Context, localname, prefix, uri string, namespaces []sax.Namespace, attrs []sax.Attribute) error {
+	r.positions = append(r.positions, fmt.Sprintf("%s %d:%d %s %s", localname, r.loc.LineNumber(), r.loc.ColumnNumber(), r.loc.PublicID(), r.loc.SystemID()))
+	return r.TreeBuilder.StartElementNS(ctxif, localname, prefix, uri, namespaces, attrs)
+}
+
+func TestDocumentLocator(t *testing.T) {
+	const input = "<!DOCTYPE doc [\n<!ENTITY ext PUBLIC \"-//EX//ENT\" \"ext.xml\">\n]>\n<doc>\n  <a/>&ext;</doc>"
+
+	r := &locatorRecorder{TreeBuilder: NewTreeBuilder()}
+	p := NewParser()
+	p.SetSAXHandler(r)
+	p.SetEntityLoader(mapEntityLoader(map[string]string{
+		"http://example.com/ext.xml": "<e>\n    <b/></e>",
+	}))
+	if !assert.NoError(t, p.SetOption(ParseNoEnt), "SetOption should succeed") {
+		return
+	}
+
+	_, err := p.parse(strings.NewReader(input), "http://example.com/doc.xml")
+	if !assert.NoError(t, err, "parse should succeed") {
+		return
+	}
+	if !assert.NotNil(t, r.loc, "SetDocumentLocator receives a locator") {
+		return
+	}
+
+	expected := []string{
+		"doc 4:6  http://example.com/doc.xml",
+		"a 5:5  http://example.com/doc.xml",
+		"e 1:4 -//EX//ENT http://example.com/ext.xml",
+		"b 2:7 -//EX//ENT http://example.com/ext.xml",
+	}
+	if !assert.Equal(t, expected, r.positions, "positions are reported in the entity being parsed") {
+		return
+	}
+}
@@ -1,5 +1,11 @@
 package helium
 
+import (
+	"strconv"
+
+	"github.com/lestrrat/helium/internal/debug"
+)
+
 func newNamespace(prefix, uri string) *Namespace {
 	n := Namespace{}
 	n.prefix = prefix
@@ -15,3 +21,229 @@ func (n Namespace) Prefix() string {
 func (n Namespace) URI() string {
 	return n.href
 }
+
+// NamespaceNodes returns the namespaces in scope on the element, as
+// nodes whose parent is the element. The xml namespace is always in
+// scope, and a default namespace that was undeclared with xmlns="" is
+// not. New nodes are created on each call.
+func (n *Element) NamespaceNodes() []*NamespaceDecl {
+	var ret []*NamespaceDecl
+	seen := map[string]struct{}{}
+	add := func(ns *Namespace) {
+		if _, ok := seen[ns.Prefix()]; ok {
+			return
+		}
+		seen[ns.Prefix()] = struct{}{}
+		if ns.URI() == "" {
+			return
+		}
+		d := &NamespaceDecl{ns: ns}
+		d.etype = NamespaceDeclNode
+		d.name = ns.Prefix()
+		d.parent = n
+		d.doc = n.doc
+		ret = append(ret, d)
+	}
+
+	for p := Node(n); p != nil; p = p.Parent() {
+		e, ok := p.(*Element)
+		if !ok {
+			break
+		}
+		for _, ns := range e.Namespaces() {
+			add(ns)
+		}
+	}
+	add(newNamespace(XMLPrefix, XMLNamespace))
+	return ret
+}
+
+// Namespace returns the namespace that the node stands for
+func (n *NamespaceDecl) Namespace() *Namespace {
+	return n.ns
+}
+
+func (n *NamespaceDecl) Prefix() string {
+	return n.ns.Prefix()
+}
+
+func (n *NamespaceDecl) URI() string {
+	return n.ns.URI()
+}
+
+// Content returns the namespace URI
+func (n *NamespaceDecl) Content() []byte {
+	return []byte(n.ns.URI())
+}
+
+func (n *NamespaceDecl) AddChild(cur Node) error {
+	return ErrInvalidOperation
+}
+
+func (n *NamespaceDecl) AddContent(b []byte) error {
+	return ErrInvalidOperation
+}
+
+func (n *NamespaceDecl) AddSibling(cur Node) error {
+	return ErrInvalidOperation
+}
+
+func (n *NamespaceDecl) Replace(cur Node) {}
+
+func (n *NamespaceDecl) SetTreeDoc(doc *Document) {}
+
+// isRedundantNamespace reports if prefix is already bound to uri in
+// the scope of n
+func isRedundantNamespace(n Node, prefix, uri string) bool {
+	return lookupNamespaceURI(n, prefix) == uri
+}
+
+// ReconcileNamespaces fixes the namespaces of e and its descendants,
+// typically after they were moved from another subtree or document,
+// like libxml2's xmlReconciliateNs. Elements and attributes whose
+// namespace is no longer declared in scope are given a declaration
+// (on e when possible), declarations that are repeated on several
+// descendants are hoisted to e, and declarations that are already in
+// scope are removed from the descendants.
+func (d *Document) ReconcileNamespaces(e *Element) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START Document.ReconcileNamespaces '%s'", e.Name())
+		defer g.IRelease("END Document.ReconcileNamespaces")
+	}
+
+	d.hoistNamespaces(e)
+	return d.reconcileTree(e, e)
+}
+
+// hoistNamespaces declares on top the prefixed namespaces that are
+// declared on more than one of its descendants, with the same URI, and
+// that top can declare without a conflict
+func (d *Document) hoistNamespaces(top *Element) {
+	var prefixes []string
+	uris := map[string]string{}
+	counts := map[string]int{}
+	conflicts := map[string]bool{}
+	Walk(top, func(n Node) error {
+		e, ok := n.(*Element)
+		if !ok || e == top {
+			return nil
+		}
+		for _, ns := range e.nsDefs {
+			p := ns.Prefix()
+			if p == "" {
+				continue
+			}
+			uri, seen := uris[p]
+			switch {
+			case !seen:
+				prefixes = append(prefixes, p)
+				uris[p] = ns.URI()
+			case uri != ns.URI():
+				conflicts[p] = true
+			}
+			counts[p]++
+		}
+		return nil
+	})
+
+	for _, p := range prefixes {
+		if conflicts[p] || counts[p] < 2 || lookupNamespaceURI(top, p) != "" {
+			continue
+		}
+		top.SetNamespace(p, uris[p])
+	}
+}
+
+// reconcileTree reconciles the namespaces of e, and of its descendants
+func (d *Document) reconcileTree(e, top *Element) error {
+	if e != top {
+		var redundant []string
+		for _, ns := range e.nsDefs {
+			if isRedundantNamespace(e.Parent(), ns.Prefix(), ns.URI()) {
+				redundant = append(redundant, ns.Prefix())
+			}
+		}
+		for _, p := range redundant {
+			e.removeNamespace(p)
+		}
+	}
+
+	if ns := e.ns; ns != nil {
+		fixed, err := d.reconcileNamespace(e, top, ns, false)
+		if err != nil {
+			return err
+		}
+		e.ns = fixed
+	} else if lookupNamespaceURI(e, "") != "" {
+		// e has no namespace, but it would inherit the default one
+		if err := e.SetNamespace("", ""); err != nil {
+			return err
+		}
+	}
+
+	for attr := e.properties; attr != nil; attr = attr.NextAttribute() {
+		if attr.ns == nil {
+			continue
+		}
+		fixed, err := d.reconcileNamespace(e, top, attr.ns, true)
+		if err != nil {
+			return err
+		}
+		attr.ns = fixed
+	}
+
+	for c := e.FirstChild(); c != nil; c = c.NextSibling() {
+		if child, ok := c.(*Element); ok {
+			if err := d.reconcileTree(child, top); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileNamespace returns a namespace with the URI of ns that is in
+// scope for e, declaring one if needed. Attributes require a prefix.
+func (d *Document) reconcileNamespace(e, top *Element, ns *Namespace, attr bool) (*Namespace, error) {
+	prefix, uri := ns.Prefix(), ns.URI()
+	if (prefix != "" || !attr) && lookupNamespaceURI(e, prefix) == uri {
+		return ns, nil
+	}
+
+	// look for another prefix that is bound to the same URI
+	for n := Node(e); n != nil; n = n.Parent() {
+		nc, ok := n.(NamespaceContainer)
+		if !ok {
+			continue
+		}
+		for _, def := range nc.Namespaces() {
+			p := def.Prefix()
+			if def.URI() != uri || (attr && p == "") || lookupNamespaceURI(e, p) != uri {
+				continue
+			}
+			return d.CreateNamespace(p, uri)
+		}
+	}
+
+	if prefix == "" && !attr {
+		// declaring a default namespace on top would change the
+		// namespace of the unqualified elements in between
+		if err := e.SetNamespace("", uri); err != nil {
+			return nil, err
+		}
+		return d.CreateNamespace("", uri)
+	}
+
+	base := prefix
+	if base == "" {
+		base = "default"
+	}
+	candidate := base
+	for i := 1; lookupNamespaceURI(top, candidate) != "" || lookupNamespaceURI(e, candidate) != ""; i++ {
+		candidate = base + strconv.Itoa(i)
+	}
+	if err := top.SetNamespace(candidate, uri); err != nil {
+		return nil, err
+	}
+	return d.CreateNamespace(candidate, uri)
+}
@@ -0,0 +1,106 @@
+package helium
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileNamespaces(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		target   string
+		expected string
+	}{
+		{
+			name:     "dangling prefix is declared on the top element",
+			source:   `<a xmlns:p="urn:p"><p:b p:attr="1"><p:c/></p:b></a>`,
+			target:   `<root/>`,
+			expected: `<root xmlns:p="urn:p"><p:b p:attr="1"><p:c/></p:b></root>`,
+		},
+		{
+			name:     "prefix that is bound to another URI is renamed",
+			source:   `<a xmlns:p="urn:p"><p:b/></a>`,
+			target:   `<root xmlns:p="urn:other"/>`,
+			expected: `<root xmlns:p="urn:other" xmlns:p1="urn:p"><p1:b/></root>`,
+		},
+		{
+			name:     "existing declaration of the URI is reused",
+			source:   `<a xmlns:p="urn:p"><p:b/></a>`,
+			target:   `<root xmlns:q="urn:p"/>`,
+			expected: `<root xmlns:q="urn:p"><q:b/></root>`,
+		},
+		{
+			name:     "default namespace is undeclared",
+			source:   `<a><b/></a>`,
+			target:   `<root xmlns="urn:d"/>`,
+			expected: `<root xmlns="urn:d"><b xmlns=""/></root>`,
+		},
+		{
+			name:     "duplicate declarations are hoisted",
+			source:   `<a><b><x xmlns:q="urn:q"/><y xmlns:q="urn:q"><q:z/></y></b></a>`,
+			target:   `<root/>`,
+			expected: `<root xmlns:q="urn:q"><b><x/><y><q:z/></y></b></root>`,
+		},
+	}
+
+	for _, test := range tests {
+		src, err := Parse([]byte(test.source))
+		if !assert.NoError(t, err, "Parse should succeed (%s)", test.name) {
+			return
+		}
+		doc, err := Parse([]byte(test.target))
+		if !assert.NoError(t, err, "Parse should succeed (%s)", test.name) {
+			return
+		}
+
+		// the attributes of parsed elements only keep their prefix, so
+		// give them a namespace like a DOM user would
+		moved := src.DocumentElement().FirstChild().(*Element)
+		for attr := moved.properties; attr != nil; attr = attr.NextAttribute() {
+			if attr.name == "p:attr" {
+				attr.name = "attr"
+				attr.ns = newNamespace("p", "urn:p")
+			}
+		}
+
+		unlinkNode(moved)
+		root := doc.DocumentElement()
+		if !assert.NoError(t, root.AddChild(moved), "AddChild should succeed (%s)", test.name) {
+			return
+		}
+		if !assert.NoError(t, doc.ReconcileNamespaces(root), "ReconcileNamespaces should succeed (%s)", test.name) {
+			return
+		}
+
+		str, err := root.XMLString()
+		if !assert.NoError(t, err, "XMLString should succeed (%s)", test.name) {
+			return
+		}
+		if !assert.Equal(t, test.expected, str, test.name) {
+			return
+		}
+	}
+}
+
+func TestNamespaceNodes(t *testing.T) {
+	doc, err := Parse([]byte(`<a xmlns="urn:d" xmlns:p="urn:p"><b xmlns="" xmlns:p="urn:other"/></a>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	b := doc.DocumentElement().FirstChild().(*Element)
+	nodes := b.NamespaceNodes()
+	if !assert.Len(t, nodes, 2, "undeclared default namespace is not in scope") {
+		return
+	}
+	for i, expected := range [][2]string{{"p", "urn:other"}, {"xml", XMLNamespace}} {
+		if !assert.Equal(t, expected[0], nodes[i].Prefix(), "prefix of namespace node %d", i) ||
+			!assert.Equal(t, expected[1], nodes[i].URI(), "URI of namespace node %d", i) ||
+			!assert.Equal(t, NamespaceDeclNode, nodes[i].Type(), "type of namespace node %d", i) ||
+			!assert.Equal(t, Node(b), nodes[i].Parent(), "parent of namespace node %d", i) {
+			return
+		}
+	}
+}
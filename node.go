@@ -78,6 +78,21 @@ func Walk(n Node, f WalkFunc) error {
 	return nil
 }
 
+// Line returns the line where the node starts, if it was parsed
+func (n docnode) Line() int {
+	return n.line
+}
+
+// Column returns the column where the node starts, if it was parsed
+func (n docnode) Column() int {
+	return n.column
+}
+
+func (n *docnode) setPosition(line, column int) {
+	n.line = line
+	n.column = column
+}
+
 func (n docnode) LocalName() string {
 	return n.name
 }
@@ -98,9 +113,35 @@ func (n docnode) LastChild() Node {
 	return n.lastChild
 }
 
+// treeDoc returns the document that n is part of
+func treeDoc(n Node) *Document {
+	if d, ok := n.(*Document); ok {
+		return d
+	}
+	return n.OwnerDocument()
+}
+
+// adoptNode prepares cur to be attached next to or under n: it is moved
+// to the document of n, and its IDs are indexed again, as they may have
+// been dropped while it was detached
+func adoptNode(n, cur Node) {
+	doc := treeDoc(n)
+	if doc == nil {
+		return
+	}
+	if cur.OwnerDocument() != doc {
+		cur.SetTreeDoc(doc)
+		return
+	}
+	if e, ok := cur.(*Element); ok {
+		doc.reindexTree(e)
+	}
+}
+
 func addChild(n Node, cur Node) error {
 	l := n.LastChild()
 	if l == nil { // No children, set firstChild to cur
+		adoptNode(n, cur)
 debug.Printf("LastChild is nil, setting firstChild and lastChild")
 		n.setFirstChild(cur)
 		n.setLastChild(cur)
@@ -133,6 +174,10 @@ func (n docnode) PrevSibling() Node {
 }
 
 func addSibling(n, cur Node) error {
+	if n != nil {
+		adoptNode(n, cur)
+	}
+
 	for n != nil {
 		if n.NextSibling() == nil {
 			n.SetNextSibling(cur)
@@ -163,6 +208,8 @@ func (n *docnode) SetParent(cur Node) {
 }
 
 func replaceNode(n Node, cur Node) {
+	adoptNode(n, cur)
+
 	if next := n.NextSibling(); next != nil {
 		cur.SetNextSibling(next) // cur.next = n.next
 		next.SetPrevSibling(cur) // n.next.prev = cur
@@ -182,6 +229,54 @@ func replaceNode(n Node, cur Node) {
 		}
 		cur.SetParent(parent)
 	}
+
+	// n is no longer part of the tree
+	n.SetParent(nil)
+	n.SetPrevSibling(nil)
+	n.SetNextSibling(nil)
+}
+
+// addNextSibling inserts cur right after n
+func addNextSibling(n, cur Node) {
+	adoptNode(n, cur)
+
+	next := n.NextSibling()
+	cur.SetParent(n.Parent())
+	cur.SetPrevSibling(n)
+	cur.SetNextSibling(next)
+	n.SetNextSibling(cur)
+	if next != nil {
+		next.SetPrevSibling(cur)
+	} else if parent := n.Parent(); parent != nil {
+		parent.setLastChild(cur)
+	}
+}
+
+// unlinkNode detaches n from its parent and siblings
+func unlinkNode(n Node) {
+	parent := n.Parent()
+	prev := n.PrevSibling()
+	next := n.NextSibling()
+
+	if prev != nil {
+		prev.SetNextSibling(next)
+	}
+	if next != nil {
+		next.SetPrevSibling(prev)
+	}
+
+	if parent != nil {
+		if parent.FirstChild() == n {
+			parent.setFirstChild(next)
+		}
+		if parent.LastChild() == n {
+			parent.setLastChild(prev)
+		}
+	}
+
+	n.SetParent(nil)
+	n.SetPrevSibling(nil)
+	n.SetNextSibling(nil)
 }
 
 func (n node) Namespace() *Namespace {
@@ -204,13 +299,33 @@ func (n *node) SetNamespace(prefix, uri string, activate ...bool) error {
 	}
 	if a {
 		n.ns = ns
-	} else {
-		n.nsDefs = append(n.nsDefs, ns)
+		return nil
 	}
 
+	for _, def := range n.nsDefs {
+		if def.Prefix() != prefix {
+			continue
+		}
+		if def.URI() != uri {
+			return ErrNamespaceRedeclared
+		}
+		// already declared
+		return nil
+	}
+	n.nsDefs = append(n.nsDefs, ns)
 	return nil
 }
 
+// removeNamespace removes the declaration of prefix from n
+func (n *node) removeNamespace(prefix string) {
+	for i, def := range n.nsDefs {
+		if def.Prefix() == prefix {
+			n.nsDefs = append(n.nsDefs[:i:i], n.nsDefs[i+1:]...)
+			return
+		}
+	}
+}
+
 func (n node) Prefix() string {
 	if ns := n.ns; ns != nil {
 		return ns.Prefix()
@@ -256,11 +371,15 @@ func setTreeDoc(n Node, doc *Document) {
 	if n.Type() == ElementNode {
 		e := n.(*Element)
 		for prop := e.properties; prop != nil; prop = prop.NextAttribute() {
-			// if prop.atype == XML_ATTRIBUTE_ID; xmlRemoveID(tree->doc, prop)
+			// the old document drops the IDs lazily, once it notices
+			// that they are gone
 			prop.doc = doc
 			if child := prop.firstChild; child != nil {
 				setListDoc(child, doc)
 			}
+			if doc != nil {
+				doc.indexAttribute(e, prop)
+			}
 		}
 	}
 	if child := n.FirstChild(); child != nil {
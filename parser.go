@@ -2,7 +2,13 @@ package helium
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
 
+	"github.com/lestrrat/helium/encoding"
 	"github.com/lestrrat/helium/internal/debug"
 	"github.com/lestrrat/helium/sax"
 )
@@ -12,6 +18,18 @@ func Parse(b []byte) (*Document, error) {
 	return p.Parse(b)
 }
 
+// ParseReader is a shortcut for NewParser().ParseReader(in)
+func ParseReader(in io.Reader) (*Document, error) {
+	p := NewParser()
+	return p.ParseReader(in)
+}
+
+// ParseFile is a shortcut for NewParser().ParseFile(fn)
+func ParseFile(fn string) (*Document, error) {
+	p := NewParser()
+	return p.ParseFile(fn)
+}
+
 func NewParser() *Parser {
 	return &Parser{
 		sax: NewTreeBuilder(),
@@ -24,17 +42,209 @@ func (p *Parser) Parse(b []byte) (*Document, error) {
 		defer g.IRelease("=== END Parser.Parse ===")
 	}
 
+	return p.ParseReader(bytes.NewReader(b))
+}
+
+// ParseReader parses the XML document read from `in`. The input is
+// consumed incrementally as the parser advances, so the whole document
+// is never buffered in memory: when building a tree the memory usage is
+// bounded by the size of the resulting tree, and when a SAX handler that
+// does not build a tree is used, it stays roughly constant.
+//
+// The location of the document is unknown, so relative references to
+// external entities are resolved against the current directory, unless
+// a base URI is set with SetBaseURI.
+func (p *Parser) ParseReader(in io.Reader) (*Document, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("=== START Parser.ParseReader ===")
+		defer g.IRelease("=== END Parser.ParseReader ===")
+	}
+
+	return p.parse(in, p.baseURI)
+}
+
+// SetBaseURI sets the location of the documents that are parsed by
+// Parse and ParseReader, which becomes the URL of the Document, and
+// against which relative references are resolved. ParseFile and
+// ParseURI use the location that they read from instead.
+func (p *Parser) SetBaseURI(uri string) {
+	p.baseURI = uri
+}
+
+// parse parses the document read from `in`. uri is the location of
+// the document, which is used to resolve relative references to
+// external entities.
+func (p *Parser) parse(in io.Reader, uri string) (*Document, error) {
 	ctx := &parserCtx{}
-	ctx.init(p, bytes.NewReader(b))
+	ctx.init(p, in)
+	ctx.baseURI = uri
 	defer ctx.release()
 
-	if err := ctx.parseDocument(); err != nil {
+	err := ctx.parseDocument()
+	if ctx.entities.input.exceeded {
+		// whatever went wrong was caused by the truncated input
+		err = ctx.limitError("MaxInputSize", ctx.limits.MaxInputSize)
+	}
+	if err == nil && ctx.options.IsSet(ParseXInclude) && ctx.doc != nil {
+		err = p.ProcessXInclude(ctx.doc)
+	}
+	if err != nil {
+		ctx.reportError(err)
+	}
+
+	// Validity errors are not fatal: the document is returned along
+	// with all of the violations
+	var verrs ErrValidationErrors
+	if err == nil && ctx.options.IsSet(ParseDTDValid) && ctx.doc != nil {
+		verrs = ctx.validateDocument()
+	}
+
+	if ctx.options.IsSet(ParseRecover) {
+		// In recovery mode, return whatever we managed to build,
+		// along with all of the errors that we encountered
+		if err != nil {
+			ctx.recovered = append(ctx.recovered, err)
+		}
+		ctx.recovered = append(ctx.recovered, verrs...)
+		if len(ctx.recovered) > 0 {
+			return ctx.doc, ErrParseErrors(ctx.recovered)
+		}
+		return ctx.doc, nil
+	}
+
+	if err != nil {
 		return nil, err
 	}
 
+	if len(verrs) > 0 {
+		return ctx.doc, verrs
+	}
 	return ctx.doc, nil
 }
 
+// ParseFile opens the file `fn`, and parses its content like
+// ParseReader. External entities and DTDs with relative system IDs
+// are looked up relative to `fn`.
+func (p *Parser) ParseFile(fn string) (*Document, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return p.parse(f, fn)
+}
+
+// ParseURI loads the document at uri, after resolving it through the
+// catalogs, with the EntityLoader of the parser, and parses it like
+// ParseReader. Relative references are resolved against uri.
+func (p *Parser) ParseURI(uri string) (*Document, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("=== START Parser.ParseURI '%s' ===", uri)
+		defer g.IRelease("=== END Parser.ParseURI ===")
+	}
+
+	ctx := &parserCtx{options: p.options, loader: p.loader, catalog: p.catalog}
+	in, err := ctx.openEntity(uri, "")
+	if err != nil {
+		return nil, err
+	}
+	if in == nil || in.Reader == nil {
+		return nil, errors.New("failed to load '" + uri + "'")
+	}
+	defer closeInput(in)
+
+	return p.parse(in.Reader, in.URI)
+}
+
 func (p *Parser) SetSAXHandler(s sax.SAX2Handler) {
 	p.sax = s
 }
+
+// SetErrorHandler sets the function that receives the errors and
+// warnings found while parsing, before they are passed to the SAX
+// handler. ParseNoError and ParseNoWarning silence it too.
+func (p *Parser) SetErrorHandler(h func(*Error)) {
+	p.onError = h
+}
+
+// supportedOptions lists the parser options that are implemented.
+// ParseNoDict and ParseCompact are memory optimizations that do not
+// apply to Go, so they are accepted but have no effect.
+const supportedOptions = ParseRecover | ParseNoEnt | ParseDTDLoad |
+	ParseDTDAttr | ParseDTDValid | ParseNoError | ParseNoWarning | ParsePedantic | ParseNoBlanks |
+	ParseNoDict | ParseCompact | ParseHuge | ParseNoNet | ParseXInclude | ParseNoXIncNode |
+	ParseNoBaseFix | ParseNsClean | ParseNoCDATA | ParseIgnoreEnc | ParseBigLines
+
+var parseOptionNames = []struct {
+	opt  ParseOption
+	name string
+}{
+	{ParseRecover, "ParseRecover"},
+	{ParseNoEnt, "ParseNoEnt"},
+	{ParseDTDLoad, "ParseDTDLoad"},
+	{ParseDTDAttr, "ParseDTDAttr"},
+	{ParseDTDValid, "ParseDTDValid"},
+	{ParseNoError, "ParseNoError"},
+	{ParseNoWarning, "ParseNoWarning"},
+	{ParsePedantic, "ParsePedantic"},
+	{ParseNoBlanks, "ParseNoBlanks"},
+	{ParseXInclude, "ParseXInclude"},
+	{ParseNoNet, "ParseNoNet"},
+	{ParseNoDict, "ParseNoDict"},
+	{ParseNsClean, "ParseNsClean"},
+	{ParseNoCDATA, "ParseNoCDATA"},
+	{ParseNoXIncNode, "ParseNoXIncNode"},
+	{ParseCompact, "ParseCompact"},
+	{ParseNoBaseFix, "ParseNoBaseFix"},
+	{ParseHuge, "ParseHuge"},
+	{ParseIgnoreEnc, "ParseIgnoreEnc"},
+	{ParseBigLines, "ParseBigLines"},
+}
+
+func (p ParseOption) String() string {
+	var names []string
+	for _, o := range parseOptionNames {
+		if p.IsSet(o.opt) {
+			names = append(names, o.name)
+			p &^= o.opt
+		}
+	}
+	if p != 0 {
+		names = append(names, "ParseOption("+strconv.Itoa(int(p))+")")
+	}
+	return strings.Join(names, "|")
+}
+
+// SetOption enables the given parser options. The options that were
+// already enabled are kept. ErrUnimplemented is returned, and none
+// of the options are enabled, if any of them are not supported yet.
+func (p *Parser) SetOption(opt ParseOption) error {
+	if unsupported := opt &^ supportedOptions; unsupported != 0 {
+		return ErrUnimplemented{target: "parser option " + unsupported.String()}
+	}
+	p.options.Set(opt)
+	return nil
+}
+
+// SetEncoding forces the encoding of the documents that are parsed,
+// regardless of the encoding that they declare or that is detected,
+// for example when it is known from the transport. An empty name
+// restores the detection.
+func (p *Parser) SetEncoding(name string) error {
+	if name != "" && encoding.Load(name) == nil {
+		return errors.New("encoding '" + name + "' not supported")
+	}
+	p.encoding = name
+	return nil
+}
+
+// UnsetOption disables the given parser options
+func (p *Parser) UnsetOption(opt ParseOption) {
+	p.options &^= opt
+}
+
+// Options returns the parser options that are currently enabled
+func (p *Parser) Options() ParseOption {
+	return p.options
+}
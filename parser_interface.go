@@ -25,6 +25,29 @@ const (
 
 const MaxNameLength = 50000
 
+// MaxHugeLength is the limit that is used instead of MaxNameLength
+// when ParseHuge is set
+const MaxHugeLength = 10000000
+
+// Limits on the expansion of entities, to protect against attacks such
+// as "billion laughs" and quadratic blowup. The amplification factor is
+// the ratio of the size of the expanded entities to the size of the
+// input, and is only enforced once more than the threshold has been
+// expanded. The huge variants are used when ParseHuge is set.
+const (
+	maxEntityDepth               = 40
+	maxHugeEntityDepth           = 1024
+	maxEntityCount               = 1000000
+	maxHugeEntityCount           = 100000000
+	maxEntityAmplification       = 5
+	entityExpansionThreshold     = 1000000
+	hugeEntityExpansionThreshold = 1000000000
+
+	// entityFixedCost is added to the size of each expansion, so that
+	// references to empty entities are accounted for
+	entityFixedCost = 20
+)
+
 var (
 	ErrAmpersandRequired            = errors.New("'&' was required here")
 	ErrAttrListNotFinished          = errors.New("attrlist must finish with a ')'")
@@ -34,9 +57,12 @@ var (
 	ErrDocTypeNameRequired          = errors.New("doctype name required")
 	ErrDocTypeNotFinished           = errors.New("doctype not finished")
 	ErrDocumentEnd                  = errors.New("extra content at document end")
+	ErrDTDValidWithoutTree          = errors.New("ParseDTDValid requires a SAX handler that builds a tree")
 	ErrEOF                          = errors.New("end of file reached")
 	ErrElementContentNotFinished    = errors.New("element content not finished")
 	ErrEmptyDocument                = errors.New("start tag expected, '<' not found")
+	ErrEntityAmplification          = errors.New("maximum entity amplification factor exceeded")
+	ErrEntityLoop                   = errors.New("detected an entity reference loop")
 	ErrEntityNotFound               = errors.New("entity not found")
 	ErrEqualSignRequired            = errors.New("'=' was required here")
 	ErrGtRequired                   = errors.New("'>' was required here")
@@ -52,11 +78,15 @@ var (
 	ErrInvalidProcessingInstruction = errors.New("invalid processing instruction")
 	ErrInvalidVersionNum            = errors.New("invalid version")
 	ErrInvalidXMLDecl               = errors.New("invalid XML declration")
+	ErrInvalidXPointer              = errors.New("invalid XPointer")
 	ErrInvalidParserCtx             = errors.New("invalid parser context")
 	ErrLtSlashRequired              = errors.New("'</' is required")
 	ErrMisplacedCDATAEnd            = errors.New("misplaced CDATA end ']]>'")
+	ErrMismatchedEndTag             = errors.New("opening and ending tag mismatch")
+	ErrMixedNotStarted              = errors.New("mixed content declaration must end with ')*'")
 	ErrNameTooLong                  = errors.New("name is too long")
 	ErrNameRequired                 = errors.New("name is required")
+	ErrNamespaceRedeclared          = errors.New("namespace prefix is already declared with a different URI")
 	ErrNmtokenRequired              = errors.New("nmtoken is required")
 	ErrNotationNameRequired         = errors.New("notation name expected in NOTATION declaration")
 	ErrNotationNotFinished          = errors.New("notation must finish with a ')'")
@@ -70,6 +100,8 @@ var (
 	ErrSpaceRequired                = errors.New("space required")
 	ErrStartTagRequired             = errors.New("start tag expected, '<' not found")
 	ErrValueRequired                = errors.New("value required")
+	ErrXIncludeRecursion            = errors.New("inclusion loop detected")
+	ErrXPointerNotFound             = errors.New("XPointer evaluation failed")
 )
 
 type ErrDTDDupToken struct {
@@ -80,6 +112,95 @@ type ErrAttrNotFound struct {
 	Token string
 }
 
+// ErrorLevel is the severity of an Error
+type ErrorLevel int
+
+const (
+	ErrorLevelNone    ErrorLevel = iota
+	ErrorLevelWarning            // a problem that does not stop the parser
+	ErrorLevelError              // a recoverable error, such as a validity error
+	ErrorLevelFatal              // a well-formedness error
+)
+
+// ErrorDomain is the module that reported an Error. The values are
+// those of libxml2's xmlErrorDomain.
+type ErrorDomain int
+
+const (
+	DomainNone      ErrorDomain = 0
+	DomainParser    ErrorDomain = 1
+	DomainTree      ErrorDomain = 2
+	DomainNamespace ErrorDomain = 3
+	DomainDTD       ErrorDomain = 4
+	DomainIO        ErrorDomain = 8
+	DomainXInclude  ErrorDomain = 11
+	DomainCatalog   ErrorDomain = 20
+	DomainValid     ErrorDomain = 23
+)
+
+// ErrorCode identifies the kind of an Error. The values are those of
+// libxml2's xmlParserErrors. CodeNone is used for the errors that have
+// not been classified.
+type ErrorCode int
+
+const (
+	CodeNone                    ErrorCode = 0
+	CodeDocumentEmpty           ErrorCode = 4
+	CodeDocumentEnd             ErrorCode = 5
+	CodeInvalidChar             ErrorCode = 9
+	CodeEntityRefSemicolMissing ErrorCode = 23
+	CodeUndeclaredEntity        ErrorCode = 26
+	CodeNsDeclError             ErrorCode = 35
+	CodeCommentNotFinished      ErrorCode = 45
+	CodePINotFinished           ErrorCode = 47
+	CodeNotationNotStarted      ErrorCode = 48
+	CodeNotationNotFinished     ErrorCode = 49
+	CodeAttlistNotStarted       ErrorCode = 50
+	CodeAttlistNotFinished      ErrorCode = 51
+	CodeMixedNotStarted         ErrorCode = 52
+	CodeElemContentNotStarted   ErrorCode = 54
+	CodeElemContentNotFinished  ErrorCode = 55
+	CodeXMLDeclNotFinished      ErrorCode = 57
+	CodeDocTypeNotFinished      ErrorCode = 61
+	CodeMisplacedCDATAEnd       ErrorCode = 62
+	CodeCDATANotFinished        ErrorCode = 63
+	CodeSpaceRequired           ErrorCode = 65
+	CodeNmtokenRequired         ErrorCode = 67
+	CodeNameRequired            ErrorCode = 68
+	CodePCDATARequired          ErrorCode = 69
+	CodeGtRequired              ErrorCode = 73
+	CodeLtSlashRequired         ErrorCode = 74
+	CodeEqualRequired           ErrorCode = 75
+	CodeTagNameMismatch         ErrorCode = 76
+	CodeEncodingName            ErrorCode = 79
+	CodeHyphenInComment         ErrorCode = 80
+	CodeValueRequired           ErrorCode = 84
+	CodeEntityLoop              ErrorCode = 89
+	CodeUnknownVersion          ErrorCode = 108
+	CodeNameTooLong             ErrorCode = 110
+	CodeXIncludeRecursion       ErrorCode = 1600
+)
+
+// Error is a structured error, like libxml2's xmlError. It is what the
+// parser returns for well-formedness errors, and what is delivered to
+// the handler set with Parser.SetErrorHandler. Err is the underlying
+// error, so that the sentinel errors still match with errors.Is.
+type Error struct {
+	Domain  ErrorDomain
+	Code    ErrorCode
+	Level   ErrorLevel
+	File    string // URI of the entity that was being parsed, if known
+	Line    int
+	Column  int
+	Context string // the line of input where the error was found
+	Node    Node   // the offending node or entity, if any
+	Err     error
+}
+
+// ErrParseError is the error that the parser used to return.
+//
+// Deprecated: the parser returns *Error, which can still be converted
+// to ErrParseError with errors.As.
 type ErrParseError struct {
 	Column     int
 	Err        error
@@ -88,8 +209,43 @@ type ErrParseError struct {
 	LineNumber int
 }
 
+// ErrParseErrors is returned when parsing in recovery mode
+// (ParseRecover), and holds all of the errors that the parser
+// recovered from.
+type ErrParseErrors []error
+
+// ErrValidation is a violation of a validity constraint of the DTD.
+// LineNumber is the line of the offending element, if known.
+type ErrValidation struct {
+	Message    string
+	Node       Node
+	LineNumber int
+}
+
+// ErrXInclude is an error raised while processing an xi:include
+// element. LineNumber is the line of the element, if known.
+type ErrXInclude struct {
+	Err        error
+	Node       Node
+	LineNumber int
+}
+
+// ErrValidationErrors is returned by Document.Validate, and by the
+// parser when ParseDTDValid is set, and holds all of the violations
+// that were found.
+type ErrValidationErrors []error
+
 type Parser struct {
-	sax sax.SAX2Handler
+	sax      sax.SAX2Handler
+	options  ParseOption
+	loader   EntityLoader
+	catalog  *Catalog
+	xpointer XPointerResolver
+	limits   ParserLimits
+	idAttrs  []string
+	encoding string // encoding forced by the caller
+	baseURI  string // location of the documents read by ParseReader
+	onError  func(*Error)
 }
 
 const (
@@ -100,6 +256,9 @@ const (
 
 type parserCtx struct {
 	options ParseOption
+	loader  EntityLoader
+	catalog *Catalog
+	limits  ParserLimits
 	// ctx.encoding contains the explicit encoding. ctx.detectedEncoding
 	// contains the encoding as detected by inspecting BOM, etc.
 	// It is important to differentiate between the two, otherwise
@@ -107,9 +266,18 @@ type parserCtx struct {
 	// <?xml version="1.0"?> vs <?xml version="1.0" encoding="utf-8"?>
 	encoding          string
 	detectedEncoding  string
+	forcedEncoding    string // set through Parser.SetEncoding
+	nodeLine          int    // line where the current node starts
+	nodeColumn        int    // column where the current node starts
+	inputEncoding     string // the encoding that the input was decoded with
 	in                io.Reader
 	bytecursor        *strcursor.ByteCursor // Used for parsing up to XML declaration
-	cursor            *strcursor.RuneCursor // Used for XML content
+	cursor            *inputStack           // Used for XML content
+	baseURI           string                // URI of the document, if known
+	publicID          string                // public identifier of the external entity being parsed
+	locator           *documentLocator      // shared with the contexts parsing entity content
+	replayed          *position             // position of the entity event being replayed
+	emptyElement      bool                  // the element being started is empty (<e/>)
 	nbread            int
 	instate           parserState
 	keepBlanks        bool
@@ -126,14 +294,19 @@ type parserCtx struct {
 	extSubURI         string
 	version           string
 	attsSpecial       map[string]AttributeType
-	attsDefault       map[string]map[string]*Attribute
+	attsDefault       map[string][]*attrData
+	idAttrs           []string // additional ID attributes for the document
 	valid             bool
 	hasPERefs         bool
 	pedantic          bool
 	wellFormed        bool
 	depth             int
+	elemDepth         int // nesting of the elements being parsed
 	loadsubset        LoadSubsetOption
 	elem              *Element // current context element
+	recovered         []error  // errors recorded in recovery mode
+	peError           error    // error from a PE reference expanded while skipping blanks
+	onError           func(*Error)
 
 	nsTab      nsStack
 	doc        *Document
@@ -141,6 +314,7 @@ type parserCtx struct {
 	nodeTab    nodeStack
 	elemidx    int
 	nbentities int
+	entities   *entityStats // shared with the contexts parsing entity content
 }
 
 type SubstitutionType int
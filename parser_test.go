@@ -2,9 +2,17 @@ package helium
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/sax"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -180,3 +188,1049 @@ func TestParseNamespace(t *testing.T) {
 		debug.Dump(doc)
 	}
 }
+
+func TestParseReader(t *testing.T) {
+	const input = `<?xml version="1.0"?>
+<root foo="bar">
+  <child>foo</child>
+  <child>bar</child>
+</root>`
+
+	expected, err := Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	expectedStr, err := expected.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+
+	p := NewParser()
+	doc, err := p.ParseReader(iotest.OneByteReader(strings.NewReader(input)))
+	if !assert.NoError(t, err, "ParseReader should succeed") {
+		return
+	}
+
+	str, err := doc.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+	if !assert.Equal(t, expectedStr, str, "ParseReader and Parse should produce the same document") {
+		return
+	}
+}
+
+// itemStream generates a document with `count` child elements on the fly,
+// without ever holding the entire document in memory
+type itemStream struct {
+	count int
+	buf   []byte
+	state int
+}
+
+func (s *itemStream) Read(b []byte) (int, error) {
+	for len(s.buf) == 0 {
+		switch {
+		case s.state == 0:
+			s.buf = []byte(`<?xml version="1.0"?><root>`)
+		case s.state <= s.count:
+			s.buf = []byte(`<item id="` + strconv.Itoa(s.state) + `">content</item>`)
+		case s.state == s.count+1:
+			s.buf = []byte(`</root>`)
+		default:
+			return 0, io.EOF
+		}
+		s.state++
+	}
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func TestParseReaderSAX(t *testing.T) {
+	const count = 10000
+
+	elements := 0
+	s := sax.New()
+	s.StartElementNSHandler = func(_ sax.Context, localname, prefix, uri string, namespaces []sax.Namespace, attrs []sax.Attribute) error {
+		elements++
+		return nil
+	}
+
+	p := NewParser()
+	p.SetSAXHandler(s)
+	if _, err := p.ParseReader(&itemStream{count: count}); !assert.NoError(t, err, "ParseReader should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, count+1, elements, "number of elements matches") {
+		return
+	}
+}
+
+func TestParseReaderError(t *testing.T) {
+	p := NewParser()
+	_, err := p.ParseReader(iotest.TimeoutReader(strings.NewReader(`<?xml version="1.0"?><root>`)))
+	if !assert.Error(t, err, "ParseReader should fail for a truncated stream") {
+		return
+	}
+}
+
+func TestParseRecover(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		errors   int
+	}{
+		{
+			input:    `<root><a>text</b></a></root>`,
+			expected: `<root><a>text</a></root>`,
+			errors:   1,
+		},
+		{
+			input:    `<root><a><b>text</a></root>`,
+			expected: `<root><a><b>text</b></a></root>`,
+			errors:   1,
+		},
+		{
+			input:    `<root><a x="1" y=>text</a></root>`,
+			expected: `<root><a x="1">text</a></root>`,
+			errors:   1,
+		},
+		{
+			input:    `<root><a x="1" <b/></a></root>`,
+			expected: `<root><a x="1"><b/></a></root>`,
+			errors:   1,
+		},
+		{
+			input:    `<root><a>text`,
+			expected: `<root><a>text</a></root>`,
+			errors:   2,
+		},
+		{
+			input:    `<root><1a>text</root>`,
+			expected: `<root/>`,
+			errors:   1,
+		},
+		{
+			input:    `<root>a &foo bar</root>`,
+			expected: `<root>a  bar</root>`,
+			errors:   1,
+		},
+		{
+			input:    `<root>a & b<c/>d</root>`,
+			expected: `<root>a  b<c/>d</root>`,
+			errors:   1,
+		},
+		{
+			input:    `<root>x]]>y &amp; z</root>`,
+			expected: `<root>&amp; z</root>`,
+			errors:   1,
+		},
+	}
+
+	for _, test := range tests {
+		p := NewParser()
+		if !assert.NoError(t, p.SetOption(ParseRecover), "SetOption should succeed") {
+			return
+		}
+
+		doc, err := p.Parse([]byte(test.input))
+		if !assert.IsType(t, ErrParseErrors{}, err, "Parse should return the recovered errors for '%s'", test.input) {
+			return
+		}
+		if !assert.Len(t, err.(ErrParseErrors), test.errors, "number of errors for '%s'", test.input) {
+			return
+		}
+		if !assert.NotNil(t, doc, "Parse should return a document for '%s'", test.input) {
+			return
+		}
+
+		str, err := doc.XMLString()
+		if !assert.NoError(t, err, "XMLString should succeed") {
+			return
+		}
+		if !assert.Equal(t, "<?xml version=\"1.0\"?>\n"+test.expected+"\n", str, "recovered document for '%s'", test.input) {
+			return
+		}
+
+		// Without ParseRecover, the same input is an error
+		doc, err = Parse([]byte(test.input))
+		if !assert.Error(t, err, "Parse without ParseRecover should fail for '%s'", test.input) || !assert.Nil(t, doc, "no document without ParseRecover") {
+			return
+		}
+	}
+}
+
+func TestParseRecoverUnclosed(t *testing.T) {
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseRecover), "SetOption should succeed") {
+		return
+	}
+
+	_, err := p.Parse([]byte(`<root><a>text`))
+	errs, ok := err.(ErrParseErrors)
+	if !assert.True(t, ok, "Parse should return the recovered errors") || !assert.Len(t, errs, 2, "one error per unclosed element") {
+		return
+	}
+	for i, name := range []string{"a", "root"} {
+		if !assert.True(t, errors.Is(errs[i], ErrPrematureEOF), "error is ErrPrematureEOF") ||
+			!assert.Contains(t, errs[i].Error(), "element '"+name+"' is not closed", "error names the unclosed element") {
+			return
+		}
+	}
+}
+
+func TestParseRecoverWellFormed(t *testing.T) {
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseRecover), "SetOption should succeed") {
+		return
+	}
+
+	doc, err := p.Parse([]byte(`<root><a>text</a></root>`))
+	if !assert.NoError(t, err, "Parse should succeed") || !assert.NotNil(t, doc, "Parse should return a document") {
+		return
+	}
+}
+
+func TestParserOptions(t *testing.T) {
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseNoBlanks|ParsePedantic), "SetOption should succeed") {
+		return
+	}
+	if !assert.Equal(t, ParseNoBlanks|ParsePedantic, p.Options(), "Options matches") {
+		return
+	}
+
+	const unknown = ParseOption(1 << 30)
+	err := p.SetOption(unknown | ParseNoEnt)
+	if !assert.IsType(t, ErrUnimplemented{}, err, "SetOption should fail for unsupported options") {
+		return
+	}
+	if !assert.Contains(t, err.Error(), unknown.String(), "error mentions the unsupported option") {
+		return
+	}
+	if !assert.Equal(t, ParseNoBlanks|ParsePedantic, p.Options(), "Options are not modified on error") {
+		return
+	}
+
+	p.UnsetOption(ParsePedantic)
+	if !assert.Equal(t, ParseNoBlanks, p.Options(), "UnsetOption removes options") {
+		return
+	}
+}
+
+func TestParseNoBlanks(t *testing.T) {
+	const input = `<root>
+  <a> </a>
+  <b>text</b>
+</root>`
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseNoBlanks), "SetOption should succeed") {
+		return
+	}
+	doc, err := p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	str, err := doc.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+	if !assert.Equal(t, "<?xml version=\"1.0\"?>\n<root><a> </a><b>text</b></root>\n", str, "blank nodes are removed") {
+		return
+	}
+}
+
+func TestParseNoEnt(t *testing.T) {
+	const input = `<!DOCTYPE root [<!ENTITY foo "bar<b>baz</b>">]><root>x&foo;y</root>`
+
+	doc, err := Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	str, err := doc.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+	if !assert.Contains(t, str, "<root>x&foo;y</root>", "entity references are kept by default") {
+		return
+	}
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseNoEnt), "SetOption should succeed") {
+		return
+	}
+	doc, err = p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	str, err = doc.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+	if !assert.Contains(t, str, "<root>xbar<b>baz</b>y</root>", "entity references are substituted with ParseNoEnt") {
+		return
+	}
+}
+
+func TestParseNoEntNested(t *testing.T) {
+	const input = `<!DOCTYPE root [<!ENTITY i "in"><!ENTITY e "<b>&i;</b>">]><root>&e;&e;</root>`
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseNoEnt), "SetOption should succeed") {
+		return
+	}
+	doc, err := p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	str, err := doc.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+	if !assert.Contains(t, str, "<root><b>in</b><b>in</b></root>", "nested entity references are substituted") {
+		return
+	}
+}
+
+func TestParseNoEntSAX(t *testing.T) {
+	const input = `<!DOCTYPE root [<!ENTITY i "in"><!ENTITY e "<b>&i;</b><!--c-->">]><root>&e;</root>`
+
+	var out bytes.Buffer
+	s := sax.New()
+	s.StartElementNSHandler = func(_ sax.Context, localname, prefix, uri string, namespaces []sax.Namespace, attrs []sax.Attribute) error {
+		fmt.Fprintf(&out, "start(%s)", localname)
+		return nil
+	}
+	s.EndElementNSHandler = func(_ sax.Context, localname, prefix, uri string) error {
+		fmt.Fprintf(&out, "end(%s)", localname)
+		return nil
+	}
+	s.CharactersHandler = func(_ sax.Context, data []byte) error {
+		fmt.Fprintf(&out, "text(%s)", data)
+		return nil
+	}
+	s.CommentHandler = func(_ sax.Context, data []byte) error {
+		fmt.Fprintf(&out, "comment(%s)", data)
+		return nil
+	}
+	s.ReferenceHandler = func(_ sax.Context, name string) error {
+		fmt.Fprintf(&out, "reference(%s)", name)
+		return nil
+	}
+
+	// the handler keeps the entities, but does not build a tree
+	entities := map[string]*Entity{}
+	s.EntityDeclHandler = func(_ sax.Context, name string, typ int, publicID, systemID, content string) error {
+		entities[name] = newEntity(name, EntityType(typ), publicID, systemID, content, "")
+		return nil
+	}
+	s.GetEntityHandler = func(_ sax.Context, name string) (sax.Entity, error) {
+		if ent, ok := entities[name]; ok {
+			return ent, nil
+		}
+		return nil, errors.New("entity not found")
+	}
+
+	p := NewParser()
+	p.SetSAXHandler(s)
+	if !assert.NoError(t, p.SetOption(ParseNoEnt), "SetOption should succeed") {
+		return
+	}
+	if _, err := p.Parse([]byte(input)); !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Equal(t, "start(root)start(b)text(in)end(b)comment(c)end(root)", out.String(), "the content of the entity is reported to the handler") {
+		return
+	}
+}
+
+func TestParsePedantic(t *testing.T) {
+	const input = `<root xmlns:foo="bar"/>`
+
+	if _, err := Parse([]byte(input)); !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParsePedantic), "SetOption should succeed") {
+		return
+	}
+	if _, err := p.Parse([]byte(input)); !assert.Error(t, err, "relative namespace URIs are errors with ParsePedantic") {
+		return
+	}
+}
+
+func TestParseNoError(t *testing.T) {
+	var reported []string
+	s := sax.New()
+	s.ErrorHandler = func(_ sax.Context, message string, args ...interface{}) error {
+		reported = append(reported, fmt.Sprintf(message, args...))
+		return nil
+	}
+
+	p := NewParser()
+	p.SetSAXHandler(s)
+	if _, err := p.Parse([]byte(`<root>`)); !assert.Error(t, err, "Parse should fail") {
+		return
+	}
+	if !assert.Len(t, reported, 1, "errors are reported to the SAX handler") {
+		return
+	}
+
+	reported = nil
+	if !assert.NoError(t, p.SetOption(ParseNoError), "SetOption should succeed") {
+		return
+	}
+	if _, err := p.Parse([]byte(`<root>`)); !assert.Error(t, err, "Parse should fail") {
+		return
+	}
+	if !assert.Len(t, reported, 0, "errors are not reported with ParseNoError") {
+		return
+	}
+}
+
+func TestParseHuge(t *testing.T) {
+	input := []byte(`<` + strings.Repeat("a", MaxNameLength+1) + `/>`)
+
+	if _, err := Parse(input); !assert.Error(t, err, "names longer than MaxNameLength are errors") {
+		return
+	}
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseHuge), "SetOption should succeed") {
+		return
+	}
+	if _, err := p.Parse(input); !assert.NoError(t, err, "ParseHuge relaxes the name length limit") {
+		return
+	}
+}
+
+func TestParserLimits(t *testing.T) {
+	tests := []struct {
+		limit  string
+		limits ParserLimits
+		input  string
+	}{
+		{"MaxDepth", ParserLimits{MaxDepth: 3}, `<a><b><c><d/></c></b></a>`},
+		{"MaxAttributes", ParserLimits{MaxAttributes: 2}, `<a x="1" y="2" z="3"/>`},
+		{"MaxNameLength", ParserLimits{MaxNameLength: 5}, `<abcdefgh/>`},
+		{"MaxTextLength", ParserLimits{MaxTextLength: 5}, `<a>hello, world</a>`},
+		{"MaxTextLength", ParserLimits{MaxTextLength: 5}, `<a><![CDATA[hello, world]]></a>`},
+		{"MaxTextLength", ParserLimits{MaxTextLength: 5}, `<a><!-- hello, world --></a>`},
+		{"MaxTextLength", ParserLimits{MaxTextLength: 5}, `<a><?pi hello, world?></a>`},
+		{"MaxAttrValueLength", ParserLimits{MaxAttrValueLength: 5}, `<a x="hello, world"/>`},
+		{"MaxInputSize", ParserLimits{MaxInputSize: 10}, `<a>hello, world</a>`},
+	}
+
+	for _, test := range tests {
+		p := NewParser()
+		p.SetLimits(test.limits)
+		if !assert.NoError(t, p.SetOption(ParseRecover), "SetOption should succeed") {
+			return
+		}
+
+		_, err := p.Parse([]byte(test.input))
+		var lerr ErrLimitExceeded
+		if !assert.True(t, errors.As(err, &lerr), "%s: error is ErrLimitExceeded", test.input) {
+			return
+		}
+		if !assert.Equal(t, test.limit, lerr.Limit, "%s: limit matches", test.input) ||
+			!assert.Equal(t, 1, lerr.LineNumber, "%s: line number is reported", test.input) ||
+			!assert.NotRegexp(t, `column \d+ at line`, err.Error(), "%s: location is reported once", test.input) {
+			return
+		}
+	}
+
+	// names that are too long are still reported as ErrNameTooLong
+	p := NewParser()
+	p.SetLimits(ParserLimits{MaxNameLength: 5})
+	if _, err := p.Parse([]byte(`<abcdefgh/>`)); !assert.True(t, errors.Is(err, ErrNameTooLong), "error is ErrNameTooLong") {
+		return
+	}
+
+	// negative values disable the limit
+	p.SetLimits(ParserLimits{MaxNameLength: 5, MaxDepth: -1})
+	deep := strings.Repeat("<a>", 300) + strings.Repeat("</a>", 300)
+	if _, err := p.Parse([]byte(deep)); !assert.NoError(t, err, "MaxDepth is disabled") {
+		return
+	}
+
+	if _, err := Parse([]byte(deep)); !assert.Error(t, err, "default MaxDepth is enforced") {
+		return
+	}
+	p = NewParser()
+	if !assert.NoError(t, p.SetOption(ParseHuge), "SetOption should succeed") {
+		return
+	}
+	if _, err := p.Parse([]byte(deep)); !assert.NoError(t, err, "ParseHuge relaxes MaxDepth") {
+		return
+	}
+}
+
+func TestEntityLimits(t *testing.T) {
+	const laughs = `<?xml version="1.0"?>
+<!DOCTYPE lolz [
+<!ENTITY lol "lol">
+<!ENTITY lol1 "&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;">
+<!ENTITY lol2 "&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;">
+<!ENTITY lol3 "&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;">
+<!ENTITY lol4 "&lol3;&lol3;&lol3;&lol3;&lol3;&lol3;&lol3;&lol3;&lol3;&lol3;">
+<!ENTITY lol5 "&lol4;&lol4;&lol4;&lol4;&lol4;&lol4;&lol4;&lol4;&lol4;&lol4;">
+<!ENTITY lol6 "&lol5;&lol5;&lol5;&lol5;&lol5;&lol5;&lol5;&lol5;&lol5;&lol5;">
+<!ENTITY lol7 "&lol6;&lol6;&lol6;&lol6;&lol6;&lol6;&lol6;&lol6;&lol6;&lol6;">
+<!ENTITY lol8 "&lol7;&lol7;&lol7;&lol7;&lol7;&lol7;&lol7;&lol7;&lol7;&lol7;">
+<!ENTITY lol9 "&lol8;&lol8;&lol8;&lol8;&lol8;&lol8;&lol8;&lol8;&lol8;&lol8;">
+]>
+<lolz a="&lol9;">&lol9;</lolz>`
+
+	for _, opt := range []ParseOption{0, ParseNoEnt} {
+		p := NewParser()
+		if !assert.NoError(t, p.SetOption(opt), "SetOption should succeed") {
+			return
+		}
+		_, err := p.Parse([]byte(laughs))
+		if !assert.True(t, errors.Is(err, ErrEntityAmplification), "billion laughs is detected (%s)", opt) {
+			return
+		}
+	}
+
+	// A large entity that is referenced many times
+	blowup := `<!DOCTYPE r [<!ENTITY a "` + strings.Repeat("x", 50000) + `">]><r>` + strings.Repeat("&a;", 100) + `</r>`
+	if _, err := Parse([]byte(blowup)); !assert.True(t, errors.Is(err, ErrEntityAmplification), "quadratic blowup is detected") {
+		return
+	}
+
+	// The same in an attribute value, where the references are kept
+	// unless ParseNoEnt is set
+	attrBlowup := `<!DOCTYPE r [<!ENTITY x "` + strings.Repeat("x", 50000) + `">]><r a="` + strings.Repeat("&x;", 50000) + `"/>`
+
+	// a handler that keeps the entities, but does not build a tree
+	s := sax.New()
+	entities := map[string]*Entity{}
+	s.EntityDeclHandler = func(_ sax.Context, name string, typ int, publicID, systemID, content string) error {
+		entities[name] = newEntity(name, EntityType(typ), publicID, systemID, content, "")
+		return nil
+	}
+	s.GetEntityHandler = func(_ sax.Context, name string) (sax.Entity, error) {
+		if ent, ok := entities[name]; ok {
+			return ent, nil
+		}
+		return nil, errors.New("entity not found")
+	}
+
+	for _, opt := range []ParseOption{0, ParseNoEnt} {
+		p := NewParser()
+		if !assert.NoError(t, p.SetOption(opt), "SetOption should succeed") {
+			return
+		}
+		_, err := p.Parse([]byte(attrBlowup))
+		if !assert.True(t, errors.Is(err, ErrEntityAmplification), "quadratic blowup in an attribute is detected (%s)", opt) {
+			return
+		}
+
+		p.SetSAXHandler(s)
+		_, err = p.Parse([]byte(attrBlowup))
+		if !assert.True(t, errors.Is(err, ErrEntityAmplification), "quadratic blowup in an attribute is detected without a tree (%s)", opt) {
+			return
+		}
+	}
+
+	doc, err := Parse([]byte(`<!DOCTYPE r [<!ENTITY x "` + strings.Repeat("x", 50000) + `">]><r/>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	err = doc.DocumentElement().SetAttribute("a", strings.Repeat("&x;", 50000))
+	if !assert.True(t, errors.Is(err, ErrEntityAmplification), "quadratic blowup in SetAttribute is detected") {
+		return
+	}
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseHuge), "SetOption should succeed") {
+		return
+	}
+	if _, err := p.Parse([]byte(blowup)); !assert.NoError(t, err, "ParseHuge raises the amplification limit") {
+		return
+	}
+
+	const loop = `<!DOCTYPE r [<!ENTITY a "&b;"><!ENTITY b "&a;">]><r>&a;</r>`
+	if _, err := Parse([]byte(loop)); !assert.True(t, errors.Is(err, ErrEntityLoop), "entity loops are detected") {
+		return
+	}
+
+	const peLoop = `<!DOCTYPE r [<!ENTITY % a "&#37;b;"><!ENTITY % b "&#37;a;">%a;]><r/>`
+	if _, err := Parse([]byte(peLoop)); !assert.True(t, errors.Is(err, ErrEntityLoop), "parameter entity loops are detected") {
+		return
+	}
+}
+
+func TestParseDTDLoad(t *testing.T) {
+	const fn = "test/dtd/doc.xml"
+
+	doc, err := ParseFile(fn)
+	if !assert.NoError(t, err, "ParseFile should succeed") {
+		return
+	}
+	if !assert.Nil(t, doc.ExtSubset(), "external subset is not loaded by default") {
+		return
+	}
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseDTDLoad|ParseNoEnt), "SetOption should succeed") {
+		return
+	}
+	doc, err = p.ParseFile(fn)
+	if !assert.NoError(t, err, "ParseFile should succeed") {
+		return
+	}
+	if !assert.Equal(t, fn, doc.URL(), "URL matches") {
+		return
+	}
+
+	ext := doc.ExtSubset()
+	if !assert.NotNil(t, ext, "external subset is loaded") ||
+		!assert.Equal(t, "doc", ext.Name(), "external subset name matches") ||
+		!assert.Equal(t, "doc.dtd", ext.systemID, "external subset system ID matches") {
+		return
+	}
+
+	if _, ok := ext.LookupElement("em", ""); !assert.True(t, ok, "declarations from external parameter entities are loaded") {
+		return
+	}
+	if _, ok := ext.LookupElement("ignored", ""); !assert.False(t, ok, "IGNORE sections are skipped") {
+		return
+	}
+	if _, ok := ext.LookupElement("nested", ""); !assert.False(t, ok, "sections nested in IGNORE sections are skipped") {
+		return
+	}
+	if n, ok := ext.LookupNotation("gif"); !assert.True(t, ok, "notation is declared") || !assert.Equal(t, "-//EXAMPLE//NOTATION GIF//EN", n.PublicID(), "notation public ID matches") {
+		return
+	}
+
+	str, err := doc.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+	if !assert.Contains(t, str, "<doc>draft Hello</doc>", "entities from the external subset are substituted") {
+		return
+	}
+
+	// the same document read from an io.Reader, with its location
+	f, err := os.Open(fn)
+	if !assert.NoError(t, err, "os.Open should succeed") {
+		return
+	}
+	defer f.Close()
+
+	p.SetBaseURI(fn)
+	doc, err = p.ParseReader(f)
+	if !assert.NoError(t, err, "ParseReader should succeed") {
+		return
+	}
+	if !assert.Equal(t, fn, doc.URL(), "URL is the base URI") ||
+		!assert.NotNil(t, doc.ExtSubset(), "external subset is loaded relative to the base URI") {
+		return
+	}
+}
+
+func TestParseDTDAttr(t *testing.T) {
+	const input = `<!DOCTYPE doc [
+<!ATTLIST doc xmlns CDATA #FIXED "http://example.com/ns">
+<!ATTLIST item kind CDATA "plain" xml:lang CDATA "en" id ID #IMPLIED>
+]>
+<doc><item id="a"/><item kind="special"/></doc>`
+
+	doc, err := Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	root := doc.DocumentElement()
+	if !assert.Equal(t, "http://example.com/ns", root.URI(), "namespace declarations are always defaulted") {
+		return
+	}
+	item := root.FirstChild().(*Element)
+	if !assert.Len(t, item.Attributes(), 1, "attributes are not defaulted without ParseDTDAttr") {
+		return
+	}
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseDTDAttr), "SetOption should succeed") {
+		return
+	}
+	doc, err = p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	item = doc.DocumentElement().FirstChild().(*Element)
+	attrs := item.Attributes()
+	if !assert.Len(t, attrs, 3, "attributes are defaulted") {
+		return
+	}
+	for i, expected := range []struct {
+		name      string
+		value     string
+		isDefault bool
+	}{
+		{"id", "a", false},
+		{"kind", "plain", true},
+		{"xml:lang", "en", true},
+	} {
+		if !assert.Equal(t, expected.name, attrs[i].Name(), "attribute name matches") ||
+			!assert.Equal(t, expected.value, attrs[i].Value(), "attribute value matches") ||
+			!assert.Equal(t, expected.isDefault, attrs[i].IsDefault(), "IsDefault matches") {
+			return
+		}
+	}
+
+	item = item.NextSibling().(*Element)
+	if !assert.Equal(t, "special", item.Attributes()[0].Value(), "specified attributes are not overridden") ||
+		!assert.False(t, item.Attributes()[0].IsDefault(), "specified attributes are not defaulted") {
+		return
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, (&Dumper{}).DumpNode(&buf, item), "DumpNode should succeed") ||
+		!assert.Equal(t, `<item kind="special" xml:lang="en"/>`, buf.String(), "defaulted attributes are serialized") {
+		return
+	}
+	buf.Reset()
+	if !assert.NoError(t, (&Dumper{OmitDefaultAttributes: true}).DumpNode(&buf, item), "DumpNode should succeed") ||
+		!assert.Equal(t, `<item kind="special"/>`, buf.String(), "defaulted attributes are omitted") {
+		return
+	}
+}
+
+type dtdResolver struct {
+	*TreeBuilder
+	dtds map[string]string
+}
+
+func (r dtdResolver) ResolveEntity(_ sax.Context, publicID, systemID string) (*sax.ParseInput, error) {
+	if s, ok := r.dtds[publicID]; ok {
+		return &sax.ParseInput{Reader: strings.NewReader(s)}, nil
+	}
+	return nil, sax.ErrHandlerUnspecified
+}
+
+func TestParseDTDLoadResolver(t *testing.T) {
+	const input = `<!DOCTYPE doc PUBLIC "-//EXAMPLE//DTD Doc//EN" "http://example.com/doc.dtd"><doc a="&greeting;"/>`
+
+	p := NewParser()
+	p.SetSAXHandler(dtdResolver{
+		TreeBuilder: NewTreeBuilder(),
+		dtds: map[string]string{
+			"-//EXAMPLE//DTD Doc//EN": `<!ENTITY greeting "hi"><!ELEMENT doc EMPTY>`,
+		},
+	})
+	if !assert.NoError(t, p.SetOption(ParseDTDLoad), "SetOption should succeed") {
+		return
+	}
+
+	doc, err := p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	ext := doc.ExtSubset()
+	if !assert.NotNil(t, ext, "external subset is loaded") ||
+		!assert.Equal(t, "-//EXAMPLE//DTD Doc//EN", ext.externalID, "external subset public ID matches") {
+		return
+	}
+	if _, ok := ext.LookupEntity("greeting"); !assert.True(t, ok, "entity is declared in the external subset") {
+		return
+	}
+
+	str, err := doc.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+	if !assert.Contains(t, str, `<!DOCTYPE doc PUBLIC "-//EXAMPLE//DTD Doc//EN" "http://example.com/doc.dtd">`, "DOCTYPE is serialized with its external ID") {
+		return
+	}
+}
+
+func TestParseNsClean(t *testing.T) {
+	const input = `<a xmlns="urn:d" xmlns:p="urn:p"><p:b xmlns:p="urn:p" xmlns="urn:d"><c xmlns:p="urn:other"/></p:b></a>`
+
+	for _, clean := range []bool{false, true} {
+		p := NewParser()
+		if clean {
+			if !assert.NoError(t, p.SetOption(ParseNsClean), "SetOption should succeed") {
+				return
+			}
+		}
+
+		doc, err := p.Parse([]byte(input))
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+		str, err := doc.DocumentElement().XMLString()
+		if !assert.NoError(t, err, "XMLString should succeed") {
+			return
+		}
+
+		expected := input
+		if clean {
+			expected = `<a xmlns="urn:d" xmlns:p="urn:p"><p:b><c xmlns:p="urn:other"/></p:b></a>`
+		}
+		if !assert.Equal(t, expected, str, "redundant declarations are removed with ParseNsClean only") {
+			return
+		}
+	}
+}
+
+func TestParseNoCDATA(t *testing.T) {
+	const input = `<a>x<![CDATA[<y> & ]]>z<![CDATA[]]></a>`
+
+	doc, err := Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	var types []ElementType
+	for c := doc.DocumentElement().FirstChild(); c != nil; c = c.NextSibling() {
+		types = append(types, c.Type())
+	}
+	if !assert.Equal(t, []ElementType{TextNode, CDATASectionNode, TextNode, CDATASectionNode}, types, "CDATA sections are kept") {
+		return
+	}
+	str, err := doc.DocumentElement().XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+	if !assert.Equal(t, input, str, "CDATA sections are written back") {
+		return
+	}
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseNoCDATA), "SetOption should succeed") {
+		return
+	}
+	doc, err = p.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	root := doc.DocumentElement()
+	if !assert.IsType(t, &Text{}, root.FirstChild(), "CDATA is merged into the text") ||
+		!assert.Nil(t, root.FirstChild().NextSibling(), "there is a single text node") ||
+		!assert.Equal(t, "x<y> & z", string(root.Content()), "content matches") {
+		return
+	}
+
+	doc, err = p.Parse([]byte(`<a><![CDATA[]]></a>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Nil(t, doc.DocumentElement().FirstChild(), "empty CDATA sections leave no text node") {
+		return
+	}
+
+	// the content of entities is parsed with the same options
+	const entInput = `<!DOCTYPE a [<!ENTITY e "x<![CDATA[<y>]]>">]><a>&e;</a>`
+	doc, err = p.Parse([]byte(entInput))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	ref := doc.DocumentElement().FirstChild()
+	if !assert.IsType(t, &EntityRef{}, ref, "entity reference is kept") {
+		return
+	}
+	ent := ref.FirstChild()
+	if !assert.IsType(t, &Text{}, ent.FirstChild(), "CDATA in the entity is merged into the text") ||
+		!assert.Nil(t, ent.FirstChild().NextSibling(), "there is a single text node in the entity") {
+		return
+	}
+
+	if !assert.NoError(t, p.SetOption(ParseNoEnt), "SetOption should succeed") {
+		return
+	}
+	doc, err = p.Parse([]byte(entInput))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	root = doc.DocumentElement()
+	if !assert.IsType(t, &Text{}, root.FirstChild(), "substituted CDATA is merged into the text") ||
+		!assert.Nil(t, root.FirstChild().NextSibling(), "there is a single text node") ||
+		!assert.Equal(t, "x<y>", string(root.Content()), "content matches") {
+		return
+	}
+}
+
+func TestParserEncoding(t *testing.T) {
+	p := NewParser()
+	if !assert.Error(t, p.SetEncoding("no-such-encoding"), "SetEncoding should fail for unknown encodings") {
+		return
+	}
+
+	// the declaration is wrong, but the caller knows better
+	if !assert.NoError(t, p.SetEncoding("iso-8859-1"), "SetEncoding should succeed") {
+		return
+	}
+	doc, err := p.Parse([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?><a>caf\xe9</a>"))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Equal(t, "café", string(doc.DocumentElement().Content()), "content is decoded with the forced encoding") ||
+		!assert.Equal(t, "iso-8859-1", doc.Encoding(), "Encoding returns the forced encoding") {
+		return
+	}
+
+	p = NewParser()
+	if !assert.NoError(t, p.SetOption(ParseIgnoreEnc), "SetOption should succeed") {
+		return
+	}
+	doc, err = p.Parse([]byte(`<?xml version="1.0" encoding="iso-8859-1"?><a>café</a>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Equal(t, "café", string(doc.DocumentElement().Content()), "declared encoding is ignored") ||
+		!assert.Equal(t, "utf8", doc.Encoding(), "Encoding returns the detected encoding") {
+		return
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	doc, err := Parse([]byte("<?xml version=\"1.0\"?>\n<root>\n  <a x=\"1\"\n     y=\"2\">text<!--c--><?pi d?></a>\n</root>"))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	root := doc.DocumentElement()
+	a := root.FirstChild().NextSibling().(*Element)
+	text := a.FirstChild()
+	comment := text.NextSibling()
+	pi := comment.NextSibling()
+	attrs := a.Attributes()
+
+	tests := []struct {
+		name   string
+		node   Positioned
+		line   int
+		column int
+	}{
+		{"root", root, 2, 1},
+		{"element", a, 3, 3},
+		{"attribute", attrs[0], 3, 6},
+		{"attribute on the next line", attrs[1], 4, 6},
+		{"text", text.(Positioned), 4, 12},
+		{"comment", comment.(Positioned), 4, 16},
+		{"processing instruction", pi.(Positioned), 4, 24},
+	}
+	for _, test := range tests {
+		if !assert.Equal(t, test.line, test.node.Line(), "line of %s", test.name) {
+			return
+		}
+		if !assert.Equal(t, test.column, test.node.Column(), "column of %s", test.name) {
+			return
+		}
+	}
+
+	input := []byte(strings.Repeat("\n", 70000))
+	input = append([]byte("<root>"), append(input, "<a/></root>"...)...)
+	for _, big := range []bool{false, true} {
+		p := NewParser()
+		expected := maxLineNumber
+		if big {
+			if !assert.NoError(t, p.SetOption(ParseBigLines), "SetOption should succeed") {
+				return
+			}
+			expected = 70001
+		}
+
+		doc, err := p.Parse(input)
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+		a := doc.DocumentElement().LastChild().(*Element)
+		if !assert.Equal(t, expected, a.Line(), "line of element past 65535 (ParseBigLines = %t)", big) {
+			return
+		}
+	}
+}
+
+func TestParserErrorHandler(t *testing.T) {
+	var reported []*Error
+	p := NewParser()
+	p.SetErrorHandler(func(e *Error) {
+		reported = append(reported, e)
+	})
+
+	_, err := p.parse(strings.NewReader("<doc>\n  <a></b>\n</doc>"), "http://example.com/doc.xml")
+	if !assert.Error(t, err, "Parse should fail") {
+		return
+	}
+	if !assert.True(t, errors.Is(err, ErrMismatchedEndTag), "the sentinel error matches with errors.Is") {
+		return
+	}
+
+	var perr *Error
+	if !assert.True(t, errors.As(err, &perr), "Parse returns an *Error") {
+		return
+	}
+	if !assert.Len(t, reported, 1, "the error is reported to the handler") {
+		return
+	}
+	if !assert.Equal(t, perr, reported[0], "the reported error is the returned one") {
+		return
+	}
+	if !assert.Equal(t, DomainParser, perr.Domain, "domain") {
+		return
+	}
+	if !assert.Equal(t, CodeTagNameMismatch, perr.Code, "code") {
+		return
+	}
+	if !assert.Equal(t, ErrorLevelFatal, perr.Level, "level") {
+		return
+	}
+	if !assert.Equal(t, "http://example.com/doc.xml", perr.File, "file") {
+		return
+	}
+	if !assert.Equal(t, 2, perr.Line, "line") {
+		return
+	}
+
+	// code written for the old error type keeps working
+	var oerr ErrParseError
+	if !assert.True(t, errors.As(err, &oerr), "Parse error converts to ErrParseError") ||
+		!assert.Equal(t, 2, oerr.LineNumber, "ErrParseError line") ||
+		!assert.True(t, errors.Is(oerr, ErrMismatchedEndTag), "ErrParseError unwraps to the sentinel error") {
+		return
+	}
+
+	// warnings go to the SAX warning handler, and to the error handler
+	var warnings []string
+	s := sax.New()
+	s.WarningHandler = func(_ sax.Context, message string, args ...interface{}) error {
+		warnings = append(warnings, fmt.Sprintf(message, args...))
+		return nil
+	}
+	reported = nil
+	p.SetSAXHandler(s)
+	if _, err := p.Parse([]byte(`<!DOCTYPE doc SYSTEM "doc.dtd" [%undeclared;]><doc/>`)); !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Len(t, warnings, 1, "the warning is reported to the SAX handler") {
+		return
+	}
+	if !assert.Len(t, reported, 1, "the warning is reported to the error handler") {
+		return
+	}
+	if !assert.Equal(t, ErrorLevelWarning, reported[0].Level, "level") {
+		return
+	}
+
+	reported = nil
+	if !assert.NoError(t, p.SetOption(ParseNoWarning), "SetOption should succeed") {
+		return
+	}
+	if _, err := p.Parse([]byte(`<!DOCTYPE doc SYSTEM "doc.dtd" [%undeclared;]><doc/>`)); !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Len(t, reported, 0, "warnings are not reported with ParseNoWarning") {
+		return
+	}
+}
@@ -22,6 +22,8 @@ type attrData struct {
 	prefix    string
 	value     string
 	isDefault bool
+	line      int
+	column    int
 }
 
 func (a attrData) LocalName() string { return a.localname }
@@ -94,6 +96,9 @@ func (ctx *parserCtx) lookupNamespace(prefix string) string {
 func (ctx *parserCtx) release() error {
 	ctx.sax = nil
 	ctx.userData = nil
+	ctx.in = nil
+	ctx.bytecursor = nil
+	ctx.cursor = nil
 	return nil
 }
 
@@ -114,35 +119,154 @@ func releaseBuffer(b *bytes.Buffer) {
 }
 
 func (ctx *parserCtx) init(p *Parser, in io.Reader) error {
-	ctx.bytecursor = strcursor.NewByteCursor(in)
+	cr := &countingReader{r: in}
+	ctx.bytecursor = strcursor.NewByteCursor(cr)
 	ctx.detectedEncoding = encUTF8
 	ctx.encoding = ""
-	ctx.in = in
+	ctx.in = cr
 	ctx.nbread = 0
-	ctx.keepBlanks = true
 	ctx.instate = psStart
 	ctx.userData = ctx // circular dep?!
 	ctx.standalone = StandaloneImplicitNo
 	ctx.attsSpecial = map[string]AttributeType{}
-	ctx.attsDefault = map[string]map[string]*Attribute{}
+	ctx.attsDefault = map[string][]*attrData{}
 	ctx.wellFormed = true
 	if p != nil {
 		ctx.sax = p.sax
+		ctx.options = p.options
+		ctx.loader = p.loader
+		ctx.catalog = p.catalog
+		ctx.idAttrs = p.idAttrs
+		ctx.forcedEncoding = p.encoding
+		ctx.onError = p.onError
+	}
+
+	def := DefaultParserLimits()
+	if ctx.options.IsSet(ParseHuge) {
+		def = HugeParserLimits()
+	}
+	if p != nil {
+		ctx.limits = p.limits.withDefaults(def)
+	} else {
+		ctx.limits = def
+	}
+	cr.max = ctx.limits.MaxInputSize
+
+	ctx.keepBlanks = !ctx.options.IsSet(ParseNoBlanks)
+	ctx.replaceEntities = ctx.options.IsSet(ParseNoEnt)
+	ctx.pedantic = ctx.options.IsSet(ParsePedantic)
+	if ctx.options.IsSet(ParseDTDLoad) {
+		ctx.loadsubset.Set(DetectIDs)
+	}
+	if ctx.options.IsSet(ParseDTDAttr) {
+		ctx.loadsubset.Set(CompleteAttrs)
+	}
+	ctx.entities = &entityStats{
+		input: cr,
+		huge:  ctx.options.IsSet(ParseHuge),
 	}
 	return nil
 }
 
+// reportError forwards the error to the error handler and to the SAX
+// error handler, unless ParseNoError is set. Errors that are not
+// structured yet are reported as recoverable errors.
+func (ctx *parserCtx) reportError(err error) {
+	if ctx.options.IsSet(ParseNoError) {
+		return
+	}
+
+	e, ok := err.(*Error)
+	if !ok {
+		e = newError(err, ErrorLevelError)
+	}
+	if h := ctx.onError; h != nil {
+		h(e)
+	}
+	if s := ctx.sax; s != nil {
+		s.Error(ctx.userData, "%s", e)
+	}
+}
+
+// warning reports a problem that does not stop the parser to the error
+// handler and to the SAX warning handler, unless ParseNoWarning is set
+func (ctx *parserCtx) warning(err error) {
+	if ctx.options.IsSet(ParseNoWarning) {
+		return
+	}
+
+	var e *Error
+	if perr, ok := err.(*Error); ok {
+		w := *perr
+		w.Level = ErrorLevelWarning
+		e = &w
+	} else {
+		e = ctx.newError(err, ErrorLevelWarning)
+	}
+	if h := ctx.onError; h != nil {
+		h(e)
+	}
+	if s := ctx.sax; s != nil {
+		s.Warning(ctx.userData, "%s", e)
+	}
+}
+
+// recoverError records the error if the parser is in recovery mode
+// (ParseRecover). It returns false if the error cannot be recovered
+// from, in which case the caller should bail out as usual.
+func (ctx *parserCtx) recoverError(err error) bool {
+	if !ctx.options.IsSet(ParseRecover) {
+		return false
+	}
+
+	// exceeding a resource limit is always fatal
+	var lerr ErrLimitExceeded
+	if errors.As(err, &lerr) || errors.Is(err, ErrEntityAmplification) || errors.Is(err, ErrEntityLoop) {
+		return false
+	}
+
+	err = ctx.error(err)
+	ctx.wellFormed = false
+	ctx.recovered = append(ctx.recovered, err)
+	ctx.reportError(err)
+	return true
+}
+
+// skipToNextMarkup skips the input up to the next '<' or '&', so that
+// the parser can resynchronize after an error in recovery mode
+func (ctx *parserCtx) skipToNextMarkup() {
+	cur := ctx.cursor
+	if c := cur.Peek(); c == '<' || c == '&' {
+		cur.Advance(1)
+	}
+	for !cur.Done() {
+		if c := cur.Peek(); c == '<' || c == '&' {
+			return
+		}
+		cur.Advance(1)
+	}
+}
+
 func (ctx *parserCtx) error(err error) error {
 	// If it's wrapped, just return as is
-	if _, ok := err.(ErrParseError); ok {
+	if _, ok := err.(*Error); ok {
 		return err
 	}
+	return ctx.newError(err, ErrorLevelFatal)
+}
 
-	e := ErrParseError{Err: err}
+// newError creates the structured error for err, located at the
+// current position of the parser
+func (ctx *parserCtx) newError(err error, level ErrorLevel) *Error {
+	e := newError(err, level)
+	e.File = ctx.baseURI
 	if cur := ctx.cursor; cur != nil {
+		if uri := cur.URI(); uri != "" {
+			e.File = uri
+		}
+		e.Line = cur.LineNumber()
 		e.Column = cur.Column()
-		e.LineNumber = cur.LineNumber()
-		e.Line = cur.Line()
+		e.Context = cur.Line()
 	}
 	return e
 }
@@ -263,7 +387,12 @@ func (ctx *parserCtx) switchEncoding() error {
 		defer g.IRelease("END switchEncoding")
 	}
 
-	encName := ctx.encoding
+	// the encoding forced by the caller wins over the declared one,
+	// which is not trusted at all with ParseIgnoreEnc
+	encName := ctx.forcedEncoding
+	if encName == "" && !ctx.options.IsSet(ParseIgnoreEnc) {
+		encName = ctx.encoding
+	}
 	if encName == "" {
 		encName = ctx.detectedEncoding
 		if encName == "" {
@@ -285,7 +414,8 @@ func (ctx *parserCtx) switchEncoding() error {
 	}
 
 	b := enc.NewDecoder().Reader(cur)
-	ctx.cursor = strcursor.NewRuneCursor(b)
+	ctx.cursor = newInputStack(strcursor.NewRuneCursor(b), ctx.baseURI)
+	ctx.inputEncoding = encName
 	// Reset, so nobody touches it
 	ctx.bytecursor = nil
 
@@ -301,7 +431,8 @@ func (ctx *parserCtx) parseDocument() error {
 	}
 
 	if s := ctx.sax; s != nil {
-		switch err := s.SetDocumentLocator(ctx.userData, nil); err {
+		ctx.locator = &documentLocator{ctx: ctx}
+		switch err := s.SetDocumentLocator(ctx.userData, ctx.locator); err {
 		case nil, sax.ErrHandlerUnspecified:
 			// no op
 		default:
@@ -350,6 +481,12 @@ func (ctx *parserCtx) parseDocument() error {
 		}
 	}
 
+	// The document is validated once it has been built, which does not
+	// happen if the SAX handler does not build a tree
+	if ctx.options.IsSet(ParseDTDValid) && ctx.doc == nil {
+		return ctx.error(ErrDTDValidWithoutTree)
+	}
+
 	// Misc part of the prolog
 	if err := ctx.parseMisc(); err != nil {
 		return ctx.error(err)
@@ -448,43 +585,36 @@ func (ctx *parserCtx) parseContent() error {
 			break
 		}
 
-		if cur.HasPrefix("<?") {
-			if err := ctx.parsePI(); err != nil {
-				return ctx.error(err)
-			}
-			continue
-		}
-
-		if cur.HasPrefix("<![CDATA[") {
-			if err := ctx.parseCDSect(); err != nil {
-				return ctx.error(err)
-			}
-			continue
+		var err error
+		reference := false
+		switch {
+		case cur.HasPrefix("<?"):
+			err = ctx.parsePI()
+		case cur.HasPrefix("<![CDATA["):
+			err = ctx.parseCDSect()
+		case cur.HasPrefix("<!--"):
+			err = ctx.parseComment()
+		case cur.HasPrefix("<"):
+			err = ctx.parseElement()
+		case cur.HasPrefix("&"):
+			reference = true
+			err = ctx.parseReference()
+		default:
+			err = ctx.parseCharData(false)
 		}
 
-		if cur.HasPrefix("<!--") {
-			if err := ctx.parseComment(); err != nil {
+		if err != nil {
+			if !ctx.recoverError(err) {
 				return ctx.error(err)
 			}
-			continue
-		}
-
-		if cur.HasPrefix("<") {
-			if err := ctx.parseElement(); err != nil {
-				return ctx.error(err)
+			if !reference {
+				ctx.skipToNextMarkup()
+				continue
 			}
-			continue
-		}
-
-		if cur.HasPrefix("&") {
-			if err := ctx.parseReference(); err != nil {
-				return ctx.error(err)
+			// the text that follows a malformed reference is kept
+			if cur.Peek() == '&' {
+				cur.Advance(1)
 			}
-			continue
-		}
-
-		if err := ctx.parseCharData(false); err != nil {
-			return err
 		}
 	}
 
@@ -510,6 +640,10 @@ func (ctx *parserCtx) parseCharData(cdata bool) error {
 	buf := bufferPool.Get().(*bytes.Buffer)
 	defer releaseBuffer(buf)
 
+	if !cdata {
+		// parseCDSect marked the start of the section already
+		ctx.markPosition()
+	}
 	cur := ctx.cursor
 
 	i := 0
@@ -530,9 +664,12 @@ func (ctx *parserCtx) parseCharData(cdata bool) error {
 
 		buf.WriteRune(c)
 		i++
+		if exceeds(buf.Len(), ctx.limits.MaxTextLength) {
+			return ctx.limitError("MaxTextLength", int64(ctx.limits.MaxTextLength))
+		}
 	}
 
-	if i <= 0 {
+	if i <= 0 && !cdata {
 		debug.Dump(cur)
 		return errors.New("Invalid char data")
 	}
@@ -542,7 +679,7 @@ func (ctx *parserCtx) parseCharData(cdata bool) error {
 
 	// XXX This is not right, but it's for now the best place to do this
 	str = strings.Replace(str, "\r\n", "\n", -1)
-	if ctx.instate == psCDATA {
+	if ctx.instate == psCDATA && !ctx.options.IsSet(ParseNoCDATA) {
 		if s := ctx.sax; s != nil {
 			switch err := s.CDataBlock(ctx.userData, []byte(str)); err {
 			case nil, sax.ErrHandlerUnspecified:
@@ -551,7 +688,9 @@ func (ctx *parserCtx) parseCharData(cdata bool) error {
 				return ctx.error(err)
 			}
 		}
-	} else if ctx.areBlanks(str, false) {
+	} else if ctx.instate == psCDATA && str == "" {
+		// merged into the surrounding text, an empty section is nothing
+	} else if ctx.instate != psCDATA && ctx.areBlanks(str, false) {
 		if s := ctx.sax; s != nil {
 			switch err := s.IgnorableWhitespace(ctx.userData, []byte(str)); err {
 			case nil, sax.ErrHandlerUnspecified:
@@ -582,6 +721,12 @@ func (ctx *parserCtx) parseElement() error {
 		defer g.IRelease("END parseElement (%d)", i)
 	}
 
+	ctx.elemDepth++
+	defer func() { ctx.elemDepth-- }()
+	if exceeds(ctx.elemDepth, ctx.limits.MaxDepth) {
+		return ctx.limitError("MaxDepth", int64(ctx.limits.MaxDepth))
+	}
+
 	// parseStartTag only parses up to the attributes.
 	// For example, given <foo>bar</foo>, the next token would
 	// be bar</foo>. Given <foo />, the next token would
@@ -592,8 +737,14 @@ func (ctx *parserCtx) parseElement() error {
 
 	cur := ctx.cursor
 	if !cur.HasPrefix("/>") {
-		if err := ctx.parseContent(); err != nil {
-			return ctx.error(err)
+		for {
+			if err := ctx.parseContent(); err != nil {
+				return ctx.error(err)
+			}
+
+			if !ctx.skipStrayEndTag() {
+				break
+			}
 		}
 	}
 
@@ -604,12 +755,56 @@ func (ctx *parserCtx) parseElement() error {
 	return nil
 }
 
+// atEndTag returns true if the cursor is at the end tag for name
+func (ctx *parserCtx) atEndTag(name string) bool {
+	cur := ctx.cursor
+	if !cur.HasPrefix("</" + name) {
+		return false
+	}
+
+	c := cur.PeekN(utf8.RuneCountInString(name) + 3)
+	return c == '>' || isBlankCh(c)
+}
+
+// atOpenEndTag returns true if the cursor is at the end tag for
+// any of the elements that are currently open
+func (ctx *parserCtx) atOpenEndTag() bool {
+	for _, item := range ctx.nodeTab.SimpleStack {
+		if ctx.atEndTag(item.(*Element).Name()) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipStrayEndTag skips an end tag that does not match any of the open
+// elements in recovery mode. It returns true if an end tag was skipped.
+func (ctx *parserCtx) skipStrayEndTag() bool {
+	cur := ctx.cursor
+	if !cur.HasPrefix("</") || ctx.atOpenEndTag() {
+		return false
+	}
+
+	if !ctx.recoverError(ErrMismatchedEndTag) {
+		return false
+	}
+
+	for !cur.Done() && cur.Peek() != '>' {
+		cur.Advance(1)
+	}
+	if !cur.Done() {
+		cur.Advance(1)
+	}
+	return true
+}
+
 func (ctx *parserCtx) parseStartTag() error {
 	if debug.Enabled {
 		g := debug.IPrintf("START parseStartTag")
 		defer g.IRelease("END parseStartTag")
 	}
 
+	ctx.markPosition()
 	cur := ctx.cursor
 	if cur.Peek() != '<' {
 		return ctx.error(ErrStartTagRequired)
@@ -617,12 +812,12 @@ func (ctx *parserCtx) parseStartTag() error {
 	cur.Advance(1)
 
 	local, prefix, err := ctx.parseQName()
-	if local == "" {
-		return ctx.error(fmt.Errorf("local name empty! local = %s, prefix = %s, err = %s", local, prefix, err))
-	}
 	if err != nil {
 		return ctx.error(err)
 	}
+	if local == "" {
+		return ctx.error(fmt.Errorf("local name empty! local = %s, prefix = %s", local, prefix))
+	}
 
 	elem, err := ctx.doc.CreateElement(local)
 	if err != nil {
@@ -630,6 +825,7 @@ func (ctx *parserCtx) parseStartTag() error {
 	}
 
 	nbNs := 0
+	nbatts := 0
 	attrs := []sax.Attribute{}
 	for ctx.instate != psEOF {
 		ctx.skipBlanks()
@@ -641,9 +837,29 @@ func (ctx *parserCtx) parseStartTag() error {
 		if cur.Peek() == '/' && cur.PeekN(2) == '>' {
 			break
 		}
+
+		// In recovery mode, treat an unterminated start tag as if
+		// it was closed right before the next tag
+		if cur.Peek() == '<' && ctx.recoverError(ErrGtRequired) {
+			break
+		}
+
+		if nbatts++; exceeds(nbatts, ctx.limits.MaxAttributes) {
+			return ctx.limitError("MaxAttributes", int64(ctx.limits.MaxAttributes))
+		}
+
+		attline, attcol := ctx.position()
 		attname, aprefix, attvalue, err := ctx.parseAttribute(local)
 		if err != nil {
-			return ctx.error(err)
+			if cur.Done() || !ctx.recoverError(err) {
+				return ctx.error(err)
+			}
+
+			// drop the offending attribute
+			for c := cur.Peek(); !cur.Done() && c != '>' && c != '<' && !isBlankCh(c) && !cur.HasPrefix("/>"); c = cur.Peek() {
+				cur.Advance(1)
+			}
+			continue
 		}
 
 		if attname == XMLNsPrefix && aprefix == "" {
@@ -659,6 +875,7 @@ func (ctx *parserCtx) parseStartTag() error {
 				return ctx.error(ErrSpaceRequired)
 			}
 			ctx.skipBlanks()
+			continue
 		} else if aprefix == XMLNsPrefix {
 			var u *url.URL // predeclare, so we can use goto SkipNS
 
@@ -690,7 +907,7 @@ func (ctx *parserCtx) parseStartTag() error {
 				return ctx.error(fmt.Errorf("xmlns:%s: URI %s is not absolute", attname, attvalue))
 			}
 
-			if ctx.nsTab.Lookup(attname) != "" {
+			if ctx.declaresNS(nbNs, attname) {
 				return ctx.error(errors.New("duplicate attribute is not allowed"))
 			}
 			ctx.pushNS(attname, attvalue)
@@ -715,13 +932,17 @@ func (ctx *parserCtx) parseStartTag() error {
 			localname: attname,
 			prefix:    aprefix,
 			value:     attvalue,
+			line:      attline,
+			column:    attcol,
 		}
 
 		attrs = append(attrs, attr)
 	}
 
-	// attributes defaulting
-	// XXX Punting a lot of stuff here. See xmlParseStartTag2
+	// attributes defaulting. The defaulted attributes are flagged
+	// through IsDefault(), and it's up to the SAX handler to decide
+	// what to do with them: the TreeBuilder only keeps them when
+	// ParseDTDAttr is set
 	if len(ctx.attsDefault) > 0 {
 		var elemName string
 		if prefix != "" {
@@ -733,10 +954,22 @@ func (ctx *parserCtx) parseStartTag() error {
 		if debug.Enabled {
 			debug.Printf("-------> %s", elemName)
 		}
-		defaults, ok := ctx.lookupAttributeDefault(elemName)
-		if ok {
-			for _, attr := range defaults {
-				attrs = append(attrs, attr)
+		for _, def := range ctx.lookupAttributeDefault(elemName) {
+			switch {
+			case def.prefix == "" && def.localname == XMLNsPrefix:
+				if !ctx.declaresNS(nbNs, "") {
+					ctx.pushNS("", def.value)
+					nbNs++
+				}
+			case def.prefix == XMLNsPrefix:
+				if !ctx.declaresNS(nbNs, def.localname) {
+					ctx.pushNS(def.localname, def.value)
+					nbNs++
+				}
+			default:
+				if !hasAttribute(attrs, def.Name()) {
+					attrs = append(attrs, def)
+				}
 			}
 		}
 	}
@@ -752,6 +985,7 @@ func (ctx *parserCtx) parseStartTag() error {
 		elem.SetNamespace(prefix, nsuri, true)
 	}
 
+	ctx.emptyElement = cur.HasPrefix("/>")
 	if s := ctx.sax; s != nil {
 		var nslist []sax.Namespace
 		if nbNs > 0 {
@@ -789,23 +1023,31 @@ func (ctx *parserCtx) parseEndTag() error {
 	}
 
 	cur := ctx.cursor
-	if !cur.Consume("/>") {
+	e := ctx.peekNode()
+	switch {
+	case cur.Consume("/>"):
+		// empty element, no op
+	case cur.Done() && ctx.recoverError(fmt.Errorf("%w: element '%s' is not closed", ErrPrematureEOF, e.Name())):
+		// recovery mode: close the element that was left open
+	case !ctx.atEndTag(e.Name()) && ctx.atOpenEndTag() && ctx.recoverError(ErrMismatchedEndTag):
+		// recovery mode: the end tag belongs to one of the ancestors,
+		// so implicitly close this element
+	default:
 		if !cur.Consume("</") {
 			return ctx.error(ErrLtSlashRequired)
 		}
 
-		e := ctx.peekNode()
 		if !cur.Consume(e.Name()) {
-			return ctx.error(errors.New("expected end tag '" + e.Name() + "'"))
+			return ctx.error(fmt.Errorf("%w: expected end tag '%s'", ErrMismatchedEndTag, e.Name()))
 		}
 
+		ctx.skipBlanks()
 		if cur.Peek() != '>' {
 			return ctx.error(ErrGtRequired)
 		}
 		cur.Advance(1)
 	}
 
-	e := ctx.peekNode()
 	if s := ctx.sax; s != nil {
 		switch err := s.EndElementNS(ctx, e.LocalName(), e.Prefix(), e.URI()); err {
 		case nil, sax.ErrHandlerUnspecified:
@@ -825,9 +1067,10 @@ func (ctx *parserCtx) parseAttributeValue(normalize bool) (value string, entitie
 		defer g.IRelease("END parseAttributeValue")
 	}
 
-	ctx.parseQuotedText(func(qch rune) (string, error) {
+	_, err = ctx.parseQuotedText(func(qch rune) (string, error) {
+		var err error
 		value, entities, err = ctx.parseAttributeValueInternal(qch, normalize)
-		return "", nil
+		return "", err
 	})
 	return
 }
@@ -848,6 +1091,11 @@ func (ctx *parserCtx) parseAttributeValueInternal(qch rune, normalize bool) (val
 	defer releaseBuffer(b)
 
 	for {
+		if exceeds(b.Len(), ctx.limits.MaxAttrValueLength) {
+			err = ctx.limitError("MaxAttrValueLength", int64(ctx.limits.MaxAttrValueLength))
+			return
+		}
+
 		c := cur.Peek()
 		// qch == quote character.
 		if (qch != 0x0 && c == qch) || !isChar(c) || c == '<' {
@@ -878,13 +1126,20 @@ func (ctx *parserCtx) parseAttributeValueInternal(qch rune, normalize bool) (val
 					return
 				}
 
-				if ent.entityType == InternalPredefinedEntity {
+				if ent == nil {
+					// undeclared entity, which may be declared in an
+					// external subset that we did not load
+				} else if ent.entityType == InternalPredefinedEntity {
 					if ent.content == "&" && !ctx.replaceEntities {
 						b.WriteString("&#38;")
 					} else {
 						b.WriteString(ent.content)
 					}
 				} else if ctx.replaceEntities {
+					if err = ctx.entityCheck(ent); err != nil {
+						err = ctx.error(err)
+						return
+					}
 					var rep string
 					rep, err = ctx.decodeEntities(ent.Content(), SubstituteRef)
 					if err != nil {
@@ -900,6 +1155,18 @@ func (ctx *parserCtx) parseAttributeValueInternal(qch rune, normalize bool) (val
 						}
 					}
 				} else {
+					// the reference is kept, but whoever reads the
+					// value expands it, so it is charged all the same
+					if err = ctx.entityCheck(ent); err != nil {
+						err = ctx.error(err)
+						return
+					}
+					if strings.IndexByte(ent.content, '&') >= 0 {
+						if _, err = ctx.decodeEntities(ent.Content(), SubstituteRef); err != nil {
+							err = ctx.error(err)
+							return
+						}
+					}
 					b.WriteString("&")
 					b.WriteString(ent.name)
 					b.WriteString(";")
@@ -962,6 +1229,7 @@ func (ctx *parserCtx) parseAttribute(elemName string) (local string, prefix stri
 	cur := ctx.cursor
 	if cur.Peek() != '=' {
 		err = ctx.error(ErrEqualSignRequired)
+		return
 	}
 	cur.Advance(1)
 	ctx.skipBlanks()
@@ -1002,6 +1270,10 @@ func (ctx *parserCtx) parseAttribute(elemName string) (local string, prefix stri
 
 func (ctx *parserCtx) skipBlanks() bool {
 	cur := ctx.cursor
+	if ctx.inSubset != 0 && (ctx.external || cur.Len() > 1) {
+		return ctx.skipBlanksPE()
+	}
+
 	i := 1
 	for ; !cur.Done(); i++ {
 		if !isBlankCh(cur.PeekN(i)) {
@@ -1016,6 +1288,45 @@ func (ctx *parserCtx) skipBlanks() bool {
 	return false
 }
 
+// skipBlanksPE skips blanks in the external subset and in parameter
+// entities, where parameter entity references that are found in
+// between are expanded. Errors from the expansion are kept in
+// ctx.peError, to be reported by the enclosing DTD parsing loop.
+func (ctx *parserCtx) skipBlanksPE() bool {
+	cur := ctx.cursor
+	skipped := false
+	for {
+		c := cur.Peek()
+		if isBlankCh(c) {
+			cur.Advance(1)
+			skipped = true
+			continue
+		}
+
+		if c != '%' || ctx.peError != nil {
+			return skipped
+		}
+		if c := cur.PeekN(2); c == 0 || isBlankCh(c) {
+			return skipped
+		}
+
+		if err := ctx.parsePEReference(); err != nil {
+			ctx.peError = err
+			return skipped
+		}
+	}
+}
+
+// checkPEError returns the error recorded by skipBlanksPE, if any
+func (ctx *parserCtx) checkPEError() error {
+	err := ctx.peError
+	if err == nil {
+		return nil
+	}
+	ctx.peError = nil
+	return ctx.error(err)
+}
+
 func skipBlankBytes(cur *strcursor.ByteCursor) bool {
 	i := 0
 	for c := cur.PeekN(i + 1); c != 0x0 && isBlankCh(rune(c)); c = cur.PeekN(i + 1) {
@@ -1367,6 +1678,7 @@ func (ctx *parserCtx) parsePI() error {
 		defer g.IRelease("END parsePI")
 	}
 
+	ctx.markPosition()
 	cur := ctx.cursor
 	if !cur.Consume("<?") {
 		return ctx.error(ErrInvalidProcessingInstruction)
@@ -1411,6 +1723,9 @@ func (ctx *parserCtx) parsePI() error {
 		}
 		buf.WriteRune(c)
 		i++
+		if exceeds(buf.Len(), ctx.limits.MaxTextLength) {
+			return ctx.limitError("MaxTextLength", int64(ctx.limits.MaxTextLength))
+		}
 	}
 
 	cur.Advance(i)
@@ -1482,8 +1797,8 @@ func (ctx *parserCtx) parseName() (name string, err error) {
 
 		i++
 	}
-	if i > MaxNameLength {
-		err = ctx.error(ErrNameTooLong)
+	if exceeds(i, ctx.limits.MaxNameLength) {
+		err = ctx.limitError("MaxNameLength", int64(ctx.limits.MaxNameLength))
 		return
 	}
 
@@ -1518,6 +1833,10 @@ func (ctx *parserCtx) parseQName() (local string, prefix string, err error) {
 	v, err = ctx.parseNCName()
 	if err != nil {
 		oerr := err
+		var lerr ErrLimitExceeded
+		if errors.As(err, &lerr) {
+			return
+		}
 		if cur.Peek() != ':' {
 			v, err = ctx.parseName()
 			if err != nil {
@@ -1587,18 +1906,18 @@ func (ctx *parserCtx) parseNmtoken() (string, error) {
 		defer g.IRelease("END parseNmtoken")
 	}
 
-	i := 1
 	cur := ctx.cursor
 	buf := bufferPool.Get().(*bytes.Buffer)
 	defer releaseBuffer(buf)
 
-	for c := cur.PeekN(i); c != 0x0; i++ {
-		if !isNameChar(c) {
-			break
-		}
+	for c := cur.Peek(); c != 0x0 && isNameChar(c); c = cur.Peek() {
 		buf.WriteRune(c)
+		cur.Advance(1)
 	}
 
+	if buf.Len() == 0 {
+		return "", ErrNmtokenRequired
+	}
 	return buf.String(), nil
 }
 
@@ -1647,8 +1966,8 @@ func (ctx *parserCtx) parseNCName() (ncname string, err error) {
 		buf.WriteRune(c)
 		i++
 	}
-	if i > MaxNameLength {
-		err = ctx.error(ErrNameTooLong)
+	if exceeds(i, ctx.limits.MaxNameLength) {
+		err = ctx.limitError("MaxNameLength", int64(ctx.limits.MaxNameLength))
 		return
 	}
 	cur.Advance(i)
@@ -1715,9 +2034,11 @@ func (ctx *parserCtx) areBlanks(s string, blankChars bool) (ret bool) {
 		return
 	}
 	if ctx.doc != nil {
-		ok, _ := ctx.doc.IsMixedElement(ctx.peekNode().Name())
-		ret = !ok
-		return
+		// if the element is not declared, fallthrough to the heuristics below
+		if ok, err := ctx.doc.IsMixedElement(ctx.peekNode().Name()); err == nil {
+			ret = !ok
+			return
+		}
 	}
 
 	cur := ctx.cursor
@@ -1726,20 +2047,24 @@ func (ctx *parserCtx) areBlanks(s string, blankChars bool) (ret bool) {
 		return
 	}
 
-	/*
-	   if ((ctxt->node->children == NULL) &&
-	       (RAW == '<') && (NXT(1) == '/')) return(0);
-
-	   lastChild = xmlGetLastChild(ctxt->node);
-	   if (lastChild == NULL) {
-	       if ((ctxt->node->type != XML_ELEMENT_NODE) &&
-	           (ctxt->node->content != NULL)) return(0);
-	   } else if (xmlNodeIsText(lastChild))
-	       return(0);
-	   else if ((ctxt->node->children != NULL) &&
-	            (xmlNodeIsText(ctxt->node->children)))
-	       return(0);
-	*/
+	// ctx.elem is only available when a tree is being built
+	if e := ctx.elem; e != nil {
+		if e.FirstChild() == nil && cur.HasPrefix("</") {
+			ret = false
+			return
+		}
+
+		if l := e.LastChild(); l != nil && l.Type() == TextNode {
+			ret = false
+			return
+		}
+
+		if f := e.FirstChild(); f != nil && f.Type() == TextNode {
+			ret = false
+			return
+		}
+	}
+
 	ret = true
 	return
 }
@@ -1767,6 +2092,7 @@ func (ctx *parserCtx) parseCDSect() error {
 		defer g.IRelease("END parseCDSect")
 	}
 
+	ctx.markPosition()
 	cur := ctx.cursor
 	if !cur.Consume("<![CDATA[") {
 		return ctx.error(ErrInvalidCDSect)
@@ -1791,6 +2117,7 @@ func (ctx *parserCtx) parseComment() error {
 		defer g.IRelease("END parseComment")
 	}
 
+	ctx.markPosition()
 	cur := ctx.cursor
 	if !cur.Consume("<!--") {
 		return ctx.error(ErrInvalidComment)
@@ -1822,6 +2149,9 @@ func (ctx *parserCtx) parseComment() error {
 		q = r
 		r = c
 		i++
+		if exceeds(buf.Len(), ctx.limits.MaxTextLength) {
+			return ctx.limitError("MaxTextLength", int64(ctx.limits.MaxTextLength))
+		}
 	}
 
 	// -2 for "-->" (note: '>' has not been consumed, so we use -2 instead of -3
@@ -1863,7 +2193,7 @@ func (ctx *parserCtx) parseDocTypeDecl() error {
 	ctx.intSubName = name
 
 	ctx.skipBlanks()
-	u, eid, err := ctx.parseExternalID()
+	u, eid, err := ctx.parseExternalID(true)
 	if err != nil {
 		return ctx.error(err)
 	}
@@ -1919,11 +2249,23 @@ func (ctx *parserCtx) parseInternalSubset() error {
 
 	for !cur.Done() && cur.Peek() != ']' {
 		ctx.skipBlanks()
-		if err := ctx.parseMarkupDecl(); err != nil {
-			return ctx.error(err)
+		if err := ctx.checkPEError(); err != nil {
+			return err
 		}
-		if err := ctx.parsePEReference(); err != nil {
-			return ctx.error(err)
+
+		switch c := cur.Peek(); {
+		case c == ']' || cur.Done():
+			continue
+		case c == '%':
+			if err := ctx.parsePEReference(); err != nil {
+				return ctx.error(err)
+			}
+		case cur.HasPrefix("<!") || cur.HasPrefix("<?"):
+			if err := ctx.parseMarkupDecl(); err != nil {
+				return ctx.error(err)
+			}
+		default:
+			return ctx.error(ErrInvalidDTD)
 		}
 	}
 
@@ -1980,6 +2322,8 @@ func (ctx *parserCtx) parseMarkupDecl() error {
 					if err := ctx.parseEntityDecl(); err != nil {
 						return ctx.error(err)
 					}
+				} else {
+					return ctx.error(ErrInvalidDTD)
 				}
 			case 'A': // <!A...
 				if err := ctx.parseAttributeListDecl(); err != nil {
@@ -1993,8 +2337,18 @@ func (ctx *parserCtx) parseMarkupDecl() error {
 				if err := ctx.parseComment(); err != nil {
 					return ctx.error(err)
 				}
+			case '[': // <![...
+				// Conditional sections are allowed in the external
+				// subset, and in entities included by PE References
+				// in the internal subset.
+				if !ctx.external && cur.Len() == 1 {
+					return ctx.error(ErrInvalidDTD)
+				}
+				if err := ctx.parseConditionalSections(); err != nil {
+					return ctx.error(err)
+				}
 			default:
-				// no op: error detected later?
+				return ctx.error(ErrInvalidDTD)
 			}
 		} else if cur.PeekN(2) == '?' {
 			return ctx.parsePI()
@@ -2012,15 +2366,6 @@ func (ctx *parserCtx) parseMarkupDecl() error {
 			return ctx.error(err)
 		}
 	}
-	/*
-	    // Conditional sections are allowed from entities included
-	    // by PE References in the internal subset.
-	   if ((ctxt->external == 0) && (ctxt->inputNr > 1)) {
-	       if ((RAW == '<') && (NXT(1) == '!') && (NXT(2) == '[')) {
-	           xmlParseConditionalSections(ctxt);
-	       }
-	   }
-	*/
 	ctx.instate = psDTD
 
 	return nil
@@ -2110,53 +2455,34 @@ func (ctx *parserCtx) parsePEReference() error {
 		 * ... The declaration of a parameter entity must
 		 * precede any reference to it...
 		 */
-		/*
-		   xmlWarningMsg(ctxt, XML_WAR_UNDECLARED_ENTITY,
-		                 "PEReference: %%%s; not found\n",
-		                 name, NULL);
-		*/
+		ctx.warning(fmt.Errorf("PEReference: %%%s; not found", name))
 		ctx.valid = false
-		if err := ctx.entityCheck(entity, 0, 0); err != nil {
-			return ctx.error(err)
-		}
 	} else {
 		/*
 		 * Internal checking in case the entity quest barfed
 		 */
-		if etype := EntityType(entity.EntityType()); etype != InternalParameterEntity && etype != ExternalParameterEntity {
-			/*
-			   xmlWarningMsg(ctxt, XML_WAR_UNDECLARED_ENTITY,
-			         "Internal: %%%s; is not a parameter entity\n",
-			                 name, NULL);
-			*/
-			/*
-			   } else if (ctxt->input->free != deallocblankswrapper) {
-			           input = xmlNewBlanksWrapperInputStream(ctxt, entity);
-			           if (xmlPushInput(ctxt, input) < 0)
-			               return;
-			*/
-		} else {
-			// TODO !!!
-			// handle the extra spaces added before and after
-			// c.f. http://www.w3.org/TR/REC-xml#as-PE
-			/*
-			   input = xmlNewEntityInputStream(ctxt, entity);
-			   if (xmlPushInput(ctxt, input) < 0)
-			       return;
-			   if ((entity->etype == XML_EXTERNAL_PARAMETER_ENTITY) &&
-			       (CMP5(CUR_PTR, '<', '?', 'x', 'm', 'l')) &&
-			       (IS_BLANK_CH(NXT(5)))) {
-			       xmlParseTextDecl(ctxt);
-			       if (ctxt->errNo ==
-			           XML_ERR_UNSUPPORTED_ENCODING) {
-			           // The XML REC instructs us to stop parsing
-			           // right here
-			           //
-			           xmlHaltParser(ctxt);
-			           return;
-			       }
-			   }
-			*/
+		ctx.hasPERefs = true
+		switch EntityType(entity.EntityType()) {
+		case InternalParameterEntity:
+		case ExternalParameterEntity:
+			// External parameter entities are only loaded when we
+			// were asked to process external DTD content
+			if !ctx.loadDTD() {
+				return nil
+			}
+			if e, ok := entity.(*Entity); ok {
+				if err := ctx.loadEntityContent(e); err != nil {
+					ctx.warning(err)
+					return nil
+				}
+			}
+		default:
+			ctx.warning(fmt.Errorf("Internal: %%%s; is not a parameter entity", name))
+			return nil
+		}
+
+		if err := ctx.pushEntity(entity); err != nil {
+			return ctx.error(err)
 		}
 	}
 	ctx.hasPERefs = true
@@ -2336,6 +2662,7 @@ func (ctx *parserCtx) parseElementMixedContentDecl() (*ElementContent, error) {
 	if !cur.Consume("#PCDATA") {
 		return nil, ctx.error(ErrPCDATARequired)
 	}
+	ctx.skipBlanks()
 
 	if cur.Peek() == ')' {
 		/*
@@ -2389,7 +2716,7 @@ func (ctx *parserCtx) parseElementMixedContentDecl() (*ElementContent, error) {
 			if err != nil {
 				return nil, ctx.error(err)
 			}
-			n.c1, err = ctx.doc.CreateElementContent("", ElementContentElement)
+			n.c1, err = ctx.doc.CreateElementContent(elem, ElementContentElement)
 			if err != nil {
 				return nil, ctx.error(err)
 			}
@@ -2425,6 +2752,8 @@ func (ctx *parserCtx) parseElementMixedContentDecl() (*ElementContent, error) {
 		                                    NULL, NULL);
 		   					}
 		*/
+	} else {
+		return nil, ctx.error(ErrMixedNotStarted)
 	}
 	return retelem, nil
 }
@@ -2473,7 +2802,8 @@ func (ctx *parserCtx) parseElementChildrenContentDeclPriv(depth int) (*ElementCo
 	if cur.Peek() == '(' {
 		cur.Advance(1)
 		ctx.skipBlanks()
-		retelem, err := ctx.parseElementChildrenContentDeclPriv(depth + 1)
+		var err error
+		retelem, err = ctx.parseElementChildrenContentDeclPriv(depth + 1)
 		if err != nil {
 			return nil, ctx.error(err)
 		}
@@ -2625,6 +2955,7 @@ LOOP:
 		}
 		cur.Advance(1)
 	case '*':
+		cur.Advance(1)
 		if retelem != nil {
 			retelem.coccur = ElementContentMult
 			curelem = retelem
@@ -2644,6 +2975,7 @@ LOOP:
 			}
 		}
 	case '+':
+		cur.Advance(1)
 		if retelem.coccur == ElementContentOpt {
 			retelem.coccur = ElementContentMult
 		} else {
@@ -2723,8 +3055,8 @@ func (ctx *parserCtx) decodeEntities(s []byte, what SubstitutionType) (ret strin
 }
 
 func (ctx *parserCtx) decodeEntitiesInternal(s []byte, what SubstitutionType, depth int) (string, error) {
-	if depth > 40 {
-		return "", errors.New("entity loop (depth > 40)")
+	if depth > ctx.entities.maxDepth() {
+		return "", ErrEntityLoop
 	}
 
 	out := bufferPool.Get().(*bytes.Buffer)
@@ -2743,7 +3075,7 @@ func (ctx *parserCtx) decodeEntitiesInternal(s []byte, what SubstitutionType, de
 			if err != nil {
 				return "", err
 			}
-			if err := ctx.entityCheck(ent, 0, 0); err != nil {
+			if err := ctx.entityCheck(ent); err != nil {
 				return "", err
 			}
 
@@ -2768,14 +3100,21 @@ func (ctx *parserCtx) decodeEntitiesInternal(s []byte, what SubstitutionType, de
 			if err != nil {
 				return "", err
 			}
-			if err := ctx.entityCheck(ent, width, 0); err != nil {
+			if err := ctx.entityCheck(ent); err != nil {
 				return "", err
 			}
-			rep, err := ctx.decodeEntitiesInternal(ent.Content(), what, depth+1)
-			if err != nil {
-				return "", err
+			if ent != nil {
+				if e, ok := ent.(*Entity); ok && e.entityType == ExternalParameterEntity && ctx.loadDTD() {
+					if err := ctx.loadEntityContent(e); err != nil {
+						ctx.warning(err)
+					}
+				}
+				rep, err := ctx.decodeEntitiesInternal(ent.Content(), what, depth+1)
+				if err != nil {
+					return "", err
+				}
+				out.WriteString(rep)
 			}
-			out.WriteString(rep)
 			s = s[width:]
 		} else {
 			out.WriteByte(s[0])
@@ -2867,6 +3206,7 @@ func (ctx *parserCtx) parseEntityDecl() error {
 
 	ctx.instate = psEntityDecl
 	var literal string
+	var publicID string
 	var value string
 	var uri string
 
@@ -2887,8 +3227,11 @@ func (ctx *parserCtx) parseEntityDecl() error {
 				}
 			}
 		} else {
-			literal, uri, err = ctx.parseExternalID()
+			uri, publicID, err = ctx.parseExternalID(true)
 			if err != nil {
+				return ctx.error(err)
+			}
+			if uri == "" && publicID == "" {
 				return ctx.error(ErrValueRequired)
 			}
 
@@ -2902,7 +3245,7 @@ func (ctx *parserCtx) parseEntityDecl() error {
 					return ctx.error(errors.New("err uri fragment"))
 				} else {
 					if s := ctx.sax; s != nil {
-						switch err := s.EntityDecl(ctx.userData, name, int(ExternalParameterEntity), literal, uri, ""); err {
+						switch err := s.EntityDecl(ctx.userData, name, int(ExternalParameterEntity), publicID, uri, ""); err {
 						case nil, sax.ErrHandlerUnspecified:
 							// no op
 						default:
@@ -2929,9 +3272,12 @@ func (ctx *parserCtx) parseEntityDecl() error {
 				}
 			}
 		} else {
-			literal, uri, err = ctx.parseExternalID()
+			uri, publicID, err = ctx.parseExternalID(true)
 			if err != nil {
-				return ctx.error(ErrValueRequired)
+				return ctx.error(err)
+			}
+			if uri == "" && publicID == "" {
+				return ctx.error(ErrValueRequired)
 			}
 
 			if uri != "" {
@@ -2942,15 +3288,6 @@ func (ctx *parserCtx) parseEntityDecl() error {
 
 				if u.Fragment != "" {
 					return ctx.error(errors.New("err uri fragment"))
-				} else {
-					if s := ctx.sax; s != nil {
-						switch err := s.EntityDecl(ctx.userData, name, int(ExternalGeneralParsedEntity), literal, uri, ""); err {
-						case nil, sax.ErrHandlerUnspecified:
-							// no op
-						default:
-							return ctx.error(err)
-						}
-					}
 				}
 			}
 
@@ -2969,7 +3306,7 @@ func (ctx *parserCtx) parseEntityDecl() error {
 					return ctx.error(err)
 				}
 				if s := ctx.sax; s != nil {
-					switch err := s.EntityDecl(ctx.userData, name, int(ExternalParameterEntity), literal, uri, ndata); err {
+					switch err := s.UnparsedEntityDecl(ctx.userData, name, publicID, uri, ndata); err {
 					case nil, sax.ErrHandlerUnspecified:
 						// no op
 					default:
@@ -2978,7 +3315,7 @@ func (ctx *parserCtx) parseEntityDecl() error {
 				}
 			} else {
 				if s := ctx.sax; s != nil {
-					switch err := s.EntityDecl(ctx.userData, name, int(ExternalParameterEntity), literal, uri, ""); err {
+					switch err := s.EntityDecl(ctx.userData, name, int(ExternalGeneralParsedEntity), publicID, uri, ""); err {
 					case nil, sax.ErrHandlerUnspecified:
 						// no op
 					default:
@@ -3077,11 +3414,13 @@ func (ctx *parserCtx) parseNotationType() (Enumeration, error) {
 		if err != nil {
 			return nil, ctx.error(ErrNotationNameRequired)
 		}
+		// a duplicate token is a validity error, not a fatal one
 		if _, ok := names[name]; ok {
-			return nil, ctx.error(ErrDTDDupToken{Name: name})
+			ctx.valid = false
+		} else {
+			names[name] = struct{}{}
+			enum = append(enum, name)
 		}
-
-		enum = append(enum, name)
 		ctx.skipBlanks()
 
 		if cur.Peek() != '|' {
@@ -3424,10 +3763,6 @@ func (ctx *parserCtx) lookupSpecialAttribute(elemName, attrName string) (Attribu
 	return v, ok
 }
 
-func validateAttributeValueInternal(doc *Document, typ AttributeType, defvalue string) error {
-	return nil
-}
-
 func (ctx *parserCtx) addAttributeDecl(dtd *DTD, elem string, name string, prefix string, atype AttributeType, def AttributeDefault, defvalue string, tree Enumeration) (attr *AttributeDecl, err error) {
 	if dtd == nil {
 		err = errors.New("dtd required")
@@ -3449,10 +3784,10 @@ func (ctx *parserCtx) addAttributeDecl(dtd *DTD, elem string, name string, prefi
 	}
 
 	if defvalue != "" {
-		if err = validateAttributeValueInternal(dtd.doc, atype, defvalue); err != nil {
-			err = fmt.Errorf("attribute %s of %s: invalid default value: %s", elem, name, err)
+		if validateAttributeValueInternal(dtd.doc, atype, defvalue) != nil {
+			// not a well-formedness error: this is reported when
+			// the document is validated
 			ctx.valid = false
-			return
 		}
 	}
 
@@ -3540,14 +3875,9 @@ func (ctx *parserCtx) addAttributeDefault(elemName, attrName, defaultValue strin
 		return
 	}
 
-	// XXX seems like when your language has a map, you can do just
-	// kinda do away with a bunch of stuff..  See xmlAddDefAttrs for
-	// details of what the original code is doing
-	m, ok := ctx.attsDefault[elemName]
-	if !ok {
-		m = map[string]*Attribute{}
-		ctx.attsDefault[elemName] = m
-	}
+	// the defaults are kept in the order they were declared. See
+	// xmlAddDefAttrs for details of what the original code is doing
+	m := ctx.attsDefault[elemName]
 
 	var prefix string
 	var local string
@@ -3558,15 +3888,12 @@ func (ctx *parserCtx) addAttributeDefault(elemName, attrName, defaultValue strin
 		local = attrName
 	}
 
-	uri := ctx.lookupNamespace(prefix)
-	attr, err := ctx.doc.CreateAttribute(local, defaultValue, newNamespace(prefix, uri))
-	if err != nil {
-		// XXX Unhandled?!
-		return
-	}
-
-	attr.SetDefault(true)
-	m[attrName] = attr
+	ctx.attsDefault[elemName] = append(m, &attrData{
+		localname: local,
+		prefix:    prefix,
+		value:     defaultValue,
+		isDefault: true,
+	})
 
 	/*
 	   	hmm, let's think about this when the time comes
@@ -3577,9 +3904,30 @@ func (ctx *parserCtx) addAttributeDefault(elemName, attrName, defaultValue strin
 	*/
 }
 
-func (ctx *parserCtx) lookupAttributeDefault(elemName string) (map[string]*Attribute, bool) {
-	v, ok := ctx.attsDefault[elemName]
-	return v, ok
+// lookupAttributeDefault returns the defaulted attributes of the
+// element, in the order they were declared
+func (ctx *parserCtx) lookupAttributeDefault(elemName string) []*attrData {
+	return ctx.attsDefault[elemName]
+}
+
+// declaresNS reports if one of the last nbNs namespaces that were
+// declared on the current element binds prefix
+func (ctx *parserCtx) declaresNS(nbNs int, prefix string) bool {
+	for _, ns := range ctx.nsTab.Peek(nbNs) {
+		if ns.(nsStackItem).prefix == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAttribute(attrs []sax.Attribute, name string) bool {
+	for _, attr := range attrs {
+		if attr.Name() == name {
+			return true
+		}
+	}
+	return false
 }
 
 /*
@@ -3689,22 +4037,330 @@ func (ctx *parserCtx) parseAttributeListDecl() error {
 	return nil
 }
 
+/*
+ * parse a notation declaration
+ *
+ * [82] NotationDecl ::= '<!NOTATION' S Name S (ExternalID |  PublicID) S? '>'
+ *
+ * Hence there is actually 3 choices:
+ *     'PUBLIC' S PubidLiteral
+ *     'PUBLIC' S PubidLiteral S SystemLiteral
+ * and 'SYSTEM' S SystemLiteral
+ *
+ * See the NOTE on parseExternalID().
+ */
 func (ctx *parserCtx) parseNotationDecl() error {
 	if debug.Enabled {
 		g := debug.IPrintf("START parseNotationDecl")
 		defer g.IRelease("END parseNotationDecl")
 	}
+
+	cur := ctx.cursor
+	if !cur.Consume("<!NOTATION") {
+		return ctx.error(errors.New("<!NOTATION not started"))
+	}
+
+	if !ctx.skipBlanks() {
+		return ctx.error(ErrSpaceRequired)
+	}
+
+	name, err := ctx.parseName()
+	if err != nil {
+		return ctx.error(ErrNotationNameRequired)
+	}
+	if strings.IndexByte(name, ':') > -1 {
+		return ctx.error(errors.New("colons are forbidden from notation names"))
+	}
+
+	if !ctx.skipBlanks() {
+		return ctx.error(ErrSpaceRequired)
+	}
+
+	systemID, publicID, err := ctx.parseExternalID(false)
+	if err != nil {
+		return ctx.error(err)
+	}
+	if systemID == "" && publicID == "" {
+		return ctx.error(ErrValueRequired)
+	}
+	ctx.skipBlanks()
+
+	if cur.Peek() != '>' {
+		return ctx.error(errors.New("notation declaration not terminated"))
+	}
+	cur.Advance(1)
+
+	if s := ctx.sax; s != nil {
+		switch err := s.NotationDecl(ctx.userData, name, publicID, systemID); err {
+		case nil, sax.ErrHandlerUnspecified:
+			// no op
+		default:
+			return ctx.error(err)
+		}
+	}
 	return nil
 }
 
-func (ctx *parserCtx) parseExternalID() (string, string, error) {
+/*
+ * Parse an External ID or a Public ID
+ *
+ * NOTE: Productions [75] and [83] interact badly since [75] can generate
+ *       'PUBLIC' S PubidLiteral S SystemLiteral
+ *
+ * [75] ExternalID ::= 'SYSTEM' S SystemLiteral
+ *                   | 'PUBLIC' S PubidLiteral S SystemLiteral
+ *
+ * [83] PublicID ::= 'PUBLIC' S PubidLiteral
+ *
+ * If strict is false, the system literal may be omitted after a
+ * public literal, as allowed in notation declarations.
+ *
+ * Returns the system literal (the URI) and the public literal. Both
+ * are empty if there was no external ID at all.
+ */
+func (ctx *parserCtx) parseExternalID(strict bool) (string, string, error) {
 	if debug.Enabled {
 		g := debug.IPrintf("START parseExternalID")
 		defer g.IRelease("END parseExternalID")
 	}
+
+	cur := ctx.cursor
+	switch {
+	case cur.Consume("SYSTEM"):
+		if !ctx.skipBlanks() {
+			return "", "", ErrSpaceRequired
+		}
+		uri, err := ctx.parseSystemLiteral()
+		if err != nil {
+			return "", "", err
+		}
+		return uri, "", nil
+	case cur.Consume("PUBLIC"):
+		if !ctx.skipBlanks() {
+			return "", "", ErrSpaceRequired
+		}
+		publicID, err := ctx.parsePubidLiteral()
+		if err != nil {
+			return "", "", err
+		}
+
+		if strict {
+			// We don't handle [83] so "S SystemLiteral" is required
+			if !ctx.skipBlanks() {
+				return "", "", ErrSpaceRequired
+			}
+		} else {
+			// We handle [83] so we return immediately, if
+			// "S SystemLiteral" is not detected.
+			if !ctx.skipBlanks() {
+				return "", publicID, nil
+			}
+			if c := cur.Peek(); c != '\'' && c != '"' {
+				return "", publicID, nil
+			}
+		}
+
+		uri, err := ctx.parseSystemLiteral()
+		if err != nil {
+			return "", "", err
+		}
+		return uri, publicID, nil
+	}
 	return "", "", nil
 }
 
+/*
+ * parse an XML Literal
+ *
+ * [11] SystemLiteral ::= ('"' [^"]* '"') | ("'" [^']* "'")
+ */
+func (ctx *parserCtx) parseSystemLiteral() (string, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START parseSystemLiteral")
+		defer g.IRelease("END parseSystemLiteral")
+	}
+
+	cur := ctx.cursor
+	s, err := ctx.parseQuotedText(func(qch rune) (string, error) {
+		buf := bufferPool.Get().(*bytes.Buffer)
+		defer releaseBuffer(buf)
+
+		for c := cur.Peek(); c != qch; c = cur.Peek() {
+			if !isChar(c) {
+				return "", ErrInvalidChar
+			}
+			buf.WriteRune(c)
+			cur.Advance(1)
+		}
+		return buf.String(), nil
+	})
+	if err != nil {
+		return "", errors.New("SystemLiteral \" or ' expected")
+	}
+	return s, nil
+}
+
+/*
+ * parse an XML public literal
+ *
+ * [12] PubidLiteral ::= '"' PubidChar* '"' | "'" (PubidChar - "'")* "'"
+ */
+func (ctx *parserCtx) parsePubidLiteral() (string, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START parsePubidLiteral")
+		defer g.IRelease("END parsePubidLiteral")
+	}
+
+	cur := ctx.cursor
+	s, err := ctx.parseQuotedText(func(qch rune) (string, error) {
+		buf := bufferPool.Get().(*bytes.Buffer)
+		defer releaseBuffer(buf)
+
+		for c := cur.Peek(); c != qch; c = cur.Peek() {
+			if !isPubidChar(c) {
+				return "", errors.New("unexpected character in PubidLiteral")
+			}
+			buf.WriteRune(c)
+			cur.Advance(1)
+		}
+		return buf.String(), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// [13] PubidChar ::= #x20 | #xD | #xA | [a-zA-Z0-9] | [-'()+,./:=?;!*#@$_%]
+func isPubidChar(c rune) bool {
+	switch {
+	case c == 0x20 || c == 0xD || c == 0xA:
+		return true
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("-'()+,./:=?;!*#@$_%", c)
+}
+
+/*
+ * Parse a conditional section. Always consumes '<!['.
+ *
+ * [61] conditionalSect ::= includeSect | ignoreSect
+ * [62] includeSect ::= '<![' S? 'INCLUDE' S? '[' extSubsetDecl ']]>'
+ * [63] ignoreSect ::= '<![' S? 'IGNORE' S? '[' ignoreSectContents* ']]>'
+ * [64] ignoreSectContents ::= Ignore ('<![' ignoreSectContents ']]>' Ignore)*
+ * [65] Ignore ::= Char* - (Char* ('<![' | ']]>') Char*)
+ */
+func (ctx *parserCtx) parseConditionalSections() error {
+	if debug.Enabled {
+		g := debug.IPrintf("START parseConditionalSections")
+		defer g.IRelease("END parseConditionalSections")
+	}
+
+	cur := ctx.cursor
+	if !cur.Consume("<![") {
+		return ctx.error(errors.New("conditional section not started"))
+	}
+
+	ctx.skipBlanks()
+	if err := ctx.checkPEError(); err != nil {
+		return err
+	}
+
+	switch {
+	case cur.Consume("INCLUDE"):
+		ctx.skipBlanks()
+		if cur.Peek() != '[' {
+			return ctx.error(errors.New("conditional section '[' expected"))
+		}
+		cur.Advance(1)
+
+		for !cur.Done() && !cur.HasPrefix("]]>") {
+			if err := ctx.parseExternalSubsetDecl(); err != nil {
+				return ctx.error(err)
+			}
+		}
+	case cur.Consume("IGNORE"):
+		ctx.skipBlanks()
+		if cur.Peek() != '[' {
+			return ctx.error(errors.New("conditional section '[' expected"))
+		}
+		cur.Advance(1)
+
+		// Parameter entity references are not recognized in
+		// ignored sections, so just count the nested sections
+		for depth := 1; !cur.Done(); {
+			if cur.Consume("<![") {
+				depth++
+			} else if cur.HasPrefix("]]>") {
+				if depth--; depth == 0 {
+					break
+				}
+				cur.Advance(3)
+			} else {
+				cur.Advance(1)
+			}
+		}
+	default:
+		return ctx.error(errors.New("conditional section INCLUDE or IGNORE keyword expected"))
+	}
+
+	if !cur.Consume("]]>") {
+		return ctx.error(errors.New("conditional section not closed"))
+	}
+	return nil
+}
+
+/*
+ * parse Markup declarations from an external subset
+ *
+ * [30] extSubset ::= textDecl? extSubsetDecl
+ *
+ * [31] extSubsetDecl ::= (markupdecl | conditionalSect | PEReference | S) *
+ *
+ * The text declaration has already been consumed by the time
+ * we get here.
+ */
+func (ctx *parserCtx) parseExternalSubset() error {
+	if debug.Enabled {
+		g := debug.IPrintf("START parseExternalSubset")
+		defer g.IRelease("END parseExternalSubset")
+	}
+
+	ctx.instate = psDTD
+	ctx.external = true
+
+	cur := ctx.cursor
+	for !cur.Done() {
+		if cur.HasPrefix("]]>") {
+			return ctx.error(errors.New("extra content at the end of the external subset"))
+		}
+		if err := ctx.parseExternalSubsetDecl(); err != nil {
+			return ctx.error(err)
+		}
+	}
+	return nil
+}
+
+// parseExternalSubsetDecl parses a single extSubsetDecl
+func (ctx *parserCtx) parseExternalSubsetDecl() error {
+	cur := ctx.cursor
+	ctx.skipBlanks()
+	if err := ctx.checkPEError(); err != nil {
+		return err
+	}
+
+	switch {
+	case cur.Done() || cur.HasPrefix("]]>"):
+		return nil
+	case cur.Peek() == '%':
+		return ctx.parsePEReference()
+	case cur.HasPrefix("<!") || cur.HasPrefix("<?"):
+		return ctx.parseMarkupDecl()
+	}
+	return errors.New("content error in the external subset")
+}
+
 func (ctx *parserCtx) parseEpilogue() error {
 	if debug.Enabled {
 		g := debug.IPrintf("START parseEpilogue")
@@ -3714,13 +4370,27 @@ func (ctx *parserCtx) parseEpilogue() error {
 	return nil
 }
 
-func (ctx *parserCtx) parseExternalEntityPrivate(uri, externalID string) (Node, error) {
-	return nil, errors.New("unimplemented")
+// parseExternalEntityPrivate loads the content of the external parsed
+// entity, and parses it as a balanced chunk of content
+func (ctx *parserCtx) parseExternalEntityPrivate(ent *Entity) (Node, *entityBuilder, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START parseExternalEntityPrivate '%s'", ent.name)
+		defer g.IRelease("END parseExternalEntityPrivate")
+	}
+
+	if err := ctx.loadEntityContent(ent); err != nil {
+		return nil, nil, err
+	}
+	return ctx.parseBalancedChunkInternal([]byte(ent.content), ent)
 }
 
 var ErrParseSucceeded = errors.New("parse succeeded")
 
-func (ctx *parserCtx) parseBalancedChunkInternal(chunk []byte, userData interface{}) (Node, error) {
+// parseBalancedChunkInternal parses chunk as content in a new context.
+// ext is the external entity that chunk was loaded from, if any. When
+// entities are substituted, the returned builder holds the SAX events
+// of the content.
+func (ctx *parserCtx) parseBalancedChunkInternal(chunk []byte, ext *Entity) (Node, *entityBuilder, error) {
 	if debug.Enabled {
 		g := debug.IPrintf("START parseBalancedChunkInternal")
 		defer g.IRelease("END parseBalancedChunkInternal")
@@ -3729,20 +4399,14 @@ func (ctx *parserCtx) parseBalancedChunkInternal(chunk []byte, userData interfac
 	ctx.depth++
 	defer func() { ctx.depth-- }()
 
-	if ctx.depth > 40 {
-		return nil, errors.New("entity loop")
+	if ctx.depth > ctx.entities.maxDepth() {
+		return nil, nil, ErrEntityLoop
 	}
 
 	newctx := &parserCtx{}
 	newctx.init(nil, bytes.NewReader(chunk))
 	defer newctx.release()
 
-	if userData != nil {
-		newctx.userData = userData
-	} else {
-		newctx.userData = newctx
-	}
-
 	if ctx.doc == nil {
 		ctx.doc = NewDocument("1.0", "", StandaloneExplicitNo)
 	}
@@ -3756,21 +4420,63 @@ func (ctx *parserCtx) parseBalancedChunkInternal(chunk []byte, userData interfac
 		ctx.doc.setFirstChild(fc)
 		ctx.doc.setLastChild(lc)
 	}()
+
+	// the content is parsed with the options of the document. When
+	// the reference is substituted, the events of the content are
+	// recorded to be replayed in the document. Otherwise they are
+	// reported as the content is parsed.
+	var builder *entityBuilder
+	if ctx.replaceEntities {
+		builder = newEntityBuilder(ctx.sax, ctx.userData)
+		newctx.sax = builder
+	} else {
+		newctx.sax = ctx.sax
+	}
 	newctx.doc = ctx.doc
-	newctx.sax = ctx.sax
+	newctx.options = ctx.options
+	newctx.keepBlanks = ctx.keepBlanks
+	newctx.replaceEntities = ctx.replaceEntities
+	newctx.pedantic = ctx.pedantic
+	newctx.loader = ctx.loader
+	newctx.catalog = ctx.catalog
+	newctx.standalone = ctx.standalone
+	newctx.hasExternalSubset = ctx.hasExternalSubset
+	newctx.hasPERefs = ctx.hasPERefs
 	newctx.attsDefault = ctx.attsDefault
-	newctx.depth = ctx.depth + 1
+	newctx.loadsubset = ctx.loadsubset
+	newctx.depth = ctx.depth
+	newctx.entities = ctx.entities
+	newctx.limits = ctx.limits
+	newctx.elemDepth = ctx.elemDepth
+	newctx.onError = ctx.onError
+	if ext != nil {
+		newctx.baseURI = ext.uri
+		newctx.publicID = ext.externalID
+	}
+
+	// the locator follows the parser into the entity
+	if loc := ctx.locator; loc != nil {
+		newctx.locator = loc
+		loc.ctx = newctx
+		defer func() { loc.ctx = ctx }()
+	}
 
 	// create a dummy node
 	newRoot, err := newctx.doc.CreateElement("pseudoroot")
 	if err != nil {
-		return nil, ctx.error(err)
+		return nil, nil, ctx.error(err)
 	}
 	newctx.pushNode(newRoot)
 	newctx.doc.AddChild(newRoot)
+	newctx.elem = newRoot
 	newctx.switchEncoding()
-	if err := newctx.parseContent(); err != nil {
-		return nil, err
+	err = newctx.parseContent()
+	if len(newctx.recovered) > 0 {
+		ctx.wellFormed = false
+		ctx.recovered = append(ctx.recovered, newctx.recovered...)
+	}
+	if err != nil {
+		return nil, nil, err
 	}
 
 	if child := newctx.doc.FirstChild(); child != nil {
@@ -3779,13 +4485,13 @@ func (ctx *parserCtx) parseBalancedChunkInternal(chunk []byte, userData interfac
 				e.SetTreeDoc(ctx.doc)
 				e.SetParent(nil)
 			}
-			return grandchild, nil
+			return grandchild, builder, nil
 		}
 	}
 
 	// this means that the parsing was successful, but there weren't
 	// any nodes generated as a result of parsing
-	return nil, ErrParseSucceeded
+	return nil, builder, ErrParseSucceeded
 }
 
 /*
@@ -3802,6 +4508,7 @@ func (ctx *parserCtx) parseReference() error {
 		defer g.IRelease("END parseReference")
 	}
 
+	ctx.markPosition()
 	cur := ctx.cursor
 	if cur.Peek() != '&' {
 		return ctx.error(ErrAmpersandRequired)
@@ -3832,9 +4539,16 @@ func (ctx *parserCtx) parseReference() error {
 	if err != nil {
 		return ctx.error(err)
 	}
+	if ent == nil {
+		// undeclared entity, which has already been reported
+		// to the SAX handler as a reference
+		return nil
+	}
 	// if !ctx.wellFormed { return } ??
 
-	wasChecked := ent.checked
+	if err := ctx.entityCheck(ent); err != nil {
+		return ctx.error(err)
+	}
 
 	// special case for predefined entities
 	if ent.name == "" || EntityType(ent.EntityType()) == InternalPredefinedEntity {
@@ -3852,295 +4566,59 @@ func (ctx *parserCtx) parseReference() error {
 		return nil
 	}
 
-	// The first reference to the entity trigger a parsing phase
-	// where the ent->children is filled with the result from
-	// the parsing.
+	// The content of the entity is parsed, and the first time it is
+	// referenced, the resulting nodes become the children of the
+	// entity.
 	// Note: external parsed entities will not be loaded, it is not
 	// required for a non-validating parser, unless the parsing option
 	// of validating, or substituting entities were given. Doing so is
 	// far more secure as the parser will only process data coming from
 	// the document entity by default.
-	var parsedEnt Node
-	if (wasChecked == 0 || (ent.firstChild == nil && ctx.options.IsSet(ParseNoEnt))) && (EntityType(ent.EntityType()) != ExternalGeneralParsedEntity || ctx.options.IsSet(ParseNoEnt|ParseDTDValid)) {
-		var userData interface{}
-		if ctx.userData != ctx {
-			userData = ctx.userData
-		}
-
-		if EntityType(ent.EntityType()) == InternalGeneralEntity {
-			parsedEnt, err = ctx.parseBalancedChunkInternal([]byte(ent.Content()), userData)
-			switch err {
-			case nil, ErrParseSucceeded:
-				// may not have generated nodes, but parse was successful
-			default:
-				return err
-			}
-		} else if EntityType(ent.EntityType()) == ExternalGeneralParsedEntity {
-			parsedEnt, err = ctx.parseExternalEntityPrivate(ent.uri, ent.externalID)
-			switch err {
-			case nil, ErrParseSucceeded:
-				// may not have generated nodes, but parse was successful
-			default:
-				return err
-			}
-		} else {
+	if EntityType(ent.EntityType()) != ExternalGeneralParsedEntity || ctx.options.IsSet(ParseNoEnt|ParseDTDValid) {
+		var parsedEnt Node
+		var content *entityBuilder
+		switch EntityType(ent.EntityType()) {
+		case InternalGeneralEntity:
+			parsedEnt, content, err = ctx.parseBalancedChunkInternal([]byte(ent.Content()), nil)
+		case ExternalGeneralParsedEntity:
+			parsedEnt, content, err = ctx.parseExternalEntityPrivate(ent)
+		default:
 			return errors.New("invalid entity type")
 		}
+		switch err {
+		case nil, ErrParseSucceeded:
+			// may not have generated nodes, but parse was successful
+		default:
+			return err
+		}
 
-		/*
-		           // Store the number of entities needing parsing for this entity
-		           // content and do checkings
-		           ent->checked = (ctxt->nbentities - oldnbent + 1) * 2;
-		           if ((ent->content != NULL) && (xmlStrchr(ent->content, '<')))
-		               ent->checked |= 1;
-		           if (ret == XML_ERR_ENTITY_LOOP) {
-		               xmlFatalErr(ctxt, XML_ERR_ENTITY_LOOP, NULL);
-		               xmlFreeNodeList(list);
-		               return;
-		           }
-		           if (xmlParserEntityCheck(ctxt, 0, ent, 0)) {
-		               xmlFreeNodeList(list);
-		               return;
-		           }
-
-		           if ((ret == XML_ERR_OK) && (list != NULL)) {
-		               if (((ent->etype == XML_INTERNAL_GENERAL_ENTITY) ||
-		                (ent->etype == XML_EXTERNAL_GENERAL_PARSED_ENTITY))&&
-		                   (ent->children == NULL)) {
-		                   ent->children = list;
-		                   if (ctxt->replaceEntities) {
-		                       // Prune it directly in the generated document
-		                       // except for single text nodes.
-		                       if (((list->type == XML_TEXT_NODE) &&
-		                            (list->next == NULL)) ||
-		                           (ctxt->parseMode == XML_PARSE_READER)) {
-		                           list->parent = (xmlNodePtr) ent;
-		                           list = NULL;
-		                           ent->owner = 1;
-		                       } else {
-		                           ent->owner = 0;
-		                           while (list != NULL) {
-		                               list->parent = (xmlNodePtr) ctxt->node;
-		                               list->doc = ctxt->myDoc;
-		                               if (list->next == NULL)
-		                                   ent->last = list;
-		                               list = list->next;
-		                           }
-		                           list = ent->children;
-		   #ifdef LIBXML_LEGACY_ENABLED
-		                           if (ent->etype == XML_EXTERNAL_GENERAL_PARSED_ENTITY)
-		                             xmlAddEntityReference(ent, list, NULL);
-		   #endif
-		                       }
-		                   } else {
-		                       ent->owner = 1;
-		                       while (list != NULL) {
-		                           list->parent = (xmlNodePtr) ent;
-		                           xmlSetTreeDoc(list, ent->doc);
-		                           if (list->next == NULL)
-		                               ent->last = list;
-		                           list = list->next;
-		                       }
-		                   }
-		               } else {
-		                   xmlFreeNodeList(list);
-		                   list = NULL;
-		               }
-		           } else if ((ret != XML_ERR_OK) &&
-		                      (ret != XML_WAR_UNDECLARED_ENTITY)) {
-		               xmlFatalErrMsgStr(ctxt, XML_ERR_UNDECLARED_ENTITY,
-		                        "Entity '%s' failed to parse\n", ent->name);
-		               xmlParserEntityCheck(ctxt, 0, ent, 0);
-		           } else if (list != NULL) {
-		               xmlFreeNodeList(list);
-		               list = NULL;
-		           }
-		           if (ent->checked == 0)
-		               ent->checked = 2;
-		       } else if (ent->checked != 1) {
-		           ctxt->nbentities += ent->checked / 2;
-		       }
-		*/
-
-		// Now that the entity content has been gathered
-		// provide it to the application, this can take different forms based
-		// on the parsing modes.
-		if ent.firstChild == nil {
-			// Probably running in SAX mode and the callbacks don't
-			// build the entity content. So unless we already went
-			// though parsing for first checking go though the entity
-			// content to generate callbacks associated to the entity
-			if wasChecked != 0 {
-				var userData interface{}
-				if ctx.userData != ctx {
-					userData = ctx.userData
-				}
-				if EntityType(ent.EntityType()) == InternalGeneralEntity {
-					parsedEnt, err = ctx.parseBalancedChunkInternal([]byte(ent.Content()), userData)
-					switch err {
-					case nil, ErrParseSucceeded:
-						// may not have generated nodes, but parse was successful
-					default:
-						return err
-					}
-				} else if EntityType(ent.EntityType()) == ExternalGeneralParsedEntity {
-					parsedEnt, err = ctx.parseExternalEntityPrivate(ent.URI(), ent.externalID)
-					switch err {
-					case nil, ErrParseSucceeded:
-						// may not have generated nodes, but parse was successful
-					default:
-						return err
-					}
-				} else {
-					return errors.New("invalid entity type")
-				}
-			}
-			if s := ctx.sax; s != nil && !ctx.replaceEntities {
-				// Entity reference callback comes second, it's somewhat
-				// superfluous but a compatibility to historical behaviour
-				switch err := s.Reference(ctx.userData, ent.name); err {
-				case nil, sax.ErrHandlerUnspecified:
-					// no op
-				default:
-					return err
-				}
+		if parsedEnt != nil && ent.firstChild == nil {
+			ent.setFirstChild(parsedEnt)
+			for n := parsedEnt; n != nil; n = n.NextSibling() {
+				n.SetParent(ent)
+				ent.setLastChild(n)
 			}
-			return nil
 		}
 
-		// If we didn't get any children for the entity being built
-		if s := ctx.sax; s != nil && !ctx.replaceEntities {
-			// Create a node.
-			switch err := s.Reference(ctx.userData, ent.name); err {
-			case nil, sax.ErrHandlerUnspecified:
-				// no op
-			default:
-				return err
+		if ctx.replaceEntities {
+			// Substitute the reference with the content of the entity,
+			// by replaying its events to the SAX handler
+			if err := content.replay(ctx); err != nil {
+				return ctx.error(err)
 			}
 			return nil
 		}
-		_ = parsedEnt
-
-		/*
-			if ctx.replaceEntities || ent.firstChild == nil {
-			           // There is a problem on the handling of _private for entities
-			           // (bug 155816): Should we copy the content of the field from
-			           // the entity (possibly overwriting some value set by the user
-			           // when a copy is created), should we leave it alone, or should
-			           // we try to take care of different situations?  The problem
-			           // is exacerbated by the usage of this field by the xmlReader.
-			           // To fix this bug, we look at _private on the created node
-			           // and, if it's NULL, we copy in whatever was in the entity.
-			           // If it's not NULL we leave it alone.  This is somewhat of a
-			           // hack - maybe we should have further tests to determine
-			           // what to do.
-				if ctx.peekNode() == nil && ent.firstChild == nil {
-			               // Seems we are generating the DOM content, do
-			               // a simple tree copy for all references except the first
-			               // In the first occurrence list contains the replacement.
-					if (parsedEnt == nil && ent.owner == nil) || ctx.parseMode == ParseReaderMode {
-
-
-
-			               if (((list == NULL) && (ent->owner == 0)) ||
-			                   (ctxt->parseMode == XML_PARSE_READER)) {
-			                   xmlNodePtr nw = NULL, cur, firstChild = NULL;
-			                   // We are copying here, make sure there is no abuse
-			                   ctxt->sizeentcopy += ent->length + 5;
-			                   if (xmlParserEntityCheck(ctxt, 0, ent, ctxt->sizeentcopy))
-			                       return;
-
-			                   // when operating on a reader, the entities definitions
-			                   // are always owning the entities subtree.
-			                   // if (ctxt->parseMode == XML_PARSE_READER)
-			                   //    ent->owner = 1;
-			                   cur = ent->children;
-			                   while (cur != NULL) {
-			                       nw = xmlDocCopyNode(cur, ctxt->myDoc, 1);
-			                       if (nw != NULL) {
-			                           if (nw->_private == NULL)
-			                               nw->_private = cur->_private;
-			                           if (firstChild == NULL){
-			                               firstChild = nw;
-			                           }
-			                           nw = xmlAddChild(ctxt->node, nw);
-			                       }
-			                       if (cur == ent->last) {
-			                           // needed to detect some strange empty
-			                           // node cases in the reader tests
-			                           if ((ctxt->parseMode == XML_PARSE_READER) &&
-			                               (nw != NULL) &&
-			                               (nw->type == XML_ELEMENT_NODE) &&
-			                               (nw->children == NULL))
-			                               nw->extra = 1;
-
-			                           break;
-			                       }
-			                       cur = cur->next;
-			                   }
-			               } else if ((list == NULL) || (ctxt->inputNr > 0)) {
-			                   xmlNodePtr nw = NULL, cur, next, last,
-			                              firstChild = NULL;
-
-			                   // We are copying here, make sure there is no abuse
-			                   ctxt->sizeentcopy += ent->length + 5;
-			                   if (xmlParserEntityCheck(ctxt, 0, ent, ctxt->sizeentcopy))
-			                       return;
-
-			                   // Copy the entity child list and make it the new
-			                   // entity child list. The goal is to make sure any
-			                   // ID or REF referenced will be the one from the
-			                   // document content and not the entity copy.
-			                   cur = ent->children;
-			                   ent->children = NULL;
-			                   last = ent->last;
-			                   ent->last = NULL;
-			                   while (cur != NULL) {
-			                       next = cur->next;
-			                       cur->next = NULL;
-			                       cur->parent = NULL;
-			                       nw = xmlDocCopyNode(cur, ctxt->myDoc, 1);
-			                       if (nw != NULL) {
-			                           if (nw->_private == NULL)
-			                               nw->_private = cur->_private;
-			                           if (firstChild == NULL){
-			                               firstChild = cur;
-			                           }
-			                           xmlAddChild((xmlNodePtr) ent, nw);
-			                           xmlAddChild(ctxt->node, cur);
-			                       }
-			                       if (cur == last)
-			                           break;
-			                       cur = next;
-			                   }
-			                   if (ent->owner == 0)
-			                       ent->owner = 1;
-			               } else {
-			                   const xmlChar *nbktext;
-			                   // the name change is to avoid coalescing of the
-			                   // node with a possible previous text one which
-			                   // would make ent->children a dangling pointer
-			                   nbktext = xmlDictLookup(ctxt->dict, BAD_CAST "nbktext",
-			                                           -1);
-			                   if (ent->children->type == XML_TEXT_NODE)
-			                       ent->children->name = nbktext;
-			                   if ((ent->last != ent->children) &&
-			                       (ent->last->type == XML_TEXT_NODE))
-			                       ent->last->name = nbktext;
-			                   xmlAddChildList(ctxt->node, ent->children);
-			               }
-
-			               // This is to avoid a nasty side effect, see
-			               // characters() in SAX.c
-			               ctxt->nodemem = 0;
-			               ctxt->nodelen = 0;
-			               return;
-			           }
-			       }
-		*/
 	}
 
-	return ErrUnimplemented{target: "parseReference"}
+	if s := ctx.sax; s != nil && !ctx.replaceEntities {
+		switch err := s.Reference(ctx.userData, ent.name); err {
+		case nil, sax.ErrHandlerUnspecified:
+			// no op
+		default:
+			return ctx.error(err)
+		}
+	}
+	return nil
 }
 
 func accumulateDecimalCharRef(val int32, c rune) (int32, error) {
@@ -4329,8 +4807,9 @@ func (ctx *parserCtx) parseStringEntityRef(s []byte) (sax.Entity, int, error) {
 	if len(s) == 0 || s[0] != '&' {
 		return nil, 0, errors.New("invalid entity ref")
 	}
+	s = s[1:]
 
-	i := 0
+	i := 1
 	name, width, err := parseStringName(s)
 	if err != nil {
 		return nil, 0, errors.New("failed to parse name")
@@ -4437,8 +4916,9 @@ func (ctx *parserCtx) parseStringPEReference(s []byte) (sax.Entity, int, error)
 	if len(s) == 0 || s[0] != '%' {
 		return nil, 0, errors.New("invalid PEreference")
 	}
+	s = s[1:]
 
-	i := 0
+	i := 1
 	name, width, err := parseStringName(s)
 	if err != nil {
 		return nil, 0, err
@@ -4645,7 +5125,7 @@ func (ctx *parserCtx) parseEntityRef() (ent *Entity, err error) {
 	// declared is a well-formedness constraint only if
 	// standalone='yes'.
 	if ent == nil {
-		if ctx.standalone == StandaloneExplicitYes || (!ctx.hasExternalSubset && ctx.hasPERefs) {
+		if ctx.standalone == StandaloneExplicitYes || (!ctx.hasExternalSubset && !ctx.hasPERefs) {
 			return nil, ctx.error(ErrUndeclaredEntity)
 		} else {
 			if ctx.inSubset == 0 {
@@ -4658,11 +5138,8 @@ func (ctx *parserCtx) parseEntityRef() (ent *Entity, err error) {
 					}
 				}
 			}
-			// ent is nil, no? why check?
-			if err := ctx.entityCheck(ent, 0, 0); err != nil {
-				return nil, ctx.error(err)
-			}
 			ctx.valid = false
+			return nil, nil
 		}
 	} else if ent.entityType == ExternalGeneralUnparsedEntity {
 		// [ WFC: Parsed Entity ]
@@ -4691,9 +5168,6 @@ func (ctx *parserCtx) parseEntityRef() (ent *Entity, err error) {
 		}
 	}
 
-	if ent == nil {
-		panic("at the end of parseEntityRef, ent == nil")
-	}
 	// [ WFC: No Recursion ]
 	// A parsed entity must not contain a recursive reference
 	// to itself, either directly or indirectly.
@@ -4701,33 +5175,89 @@ func (ctx *parserCtx) parseEntityRef() (ent *Entity, err error) {
 	return ent, nil
 }
 
+// entityStats tracks the expansion of entities during a parse, to
+// detect entity loops and amplification attacks
+type entityStats struct {
+	input    *countingReader // the document being parsed
+	external int64           // size of the external entities that were loaded
+	copied   int64           // size of the entity content that was expanded
+	count    int             // number of entity references that were expanded
+	huge     bool
+}
+
+// maxDepth returns the maximum nesting of entity references
+func (st *entityStats) maxDepth() int {
+	if st.huge {
+		return maxHugeEntityDepth
+	}
+	return maxEntityDepth
+}
+
 /* Function to check non-linear entity expansion behaviour
  * This is here to detect and stop exponential linear entity expansion
  * This is not a limitation of the parser but a safety
- * boundary feature. It can be disabled with the XML_PARSE_HUGE
+ * boundary feature. The limits are raised with the ParseHuge
  * parser option.
+ *
+ * entityCheck must be called each time the content of ent is expanded.
  */
-func (ctx *parserCtx) entityCheck(ent sax.Entity, size, replacement int) error {
-	return nil
-	/*
-	   size_t consumed = 0;
+func (ctx *parserCtx) entityCheck(ent sax.Entity) error {
+	if ent == nil || EntityType(ent.EntityType()) == InternalPredefinedEntity {
+		return nil
+	}
+	return ctx.entities.charge(len(ent.Content()))
+}
 
-	   if ((ctxt == NULL) || (ctxt->options & XML_PARSE_HUGE))
-	       return (0);
-	   if (ctxt->lastError.code == XML_ERR_ENTITY_LOOP)
-	       return (1);
-	*/
+// newValueEntityStats returns the stats for expanding the entities
+// referenced by a value that is not being parsed, such as the value
+// given to Element.SetAttribute. The value is the whole input.
+func newValueEntityStats(value string) *entityStats {
+	return &entityStats{input: &countingReader{n: int64(len(value))}}
+}
 
-	// This may look absurd but is needed to detect
-	// entities problems
-/*
-	if ent != nil && EntityType(ent.EntityType()) != InternalPredefinedEntity && ent.Content() != nil && !ent.Checked() {
-		rep, err := decodeEntities(ent.Content(), SubstituteRef)
-		if err != nil {
-			return ctx.error(err)
-		}
+// charge accounts for the expansion of size bytes of entity content,
+// and fails if too much has been expanded
+func (st *entityStats) charge(size int) error {
+	st.count++
+	st.copied += int64(size) + entityFixedCost
+
+	maxCount, threshold := maxEntityCount, int64(entityExpansionThreshold)
+	if st.huge {
+		maxCount, threshold = maxHugeEntityCount, hugeEntityExpansionThreshold
+	}
+	if st.count > maxCount {
+		return ErrEntityAmplification
 	}
 
+	consumed := st.input.n + st.external
+	if consumed < 1 {
+		consumed = 1
+	}
+	if st.copied > threshold && st.copied/consumed > maxEntityAmplification {
+		return ErrEntityAmplification
+	}
 	return nil
-*/
+}
+
+// maxLineNumber is the largest line number that is recorded on the
+// nodes without ParseBigLines, like libxml2 which stores them in 16 bits
+const maxLineNumber = 65535
+
+// position returns the current line and column
+func (ctx *parserCtx) position() (int, int) {
+	cur := ctx.cursor
+	if cur == nil {
+		return 0, 0
+	}
+	line := cur.LineNumber()
+	if line > maxLineNumber && !ctx.options.IsSet(ParseBigLines) {
+		line = maxLineNumber
+	}
+	return line, cur.Column()
+}
+
+// markPosition records the position where the node that is being
+// parsed starts, for the TreeBuilder
+func (ctx *parserCtx) markPosition() {
+	ctx.nodeLine, ctx.nodeColumn = ctx.position()
 }
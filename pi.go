@@ -4,6 +4,16 @@ func (p *ProcessingInstruction) Type() ElementType {
 	return ProcessingInstructionNode
 }
 
+// Target returns the target of the processing instruction
+func (p *ProcessingInstruction) Target() string {
+	return p.target
+}
+
+// Data returns the content of the processing instruction
+func (p *ProcessingInstruction) Data() string {
+	return p.data
+}
+
 func (p *ProcessingInstruction) AddChild(cur Node) error {
 	return addChild(p, cur)
 }
@@ -0,0 +1,228 @@
+package helium
+
+import (
+	"errors"
+	"io"
+
+	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/sax"
+)
+
+var (
+	ErrPushParserFinished = errors.New("push parser has already finished parsing")
+	ErrPushParserClosed   = errors.New("push parser has been closed")
+)
+
+// PushParser is an incremental parser, equivalent to libxml2's
+// xmlCreatePushParserCtxt/xmlParseChunk: the document is fed to the
+// parser chunk by chunk via Push(), and SAX events are emitted as soon
+// as they can be decided from the data received so far.
+//
+// Internally the same parserCtx that powers Parser.Parse is used: it
+// is run on a separate goroutine that reads from the pushed chunks, and
+// Push() blocks until the parser has consumed the chunk and needs more
+// input (or has finished). This means that all SAX callbacks for the
+// data in a chunk have been called by the time Push() returns.
+//
+// A PushParser is not safe for concurrent use. Parsing must always be
+// completed by calling Push with final set to true, or abandoned by
+// calling Close.
+type PushParser struct {
+	parser   *Parser
+	chunks   chan []byte
+	need     chan struct{}
+	done     chan struct{}
+	closed   chan struct{}
+	doc      *Document
+	err      error
+	started  bool
+	hungry   bool
+	finished bool
+}
+
+// pushReader is the io.Reader that the parser goroutine reads from.
+// Whenever it runs out of data, it notifies the PushParser and waits
+// for the next chunk.
+type pushReader struct {
+	chunks <-chan []byte
+	need   chan<- struct{}
+	closed <-chan struct{}
+	buf    []byte
+	eof    bool
+}
+
+func (r *pushReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		select {
+		case r.need <- struct{}{}:
+		case <-r.closed:
+			return 0, ErrPushParserClosed
+		}
+
+		select {
+		case chunk, ok := <-r.chunks:
+			if !ok {
+				r.eof = true
+				continue
+			}
+			r.buf = chunk
+		case <-r.closed:
+			return 0, ErrPushParserClosed
+		}
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// NewPushParser creates a new PushParser that emits events to the
+// given SAX handler. If the handler is nil, a TreeBuilder is used, and
+// the resulting document can be retrieved via Document() after the
+// final chunk has been pushed.
+func NewPushParser(s sax.SAX2Handler) *PushParser {
+	p := NewParser()
+	if s != nil {
+		p.SetSAXHandler(s)
+	}
+	return p.NewPushParser()
+}
+
+// NewPushParser creates a new PushParser that uses the same settings
+// as this parser.
+func (p *Parser) NewPushParser() *PushParser {
+	return &PushParser{
+		parser: p,
+		chunks: make(chan []byte),
+		need:   make(chan struct{}),
+		done:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+func (pp *PushParser) start() {
+	if pp.started {
+		return
+	}
+	pp.started = true
+
+	rdr := &pushReader{
+		chunks: pp.chunks,
+		need:   pp.need,
+		closed: pp.closed,
+	}
+	go func() {
+		defer close(pp.done)
+		pp.doc, pp.err = pp.parser.ParseReader(rdr)
+	}()
+}
+
+// waitForReader blocks until either the parser asks for more input,
+// in which case it returns true, or the parser is done.
+func (pp *PushParser) waitForReader() bool {
+	if pp.hungry {
+		return true
+	}
+
+	select {
+	case <-pp.need:
+		pp.hungry = true
+		return true
+	case <-pp.done:
+		return false
+	}
+}
+
+func (pp *PushParser) finish() error {
+	pp.finished = true
+	return pp.err
+}
+
+// Push feeds the next chunk of the document to the parser. Set final
+// to true when this is the last chunk (chunk may be empty in this case).
+// Any parse error encountered so far is returned.
+func (pp *PushParser) Push(chunk []byte, final bool) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START PushParser.Push (%d bytes, final = %t)", len(chunk), final)
+		defer g.IRelease("END PushParser.Push")
+	}
+
+	if pp.finished {
+		if pp.err != nil {
+			return pp.err
+		}
+		return ErrPushParserFinished
+	}
+
+	pp.start()
+
+	if len(chunk) > 0 {
+		if !pp.waitForReader() {
+			return pp.finish()
+		}
+
+		// The parser may hold on to the chunk after we return, so
+		// the caller should be free to reuse their buffer
+		buf := make([]byte, len(chunk))
+		copy(buf, chunk)
+		pp.hungry = false
+		pp.chunks <- buf
+
+		// Wait until the parser has processed everything that it
+		// could from this chunk
+		if !pp.waitForReader() {
+			return pp.finish()
+		}
+	}
+
+	if final {
+		if pp.waitForReader() {
+			pp.hungry = false
+			close(pp.chunks)
+		}
+		<-pp.done
+		return pp.finish()
+	}
+
+	return nil
+}
+
+// Document returns the document built by the TreeBuilder, once the
+// final chunk has been pushed. It returns nil if parsing has not
+// finished, or if the SAX handler does not build a document.
+func (pp *PushParser) Document() *Document {
+	if !pp.finished {
+		return nil
+	}
+	return pp.doc
+}
+
+// Close abandons parsing. If the final chunk has not been pushed yet,
+// the parser stops reading with ErrPushParserClosed, and Close waits
+// for it to exit. Calling Close after parsing has finished does
+// nothing.
+func (pp *PushParser) Close() error {
+	if debug.Enabled {
+		g := debug.IPrintf("START PushParser.Close")
+		defer g.IRelease("END PushParser.Close")
+	}
+
+	if pp.finished {
+		return nil
+	}
+	pp.finished = true
+	pp.err = ErrPushParserClosed
+
+	if !pp.started {
+		return nil
+	}
+	close(pp.closed)
+	<-pp.done
+	pp.doc = nil
+	pp.err = ErrPushParserClosed
+	return nil
+}
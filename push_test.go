@@ -0,0 +1,151 @@
+package helium
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lestrrat/helium/sax"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushParser(t *testing.T) {
+	const input = `<?xml version="1.0"?>
+<root foo="bar">
+  <!-- comment -->
+  <child>foo</child>
+  <child><![CDATA[bar]]></child>
+</root>`
+
+	expected, err := Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	expectedStr, err := expected.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+
+	for _, size := range []int{1, 3, 16, len(input)} {
+		pp := NewPushParser(nil)
+		b := []byte(input)
+		for len(b) > 0 {
+			n := size
+			if n > len(b) {
+				n = len(b)
+			}
+			if !assert.NoError(t, pp.Push(b[:n], false), "Push should succeed (chunk size = %d)", size) {
+				return
+			}
+			b = b[n:]
+		}
+		if !assert.NoError(t, pp.Push(nil, true), "final Push should succeed (chunk size = %d)", size) {
+			return
+		}
+
+		doc := pp.Document()
+		if !assert.NotNil(t, doc, "Document should be available") {
+			return
+		}
+		str, err := doc.XMLString()
+		if !assert.NoError(t, err, "XMLString should succeed") {
+			return
+		}
+		if !assert.Equal(t, expectedStr, str, "push parser builds the same document (chunk size = %d)", size) {
+			return
+		}
+
+		if !assert.Equal(t, ErrPushParserFinished, pp.Push([]byte("<foo/>"), true), "Push after finish fails") {
+			return
+		}
+	}
+}
+
+func TestPushParserEvents(t *testing.T) {
+	out := bytes.Buffer{}
+	s := sax.New()
+	s.StartElementNSHandler = func(_ sax.Context, localname, prefix, uri string, namespaces []sax.Namespace, attrs []sax.Attribute) error {
+		fmt.Fprintf(&out, "start(%s)", localname)
+		return nil
+	}
+	s.EndElementNSHandler = func(_ sax.Context, localname, prefix, uri string) error {
+		fmt.Fprintf(&out, "end(%s)", localname)
+		return nil
+	}
+
+	// Note: the parser needs a small amount of lookahead (for example,
+	// to tell "<![CDATA[" apart from a start tag), so events are only
+	// emitted once enough data is available to decide them.
+	pp := NewPushParser(s)
+	if !assert.NoError(t, pp.Push([]byte(`<?xml version="1.0"?><root><a>hello, world</a>`), false), "Push should succeed") {
+		return
+	}
+	if !assert.Contains(t, out.String(), "start(root)start(a)", "events for the first chunk have been emitted") {
+		return
+	}
+
+	if !assert.NoError(t, pp.Push([]byte(`<b>hello, world</b><c/>`), false), "Push should succeed") {
+		return
+	}
+	if !assert.Contains(t, out.String(), "start(root)start(a)end(a)start(b)end(b)", "events for the second chunk have been emitted") {
+		return
+	}
+
+	if !assert.NoError(t, pp.Push([]byte(`</root>`), true), "Push should succeed") {
+		return
+	}
+	if !assert.Equal(t, "start(root)start(a)end(a)start(b)end(b)start(c)end(c)end(root)", out.String(), "all events have been emitted") {
+		return
+	}
+}
+
+func TestPushParserError(t *testing.T) {
+	pp := NewPushParser(nil)
+	if !assert.NoError(t, pp.Push([]byte(`<?xml version="1.0"?><root>`), false), "Push should succeed") {
+		return
+	}
+
+	err := pp.Push([]byte(`</toor>`), false)
+	if err == nil {
+		err = pp.Push(nil, true)
+	}
+	if !assert.Error(t, err, "Push should report the parse error") {
+		return
+	}
+	if !assert.Nil(t, pp.Document(), "no document is available") {
+		return
+	}
+}
+
+func TestPushParserClose(t *testing.T) {
+	pp := NewPushParser(nil)
+	if !assert.NoError(t, pp.Push([]byte(`<?xml version="1.0"?><root><a>`), false), "Push should succeed") {
+		return
+	}
+	if !assert.NoError(t, pp.Close(), "Close should succeed") {
+		return
+	}
+
+	select {
+	case <-pp.done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("parser goroutine should exit after Close")
+		return
+	}
+
+	if !assert.Equal(t, ErrPushParserClosed, pp.Push([]byte(`</a></root>`), true), "Push after Close fails") {
+		return
+	}
+	if !assert.Nil(t, pp.Document(), "no document is available") {
+		return
+	}
+	if !assert.NoError(t, pp.Close(), "Close can be called again") {
+		return
+	}
+
+	// closing a parser that has not started does not leak either
+	if !assert.NoError(t, NewPushParser(nil).Close(), "Close should succeed") {
+		return
+	}
+}
@@ -0,0 +1,724 @@
+package helium
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/sax"
+)
+
+// ReaderNodeType is the type of the node that the Reader is positioned
+// on. The values are the same as libxml2's xmlReaderTypes
+type ReaderNodeType int
+
+const (
+	ReaderTypeNone ReaderNodeType = iota
+	ReaderTypeElement
+	ReaderTypeAttribute
+	ReaderTypeText
+	ReaderTypeCDATA
+	ReaderTypeEntityReference
+	ReaderTypeEntity
+	ReaderTypeProcessingInstruction
+	ReaderTypeComment
+	ReaderTypeDocument
+	ReaderTypeDocumentType
+	ReaderTypeDocumentFragment
+	ReaderTypeNotation
+	ReaderTypeWhitespace
+	ReaderTypeSignificantWhitespace
+	ReaderTypeEndElement
+	ReaderTypeEndEntity
+	ReaderTypeXMLDeclaration
+)
+
+var errReaderClosed = errors.New("reader has been closed")
+
+const xmlnsNamespace = "http://www.w3.org/2000/xmlns/"
+
+// Reader is a pull parser, equivalent to libxml2's xmlTextReader.
+// Each call to Read() moves the cursor to the next node in document
+// order, and the accessor methods report on the current node.
+//
+// The nodes are built using the same TreeBuilder that Parse uses,
+// but nodes that the cursor has moved past are detached from the
+// tree, so that huge documents can be walked in constant memory.
+// Because of this, nodes obtained via Expand() are only guaranteed to
+// be intact until the next call to Read().
+//
+// Internally the parser runs on a separate goroutine, which is only
+// allowed to proceed while the Reader is waiting for the next node.
+// Call Close() if you stop reading before the end of the document.
+//
+// As the tree is never complete, ParseDTDValid is not supported.
+type Reader struct {
+	parser   *Parser
+	builder  *readerBuilder
+	events   chan readerEvent
+	resume   chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	in       io.Reader
+	err      error
+	queue    []readerEvent
+	cur      readerEvent
+	attrs    []readerAttr
+	attrIdx  int
+	level    int
+	depth    int
+	started  bool
+	finished bool
+	eof      bool
+}
+
+type readerEvent struct {
+	kind  ReaderNodeType
+	node  Node
+	empty bool
+}
+
+// readerAttr represents an attribute or a namespace declaration
+// of the current element
+type readerAttr struct {
+	node   *Attribute // nil for namespace declarations
+	prefix string
+	local  string
+	uri    string
+	value  string
+}
+
+func (a readerAttr) name() string {
+	if a.prefix != "" {
+		return a.prefix + ":" + a.local
+	}
+	return a.local
+}
+
+// readerBuilder is a TreeBuilder that notifies the Reader every time
+// a node has been added to the tree, and waits for the Reader to ask
+// for the next node before it continues.
+type readerBuilder struct {
+	*TreeBuilder
+	events chan<- readerEvent
+	resume <-chan struct{}
+	quit   <-chan struct{}
+	empty  *Element
+}
+
+// NewReader creates a new Reader that reads the document from the
+// given io.Reader, with the default options. Use Parser.NewReader to
+// set options, limits or an EntityLoader.
+func NewReader(in io.Reader) *Reader {
+	return NewParser().NewReader(in)
+}
+
+// NewReader creates a new Reader that reads the document from the
+// given io.Reader, with the settings of this parser. The SAX handler
+// of the parser is not used, and later changes to the parser do not
+// affect the Reader.
+func (p *Parser) NewReader(in io.Reader) *Reader {
+	parser := *p
+	return &Reader{
+		parser:  &parser,
+		in:      in,
+		events:  make(chan readerEvent),
+		resume:  make(chan struct{}),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		attrIdx: -1,
+	}
+}
+
+func (b *readerBuilder) emit(ev readerEvent) error {
+	select {
+	case b.events <- ev:
+	case <-b.quit:
+		return errReaderClosed
+	}
+
+	select {
+	case <-b.resume:
+		return nil
+	case <-b.quit:
+		return errReaderClosed
+	}
+}
+
+// lastNode returns the node that was most recently added to the tree
+func lastNode(ctx *parserCtx) Node {
+	if e := ctx.elem; e != nil {
+		return e.LastChild()
+	}
+	return ctx.doc.LastChild()
+}
+
+func (b *readerBuilder) StartElementNS(ctxif sax.Context, localname, prefix, uri string, namespaces []sax.Namespace, attrs []sax.Attribute) error {
+	if err := b.TreeBuilder.StartElementNS(ctxif, localname, prefix, uri, namespaces, attrs); err != nil {
+		return err
+	}
+
+	ctx := ctxif.(*parserCtx)
+	e := ctx.elem
+
+	// empty elements are reported when the parser is done with them,
+	// so that the Reader does not release them too early
+	if ctx.emptyElement {
+		b.empty = e
+		return nil
+	}
+	return b.emit(readerEvent{kind: ReaderTypeElement, node: e})
+}
+
+func (b *readerBuilder) EndElementNS(ctxif sax.Context, localname, prefix, uri string) error {
+	ctx := ctxif.(*parserCtx)
+	e := ctx.elem
+	if err := b.TreeBuilder.EndElementNS(ctxif, localname, prefix, uri); err != nil {
+		return err
+	}
+
+	// empty elements do not get an EndElement node
+	if b.empty != nil && b.empty == e {
+		b.empty = nil
+		return b.emit(readerEvent{kind: ReaderTypeElement, node: e, empty: true})
+	}
+	return b.emit(readerEvent{kind: ReaderTypeEndElement, node: e})
+}
+
+func (b *readerBuilder) Characters(ctxif sax.Context, data []byte) error {
+	if err := b.TreeBuilder.Characters(ctxif, data); err != nil {
+		return err
+	}
+	return b.emit(readerEvent{kind: ReaderTypeText, node: lastNode(ctxif.(*parserCtx))})
+}
+
+func (b *readerBuilder) CDataBlock(ctxif sax.Context, data []byte) error {
+	if err := b.TreeBuilder.CDataBlock(ctxif, data); err != nil {
+		return err
+	}
+	return b.emit(readerEvent{kind: ReaderTypeCDATA, node: lastNode(ctxif.(*parserCtx))})
+}
+
+func (b *readerBuilder) IgnorableWhitespace(ctxif sax.Context, data []byte) error {
+	ctx := ctxif.(*parserCtx)
+	if !ctx.keepBlanks {
+		return nil
+	}
+	return b.Characters(ctxif, data)
+}
+
+func (b *readerBuilder) Comment(ctxif sax.Context, data []byte) error {
+	ctx := ctxif.(*parserCtx)
+	if ctx.inSubset != 0 {
+		return nil
+	}
+
+	if err := b.TreeBuilder.Comment(ctxif, data); err != nil {
+		return err
+	}
+	return b.emit(readerEvent{kind: ReaderTypeComment, node: lastNode(ctx)})
+}
+
+func (b *readerBuilder) ProcessingInstruction(ctxif sax.Context, target, data string) error {
+	ctx := ctxif.(*parserCtx)
+	if ctx.inSubset != 0 {
+		return nil
+	}
+
+	if err := b.TreeBuilder.ProcessingInstruction(ctxif, target, data); err != nil {
+		return err
+	}
+	return b.emit(readerEvent{kind: ReaderTypeProcessingInstruction, node: lastNode(ctx)})
+}
+
+func (b *readerBuilder) Reference(ctxif sax.Context, name string) error {
+	if err := b.TreeBuilder.Reference(ctxif, name); err != nil {
+		return err
+	}
+	return b.emit(readerEvent{kind: ReaderTypeEntityReference, node: lastNode(ctxif.(*parserCtx))})
+}
+
+func (b *readerBuilder) InternalSubset(ctxif sax.Context, name, eid, uri string) error {
+	if err := b.TreeBuilder.InternalSubset(ctxif, name, eid, uri); err != nil {
+		return err
+	}
+	return b.emit(readerEvent{kind: ReaderTypeDocumentType, node: ctxif.(*parserCtx).doc.IntSubset()})
+}
+
+func (r *Reader) start() {
+	r.started = true
+
+	// the nodes are detached as the cursor moves on, so there is never
+	// a complete tree to validate
+	if r.parser.Options().IsSet(ParseDTDValid) {
+		r.err = ErrDTDValidWithoutTree
+		close(r.done)
+		return
+	}
+
+	r.builder = &readerBuilder{
+		TreeBuilder: NewTreeBuilder(),
+		events:      r.events,
+		resume:      r.resume,
+		quit:        r.quit,
+	}
+	r.parser.SetSAXHandler(r.builder)
+
+	go func() {
+		defer close(r.done)
+		if _, err := r.parser.ParseReader(r.in); err != nil {
+			r.err = err
+		}
+	}()
+}
+
+// fill lets the parser run until it produces the next node, and
+// appends it to the queue. It returns false if there are no more nodes.
+func (r *Reader) fill() bool {
+	if r.finished {
+		return false
+	}
+
+	if !r.started {
+		r.start()
+	} else {
+		r.resume <- struct{}{}
+	}
+
+	select {
+	case ev := <-r.events:
+		r.queue = append(r.queue, ev)
+		return true
+	case <-r.done:
+		r.finished = true
+		return false
+	}
+}
+
+// release detaches the current node from the tree, if the cursor is
+// done with it
+func (r *Reader) release() {
+	n := r.cur.node
+	if n == nil || n.Parent() == nil {
+		return
+	}
+
+	switch r.cur.kind {
+	case ReaderTypeElement:
+		if !r.cur.empty {
+			return
+		}
+	case ReaderTypeDocumentType:
+		return
+	}
+	unlinkNode(n)
+}
+
+// Read moves the cursor to the next node. It returns false when there
+// are no more nodes, along with an error if the document could not be
+// parsed.
+func (r *Reader) Read() (bool, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START Reader.Read")
+		defer g.IRelease("END Reader.Read")
+	}
+
+	if r.eof {
+		return false, r.err
+	}
+
+	r.release()
+	r.attrs = nil
+	r.attrIdx = -1
+
+	if len(r.queue) == 0 && !r.fill() {
+		r.eof = true
+		r.cur = readerEvent{}
+		return false, r.err
+	}
+
+	ev := r.queue[0]
+	r.queue = r.queue[1:]
+
+	// text may be delivered in several chunks, but they all end
+	// up in the same node. Only report it once.
+	if ev.kind == ReaderTypeText {
+		for {
+			if len(r.queue) == 0 && !r.fill() {
+				break
+			}
+			if next := r.queue[0]; next.kind != ReaderTypeText || next.node != ev.node {
+				break
+			}
+			r.queue = r.queue[1:]
+		}
+	}
+
+	switch ev.kind {
+	case ReaderTypeElement:
+		r.depth = r.level
+		if !ev.empty {
+			r.level++
+		}
+	case ReaderTypeEndElement:
+		r.level--
+		r.depth = r.level
+	default:
+		r.depth = r.level
+	}
+	r.cur = ev
+
+	return true, nil
+}
+
+// Close stops the parser. It must be called if the document is not
+// read until the end.
+func (r *Reader) Close() error {
+	if r.started && !r.finished {
+		close(r.quit)
+		<-r.done
+		r.finished = true
+	}
+	r.eof = true
+	r.queue = nil
+	r.cur = readerEvent{}
+	return nil
+}
+
+func (r *Reader) attr() *readerAttr {
+	if r.attrIdx < 0 || r.attrIdx >= len(r.attrs) {
+		return nil
+	}
+	return &r.attrs[r.attrIdx]
+}
+
+// NodeType returns the type of the current node
+func (r *Reader) NodeType() ReaderNodeType {
+	if r.attr() != nil {
+		return ReaderTypeAttribute
+	}
+
+	if r.cur.kind == ReaderTypeText && isBlankText(r.cur.node.Content()) {
+		if spacePreserved(r.cur.node.Parent()) {
+			return ReaderTypeSignificantWhitespace
+		}
+		return ReaderTypeWhitespace
+	}
+	return r.cur.kind
+}
+
+// Name returns the qualified name of the current node
+func (r *Reader) Name() string {
+	if a := r.attr(); a != nil {
+		return a.name()
+	}
+
+	switch r.cur.kind {
+	case ReaderTypeNone:
+		return ""
+	case ReaderTypeText:
+		return "#text"
+	case ReaderTypeCDATA:
+		return "#cdata-section"
+	case ReaderTypeComment:
+		return "#comment"
+	}
+	return r.cur.node.Name()
+}
+
+// LocalName returns the local name of the current node
+func (r *Reader) LocalName() string {
+	if a := r.attr(); a != nil {
+		return a.local
+	}
+
+	switch r.cur.kind {
+	case ReaderTypeElement, ReaderTypeEndElement:
+		return r.cur.node.(*Element).LocalName()
+	}
+	return r.Name()
+}
+
+// Prefix returns the namespace prefix of the current node
+func (r *Reader) Prefix() string {
+	if a := r.attr(); a != nil {
+		return a.prefix
+	}
+
+	switch r.cur.kind {
+	case ReaderTypeElement, ReaderTypeEndElement:
+		return r.cur.node.(*Element).Prefix()
+	}
+	return ""
+}
+
+// NamespaceURI returns the namespace URI of the current node
+func (r *Reader) NamespaceURI() string {
+	if a := r.attr(); a != nil {
+		return a.uri
+	}
+
+	switch r.cur.kind {
+	case ReaderTypeElement, ReaderTypeEndElement:
+		return r.cur.node.(*Element).URI()
+	}
+	return ""
+}
+
+// Value returns the text value of the current node
+func (r *Reader) Value() string {
+	if a := r.attr(); a != nil {
+		return a.value
+	}
+
+	switch r.cur.kind {
+	case ReaderTypeText, ReaderTypeCDATA, ReaderTypeComment:
+		return string(r.cur.node.Content())
+	case ReaderTypeProcessingInstruction:
+		return r.cur.node.(*ProcessingInstruction).Data()
+	}
+	return ""
+}
+
+// Depth returns the depth of the current node in the tree
+func (r *Reader) Depth() int {
+	if r.attr() != nil {
+		return r.depth + 1
+	}
+	return r.depth
+}
+
+// IsEmptyElement returns true if the current node is an empty
+// element, such as <foo/>
+func (r *Reader) IsEmptyElement() bool {
+	return r.attr() == nil && r.cur.kind == ReaderTypeElement && r.cur.empty
+}
+
+func (r *Reader) loadAttributes() {
+	if r.attrs != nil || r.cur.kind != ReaderTypeElement {
+		return
+	}
+
+	e := r.cur.node.(*Element)
+	r.attrs = []readerAttr{}
+	for _, ns := range e.Namespaces() {
+		a := readerAttr{uri: xmlnsNamespace, value: ns.URI()}
+		if ns.Prefix() == "" {
+			a.local = XMLNsPrefix
+		} else {
+			a.prefix = XMLNsPrefix
+			a.local = ns.Prefix()
+		}
+		r.attrs = append(r.attrs, a)
+	}
+
+	for _, attr := range e.Attributes() {
+		a := readerAttr{node: attr, value: attr.Value()}
+		if i := strings.IndexByte(attr.Name(), ':'); i > -1 {
+			a.prefix = attr.Name()[:i]
+			a.local = attr.Name()[i+1:]
+			a.uri = lookupNamespaceURI(e, a.prefix)
+		} else {
+			a.local = attr.Name()
+		}
+		r.attrs = append(r.attrs, a)
+	}
+}
+
+// AttributeCount returns the number of attributes (including namespace
+// declarations) of the current node
+func (r *Reader) AttributeCount() int {
+	r.loadAttributes()
+	return len(r.attrs)
+}
+
+// GetAttribute returns the value of the attribute with the given
+// qualified name. The second return value is false if there is no such
+// attribute.
+func (r *Reader) GetAttribute(name string) (string, bool) {
+	r.loadAttributes()
+	for _, a := range r.attrs {
+		if a.name() == name {
+			return a.value, true
+		}
+	}
+	return "", false
+}
+
+// MoveToAttribute moves the cursor to the attribute with the given
+// qualified name. It returns false if there is no such attribute.
+func (r *Reader) MoveToAttribute(name string) bool {
+	r.loadAttributes()
+	for i, a := range r.attrs {
+		if a.name() == name {
+			r.attrIdx = i
+			return true
+		}
+	}
+	return false
+}
+
+// MoveToFirstAttribute moves the cursor to the first attribute of
+// the current element
+func (r *Reader) MoveToFirstAttribute() bool {
+	r.loadAttributes()
+	if len(r.attrs) == 0 {
+		return false
+	}
+	r.attrIdx = 0
+	return true
+}
+
+// MoveToNextAttribute moves the cursor to the next attribute of
+// the current element
+func (r *Reader) MoveToNextAttribute() bool {
+	if r.attrIdx < 0 {
+		return r.MoveToFirstAttribute()
+	}
+	if r.attrIdx+1 >= len(r.attrs) {
+		return false
+	}
+	r.attrIdx++
+	return true
+}
+
+// MoveToElement moves the cursor from an attribute back to the
+// element that owns it
+func (r *Reader) MoveToElement() bool {
+	if r.attrIdx < 0 {
+		return false
+	}
+	r.attrIdx = -1
+	return true
+}
+
+// Expand reads the entire subtree of the current node, and returns it.
+// The returned nodes are only valid until the next call to Read().
+func (r *Reader) Expand() (Node, error) {
+	if a := r.attr(); a != nil {
+		if a.node == nil {
+			return nil, ErrInvalidOperation
+		}
+		return a.node, nil
+	}
+
+	if r.cur.node == nil {
+		return nil, ErrNilNode
+	}
+
+	if r.cur.kind == ReaderTypeElement && !r.cur.empty {
+		for i := 0; ; i++ {
+			if i >= len(r.queue) && !r.fill() {
+				if r.err != nil {
+					return nil, r.err
+				}
+				return nil, ErrPrematureEOF
+			}
+			if ev := r.queue[i]; ev.kind == ReaderTypeEndElement && ev.node == r.cur.node {
+				break
+			}
+		}
+	}
+	return r.cur.node, nil
+}
+
+// ReadInnerXML returns the XML representation of the contents of the
+// current node, excluding the node itself
+func (r *Reader) ReadInnerXML() (string, error) {
+	if a := r.attr(); a != nil {
+		return a.value, nil
+	}
+
+	n, err := r.Expand()
+	if err != nil {
+		return "", err
+	}
+
+	if n.Type() != ElementNode {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	var d Dumper
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if err := d.DumpNode(&buf, c); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// ReadOuterXML returns the XML representation of the current node,
+// including its contents
+func (r *Reader) ReadOuterXML() (string, error) {
+	var buf bytes.Buffer
+	if a := r.attr(); a != nil {
+		buf.WriteString(a.name())
+		buf.WriteString(`="`)
+		if err := escapeAttrValue(&buf, []byte(a.value)); err != nil {
+			return "", err
+		}
+		buf.WriteByte('"')
+		return buf.String(), nil
+	}
+
+	n, err := r.Expand()
+	if err != nil {
+		return "", err
+	}
+
+	var d Dumper
+	if err := d.DumpNode(&buf, n); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func isBlankText(b []byte) bool {
+	for _, c := range b {
+		if !isBlankCh(rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// spacePreserved returns true if xml:space="preserve" is in effect
+// for the given node
+func spacePreserved(n Node) bool {
+	for ; n != nil; n = n.Parent() {
+		e, ok := n.(*Element)
+		if !ok {
+			continue
+		}
+		for _, attr := range e.Attributes() {
+			if attr.Name() == "xml:space" {
+				return attr.Value() == "preserve"
+			}
+		}
+	}
+	return false
+}
+
+// lookupNamespaceURI finds the namespace URI that the prefix is bound
+// to in the scope of the given node
+func lookupNamespaceURI(n Node, prefix string) string {
+	if prefix == XMLPrefix {
+		return XMLNamespace
+	}
+
+	for ; n != nil; n = n.Parent() {
+		nc, ok := n.(NamespaceContainer)
+		if !ok {
+			continue
+		}
+		for _, ns := range nc.Namespaces() {
+			if ns.Prefix() == prefix {
+				return ns.URI()
+			}
+		}
+	}
+	return ""
+}
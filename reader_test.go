@@ -0,0 +1,259 @@
+package helium
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader(t *testing.T) {
+	const input = `<?xml version="1.0"?>
+<!DOCTYPE root>
+<root xmlns:x="http://example.com/x" a="1" x:b="2">
+  <!-- comment -->
+  <child>foo</child>
+  <?pi data?>
+  <x:empty/>
+  <pre xml:space="preserve"> </pre>
+</root>`
+
+	r := NewReader(strings.NewReader(input))
+	defer r.Close()
+
+	var out bytes.Buffer
+	for {
+		ok, err := r.Read()
+		if !assert.NoError(t, err, "Read should succeed") {
+			return
+		}
+		if !ok {
+			break
+		}
+		fmt.Fprintf(&out, "%d %d %s %q %t\n", r.Depth(), r.NodeType(), r.Name(), r.Value(), r.IsEmptyElement())
+	}
+
+	const expected = `0 10 root "" false
+0 1 root "" false
+1 13 #text "\n  " false
+1 8 #comment " comment " false
+1 13 #text "\n  " false
+1 1 child "" false
+2 3 #text "foo" false
+1 15 child "" false
+1 13 #text "\n  " false
+1 7 pi "data" false
+1 13 #text "\n  " false
+1 1 x:empty "" true
+1 13 #text "\n  " false
+1 1 pre "" false
+2 14 #text " " false
+1 15 pre "" false
+1 13 #text "\n" false
+0 15 root "" false
+`
+	if !assert.Equal(t, expected, out.String(), "nodes are reported in document order") {
+		return
+	}
+
+	ok, err := r.Read()
+	if !assert.False(t, ok, "Read after the end returns false") || !assert.NoError(t, err, "Read after the end succeeds") {
+		return
+	}
+}
+
+func TestReaderAttributes(t *testing.T) {
+	const input = `<root xmlns="http://example.com/" xmlns:x="http://example.com/x" a="1" x:b="2"/>`
+
+	r := NewReader(strings.NewReader(input))
+	defer r.Close()
+
+	if ok, err := r.Read(); !assert.True(t, ok, "Read should succeed") || !assert.NoError(t, err, "Read should succeed") {
+		return
+	}
+
+	if !assert.Equal(t, "root", r.LocalName(), "LocalName matches") ||
+		!assert.Equal(t, "http://example.com/", r.NamespaceURI(), "NamespaceURI matches") ||
+		!assert.Equal(t, 4, r.AttributeCount(), "AttributeCount matches") {
+		return
+	}
+
+	if v, ok := r.GetAttribute("a"); !assert.True(t, ok, "GetAttribute should succeed") || !assert.Equal(t, "1", v, "attribute value matches") {
+		return
+	}
+
+	if !assert.True(t, r.MoveToAttribute("x:b"), "MoveToAttribute should succeed") {
+		return
+	}
+	if !assert.Equal(t, ReaderTypeAttribute, r.NodeType(), "NodeType is attribute") ||
+		!assert.Equal(t, "x:b", r.Name(), "Name matches") ||
+		!assert.Equal(t, "b", r.LocalName(), "LocalName matches") ||
+		!assert.Equal(t, "x", r.Prefix(), "Prefix matches") ||
+		!assert.Equal(t, "http://example.com/x", r.NamespaceURI(), "NamespaceURI matches") ||
+		!assert.Equal(t, "2", r.Value(), "Value matches") ||
+		!assert.Equal(t, 1, r.Depth(), "Depth matches") {
+		return
+	}
+
+	if !assert.False(t, r.MoveToAttribute("nope"), "MoveToAttribute fails for unknown attributes") {
+		return
+	}
+
+	var names []string
+	for ok := r.MoveToFirstAttribute(); ok; ok = r.MoveToNextAttribute() {
+		names = append(names, r.Name()+"="+r.NamespaceURI())
+	}
+	if !assert.Equal(t, []string{"xmlns=" + xmlnsNamespace, "xmlns:x=" + xmlnsNamespace, "a=", "x:b=http://example.com/x"}, names, "attributes are listed in order") {
+		return
+	}
+
+	if !assert.True(t, r.MoveToElement(), "MoveToElement should succeed") || !assert.Equal(t, ReaderTypeElement, r.NodeType(), "NodeType is element") {
+		return
+	}
+}
+
+func TestReaderExpand(t *testing.T) {
+	const input = `<root><a x="1"><b>hello</b><c/></a><d>world</d></root>`
+
+	r := NewReader(strings.NewReader(input))
+	defer r.Close()
+
+	for {
+		ok, err := r.Read()
+		if !assert.NoError(t, err, "Read should succeed") || !assert.True(t, ok, "element a should be found") {
+			return
+		}
+		if r.NodeType() == ReaderTypeElement && r.Name() == "a" {
+			break
+		}
+	}
+
+	inner, err := r.ReadInnerXML()
+	if !assert.NoError(t, err, "ReadInnerXML should succeed") || !assert.Equal(t, `<b>hello</b><c/>`, inner, "inner XML matches") {
+		return
+	}
+
+	outer, err := r.ReadOuterXML()
+	if !assert.NoError(t, err, "ReadOuterXML should succeed") || !assert.Equal(t, `<a x="1"><b>hello</b><c/></a>`, outer, "outer XML matches") {
+		return
+	}
+
+	n, err := r.Expand()
+	if !assert.NoError(t, err, "Expand should succeed") || !assert.Equal(t, "a", n.Name(), "Expand returns the current node") {
+		return
+	}
+
+	// Reading continues from inside the expanded subtree
+	var names []string
+	for {
+		ok, err := r.Read()
+		if !assert.NoError(t, err, "Read should succeed") {
+			return
+		}
+		if !ok {
+			break
+		}
+		if r.NodeType() == ReaderTypeElement {
+			names = append(names, r.Name())
+		}
+	}
+	if !assert.Equal(t, []string{"b", "c", "d"}, names, "elements after Expand are still reported") {
+		return
+	}
+}
+
+func TestReaderLargeDocument(t *testing.T) {
+	const count = 10000
+
+	r := NewReader(&itemStream{count: count})
+	defer r.Close()
+
+	items := 0
+	for {
+		ok, err := r.Read()
+		if !assert.NoError(t, err, "Read should succeed") {
+			return
+		}
+		if !ok {
+			break
+		}
+		if r.NodeType() != ReaderTypeElement || r.Name() != "item" {
+			continue
+		}
+		items++
+
+		// nodes that have already been read are released, so the
+		// current item is always the only child of root
+		if n := r.cur.node; !assert.Nil(t, n.PrevSibling(), "previous items have been released") {
+			return
+		}
+	}
+
+	if !assert.Equal(t, count, items, "number of items matches") {
+		return
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	r := NewReader(strings.NewReader(`<root><a></b></root>`))
+	defer r.Close()
+
+	var err error
+	for {
+		var ok bool
+		ok, err = r.Read()
+		if !ok {
+			break
+		}
+	}
+	if !assert.Error(t, err, "Read should fail for a mismatched end tag") {
+		return
+	}
+}
+
+func TestReaderClose(t *testing.T) {
+	r := NewReader(&itemStream{count: 100})
+	if ok, err := r.Read(); !assert.True(t, ok, "Read should succeed") || !assert.NoError(t, err, "Read should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, r.Close(), "Close should succeed") {
+		return
+	}
+
+	if ok, _ := r.Read(); !assert.False(t, ok, "Read after Close returns false") {
+		return
+	}
+}
+
+func TestReaderNoEnt(t *testing.T) {
+	const input = `<!DOCTYPE root [<!ENTITY e "<b>text</b><c/>">]><root>&e;</root>`
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseNoEnt), "SetOption should succeed") {
+		return
+	}
+	r := p.NewReader(strings.NewReader(input))
+	defer r.Close()
+
+	var names []string
+	for {
+		ok, err := r.Read()
+		if !assert.NoError(t, err, "Read should succeed") {
+			return
+		}
+		if !ok {
+			break
+		}
+		if r.NodeType() != ReaderTypeDocumentType {
+			names = append(names, fmt.Sprintf("%d %s", r.NodeType(), r.Name()))
+		}
+	}
+
+	expected := []string{"1 root", "1 b", "3 #text", "15 b", "1 c", "15 root"}
+	if !assert.Equal(t, expected, names, "the content of the entity is read") {
+		return
+	}
+}
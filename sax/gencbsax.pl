@@ -78,7 +78,7 @@ foreach my $func (@handler_funcs) {
         join ", ",
             map { $_ eq "error" ? "ErrHandlerUnspecified" : $_ eq "bool" ? "false" : "nil" }
             split /\s*,\s*/, $ret =~ s{\(([^\)]+)\)}{$1}r;
-    my $bare_args = join ", ", map { (split /\s+/, $_)[0] } split /\s*,\s*/, $args;
+    my $bare_args = join ", ", map { my ($name, $type) = split /\s+/, $_; $type =~ /^\.\.\./ ? "$name..." : $name } split /\s*,\s*/, $args;
     print $out <<EOM
 func (s $klass) $func($args) $ret {
 \tif h := s.${func}Handler; h != nil {
@@ -1,15 +1,40 @@
 package sax
 
+import "io"
+
 // Context is always passed as the first argument to SAX handlers.
 // It is intentionally left as an opaque value so applications can
 // use type assertions to pass whatever object they need to pass.
 type Context interface{}
 
-// TODO fix Context
-type DocumentLocator interface{}
+// DocumentLocator is handed to SetDocumentLocator at the start of the
+// document. While the other events are being delivered, it reports the
+// position of the parser in the entity that is being parsed.
+type DocumentLocator interface {
+	// LineNumber returns the current line, starting at 1
+	LineNumber() int
+	// ColumnNumber returns the current column, starting at 1
+	ColumnNumber() int
+	// PublicID returns the public identifier of the current entity,
+	// if it has one
+	PublicID() string
+	// SystemID returns the URI of the current entity, if known
+	SystemID() string
+}
 
-// TODO
-type ParseInput interface{}
+// ParseInput is the content of an external entity, as returned
+// by ResolveEntity.
+type ParseInput struct {
+	io.Reader
+
+	// URI is the location of the input. It is used as the base URI
+	// to resolve the relative references found in the entity.
+	URI string
+
+	// Encoding is the encoding of the input. If empty, it is detected
+	// from the byte order mark and the text declaration.
+	Encoding string
+}
 
 // TODO fix Context
 type Entity interface {
@@ -74,9 +99,10 @@ type ReferenceFunc func(ctx Context, name string) error
  *
  * Returns the xmlParserInputPtr if inlined or NULL for DOM behaviour.
  */
-type ResolveEntityFunc func(ctx Context, publicID string, systemID string) (ParseInput, error)
+type ResolveEntityFunc func(ctx Context, publicID string, systemID string) (*ParseInput, error)
 type SetDocumentLocatorFunc func(ctx Context, locator DocumentLocator) error
 type StartDocumentFunc func(ctx Context) error
 type StartElementNSFunc func(ctx Context, localname string, prefix string, uri string, namespaces []Namespace, attrs []Attribute) error
 type UnparsedEntityDeclFunc func(ctx Context, name string, publicID string, systemID string, notationName string) error
 
+type WarningFunc func(ctx Context, message string, args ...interface{}) error
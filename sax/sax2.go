@@ -31,11 +31,12 @@ type SAX2Handler interface {
 	NotationDecl(ctx Context, name string, publicID string, systemID string) error
 	ProcessingInstruction(ctx Context, target string, data string) error
 	Reference(ctx Context, name string) error
-	ResolveEntity(ctx Context, publicID string, systemID string) (ParseInput, error)
+	ResolveEntity(ctx Context, publicID string, systemID string) (*ParseInput, error)
 	SetDocumentLocator(ctx Context, locator DocumentLocator) error
 	StartDocument(ctx Context) error
 	StartElementNS(ctx Context, localname string, prefix string, uri string, namespaces []Namespace, attrs []Attribute) error
 	UnparsedEntityDecl(ctx Context, name string, publicID string, systemID string, notationName string) error
+	Warning(ctx Context, message string, args ...interface{}) error
 }
 
 // SAX2 is the callback based SAX2 handler.
@@ -65,6 +66,7 @@ type SAX2 struct {
 	StartDocumentHandler StartDocumentFunc
 	StartElementNSHandler StartElementNSFunc
 	UnparsedEntityDeclHandler UnparsedEntityDeclFunc
+	WarningHandler WarningFunc
 }
 
 // New creates a new instance of SAX2. All callbacks are
@@ -131,7 +133,7 @@ func (s SAX2) EntityDecl(ctx Context, name string, typ int, publicID string, sys
 
 func (s SAX2) Error(ctx Context, message string, args ...interface{}) error {
 	if h := s.ErrorHandler; h != nil {
-		return h(ctx, message, args)
+		return h(ctx, message, args...)
 	}
 	return ErrHandlerUnspecified;
 }
@@ -213,7 +215,7 @@ func (s SAX2) Reference(ctx Context, name string) error {
 	return ErrHandlerUnspecified;
 }
 
-func (s SAX2) ResolveEntity(ctx Context, publicID string, systemID string) (ParseInput, error) {
+func (s SAX2) ResolveEntity(ctx Context, publicID string, systemID string) (*ParseInput, error) {
 	if h := s.ResolveEntityHandler; h != nil {
 		return h(ctx, publicID, systemID)
 	}
@@ -248,3 +250,10 @@ func (s SAX2) UnparsedEntityDecl(ctx Context, name string, publicID string, syst
 	return ErrHandlerUnspecified;
 }
 
+func (s SAX2) Warning(ctx Context, message string, args ...interface{}) error {
+	if h := s.WarningHandler; h != nil {
+		return h(ctx, message, args...)
+	}
+	return ErrHandlerUnspecified;
+}
+
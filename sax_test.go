@@ -128,7 +128,7 @@ func newEventEmitter(out io.Writer) sax.SAX2Handler {
 
 		fmt.Fprintf(out, "%d, %d",
 			len(attrs),
-			defaulted, /* TODO - number of defaulted attributes */
+			defaulted,
 		)
 
 		if len(attrs) > 0 {
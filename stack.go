@@ -33,8 +33,11 @@ func newNsStack() nsStack {
 	return nsStack{}
 }
 
+// Push adds a namespace declaration. A prefix may be declared again
+// by a descendant, which shadows the previous declaration until it is
+// popped, so the uniqueness of UniqueStack is not enforced here.
 func (s *nsStack) Push(prefix, uri string) {
-	s.UniqueStack.Push(nsStackItem{prefix: prefix, href: uri})
+	s.UniqueStack = append(s.UniqueStack, nsStackItem{prefix: prefix, href: uri})
 }
 
 func (s *nsStack) Lookup(prefix string) string {
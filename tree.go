@@ -32,6 +32,9 @@ func (t *TreeBuilder) StartDocument(ctxif sax.Context) error {
 
 	ctx := ctxif.(*parserCtx)
 	ctx.doc = NewDocument(ctx.version, ctx.encoding, ctx.standalone)
+	ctx.doc.url = ctx.baseURI
+	ctx.doc.inputEncoding = ctx.inputEncoding
+	ctx.doc.idAttrs = ctx.idAttrs
 	return nil
 }
 
@@ -54,12 +57,13 @@ func (t *TreeBuilder) ProcessingInstruction(ctxif sax.Context, target, data stri
 	if err != nil {
 		return err
 	}
+	pi.setPosition(ctx.nodeLine, ctx.nodeColumn)
 
 	switch ctx.inSubset {
 	case 1:
-		doc.IntSubset().AddChild(pi)
+		return doc.IntSubset().AddChild(pi)
 	case 2:
-		doc.ExtSubset().AddChild(pi)
+		return doc.ExtSubset().AddChild(pi)
 	}
 
 	parent := ctx.elem
@@ -93,32 +97,28 @@ func (t *TreeBuilder) StartElementNS(ctxif sax.Context, localname, prefix, uri s
 	if err != nil {
 		return err
 	}
+	e.setPosition(ctx.nodeLine, ctx.nodeColumn)
 
 	if uri != "" {
 		e.SetNamespace(prefix, uri, true)
 	}
 
-	for _, ns := range namespaces {
-		e.SetNamespace(ns.Prefix(), ns.URI(), false)
+	var parent Node
+	if e := ctx.elem; e != nil {
+		parent = e
 	}
 
-debug.Printf("We got %d attributes", len(attrs))
-	for _, attr := range attrs {
-		if attr.IsDefault() && !ctx.loadsubset.IsSet(CompleteAttrs) {
-			if debug.Enabled {
-				debug.Printf("Skipping default attribute %s", attr.Name())
-			}
+	for _, ns := range namespaces {
+		// with ParseNsClean, declarations that are already in scope
+		// are dropped
+		if ctx.options.IsSet(ParseNsClean) && isRedundantNamespace(parent, ns.Prefix(), ns.URI()) {
 			continue
 		}
-		if err := e.SetAttribute(attr.Name(), attr.Value()); err != nil {
-			return err
-		}
+		e.SetNamespace(ns.Prefix(), ns.URI(), false)
 	}
 
-	var parent Node
-	if e := ctx.elem; e != nil {
-		parent = e
-	}
+	// the element is attached before its attributes are set, so that
+	// they are not indexed twice
 	if parent == nil {
 		doc.AddChild(e)
 	} else if parent.Type() == ElementNode {
@@ -127,6 +127,28 @@ debug.Printf("We got %d attributes", len(attrs))
 		parent.AddSibling(e)
 	}
 
+debug.Printf("We got %d attributes", len(attrs))
+	for _, attr := range attrs {
+		if attr.IsDefault() {
+			if !ctx.loadsubset.IsSet(CompleteAttrs) {
+				if debug.Enabled {
+					debug.Printf("Skipping default attribute %s", attr.Name())
+				}
+				continue
+			}
+			if err := e.setDefaultAttribute(attr.Name(), attr.Value(), ctx.entities); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := e.setAttribute(attr.Name(), attr.Value(), ctx.entities); err != nil {
+			return err
+		}
+		if a, ok := attr.(*attrData); ok {
+			e.lastAttribute().setPosition(a.line, a.column)
+		}
+	}
+
 	ctx.elem = e
 
 	return nil
@@ -172,15 +194,34 @@ func (t *TreeBuilder) Characters(ctxif sax.Context, data []byte) error {
 		debug.Printf("Calling AddContent() on '%s' node", n.Name())
 	}
 
-	return n.AddContent(data)
+	// text that follows a text node is merged into it, which keeps
+	// the position of the first chunk
+	text, err := ctx.doc.CreateText(data)
+	if err != nil {
+		return err
+	}
+	text.setPosition(ctx.nodeLine, ctx.nodeColumn)
+	return n.AddChild(text)
 }
 
-func (t *TreeBuilder) CDataBlock(_ sax.Context, data []byte) error {
+func (t *TreeBuilder) CDataBlock(ctxif sax.Context, data []byte) error {
 	if debug.Enabled {
 		g := debug.IPrintf("START tree.CDATABlock")
 		defer g.IRelease("END tree.CDATABlock")
 	}
-	return nil
+
+	ctx := ctxif.(*parserCtx)
+	n := ctx.elem
+	if n == nil {
+		return errors.New("CDATA section placed in wrong location")
+	}
+
+	c, err := ctx.doc.CreateCDATASection(data)
+	if err != nil {
+		return err
+	}
+	c.setPosition(ctx.nodeLine, ctx.nodeColumn)
+	return n.AddChild(c)
 }
 
 func (t *TreeBuilder) Comment(ctxif sax.Context, data []byte) error {
@@ -199,6 +240,7 @@ func (t *TreeBuilder) Comment(ctxif sax.Context, data []byte) error {
 	if err != nil {
 		return err
 	}
+	e.setPosition(ctx.nodeLine, ctx.nodeColumn)
 
 	n := ctx.elem
 	if n == nil {
@@ -233,7 +275,22 @@ func (t *TreeBuilder) InternalSubset(ctxif sax.Context, name, eid, uri string) e
 }
 
 func (t *TreeBuilder) ExternalSubset(ctxif sax.Context, name, eid, uri string) error {
-	return nil
+	if debug.Enabled {
+		g := debug.IPrintf("START tree.ExternalSubset %s,%s,%s", name, eid, uri)
+		defer g.IRelease("END tree.ExternalSubset")
+	}
+
+	if eid == "" && uri == "" {
+		return nil
+	}
+
+	// The external subset is only loaded if we were asked to
+	ctx := ctxif.(*parserCtx)
+	if !ctx.loadDTD() || !ctx.wellFormed || ctx.doc == nil {
+		return nil
+	}
+
+	return ctx.loadExternalSubset(name, eid, uri, ctx.cursor.URI())
 }
 
 func (t *TreeBuilder) HasInternalSubset(ctxif sax.Context) (bool, error) {
@@ -405,7 +462,18 @@ func (t *TreeBuilder) GetExternalSubset(ctxif sax.Context, name string, baseURI
 		defer g.IRelease("END tree.GetExternalSubset")
 	}
 
-	return nil
+	// Load the external subset declared by the document, resolving
+	// its system ID against baseURI, unless it is already loaded
+	ctx := ctxif.(*parserCtx)
+	doc := ctx.doc
+	if doc == nil || doc.extSubset != nil {
+		return nil
+	}
+	if ctx.extSubSystem == "" && ctx.extSubURI == "" {
+		return nil
+	}
+
+	return ctx.loadExternalSubset(name, ctx.extSubSystem, ctx.extSubURI, baseURI)
 }
 
 func (t *TreeBuilder) IgnorableWhitespace(ctxif sax.Context, content []byte) error {
@@ -437,7 +505,20 @@ func (t *TreeBuilder) NotationDecl(ctxif sax.Context, name string, publicID stri
 		defer g.IRelease("END tree.NotationDecl")
 	}
 
-	return nil
+	ctx := ctxif.(*parserCtx)
+	doc := ctx.doc
+	var dtd *DTD
+	switch ctx.inSubset {
+	case 1:
+		dtd = doc.intSubset
+	case 2:
+		dtd = doc.extSubset
+	default:
+		return errors.New("sax.NotationDecl called while not in subset")
+	}
+
+	_, err := dtd.AddNotation(name, publicID, systemID)
+	return err
 }
 
 func (t *TreeBuilder) Reference(ctxif sax.Context, name string) error {
@@ -448,7 +529,7 @@ func (t *TreeBuilder) Reference(ctxif sax.Context, name string) error {
 
 	ctx := ctxif.(*parserCtx)
 	doc := ctx.doc
-	var n Node
+	var n *EntityRef
 	var err error
 	if name[0] == '#' {
 		if n, err = doc.CreateCharRef(name); err != nil {
@@ -460,17 +541,23 @@ func (t *TreeBuilder) Reference(ctxif sax.Context, name string) error {
 		}
 	}
 
+	n.setPosition(ctx.nodeLine, ctx.nodeColumn)
+
 	parent := ctx.elem
 	return parent.AddChild(n)
 }
 
-func (t *TreeBuilder) ResolveEntity(ctxif sax.Context, publicID string, systemID string) (sax.ParseInput, error) {
+// ResolveEntity loads the external entity using the catalogs and the
+// EntityLoader of the parser. systemID has already been resolved against
+// the base URI.
+func (t *TreeBuilder) ResolveEntity(ctxif sax.Context, publicID string, systemID string) (*sax.ParseInput, error) {
 	if debug.Enabled {
-		g := debug.IPrintf("START tree.ResolveEntity '%s'", publicID, systemID)
+		g := debug.IPrintf("START tree.ResolveEntity '%s' '%s'", publicID, systemID)
 		defer g.IRelease("END tree.ResolveEntity")
 	}
 
-	return nil, sax.ErrHandlerUnspecified
+	ctx := ctxif.(*parserCtx)
+	return ctx.openEntity(systemID, publicID)
 }
 
 func (t *TreeBuilder) SkippedEntity(ctxif sax.Context, name string) error {
@@ -518,24 +605,26 @@ func (t *TreeBuilder) EntityDecl(ctxif sax.Context, name string, typ int, public
 		return errors.New("sax.EntityDecl called while note in subset")
 	}
 
+	// The first declaration of an entity is binding
+	var found bool
+	switch EntityType(typ) {
+	case InternalParameterEntity, ExternalParameterEntity:
+		_, found = dtd.LookupParameterEntity(name)
+	default:
+		_, found = dtd.LookupEntity(name)
+	}
+	if found {
+		ctx.warning(errors.New("entity '" + name + "' already defined"))
+		return nil
+	}
+
 	ent, err := dtd.RegisterEntity(name, EntityType(typ), publicID, systemID, notation)
 	if err != nil {
 		return err
 	}
 
 	if ent.uri == "" && systemID != "" {
-			/*
-            xmlChar *URI;
-            const char *base = NULL;
-
-            if (ctxt->input != NULL)
-                base = ctxt->input->filename;
-            if (base == NULL)
-                base = ctxt->directory;
-
-            URI = xmlBuildURI(systemId, (const xmlChar *) base);
-            ent->URI = URI;
-			*/
+		ent.uri = buildURI(systemID, ctx.cursor.URI())
 	}
 
 	return nil
@@ -547,12 +636,190 @@ func (t *TreeBuilder) UnparsedEntityDecl(ctxif sax.Context, name string, publicI
 		defer g.IRelease("END tree.UnparsedEntityDecl")
 	}
 
-	// Because the parser needs to know about entities even in cases where
-	// there isn't a SAX handler registered, call to Document.RegisterEntry
-	// is done in the main parser -- and not here.
-	return nil
+	return t.EntityDecl(ctxif, name, int(ExternalGeneralUnparsedEntity), publicID, systemID, notation)
 }
 
 func (t *TreeBuilder) Error(ctxif sax.Context, message string, args ...interface{}) error {
 	return nil
 }
+
+func (t *TreeBuilder) Warning(ctxif sax.Context, message string, args ...interface{}) error {
+	return nil
+}
+
+// entityBuilder builds the nodes for the content of an entity, which
+// is parsed in a context of its own. The content events are recorded
+// along with their position, so that they can be replayed to the SAX
+// handler of the document when the reference is substituted. Lookups
+// and errors are forwarded to the SAX handler of the document.
+type entityBuilder struct {
+	*TreeBuilder
+	sax      sax.SAX2Handler
+	userData sax.Context
+	events   []entityEvent
+}
+
+// entityEvent is a recorded SAX event. empty is set for the start of
+// an empty element.
+type entityEvent struct {
+	pos   position
+	empty bool
+	emit  func(s sax.SAX2Handler, ctx sax.Context) error
+}
+
+func newEntityBuilder(s sax.SAX2Handler, userData sax.Context) *entityBuilder {
+	return &entityBuilder{
+		TreeBuilder: NewTreeBuilder(),
+		sax:         s,
+		userData:    userData,
+	}
+}
+
+func (b *entityBuilder) record(ctxif sax.Context, emit func(s sax.SAX2Handler, ctx sax.Context) error) {
+	b.events = append(b.events, entityEvent{
+		pos:  ctxif.(*parserCtx).currentPosition(),
+		emit: emit,
+	})
+}
+
+// replay emits the recorded events to the SAX handler of ctx. While an
+// event is replayed, the locator reports the position it was recorded
+// at.
+func (b *entityBuilder) replay(ctx *parserCtx) error {
+	s := ctx.sax
+	if s == nil {
+		return nil
+	}
+
+	saved, line, column, empty := ctx.replayed, ctx.nodeLine, ctx.nodeColumn, ctx.emptyElement
+	defer func() {
+		ctx.replayed, ctx.nodeLine, ctx.nodeColumn, ctx.emptyElement = saved, line, column, empty
+	}()
+
+	for i := range b.events {
+		ev := &b.events[i]
+		ctx.replayed = &ev.pos
+		ctx.nodeLine, ctx.nodeColumn = ev.pos.nodeLine, ev.pos.nodeColumn
+		ctx.emptyElement = ev.empty
+		switch err := ev.emit(s, ctx.userData); err {
+		case nil, sax.ErrHandlerUnspecified:
+			// no op
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *entityBuilder) StartElementNS(ctxif sax.Context, localname, prefix, uri string, namespaces []sax.Namespace, attrs []sax.Attribute) error {
+	if err := b.TreeBuilder.StartElementNS(ctxif, localname, prefix, uri, namespaces, attrs); err != nil {
+		return err
+	}
+	b.record(ctxif, func(s sax.SAX2Handler, ctx sax.Context) error {
+		return s.StartElementNS(ctx, localname, prefix, uri, namespaces, attrs)
+	})
+	b.events[len(b.events)-1].empty = ctxif.(*parserCtx).emptyElement
+	return nil
+}
+
+func (b *entityBuilder) EndElementNS(ctxif sax.Context, localname, prefix, uri string) error {
+	if err := b.TreeBuilder.EndElementNS(ctxif, localname, prefix, uri); err != nil {
+		return err
+	}
+	b.record(ctxif, func(s sax.SAX2Handler, ctx sax.Context) error {
+		return s.EndElementNS(ctx, localname, prefix, uri)
+	})
+	return nil
+}
+
+func (b *entityBuilder) Characters(ctxif sax.Context, data []byte) error {
+	if err := b.TreeBuilder.Characters(ctxif, data); err != nil {
+		return err
+	}
+	data = append([]byte(nil), data...)
+	b.record(ctxif, func(s sax.SAX2Handler, ctx sax.Context) error {
+		return s.Characters(ctx, data)
+	})
+	return nil
+}
+
+func (b *entityBuilder) IgnorableWhitespace(ctxif sax.Context, data []byte) error {
+	if err := b.TreeBuilder.IgnorableWhitespace(ctxif, data); err != nil {
+		return err
+	}
+	data = append([]byte(nil), data...)
+	b.record(ctxif, func(s sax.SAX2Handler, ctx sax.Context) error {
+		return s.IgnorableWhitespace(ctx, data)
+	})
+	return nil
+}
+
+func (b *entityBuilder) CDataBlock(ctxif sax.Context, data []byte) error {
+	if err := b.TreeBuilder.CDataBlock(ctxif, data); err != nil {
+		return err
+	}
+	data = append([]byte(nil), data...)
+	b.record(ctxif, func(s sax.SAX2Handler, ctx sax.Context) error {
+		return s.CDataBlock(ctx, data)
+	})
+	return nil
+}
+
+func (b *entityBuilder) Comment(ctxif sax.Context, data []byte) error {
+	if err := b.TreeBuilder.Comment(ctxif, data); err != nil {
+		return err
+	}
+	data = append([]byte(nil), data...)
+	b.record(ctxif, func(s sax.SAX2Handler, ctx sax.Context) error {
+		return s.Comment(ctx, data)
+	})
+	return nil
+}
+
+func (b *entityBuilder) ProcessingInstruction(ctxif sax.Context, target, data string) error {
+	if err := b.TreeBuilder.ProcessingInstruction(ctxif, target, data); err != nil {
+		return err
+	}
+	b.record(ctxif, func(s sax.SAX2Handler, ctx sax.Context) error {
+		return s.ProcessingInstruction(ctx, target, data)
+	})
+	return nil
+}
+
+func (b *entityBuilder) Reference(ctxif sax.Context, name string) error {
+	if err := b.TreeBuilder.Reference(ctxif, name); err != nil {
+		return err
+	}
+	b.record(ctxif, func(s sax.SAX2Handler, ctx sax.Context) error {
+		return s.Reference(ctx, name)
+	})
+	return nil
+}
+
+func (b *entityBuilder) GetEntity(ctxif sax.Context, name string) (sax.Entity, error) {
+	if b.sax == nil {
+		return nil, sax.ErrHandlerUnspecified
+	}
+	return b.sax.GetEntity(b.userData, name)
+}
+
+func (b *entityBuilder) ResolveEntity(ctxif sax.Context, publicID string, systemID string) (*sax.ParseInput, error) {
+	if b.sax == nil {
+		return nil, sax.ErrHandlerUnspecified
+	}
+	return b.sax.ResolveEntity(b.userData, publicID, systemID)
+}
+
+func (b *entityBuilder) Error(ctxif sax.Context, message string, args ...interface{}) error {
+	if b.sax == nil {
+		return nil
+	}
+	return b.sax.Error(b.userData, message, args...)
+}
+
+func (b *entityBuilder) Warning(ctxif sax.Context, message string, args ...interface{}) error {
+	if b.sax == nil {
+		return nil
+	}
+	return b.sax.Warning(b.userData, message, args...)
+}
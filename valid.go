@@ -1,7 +1,10 @@
 package helium
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/lestrrat/helium/internal/debug"
@@ -85,3 +88,636 @@ func (elem *ElementContent) copyElementContent() *ElementContent {
 	return ret
 }
 
+// contentModel is an element content model compiled into a
+// nondeterministic automaton over the names of the child elements.
+// State 0 is the initial state.
+type contentModel struct {
+	states []cmState
+	final  int
+}
+
+type cmState struct {
+	name string // name of the element that moves to next, if any
+	next int
+	eps  []int // transitions that do not consume an element
+}
+
+func compileContentModel(c *ElementContent) *contentModel {
+	if debug.Enabled {
+		g := debug.IPrintf("START compileContentModel")
+		defer g.IRelease("END compileContentModel")
+	}
+
+	m := &contentModel{}
+	m.final = m.compile(c, m.newState())
+	return m
+}
+
+func (m *contentModel) newState() int {
+	m.states = append(m.states, cmState{next: -1})
+	return len(m.states) - 1
+}
+
+func (m *contentModel) epsilon(from, to int) {
+	m.states[from].eps = append(m.states[from].eps, to)
+}
+
+// compile adds the transitions that match c from the state `from`,
+// and returns the state that is reached once c has been matched
+func (m *contentModel) compile(c *ElementContent, from int) int {
+	if c == nil {
+		return from
+	}
+
+	start := m.newState()
+	m.epsilon(from, start)
+
+	var end int
+	switch c.ctype {
+	case ElementContentElement:
+		end = m.newState()
+		name := c.name
+		if c.prefix != "" {
+			name = c.prefix + ":" + name
+		}
+		m.states[start].name = name
+		m.states[start].next = end
+	case ElementContentSeq:
+		end = m.compile(c.c2, m.compile(c.c1, start))
+	case ElementContentOr:
+		end = m.newState()
+		m.epsilon(m.compile(c.c1, start), end)
+		m.epsilon(m.compile(c.c2, start), end)
+	default: // #PCDATA does not match any element
+		end = start
+	}
+
+	switch c.coccur {
+	case ElementContentOpt:
+		m.epsilon(start, end)
+	case ElementContentMult:
+		m.epsilon(start, end)
+		m.epsilon(end, start)
+	case ElementContentPlus:
+		m.epsilon(end, start)
+	}
+
+	// a fresh final state keeps the loops above from leaking into
+	// whatever follows
+	final := m.newState()
+	m.epsilon(end, final)
+	return final
+}
+
+// closure adds the states that can be reached from set without
+// consuming an element
+func (m *contentModel) closure(set []int) []int {
+	seen := make([]bool, len(m.states))
+	for _, s := range set {
+		seen[s] = true
+	}
+	for i := 0; i < len(set); i++ {
+		for _, s := range m.states[set[i]].eps {
+			if !seen[s] {
+				seen[s] = true
+				set = append(set, s)
+			}
+		}
+	}
+	return set
+}
+
+// match reports if the sequence of element names is accepted
+func (m *contentModel) match(names []string) bool {
+	cur := m.closure([]int{0})
+	for _, name := range names {
+		var next []int
+		for _, s := range cur {
+			if st := m.states[s]; st.next >= 0 && st.name == name {
+				next = append(next, st.next)
+			}
+		}
+		if len(next) == 0 {
+			return false
+		}
+		cur = m.closure(next)
+	}
+
+	for _, s := range cur {
+		if s == m.final {
+			return true
+		}
+	}
+	return false
+}
+
+// validator holds the state of the validation of a document
+type validator struct {
+	doc    *Document
+	dtds   []*DTD
+	models map[*ElementDecl]*contentModel
+	ids    map[string]*Element
+	refs   []idref
+	errors []error
+}
+
+// idref is a reference to an ID, which is checked once the whole
+// document has been seen
+type idref struct {
+	elem  *Element
+	attr  string
+	value string
+}
+
+// Validate checks the document against the validity constraints of
+// dtd. If dtd is nil, the internal and external subsets of the document
+// are used. All of the violations are returned in ErrValidationErrors.
+func (d *Document) Validate(dtd *DTD) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START Document.Validate")
+		defer g.IRelease("END Document.Validate")
+	}
+
+	v := &validator{
+		doc:    d,
+		models: map[*ElementDecl]*contentModel{},
+		ids:    map[string]*Element{},
+	}
+	if dtd != nil {
+		v.dtds = []*DTD{dtd}
+	} else {
+		for _, s := range []*DTD{d.intSubset, d.extSubset} {
+			if s != nil {
+				v.dtds = append(v.dtds, s)
+			}
+		}
+	}
+
+	v.validate()
+	if len(v.errors) > 0 {
+		return ErrValidationErrors(v.errors)
+	}
+	return nil
+}
+
+// validateDocument validates the document that was just parsed, when
+// ParseDTDValid is set. The violations are reported to the SAX handler.
+func (ctx *parserCtx) validateDocument() ErrValidationErrors {
+	err := ctx.doc.Validate(nil)
+	if err == nil {
+		return nil
+	}
+
+	ctx.valid = false
+	verrs := err.(ErrValidationErrors)
+	for _, verr := range verrs {
+		ctx.reportError(verr)
+	}
+	return verrs
+}
+
+func (v *validator) errorf(n Node, format string, args ...interface{}) {
+	e := ErrValidation{Message: fmt.Sprintf(format, args...), Node: n}
+	if elem, ok := n.(*Element); ok {
+		e.LineNumber = elem.line
+	}
+	v.errors = append(v.errors, e)
+}
+
+func (v *validator) validate() {
+	if len(v.dtds) == 0 {
+		v.errorf(v.doc, "no DTD found")
+		return
+	}
+
+	v.validateDTD()
+
+	root := v.doc.DocumentElement()
+	if root == nil {
+		return
+	}
+
+	// [ VC: Root Element Type ]
+	for _, dtd := range v.dtds {
+		if dtd.name != "" {
+			if dtd.name != root.Name() {
+				v.errorf(root, "root element %s does not match the DTD name %s", root.Name(), dtd.name)
+			}
+			break
+		}
+	}
+
+	v.validateTree(root)
+
+	// [ VC: IDREF ]
+	for _, ref := range v.refs {
+		if _, ok := v.ids[ref.value]; !ok {
+			v.errorf(ref.elem, "IDREF attribute %s references an unknown ID \"%s\"", ref.attr, ref.value)
+		}
+	}
+}
+
+// validateDTD checks the declarations themselves
+func (v *validator) validateDTD() {
+	for _, dtd := range v.dtds {
+		idattrs := map[string]string{}
+		for _, key := range sortedAttributeKeys(dtd.attributes) {
+			decl := dtd.attributes[key]
+			name := decl.name
+			if decl.prefix != "" {
+				name = decl.prefix + ":" + name
+			}
+
+			if decl.defvalue != "" && validateAttributeValueInternal(v.doc, decl.atype, decl.defvalue) != nil {
+				v.errorf(decl, "attribute %s of %s: invalid default value", name, decl.elem)
+			}
+
+			switch decl.atype {
+			case AttrID:
+				// [ VC: ID Attribute Default ]
+				if decl.def != AttrDefaultImplied && decl.def != AttrDefaultRequired {
+					v.errorf(decl, "ID attribute %s of %s is not valid must be #IMPLIED or #REQUIRED", name, decl.elem)
+				}
+				// [ VC: One ID per Element Type ]
+				if other, ok := idattrs[decl.elem]; ok {
+					v.errorf(decl, "element %s has too many ID attributes defined: %s and %s", decl.elem, other, name)
+				} else {
+					idattrs[decl.elem] = name
+				}
+			case AttrNotation:
+				// [ VC: Notation Attributes ]
+				for _, n := range decl.tree {
+					if _, ok := v.lookupNotation(n); !ok {
+						v.errorf(decl, "attribute %s of %s: NOTATION %s is not declared", name, decl.elem, n)
+					}
+				}
+			}
+		}
+
+		// [ VC: Notation Declared ]
+		for _, key := range sortedEntityKeys(dtd.entities) {
+			ent := dtd.entities[key]
+			if ent.entityType != ExternalGeneralUnparsedEntity {
+				continue
+			}
+			if _, ok := v.lookupNotation(ent.content); !ok {
+				v.errorf(ent, "entity %s: NOTATION %s is not declared", ent.name, ent.content)
+			}
+		}
+	}
+}
+
+// the declarations are checked in a stable order, so that the
+// violations are always reported in the same order
+
+func sortedAttributeKeys(m map[string]*AttributeDecl) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedEntityKeys(m map[string]*Entity) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *validator) lookupElement(e *Element) *ElementDecl {
+	for _, dtd := range v.dtds {
+		if decl, ok := dtd.LookupElement(e.LocalName(), e.Prefix()); ok && decl.decltype != UndefinedElementType {
+			return decl
+		}
+	}
+	return nil
+}
+
+func (v *validator) lookupAttribute(name, elem string) *AttributeDecl {
+	var prefix string
+	if i := strings.IndexByte(name, ':'); i > -1 {
+		prefix = name[:i]
+		name = name[i+1:]
+	}
+	for _, dtd := range v.dtds {
+		if decl, ok := dtd.LookupAttribute(name, prefix, elem); ok {
+			return decl
+		}
+	}
+	return nil
+}
+
+// elementAttributes returns the attributes declared for elem
+func (v *validator) elementAttributes(elem string) []*AttributeDecl {
+	var ret []*AttributeDecl
+	seen := map[string]struct{}{}
+	for _, dtd := range v.dtds {
+		for _, key := range sortedAttributeKeys(dtd.attributes) {
+			decl := dtd.attributes[key]
+			if decl.elem != elem {
+				continue
+			}
+			// the first declaration is binding
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			ret = append(ret, decl)
+		}
+	}
+	return ret
+}
+
+func (v *validator) lookupEntity(name string) (*Entity, bool) {
+	for _, dtd := range v.dtds {
+		if ent, ok := dtd.LookupEntity(name); ok {
+			return ent, true
+		}
+	}
+	return nil, false
+}
+
+func (v *validator) lookupNotation(name string) (*Notation, bool) {
+	for _, dtd := range v.dtds {
+		if n, ok := dtd.LookupNotation(name); ok {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// validateTree validates e and all of its descendants
+func (v *validator) validateTree(e *Element) {
+	v.validateElement(e)
+	for c := e.FirstChild(); c != nil; c = c.NextSibling() {
+		if child, ok := c.(*Element); ok {
+			v.validateTree(child)
+		}
+	}
+}
+
+// eachChild calls f for each child of n, looking into the content of
+// entity references
+func eachChild(n Node, f func(Node)) {
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if c.Type() == EntityRefNode {
+			if ent := c.FirstChild(); ent != nil {
+				eachChild(ent, f)
+			}
+			continue
+		}
+		f(c)
+	}
+}
+
+func (v *validator) validateElement(e *Element) {
+	name := e.Name()
+	decl := v.lookupElement(e)
+	if decl == nil {
+		// [ VC: Element Valid ]
+		v.errorf(e, "no declaration for element %s", name)
+	} else {
+		v.validateContent(e, decl)
+	}
+
+	v.validateAttributes(e)
+}
+
+func (v *validator) validateContent(e *Element, decl *ElementDecl) {
+	name := e.Name()
+	switch decl.decltype {
+	case EmptyElementType:
+		if e.FirstChild() != nil {
+			v.errorf(e, "element %s was declared EMPTY this one has content", name)
+		}
+	case AnyElementType:
+		// anything goes
+	case MixedElementType:
+		model := v.contentModel(decl)
+		eachChild(e, func(c Node) {
+			if c.Type() != ElementNode {
+				return
+			}
+			if !model.match([]string{c.Name()}) {
+				v.errorf(e, "element %s is not declared in %s list of possible children", c.Name(), name)
+			}
+		})
+	case ElementElementType:
+		var names []string
+		pcdata := false
+		eachChild(e, func(c Node) {
+			switch c.Type() {
+			case ElementNode:
+				names = append(names, c.Name())
+			case TextNode:
+				if !isBlankText(c.Content()) {
+					pcdata = true
+				}
+			case CDATASectionNode:
+				pcdata = true
+			}
+		})
+		if pcdata {
+			v.errorf(e, "element %s content does not follow the DTD, text not allowed", name)
+			return
+		}
+		if !v.contentModel(decl).match(names) {
+			var expected bytes.Buffer
+			dumpElementContent(&expected, decl.content, true)
+			v.errorf(e, "element %s content does not follow the DTD, expecting %s, got (%s)", name, expected.String(), strings.Join(names, " "))
+		}
+	}
+}
+
+func (v *validator) contentModel(decl *ElementDecl) *contentModel {
+	model, ok := v.models[decl]
+	if !ok {
+		model = compileContentModel(decl.content)
+		v.models[decl] = model
+	}
+	return model
+}
+
+func (v *validator) validateAttributes(e *Element) {
+	name := e.Name()
+	for attr := e.properties; attr != nil; attr = attr.NextAttribute() {
+		decl := v.lookupAttribute(attr.Name(), name)
+		if decl == nil {
+			// [ VC: Attribute Value Type ]
+			v.errorf(e, "no declaration for attribute %s of element %s", attr.Name(), name)
+			continue
+		}
+		v.validateAttributeValue(e, decl, attr.Name(), attr.Value())
+	}
+
+	for _, decl := range v.elementAttributes(name) {
+		aname := decl.name
+		if decl.prefix != "" {
+			aname = decl.prefix + ":" + aname
+		}
+
+		value, ok := attributeValue(e, decl)
+		switch decl.def {
+		case AttrDefaultRequired:
+			// [ VC: Required Attribute ]
+			if !ok {
+				v.errorf(e, "element %s does not carry attribute %s", name, aname)
+			}
+		case AttrDefaultFixed:
+			// [ VC: Fixed Attribute Default ]
+			if ok && value != decl.defvalue {
+				v.errorf(e, "value for attribute %s of %s is different from default \"%s\"", aname, name, decl.defvalue)
+			}
+		}
+	}
+}
+
+// attributeValue looks up the value of the declared attribute on e.
+// Namespace declarations are not stored as attributes, so they are
+// looked up separately.
+func attributeValue(e *Element, decl *AttributeDecl) (string, bool) {
+	switch {
+	case decl.prefix == "" && decl.name == "xmlns":
+		return namespaceDeclaration(e, "")
+	case decl.prefix == "xmlns":
+		return namespaceDeclaration(e, decl.name)
+	}
+
+	name := decl.name
+	if decl.prefix != "" {
+		name = decl.prefix + ":" + name
+	}
+	for attr := e.properties; attr != nil; attr = attr.NextAttribute() {
+		if attr.Name() == name {
+			value := attr.Value()
+			if decl.atype != AttrCDATA {
+				value = normalizeAttributeValue(value)
+			}
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func namespaceDeclaration(e *Element, prefix string) (string, bool) {
+	for _, ns := range e.nsDefs {
+		if ns.Prefix() == prefix {
+			return ns.URI(), true
+		}
+	}
+	return "", false
+}
+
+// normalizeAttributeValue discards leading and trailing spaces, and
+// replaces sequences of spaces with a single space
+func normalizeAttributeValue(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func (v *validator) validateAttributeValue(e *Element, decl *AttributeDecl, name, value string) {
+	if decl.atype != AttrCDATA {
+		value = normalizeAttributeValue(value)
+	}
+
+	if validateAttributeValueInternal(v.doc, decl.atype, value) != nil {
+		v.errorf(e, "syntax of value for attribute %s of %s is not valid", name, e.Name())
+		return
+	}
+
+	switch decl.atype {
+	case AttrID:
+		// [ VC: ID ]
+		if _, ok := v.ids[value]; ok {
+			v.errorf(e, "ID %s already defined", value)
+		} else {
+			v.ids[value] = e
+		}
+	case AttrIDRef:
+		v.refs = append(v.refs, idref{elem: e, attr: name, value: value})
+	case AttrIDRefs:
+		for _, tok := range strings.Split(value, " ") {
+			v.refs = append(v.refs, idref{elem: e, attr: name, value: tok})
+		}
+	case AttrEntity, AttrEntities:
+		// [ VC: Entity Name ]
+		for _, tok := range strings.Split(value, " ") {
+			ent, ok := v.lookupEntity(tok)
+			if !ok {
+				v.errorf(e, "ENTITY attribute %s references an unknown entity \"%s\"", name, tok)
+			} else if ent.entityType != ExternalGeneralUnparsedEntity {
+				v.errorf(e, "ENTITY attribute %s references an entity \"%s\" of wrong type", name, tok)
+			}
+		}
+	case AttrNotation, AttrEnumeration:
+		// [ VC: Notation Attributes ], [ VC: Enumeration ]
+		found := false
+		for _, tok := range decl.tree {
+			if tok == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.errorf(e, "value \"%s\" for attribute %s of %s is not among the enumerated set", value, name, e.Name())
+		}
+	}
+}
+
+// validateAttributeValueInternal checks that value matches the
+// production of the attribute type. value must already be normalized.
+func validateAttributeValueInternal(doc *Document, typ AttributeType, value string) error {
+	switch typ {
+	case AttrEntities, AttrIDRefs:
+		if !isValidNames(value, isValidName) {
+			return errors.New("invalid names")
+		}
+	case AttrEntity, AttrIDRef, AttrID, AttrNotation:
+		if !isValidName(value) {
+			return errors.New("invalid name")
+		}
+	case AttrNmtokens, AttrEnumeration:
+		if !isValidNames(value, isValidNmtoken) {
+			return errors.New("invalid nmtokens")
+		}
+	case AttrNmtoken:
+		if !isValidNmtoken(value) {
+			return errors.New("invalid nmtoken")
+		}
+	}
+	return nil
+}
+
+func isValidName(s string) bool {
+	for i, r := range s {
+		if i == 0 && !isNameStartChar(r) {
+			return false
+		}
+		if !isNameChar(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isValidNmtoken(s string) bool {
+	for _, r := range s {
+		if !isNameChar(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isValidNames checks a list of tokens separated by a single space
+func isValidNames(s string, valid func(string) bool) bool {
+	for _, tok := range strings.Split(s, " ") {
+		if !valid(tok) {
+			return false
+		}
+	}
+	return true
+}
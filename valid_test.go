@@ -0,0 +1,164 @@
+package helium
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/helium/sax"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDTDValid(t *testing.T) {
+	const input = `<!DOCTYPE doc [
+<!ELEMENT doc (head, item*)>
+<!ELEMENT head (#PCDATA)>
+<!ELEMENT item EMPTY>
+<!ATTLIST item id ID #REQUIRED ref IDREF #IMPLIED kind (a|b) "a" v CDATA #FIXED "x" n NMTOKEN #IMPLIED>
+]>
+<doc>
+  <head>title<b/></head>
+  <item id="i1" kind="c"/>
+  <item id="i1" ref="nope" v="y"/>
+  <item>text</item>
+  <item id="i2" n="a b" bogus="1"/>
+</doc>`
+
+	p := NewParser()
+	if !assert.NoError(t, p.SetOption(ParseDTDValid), "SetOption should succeed") {
+		return
+	}
+
+	doc, err := p.Parse([]byte(input))
+	if !assert.NotNil(t, doc, "document is returned along with validity errors") {
+		return
+	}
+
+	var verrs ErrValidationErrors
+	if !assert.True(t, errors.As(err, &verrs), "error should be ErrValidationErrors") {
+		return
+	}
+
+	expected := []string{
+		"element b is not declared in head list of possible children at line 8",
+		"no declaration for element b at line 8",
+		`value "c" for attribute kind of item is not among the enumerated set at line 9`,
+		"ID i1 already defined at line 10",
+		`value for attribute v of item is different from default "x" at line 10`,
+		"element item was declared EMPTY this one has content at line 11",
+		"element item does not carry attribute id at line 11",
+		"syntax of value for attribute n of item is not valid at line 12",
+		"no declaration for attribute bogus of element item at line 12",
+		`IDREF attribute ref references an unknown ID "nope" at line 10`,
+	}
+	var messages []string
+	for _, e := range verrs {
+		messages = append(messages, e.Error())
+	}
+	if !assert.Equal(t, expected, messages, "all violations are reported") {
+		return
+	}
+}
+
+func TestParseDTDValidWithoutTree(t *testing.T) {
+	const input = `<!DOCTYPE doc [<!ELEMENT doc EMPTY>]><doc>text</doc>`
+
+	p := NewParser()
+	p.SetSAXHandler(sax.New())
+	if !assert.NoError(t, p.SetOption(ParseDTDValid), "SetOption should succeed") {
+		return
+	}
+	if _, err := p.Parse([]byte(input)); !assert.True(t, errors.Is(err, ErrDTDValidWithoutTree), "validation without a tree is rejected") {
+		return
+	}
+
+	p = NewParser()
+	if !assert.NoError(t, p.SetOption(ParseDTDValid), "SetOption should succeed") {
+		return
+	}
+	r := p.NewReader(strings.NewReader(input))
+	defer r.Close()
+	if _, err := r.Read(); !assert.True(t, errors.Is(err, ErrDTDValidWithoutTree), "validation is rejected by the Reader") {
+		return
+	}
+}
+
+func TestContentModel(t *testing.T) {
+	const dtd = `<!DOCTYPE doc [
+<!ELEMENT doc ((a | b)*, c+, d?)>
+<!ELEMENT a EMPTY>
+<!ELEMENT b EMPTY>
+<!ELEMENT c EMPTY>
+<!ELEMENT d EMPTY>
+]>`
+
+	tests := []struct {
+		content string
+		valid   bool
+	}{
+		{"<c/>", true},
+		{"<a/><b/><a/><c/><c/><d/>", true},
+		{" <b/> <c/> ", true},
+		{"<c/><!-- comment --><?pi?><d/>", true},
+		{"", false},
+		{"<a/><b/>", false},
+		{"<c/><d/><d/>", false},
+		{"<c/><a/>", false},
+		{"<c/>text", false},
+	}
+
+	for _, test := range tests {
+		doc, err := Parse([]byte(dtd + "<doc>" + test.content + "</doc>"))
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+
+		err = doc.Validate(nil)
+		if test.valid {
+			if !assert.NoError(t, err, "%q should be valid", test.content) {
+				return
+			}
+		} else {
+			if !assert.Error(t, err, "%q should be invalid", test.content) {
+				return
+			}
+		}
+	}
+}
+
+func TestValidateWithDTD(t *testing.T) {
+	schema, err := Parse([]byte(`<!DOCTYPE doc [
+<!ELEMENT doc (p+)>
+<!ELEMENT p (#PCDATA | em)*>
+<!ELEMENT em (#PCDATA)>
+<!ATTLIST p ref IDREFS #IMPLIED id ID #IMPLIED>
+<!ATTLIST doc xmlns CDATA #FIXED "http://example.com/ns">
+]><doc xmlns="http://example.com/ns"><p/></doc>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	doc, err := Parse([]byte(`<doc xmlns="http://example.com/ns"><p id="a">one <em>two</em></p><p ref="a  b" id="b"/></doc>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	if !assert.Error(t, doc.Validate(nil), "a document without a DTD is not valid") {
+		return
+	}
+	if !assert.NoError(t, doc.Validate(schema.IntSubset()), "document is valid against the given DTD") {
+		return
+	}
+
+	doc, err = Parse([]byte(`<doc xmlns="http://example.com/other"><p ref="c"/></doc>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	err = doc.Validate(schema.IntSubset())
+	if !assert.Error(t, err, "document should be invalid") {
+		return
+	}
+	if !assert.Len(t, err.(ErrValidationErrors), 2, "fixed namespace and dangling IDREFS are reported") {
+		return
+	}
+}
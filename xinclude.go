@@ -0,0 +1,836 @@
+package helium
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/lestrrat/helium/encoding"
+	"github.com/lestrrat/helium/internal/debug"
+)
+
+func newXIncludeNode(etype ElementType) *XIncludeNode {
+	n := XIncludeNode{}
+	n.etype = etype
+	return &n
+}
+
+func (n *XIncludeNode) AddChild(cur Node) error {
+	return addChild(n, cur)
+}
+
+func (n *XIncludeNode) AddContent(b []byte) error {
+	return addContent(n, b)
+}
+
+func (n *XIncludeNode) AddSibling(cur Node) error {
+	return addSibling(n, cur)
+}
+
+func (n *XIncludeNode) Replace(cur Node) {
+	replaceNode(n, cur)
+}
+
+func (n *XIncludeNode) SetTreeDoc(doc *Document) {
+	setTreeDoc(n, doc)
+}
+
+// xincluder processes the xi:include elements of a document, and of
+// the documents that they include
+type xincluder struct {
+	parser *Parser
+	ctx    *parserCtx           // loads resources through the catalogs and the EntityLoader
+	docs   map[string]*Document // included documents, by URI
+	stack  []string             // URIs that are being included, to detect loops
+}
+
+// ProcessXInclude replaces the xi:include elements of doc with the
+// resources that they include. Resources are loaded through the
+// catalogs and the EntityLoader of the parser, and ParseNoNet,
+// ParseNoXIncNode and ParseNoBaseFix are honored.
+func (p *Parser) ProcessXInclude(doc *Document) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START Parser.ProcessXInclude")
+		defer g.IRelease("END Parser.ProcessXInclude")
+	}
+
+	x := &xincluder{
+		parser: p,
+		ctx: &parserCtx{
+			options: p.options,
+			loader:  p.loader,
+			catalog: p.catalog,
+		},
+		docs: map[string]*Document{},
+	}
+	if uri := doc.URL(); uri != "" {
+		x.stack = append(x.stack, uri)
+	}
+	return x.processChildren(doc)
+}
+
+// ProcessXInclude is a shortcut for NewParser().ProcessXInclude(d)
+func (d *Document) ProcessXInclude() error {
+	return NewParser().ProcessXInclude(d)
+}
+
+// processChildren processes the xi:include elements below n
+func (x *xincluder) processChildren(n Node) error {
+	for c := n.FirstChild(); c != nil; {
+		next := c.NextSibling()
+		if e, ok := c.(*Element); ok {
+			switch {
+			case isXIncludeElement(e, "include"):
+				if err := x.include(e); err != nil {
+					return err
+				}
+			case isXIncludeElement(e, "fallback"):
+				return xincludeError(e, errors.New("fallback is not the child of an include"))
+			default:
+				if err := x.processChildren(e); err != nil {
+					return err
+				}
+			}
+		}
+		c = next
+	}
+	return nil
+}
+
+// processNodes processes the xi:include elements in, and below, nodes
+func (x *xincluder) processNodes(nodes []Node, doc *Document) ([]Node, error) {
+	holder, err := doc.CreateElement("include")
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		if err := holder.AddChild(n); err != nil {
+			return nil, err
+		}
+	}
+	if err := x.processChildren(holder); err != nil {
+		return nil, err
+	}
+	return detachChildren(holder), nil
+}
+
+// include replaces e, an xi:include element, with the resource that it
+// includes, or with the content of its fallback
+func (x *xincluder) include(e *Element) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START xincluder.include")
+		defer g.IRelease("END xincluder.include")
+	}
+
+	var fallback *Element
+	for c := e.FirstChild(); c != nil; c = c.NextSibling() {
+		child, ok := c.(*Element)
+		if !ok {
+			continue
+		}
+		switch {
+		case isXIncludeElement(child, "fallback"):
+			if fallback != nil {
+				return xincludeError(child, errors.New("include has multiple fallback children"))
+			}
+			fallback = child
+		case isXIncludeElement(child, "include"):
+			return xincludeError(child, errors.New("include has an include child"))
+		}
+	}
+
+	href, _ := getAttribute(e, "href")
+	xptr, _ := getAttribute(e, "xpointer")
+	parse, ok := getAttribute(e, "parse")
+	if !ok {
+		parse = "xml"
+	}
+
+	switch {
+	case parse != "xml" && parse != "text":
+		return xincludeError(e, fmt.Errorf("invalid value '%s' for parse", parse))
+	case href == "" && (parse == "text" || xptr == ""):
+		return xincludeError(e, ErrXIncludeRecursion)
+	case parse == "text" && xptr != "":
+		return xincludeError(e, errors.New("xpointer is not allowed with parse=\"text\""))
+	case strings.Contains(href, "#"):
+		return xincludeError(e, errors.New("fragment identifiers are not allowed in href"))
+	}
+
+	var uri string
+	if href != "" {
+		uri = buildURI(href, nodeBase(e))
+	}
+
+	var nodes []Node
+	var err error
+	if parse == "text" {
+		nodes, err = x.loadText(e, uri)
+	} else {
+		nodes, err = x.loadXML(e, uri, xptr)
+	}
+	if err != nil {
+		if _, ok := err.(ErrXInclude); ok || fallback == nil || err == ErrXIncludeRecursion {
+			return xincludeError(e, err)
+		}
+
+		if err := x.processChildren(fallback); err != nil {
+			return err
+		}
+		nodes = detachChildren(fallback)
+	}
+	return x.replace(e, nodes)
+}
+
+// loadXML loads the nodes that are included as XML from uri, or from
+// the document of e when uri is empty, and selected by xptr
+func (x *xincluder) loadXML(e *Element, uri, xptr string) ([]Node, error) {
+	doc := e.OwnerDocument()
+	if uri == "" {
+		targets, err := x.resolveXPointer(doc, xptr)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			for p := Node(e); p != nil; p = p.Parent() {
+				if p == target {
+					return nil, ErrXIncludeRecursion
+				}
+			}
+		}
+
+		key := doc.URL() + "#" + xptr
+		if x.including(key) {
+			return nil, ErrXIncludeRecursion
+		}
+		x.stack = append(x.stack, key)
+		defer func() { x.stack = x.stack[:len(x.stack)-1] }()
+
+		nodes, err := copyNodes(targets, doc, e.Parent())
+		if err != nil {
+			return nil, err
+		}
+		return x.processNodes(nodes, doc)
+	}
+
+	if x.including(uri) {
+		return nil, ErrXIncludeRecursion
+	}
+	src, err := x.loadDoc(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []Node
+	if xptr == "" {
+		for c := src.FirstChild(); c != nil; c = c.NextSibling() {
+			selected = append(selected, c)
+		}
+	} else {
+		if selected, err = x.resolveXPointer(src, xptr); err != nil {
+			return nil, err
+		}
+	}
+
+	nodes, err := copyNodes(selected, doc, e.Parent())
+	if err != nil {
+		return nil, err
+	}
+
+	if !x.parser.options.IsSet(ParseNoBaseFix) {
+		base := nodeBase(e.Parent())
+		for _, n := range nodes {
+			if c, ok := n.(*Element); ok {
+				fixBase(c, uri, base)
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// loadDoc parses the document at uri, and processes its xi:include elements
+func (x *xincluder) loadDoc(uri string) (*Document, error) {
+	if doc, ok := x.docs[uri]; ok {
+		return doc, nil
+	}
+
+	in, err := x.ctx.openResource(uri)
+	if err != nil {
+		return nil, err
+	}
+	if in == nil || in.Reader == nil {
+		return nil, errors.New("failed to load '" + uri + "'")
+	}
+	defer closeInput(in)
+
+	p := *x.parser
+	p.sax = NewTreeBuilder()
+	p.options &^= ParseXInclude | ParseDTDValid | ParseRecover
+	doc, err := p.parse(in.Reader, in.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	x.stack = append(x.stack, uri)
+	err = x.processChildren(doc)
+	x.stack = x.stack[:len(x.stack)-1]
+	if err != nil {
+		return nil, err
+	}
+
+	x.docs[uri] = doc
+	return doc, nil
+}
+
+// loadText loads the text that is included from uri, decoded with the
+// encoding given by e
+func (x *xincluder) loadText(e *Element, uri string) ([]Node, error) {
+	name, ok := getAttribute(e, "encoding")
+	if !ok {
+		name = "utf-8"
+	}
+	enc := encoding.Load(name)
+	if enc == nil {
+		return nil, fmt.Errorf("encoding '%s' is not supported", name)
+	}
+
+	in, err := x.ctx.openResource(uri)
+	if err != nil {
+		return nil, err
+	}
+	if in == nil || in.Reader == nil {
+		return nil, errors.New("failed to load '" + uri + "'")
+	}
+	defer closeInput(in)
+
+	b, err := io.ReadAll(enc.NewDecoder().Reader(in.Reader))
+	if err != nil {
+		return nil, err
+	}
+
+	s := strings.TrimPrefix(string(b), "\uFEFF")
+	for _, r := range s {
+		if !isChar(r) {
+			return nil, fmt.Errorf("'%s' contains invalid char 0x%X", uri, r)
+		}
+	}
+	if s == "" {
+		return nil, nil
+	}
+
+	t, err := e.OwnerDocument().CreateText([]byte(s))
+	if err != nil {
+		return nil, err
+	}
+	return []Node{t}, nil
+}
+
+// replace replaces e with nodes, between a pair of XIncludeNode markers
+// unless ParseNoXIncNode is set
+func (x *xincluder) replace(e *Element, nodes []Node) error {
+	if _, ok := e.Parent().(*Document); ok {
+		count := 0
+		for _, n := range nodes {
+			switch n.Type() {
+			case ElementNode:
+				count++
+			case TextNode:
+				if !isBlankText(n.Content()) {
+					return xincludeError(e, errors.New("text cannot be included at the top level of the document"))
+				}
+			}
+		}
+		if count != 1 {
+			return xincludeError(e, errors.New("the result must be a single element at the top level of the document"))
+		}
+	}
+
+	if x.parser.options.IsSet(ParseNoXIncNode) {
+		var ref Node = e
+		for _, n := range nodes {
+			addNextSibling(ref, n)
+			ref = n
+		}
+		unlinkNode(e)
+		return nil
+	}
+
+	start := newXIncludeNode(XIncludeStartNode)
+	start.doc = e.doc
+	start.name = e.name
+	start.ns = e.ns
+	start.nsDefs = e.nsDefs
+	start.setPosition(e.line, e.column)
+	start.properties = e.properties
+	for attr := start.properties; attr != nil; attr = attr.NextAttribute() {
+		attr.SetParent(start)
+	}
+	e.properties = nil
+	e.Replace(start)
+
+	var ref Node = start
+	for _, n := range nodes {
+		addNextSibling(ref, n)
+		ref = n
+	}
+	end := newXIncludeNode(XIncludeEndNode)
+	end.doc = e.doc
+	addNextSibling(ref, end)
+	return nil
+}
+
+func (x *xincluder) including(uri string) bool {
+	for _, s := range x.stack {
+		if s == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func isXIncludeElement(e *Element, name string) bool {
+	if e.LocalName() != name {
+		return false
+	}
+	uri := e.URI()
+	return uri == XIncludeNamespace || uri == XIncludeOldNamespace
+}
+
+func xincludeError(n Node, err error) error {
+	if _, ok := err.(ErrXInclude); ok {
+		return err
+	}
+	e := ErrXInclude{Err: err, Node: n}
+	if elem, ok := n.(*Element); ok {
+		e.LineNumber = elem.line
+	}
+	return e
+}
+
+// getAttribute returns the value of the attribute name of e
+func getAttribute(e *Element, name string) (string, bool) {
+	for attr := e.properties; attr != nil; attr = attr.NextAttribute() {
+		if attr.Name() == name {
+			return attr.Value(), true
+		}
+	}
+	return "", false
+}
+
+// detachChildren unlinks the children of n, and returns them
+func detachChildren(n Node) []Node {
+	var ret []Node
+	for c := n.FirstChild(); c != nil; c = n.FirstChild() {
+		unlinkNode(c)
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// nodeBase returns the base URI of n, from the xml:base attributes of n
+// and of its ancestors, and the URI of the document
+func nodeBase(n Node) string {
+	var bases []string
+	var base string
+	for ; n != nil; n = n.Parent() {
+		if d, ok := n.(*Document); ok {
+			base = d.URL()
+			break
+		}
+		if e, ok := n.(*Element); ok {
+			if b, ok := getAttribute(e, "xml:base"); ok {
+				bases = append(bases, b)
+			}
+		}
+		if n.Parent() == nil {
+			if d := n.OwnerDocument(); d != nil {
+				base = d.URL()
+			}
+		}
+	}
+
+	for i := len(bases) - 1; i >= 0; i-- {
+		base = buildURI(bases[i], base)
+	}
+	return base
+}
+
+// relativeURI expresses uri relative to base when possible
+func relativeURI(uri, base string) string {
+	if base == "" {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return uri
+	}
+
+	var rel string
+	switch {
+	case len(u.Scheme) < 2 && len(b.Scheme) < 2:
+		rel, err = filepath.Rel(filepath.Dir(base), uri)
+	case u.Scheme == b.Scheme && u.Host == b.Host:
+		rel, err = filepath.Rel(path.Dir(b.Path), u.Path)
+	default:
+		return uri
+	}
+	if err != nil {
+		return uri
+	}
+	return filepath.ToSlash(rel)
+}
+
+// fixBase sets xml:base on e, an element that was included from uri,
+// so that relative references in e are still resolved correctly in its
+// new location, whose base is base
+func fixBase(e *Element, uri, base string) {
+	target := uri
+	b, explicit := getAttribute(e, "xml:base")
+	if explicit {
+		target = buildURI(b, uri)
+	}
+
+	rel := relativeURI(target, base)
+	if !explicit && !strings.Contains(rel, "/") {
+		// same directory, nothing changes
+		return
+	}
+	e.RemoveAttribute("xml:base")
+	e.SetAttribute("xml:base", rel)
+}
+
+// copyNodes copies nodes into doc, to be inserted below parent. The
+// namespaces that are declared on the ancestors of the nodes are declared
+// on the copies as well, unless they are already in scope below parent.
+func copyNodes(nodes []Node, doc *Document, parent Node) ([]Node, error) {
+	var ret []Node
+	for _, n := range nodes {
+		copies, err := copyNode(n, doc, nil)
+		if err != nil {
+			return nil, err
+		}
+		if src, ok := n.(*Element); ok {
+			declareInScopeNamespaces(copies[0].(*Element), src, parent)
+		}
+		ret = append(ret, copies...)
+	}
+	return ret, nil
+}
+
+// copyNode copies n, and its descendants, into doc. Nodes that cannot
+// be included, such as the DTD, and the nodes for which skip returns
+// true result in no copies.
+func copyNode(n Node, doc *Document, skip func(Node) bool) ([]Node, error) {
+	if skip != nil && skip(n) {
+		return nil, nil
+	}
+
+	switch n := n.(type) {
+	case *Element:
+		e, err := doc.CreateElement(n.LocalName())
+		if err != nil {
+			return nil, err
+		}
+		e.setPosition(n.line, n.column)
+		for _, ns := range n.nsDefs {
+			if err := e.SetNamespace(ns.Prefix(), ns.URI()); err != nil {
+				return nil, err
+			}
+		}
+		if ns := n.ns; ns != nil {
+			if err := e.SetNamespace(ns.Prefix(), ns.URI(), true); err != nil {
+				return nil, err
+			}
+		}
+		for attr := n.properties; attr != nil; attr = attr.NextAttribute() {
+			// the value is already parsed, so it must not be parsed again
+			a := newAttribute(attr.name, attr.ns)
+			a.SetDefault(attr.IsDefault())
+			t, err := doc.CreateText([]byte(attr.Value()))
+			if err != nil {
+				return nil, err
+			}
+			if err := a.AddChild(t); err != nil {
+				return nil, err
+			}
+			if err := e.appendAttribute(a); err != nil {
+				return nil, err
+			}
+		}
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			copies, err := copyNode(c, doc, skip)
+			if err != nil {
+				return nil, err
+			}
+			for _, cc := range copies {
+				if err := e.AddChild(cc); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return []Node{e}, nil
+	case *Text:
+		t, err := doc.CreateText(n.Content())
+		if err != nil {
+			return nil, err
+		}
+		return []Node{t}, nil
+	case *CDATASection:
+		c, err := doc.CreateCDATASection(n.Content())
+		if err != nil {
+			return nil, err
+		}
+		return []Node{c}, nil
+	case *Comment:
+		c, err := doc.CreateComment(n.Content())
+		if err != nil {
+			return nil, err
+		}
+		return []Node{c}, nil
+	case *ProcessingInstruction:
+		pi, err := doc.CreatePI(n.target, n.data)
+		if err != nil {
+			return nil, err
+		}
+		return []Node{pi}, nil
+	case *EntityRef:
+		r, err := doc.CreateCharRef(n.name)
+		if err != nil {
+			return nil, err
+		}
+		r.content = n.content
+		if ent := n.FirstChild(); ent != nil {
+			r.setFirstChild(ent)
+			r.setLastChild(ent)
+		}
+		return []Node{r}, nil
+	}
+	return nil, nil
+}
+
+// declareInScopeNamespaces declares the namespaces that are in scope
+// for src, but declared on its ancestors, on dst unless they are in
+// scope below parent already
+func declareInScopeNamespaces(dst, src *Element, parent Node) {
+	for p := src.Parent(); p != nil; p = p.Parent() {
+		e, ok := p.(*Element)
+		if !ok {
+			continue
+		}
+		for _, ns := range e.nsDefs {
+			declared := false
+			for _, d := range dst.nsDefs {
+				if d.Prefix() == ns.Prefix() {
+					declared = true
+					break
+				}
+			}
+			if lookupNamespaceURI(parent, ns.Prefix()) == ns.URI() {
+				declared = true
+			}
+			if !declared {
+				dst.SetNamespace(ns.Prefix(), ns.URI())
+			}
+		}
+	}
+}
+
+// XPointerResolver returns the nodes of doc that are identified by the
+// XPointer ptr. It is used by XInclude to resolve the xpointer attribute.
+type XPointerResolver func(doc *Document, ptr string) ([]Node, error)
+
+// SetXPointerResolver sets the XPointerResolver that is used by this
+// parser when processing XInclude, for instance to support the schemes
+// of the xpointer package. Passing nil restores DefaultXPointerResolver.
+func (p *Parser) SetXPointerResolver(r XPointerResolver) {
+	p.xpointer = r
+}
+
+// resolveXPointer resolves ptr with the XPointerResolver of the parser.
+// The nodes that cannot be included, such as attributes, are rejected.
+func (x *xincluder) resolveXPointer(doc *Document, ptr string) ([]Node, error) {
+	r := x.parser.xpointer
+	if r == nil {
+		r = DefaultXPointerResolver
+	}
+
+	nodes, err := r(doc, ptr)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("%w: #%s", ErrXPointerNotFound, ptr)
+	}
+	var ret []Node
+	for _, n := range nodes {
+		switch n.Type() {
+		case AttributeNode, NamespaceDeclNode:
+			return nil, fmt.Errorf("XPointer selects an attribute: #%s", ptr)
+		case DocumentNode:
+			// the document stands for its children
+			for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+				ret = append(ret, c)
+			}
+		default:
+			ret = append(ret, n)
+		}
+	}
+	return ret, nil
+}
+
+// DefaultXPointerResolver supports shorthand pointers (an ID) and
+// sequences of pointer parts, of which the element() scheme is
+// supported
+func DefaultXPointerResolver(doc *Document, ptr string) ([]Node, error) {
+	parts, err := ParseXPointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		var e *Element
+		switch p.Scheme {
+		case "":
+			e = doc.GetElementByID(p.Data)
+		case "element":
+			e = XPointerElement(doc, p.Data)
+		}
+		// parts with unknown schemes are skipped
+		if e != nil {
+			return []Node{e}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: #%s", ErrXPointerNotFound, strings.TrimSpace(ptr))
+}
+
+// XPointerPart is a part of an XPointer, such as element(/1/2). The
+// escaping of Data has been removed. A shorthand pointer, which is the
+// value of an ID, is a single part whose Scheme is empty.
+type XPointerPart struct {
+	Scheme string
+	Data   string
+}
+
+// ParseXPointer splits ptr in pointer parts. It fails with
+// ErrInvalidXPointer if ptr is not a shorthand pointer or a sequence
+// of pointer parts. The parts are not evaluated.
+func ParseXPointer(ptr string) ([]XPointerPart, error) {
+	ptr = strings.TrimSpace(ptr)
+	if !strings.ContainsRune(ptr, '(') {
+		if !isNCName(ptr) {
+			return nil, fmt.Errorf("%w: '%s'", ErrInvalidXPointer, ptr)
+		}
+		return []XPointerPart{{Data: ptr}}, nil
+	}
+
+	var parts []XPointerPart
+	for rest := ptr; rest != ""; rest = strings.TrimLeftFunc(rest, unicode.IsSpace) {
+		i := strings.IndexByte(rest, '(')
+		if i < 1 || !isQName(rest[:i]) {
+			return nil, fmt.Errorf("%w: '%s'", ErrInvalidXPointer, ptr)
+		}
+
+		// the data ends at the matching parenthesis. '^' escapes
+		// parentheses and itself
+		var data []byte
+		depth := 1
+		j := i + 1
+		for ; j < len(rest) && depth > 0; j++ {
+			c := rest[j]
+			switch c {
+			case '^':
+				j++
+				if j == len(rest) || !strings.ContainsRune("()^", rune(rest[j])) {
+					return nil, fmt.Errorf("%w: '%s'", ErrInvalidXPointer, ptr)
+				}
+				c = rest[j]
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					continue
+				}
+			}
+			data = append(data, c)
+		}
+		if depth > 0 {
+			return nil, fmt.Errorf("%w: '%s'", ErrInvalidXPointer, ptr)
+		}
+		parts = append(parts, XPointerPart{Scheme: rest[:i], Data: string(data)})
+		rest = rest[j:]
+	}
+	return parts, nil
+}
+
+// XPointerElement evaluates the data of an element() pointer part,
+// which is an ID followed by a child sequence such as "/1/2", or
+// either of them. It returns nil if there is no such element.
+func XPointerElement(doc *Document, data string) *Element {
+	steps := strings.Split(data, "/")
+	var cur Node = doc
+	if steps[0] != "" {
+		e := doc.GetElementByID(steps[0])
+		if e == nil {
+			return nil
+		}
+		cur = e
+	} else if len(steps) == 1 {
+		return nil
+	}
+
+	for _, step := range steps[1:] {
+		n, err := strconv.Atoi(step)
+		if err != nil || n < 1 {
+			return nil
+		}
+
+		var found Node
+		for c := cur.FirstChild(); c != nil; c = c.NextSibling() {
+			if c.Type() != ElementNode {
+				continue
+			}
+			if n--; n == 0 {
+				found = c
+				break
+			}
+		}
+		if found == nil {
+			return nil
+		}
+		cur = found
+	}
+	e, _ := cur.(*Element)
+	return e
+}
+
+func isQName(s string) bool {
+	if prefix, local, ok := strings.Cut(s, ":"); ok {
+		return isNCName(prefix) && isNCName(local)
+	}
+	return isNCName(s)
+}
+
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r) || unicode.In(r, unicode.Mn, unicode.Mc)):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package helium
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXInclude(t *testing.T) {
+	files := map[string]string{
+		"http://example.com/doc.xml":        `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="sub/inc.xml"/></doc>`,
+		"http://example.com/sub/inc.xml":    `<?xml version="1.0"?><inc xmlns:a="urn:a"><a:x xml:id="x">one</a:x><y><z/><z>two</z></y></inc>`,
+		"http://example.com/sub/nested.xml": `<nested xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="inc.xml" xpointer="x"/></nested>`,
+		"http://example.com/text.txt":       "a < b & c",
+		"http://example.com/latin1.txt":     "caf\xe9",
+		"http://example.com/loop.xml":       `<loop xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="loop.xml"/></loop>`,
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		options  ParseOption
+		expected string
+	}{
+		{
+			name:     "whole document with base fixup",
+			input:    `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="sub/inc.xml"/></doc>`,
+			options:  ParseNoXIncNode,
+			expected: `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><inc xmlns:a="urn:a" xml:base="sub/inc.xml"><a:x xml:id="x">one</a:x><y><z/><z>two</z></y></inc></doc>`,
+		},
+		{
+			name:     "without base fixup",
+			input:    `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="sub/inc.xml"/></doc>`,
+			options:  ParseNoXIncNode | ParseNoBaseFix,
+			expected: `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><inc xmlns:a="urn:a"><a:x xml:id="x">one</a:x><y><z/><z>two</z></y></inc></doc>`,
+		},
+		{
+			name:     "shorthand xpointer keeps the namespaces in scope",
+			input:    `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="sub/inc.xml" xpointer="x"/></doc>`,
+			options:  ParseNoXIncNode | ParseNoBaseFix,
+			expected: `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><a:x xmlns:a="urn:a" xml:id="x">one</a:x></doc>`,
+		},
+		{
+			name:     "element() scheme",
+			input:    `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="sub/inc.xml" xpointer="element(/1/2/2)"/></doc>`,
+			options:  ParseNoXIncNode | ParseNoBaseFix,
+			expected: `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><z xmlns:a="urn:a">two</z></doc>`,
+		},
+		{
+			name:     "nested includes",
+			input:    `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="sub/nested.xml"/></doc>`,
+			options:  ParseNoXIncNode | ParseNoBaseFix,
+			expected: `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><nested xmlns:xi="http://www.w3.org/2001/XInclude"><a:x xmlns:a="urn:a" xml:id="x">one</a:x></nested></doc>`,
+		},
+		{
+			name:     "text",
+			input:    `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="text.txt" parse="text"/></doc>`,
+			options:  ParseNoXIncNode,
+			expected: `<doc xmlns:xi="http://www.w3.org/2001/XInclude">a &lt; b &amp; c</doc>`,
+		},
+		{
+			name:     "text with encoding",
+			input:    `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="latin1.txt" parse="text" encoding="iso-8859-1"/></doc>`,
+			options:  ParseNoXIncNode,
+			expected: `<doc xmlns:xi="http://www.w3.org/2001/XInclude">café</doc>`,
+		},
+		{
+			name:     "fallback",
+			input:    `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="missing.xml"><xi:fallback><xi:include href="text.txt" parse="text"/>!</xi:fallback></xi:include></doc>`,
+			options:  ParseNoXIncNode,
+			expected: `<doc xmlns:xi="http://www.w3.org/2001/XInclude">a &lt; b &amp; c!</doc>`,
+		},
+		{
+			name:     "local reference",
+			input:    `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><p xml:id="p">hello</p><xi:include xpointer="element(p)"/></doc>`,
+			options:  ParseNoXIncNode,
+			expected: `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><p xml:id="p">hello</p><p xml:id="p">hello</p></doc>`,
+		},
+		{
+			name:     "markers are not serialized",
+			input:    `<doc xmlns:xi="http://www.w3.org/2003/XInclude"><xi:include href="text.txt" parse="text"/></doc>`,
+			expected: `<doc xmlns:xi="http://www.w3.org/2003/XInclude">a &lt; b &amp; c</doc>`,
+		},
+	}
+
+	for _, test := range tests {
+		p := NewParser()
+		p.SetEntityLoader(mapEntityLoader(files))
+		if !assert.NoError(t, p.SetOption(ParseXInclude|test.options), "SetOption should succeed (%s)", test.name) {
+			return
+		}
+
+		doc, err := p.parse(strings.NewReader(test.input), "http://example.com/doc.xml")
+		if !assert.NoError(t, err, "parse should succeed (%s)", test.name) {
+			return
+		}
+
+		str, err := doc.DocumentElement().XMLString()
+		if !assert.NoError(t, err, "XMLString should succeed (%s)", test.name) {
+			return
+		}
+		if !assert.Equal(t, test.expected, str, test.name) {
+			return
+		}
+	}
+}
+
+func TestXIncludeNodes(t *testing.T) {
+	doc, err := Parse([]byte(`<doc xmlns:xi="http://www.w3.org/2001/XInclude"><p xml:id="p"/><xi:include xpointer="p"/></doc>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.NoError(t, doc.ProcessXInclude(), "ProcessXInclude should succeed") {
+		return
+	}
+
+	var types []ElementType
+	for c := doc.DocumentElement().FirstChild(); c != nil; c = c.NextSibling() {
+		types = append(types, c.Type())
+	}
+	if !assert.Equal(t, []ElementType{ElementNode, XIncludeStartNode, ElementNode, XIncludeEndNode}, types, "included nodes are between markers") {
+		return
+	}
+
+	start := doc.DocumentElement().FirstChild().NextSibling()
+	if !assert.Equal(t, "xi:include", start.Name(), "start marker keeps the name") {
+		return
+	}
+}
+
+func TestDefaultXPointerResolver(t *testing.T) {
+	doc, err := Parse([]byte(`<doc><p xml:id="p"><a/><b/></p></doc>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	tests := map[string]string{
+		"p":                       "p",
+		"element(p/2)":            "b",
+		"x:y(^)) element(/1/1/1)": "a",
+	}
+	for ptr, expected := range tests {
+		nodes, err := DefaultXPointerResolver(doc, ptr)
+		if !assert.NoError(t, err, "%s should resolve", ptr) ||
+			!assert.Len(t, nodes, 1, "%s identifies a node", ptr) ||
+			!assert.Equal(t, expected, nodes[0].Name(), "%s identifies the node", ptr) {
+			return
+		}
+	}
+
+	errs := map[string]error{
+		"missing":          ErrXPointerNotFound,
+		"element(/2)":      ErrXPointerNotFound,
+		"1st":              ErrInvalidXPointer,
+		"element(^x)":      ErrInvalidXPointer,
+		"1x(y) element(p)": ErrInvalidXPointer,
+	}
+	for ptr, expected := range errs {
+		_, err := DefaultXPointerResolver(doc, ptr)
+		if !assert.True(t, errors.Is(err, expected), "%s should fail with %v, got %v", ptr, expected, err) {
+			return
+		}
+	}
+}
+
+func TestXIncludeErrors(t *testing.T) {
+	files := map[string]string{
+		"http://example.com/loop.xml": `<loop xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="loop.xml"/></loop>`,
+	}
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"missing resource without fallback", `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="missing.xml"/></doc>`},
+		{"inclusion loop", `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="loop.xml"/></doc>`},
+		{"local loop", `<doc xmlns:xi="http://www.w3.org/2001/XInclude" xml:id="d"><xi:include xpointer="d"/></doc>`},
+		{"no href and no xpointer", `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include/></doc>`},
+		{"invalid parse", `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="loop.xml" parse="html"/></doc>`},
+		{"stray fallback", `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:fallback/></doc>`},
+		{"unresolved xpointer", `<doc xmlns:xi="http://www.w3.org/2001/XInclude"><xi:include href="loop.xml" xpointer="element(/2)"/></doc>`},
+	}
+
+	for _, test := range tests {
+		p := NewParser()
+		p.SetEntityLoader(mapEntityLoader(files))
+		if !assert.NoError(t, p.SetOption(ParseXInclude), "SetOption should succeed") {
+			return
+		}
+
+		_, err := p.parse(strings.NewReader(test.input), "http://example.com/doc.xml")
+		if !assert.Error(t, err, "parse should fail (%s)", test.name) {
+			return
+		}
+		if !assert.IsType(t, ErrXInclude{}, err, "error is an ErrXInclude (%s)", test.name) {
+			return
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package xpath
+
+import (
+	"strings"
+
+	"github.com/lestrrat/helium"
+)
+
+func isReverseAxis(a axis) bool {
+	switch a {
+	case axisAncestor, axisAncestorOrSelf, axisPreceding, axisPrecedingSibling:
+		return true
+	}
+	return false
+}
+
+// isTreeNode reports if n is one of the nodes of the XPath data model
+// that appear as children. DTDs and XInclude markers are skipped.
+func isTreeNode(n helium.Node) bool {
+	switch n.Type() {
+	case helium.ElementNode, helium.TextNode, helium.CDATASectionNode, helium.CommentNode,
+		helium.ProcessingInstructionNode, helium.EntityRefNode:
+		return true
+	}
+	return false
+}
+
+func hasChildren(n helium.Node) bool {
+	switch n.Type() {
+	case helium.ElementNode, helium.DocumentNode:
+		return true
+	}
+	return false
+}
+
+func parentOf(n helium.Node) helium.Node {
+	p := n.Parent()
+	if p == nil {
+		return nil
+	}
+	switch p.Type() {
+	case helium.ElementNode, helium.DocumentNode:
+		return p
+	}
+	return nil
+}
+
+// root returns the root of the tree that n belongs to
+func root(n helium.Node) helium.Node {
+	for {
+		p := parentOf(n)
+		if p == nil {
+			return n
+		}
+		n = p
+	}
+}
+
+func firstChild(n helium.Node) helium.Node {
+	if !hasChildren(n) {
+		return nil
+	}
+	c := n.FirstChild()
+	if c != nil && !isTreeNode(c) {
+		c = nextSibling(c)
+	}
+	return c
+}
+
+func lastChild(n helium.Node) helium.Node {
+	if !hasChildren(n) {
+		return nil
+	}
+	c := n.LastChild()
+	if c != nil && !isTreeNode(c) {
+		c = prevSibling(c)
+	}
+	return c
+}
+
+func nextSibling(n helium.Node) helium.Node {
+	for n = n.NextSibling(); n != nil; n = n.NextSibling() {
+		if isTreeNode(n) {
+			return n
+		}
+	}
+	return nil
+}
+
+func prevSibling(n helium.Node) helium.Node {
+	for n = n.PrevSibling(); n != nil; n = n.PrevSibling() {
+		if isTreeNode(n) {
+			return n
+		}
+	}
+	return nil
+}
+
+// isAttributeLike reports if n is an attribute or a namespace node,
+// which have a parent but are not its children
+func isAttributeLike(n helium.Node) bool {
+	switch n.Type() {
+	case helium.AttributeNode, helium.NamespaceDeclNode:
+		return true
+	}
+	return false
+}
+
+// walkAxis calls f with each node on the axis of n, in the order of
+// the axis: reverse axes go backwards in document order
+func walkAxis(a axis, n helium.Node, f func(helium.Node)) {
+	switch a {
+	case axisSelf:
+		f(n)
+	case axisChild:
+		for c := firstChild(n); c != nil; c = nextSibling(c) {
+			f(c)
+		}
+	case axisDescendant:
+		walkDescendants(n, f)
+	case axisDescendantOrSelf:
+		f(n)
+		walkDescendants(n, f)
+	case axisParent:
+		if p := parentOf(n); p != nil {
+			f(p)
+		}
+	case axisAncestor:
+		for p := parentOf(n); p != nil; p = parentOf(p) {
+			f(p)
+		}
+	case axisAncestorOrSelf:
+		for p := n; p != nil; p = parentOf(p) {
+			f(p)
+		}
+	case axisFollowingSibling:
+		if isAttributeLike(n) {
+			return
+		}
+		for s := nextSibling(n); s != nil; s = nextSibling(s) {
+			f(s)
+		}
+	case axisPrecedingSibling:
+		if isAttributeLike(n) {
+			return
+		}
+		for s := prevSibling(n); s != nil; s = prevSibling(s) {
+			f(s)
+		}
+	case axisFollowing:
+		if isAttributeLike(n) {
+			// the children of the element follow its attributes
+			n = parentOf(n)
+			if n == nil {
+				return
+			}
+			walkDescendants(n, f)
+		}
+		for cur := n; cur != nil; cur = parentOf(cur) {
+			for s := nextSibling(cur); s != nil; s = nextSibling(s) {
+				f(s)
+				walkDescendants(s, f)
+			}
+		}
+	case axisPreceding:
+		if isAttributeLike(n) {
+			n = parentOf(n)
+		}
+		for cur := n; cur != nil; cur = parentOf(cur) {
+			for s := prevSibling(cur); s != nil; s = prevSibling(s) {
+				walkReverse(s, f)
+			}
+		}
+	case axisAttribute:
+		if e, ok := n.(*helium.Element); ok {
+			for _, attr := range e.Attributes() {
+				f(attr)
+			}
+		}
+	case axisNamespace:
+		if e, ok := n.(*helium.Element); ok {
+			for _, ns := range e.NamespaceNodes() {
+				f(ns)
+			}
+		}
+	}
+}
+
+// walkDescendants calls f with the descendants of n, in document order
+func walkDescendants(n helium.Node, f func(helium.Node)) {
+	for c := firstChild(n); c != nil; c = nextSibling(c) {
+		f(c)
+		walkDescendants(c, f)
+	}
+}
+
+// walkReverse calls f with n and its descendants, in reverse document order
+func walkReverse(n helium.Node, f func(helium.Node)) {
+	for c := lastChild(n); c != nil; c = prevSibling(c) {
+		walkReverse(c, f)
+	}
+	f(n)
+}
+
+// nodeMatcher returns the function that applies the node test of s to
+// the nodes on its axis
+func (env *environment) nodeMatcher(s *step) (func(helium.Node) bool, error) {
+	switch s.test.typ {
+	case testNode:
+		return func(helium.Node) bool { return true }, nil
+	case testText:
+		return func(n helium.Node) bool {
+			t := n.Type()
+			return t == helium.TextNode || t == helium.CDATASectionNode
+		}, nil
+	case testComment:
+		return func(n helium.Node) bool { return n.Type() == helium.CommentNode }, nil
+	case testPI:
+		target := s.test.local
+		return func(n helium.Node) bool {
+			pi, ok := n.(*helium.ProcessingInstruction)
+			return ok && (target == "" || pi.Target() == target)
+		}, nil
+	}
+
+	// name tests only match the principal node type of the axis
+	principal := helium.ElementNode
+	switch s.axis {
+	case axisAttribute:
+		principal = helium.AttributeNode
+	case axisNamespace:
+		principal = helium.NamespaceDeclNode
+	}
+
+	local := s.test.local
+	if local == "*" && s.test.prefix == "" {
+		return func(n helium.Node) bool { return n.Type() == principal }, nil
+	}
+
+	var uri string
+	if s.test.prefix != "" {
+		var err error
+		if uri, err = env.lookupNamespace(s.test.prefix); err != nil {
+			return nil, err
+		}
+	}
+	return func(n helium.Node) bool {
+		if n.Type() != principal {
+			return false
+		}
+		nlocal, nuri := expandedName(n)
+		return (local == "*" || local == nlocal) && uri == nuri
+	}, nil
+}
+
+// expandedName returns the local name and the namespace URI of n. Nodes
+// created by the parser may carry a prefixed name without a namespace,
+// in which case the prefix is looked up in the scope of the node.
+func expandedName(n helium.Node) (local, uri string) {
+	switch n := n.(type) {
+	case *helium.Element:
+		local = n.LocalName()
+		uri = n.URI()
+	case *helium.Attribute:
+		local = n.LocalName()
+		uri = n.URI()
+	case *helium.ProcessingInstruction:
+		return n.Target(), ""
+	case *helium.NamespaceDecl:
+		return n.Prefix(), ""
+	default:
+		return "", ""
+	}
+
+	if uri == "" {
+		if i := strings.IndexByte(local, ':'); i > -1 {
+			uri = lookupPrefix(n, local[:i])
+			local = local[i+1:]
+		}
+	}
+	return local, uri
+}
+
+// lookupPrefix returns the namespace URI bound to prefix in the scope
+// of n, or "" if it is not bound
+func lookupPrefix(n helium.Node, prefix string) string {
+	if prefix == helium.XMLPrefix {
+		return helium.XMLNamespace
+	}
+	for p := n; p != nil; p = p.Parent() {
+		e, ok := p.(*helium.Element)
+		if !ok {
+			continue
+		}
+		for _, ns := range e.Namespaces() {
+			if ns.Prefix() == prefix {
+				return ns.URI()
+			}
+		}
+	}
+	return ""
+}
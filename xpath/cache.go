@@ -0,0 +1,40 @@
+package xpath
+
+// defaultCache holds the expressions compiled by Context.Evaluate and
+// Context.Find
+var defaultCache = newExprCache(1024)
+
+func newExprCache(max int) *exprCache {
+	return &exprCache{
+		max:   max,
+		exprs: make(map[string]*Expr),
+	}
+}
+
+// get returns the compiled expression s, compiling it if it is not
+// in the cache yet. Errors are not cached.
+func (c *exprCache) get(s string) (*Expr, error) {
+	c.mu.RLock()
+	e, ok := c.exprs[s]
+	c.mu.RUnlock()
+	if ok {
+		return e, nil
+	}
+
+	e, err := Compile(s)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.exprs) >= c.max {
+		// make room by dropping an arbitrary expression
+		for k := range c.exprs {
+			delete(c.exprs, k)
+			break
+		}
+	}
+	c.exprs[s] = e
+	return e, nil
+}
@@ -0,0 +1,7 @@
+package xpath
+
+import "fmt"
+
+func (e ErrSyntax) Error() string {
+	return fmt.Sprintf("xpath: %s at offset %d in '%s'", e.Msg, e.Pos, e.Expr)
+}
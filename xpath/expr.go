@@ -0,0 +1,378 @@
+package xpath
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/lestrrat/helium"
+)
+
+type literalExpr string
+
+func (e literalExpr) eval(ctx *evalContext) (interface{}, error) {
+	return string(e), nil
+}
+
+type numberExpr float64
+
+func (e numberExpr) eval(ctx *evalContext) (interface{}, error) {
+	return float64(e), nil
+}
+
+type variableExpr struct {
+	prefix string
+	local  string
+}
+
+func (e *variableExpr) eval(ctx *evalContext) (interface{}, error) {
+	name := e.local
+	if e.prefix != "" {
+		uri, err := ctx.env.lookupNamespace(e.prefix)
+		if err != nil {
+			return nil, err
+		}
+		name = expandName(uri, e.local)
+	}
+
+	v, ok := ctx.env.ctx.Variables[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: $%s", ErrUndefinedVariable, name)
+	}
+	return ctx.env.fromGo(v)
+}
+
+type negateExpr struct {
+	e expr
+}
+
+func (e *negateExpr) eval(ctx *evalContext) (interface{}, error) {
+	v, err := e.e.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return -toNumber(v), nil
+}
+
+type binaryExpr struct {
+	op  tokenType
+	lhs expr
+	rhs expr
+}
+
+func (e *binaryExpr) eval(ctx *evalContext) (interface{}, error) {
+	lhs, err := e.lhs.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// the right operand of 'and' and 'or' is only evaluated if needed
+	switch e.op {
+	case tokOr:
+		if toBool(lhs) {
+			return true, nil
+		}
+	case tokAnd:
+		if !toBool(lhs) {
+			return false, nil
+		}
+	}
+
+	rhs, err := e.rhs.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case tokOr, tokAnd:
+		return toBool(rhs), nil
+	case tokEq, tokNeq, tokLt, tokLe, tokGt, tokGe:
+		return compare(e.op, lhs, rhs), nil
+	}
+
+	l := toNumber(lhs)
+	r := toNumber(rhs)
+	switch e.op {
+	case tokPlus:
+		return l + r, nil
+	case tokMinus:
+		return l - r, nil
+	case tokMultiply:
+		return l * r, nil
+	case tokDiv:
+		return l / r, nil
+	case tokMod:
+		return math.Mod(l, r), nil
+	}
+	return nil, fmt.Errorf("unknown operator %d", e.op)
+}
+
+type unionExpr struct {
+	lhs expr
+	rhs expr
+}
+
+func (e *unionExpr) eval(ctx *evalContext) (interface{}, error) {
+	lhs, err := evalNodeSet(ctx, e.lhs)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := evalNodeSet(ctx, e.rhs)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(NodeSet, 0, len(lhs)+len(rhs))
+	nodes = append(nodes, lhs...)
+	nodes = append(nodes, rhs...)
+	return ctx.env.sortNodes(nodes), nil
+}
+
+type filterExpr struct {
+	e     expr
+	preds []expr
+}
+
+func (e *filterExpr) eval(ctx *evalContext) (interface{}, error) {
+	nodes, err := evalNodeSet(ctx, e.e)
+	if err != nil {
+		return nil, err
+	}
+	for _, pred := range e.preds {
+		if nodes, err = ctx.env.filter(nodes, pred); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// pathExpr is a location path, which starts at the root if absolute,
+// at the nodes selected by filter if any, or at the context node
+type pathExpr struct {
+	filter   expr
+	absolute bool
+	steps    []*step
+}
+
+func (e *pathExpr) eval(ctx *evalContext) (interface{}, error) {
+	var nodes NodeSet
+	switch {
+	case e.filter != nil:
+		var err error
+		if nodes, err = evalNodeSet(ctx, e.filter); err != nil {
+			return nil, err
+		}
+	case e.absolute:
+		nodes = NodeSet{root(ctx.node)}
+	default:
+		nodes = NodeSet{ctx.node}
+	}
+
+	for _, s := range e.steps {
+		var err error
+		if nodes, err = ctx.env.applyStep(s, nodes); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+type functionCall struct {
+	prefix string
+	local  string
+	args   []expr
+}
+
+func (e *functionCall) eval(ctx *evalContext) (interface{}, error) {
+	fn, err := ctx.env.lookupFunction(e.prefix, e.local)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		v, err := arg.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	v, err := fn(ctx, args)
+	if err != nil {
+		if e.prefix != "" {
+			return nil, fmt.Errorf("%s:%s(): %w", e.prefix, e.local, err)
+		}
+		return nil, fmt.Errorf("%s(): %w", e.local, err)
+	}
+	return v, nil
+}
+
+// applyStep selects the nodes of the step, starting from each of nodes
+func (env *environment) applyStep(s *step, nodes NodeSet) (NodeSet, error) {
+	match, err := env.nodeMatcher(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret NodeSet
+	for _, n := range nodes {
+		var selected NodeSet
+		walkAxis(s.axis, n, func(c helium.Node) {
+			if match(c) {
+				selected = append(selected, c)
+			}
+		})
+
+		// the positions in the predicates follow the direction of the axis
+		for _, pred := range s.preds {
+			if selected, err = env.filter(selected, pred); err != nil {
+				return nil, err
+			}
+		}
+		if isReverseAxis(s.axis) {
+			for i, j := 0, len(selected)-1; i < j; i, j = i+1, j-1 {
+				selected[i], selected[j] = selected[j], selected[i]
+			}
+		}
+		ret = append(ret, selected...)
+	}
+
+	if len(nodes) > 1 {
+		ret = env.sortNodes(ret)
+	}
+	return ret, nil
+}
+
+// filter returns the nodes for which pred is true
+func (env *environment) filter(nodes NodeSet, pred expr) (NodeSet, error) {
+	// fast path for [n]
+	if n, ok := pred.(numberExpr); ok {
+		i := float64(n)
+		if i < 1 || i > float64(len(nodes)) || i != math.Floor(i) {
+			return nil, nil
+		}
+		return NodeSet{nodes[int(i)-1]}, nil
+	}
+
+	var ret NodeSet
+	for i, n := range nodes {
+		v, err := pred.eval(&evalContext{node: n, pos: i + 1, size: len(nodes), env: env})
+		if err != nil {
+			return nil, err
+		}
+
+		var keep bool
+		if f, ok := v.(float64); ok {
+			keep = f == float64(i+1)
+		} else {
+			keep = toBool(v)
+		}
+		if keep {
+			ret = append(ret, n)
+		}
+	}
+	return ret, nil
+}
+
+func evalNodeSet(ctx *evalContext, e expr) (NodeSet, error) {
+	v, err := e.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nodes, ok := v.(NodeSet)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a node-set", ErrInvalidType)
+	}
+	return nodes, nil
+}
+
+// compare implements the comparison operators, which have special
+// rules when node-sets are involved
+func compare(op tokenType, lhs, rhs interface{}) bool {
+	lnodes, lok := lhs.(NodeSet)
+	rnodes, rok := rhs.(NodeSet)
+	switch {
+	case lok && rok:
+		for _, l := range lnodes {
+			ls := stringValue(l)
+			for _, r := range rnodes {
+				if compareValues(op, ls, stringValue(r)) {
+					return true
+				}
+			}
+		}
+		return false
+	case lok:
+		return compareNodeSet(op, lnodes, rhs, false)
+	case rok:
+		return compareNodeSet(op, rnodes, lhs, true)
+	}
+	return compareValues(op, lhs, rhs)
+}
+
+// compareNodeSet compares each node of nodes to v. If swapped, the
+// node-set is the right operand.
+func compareNodeSet(op tokenType, nodes NodeSet, v interface{}, swapped bool) bool {
+	if b, ok := v.(bool); ok {
+		if swapped {
+			return compareValues(op, b, len(nodes) > 0)
+		}
+		return compareValues(op, len(nodes) > 0, b)
+	}
+
+	for _, n := range nodes {
+		var nv interface{} = stringValue(n)
+		if _, ok := v.(float64); ok {
+			nv = toNumber(nv)
+		}
+
+		var ok bool
+		if swapped {
+			ok = compareValues(op, v, nv)
+		} else {
+			ok = compareValues(op, nv, v)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValues compares two values that are not node-sets
+func compareValues(op tokenType, lhs, rhs interface{}) bool {
+	switch op {
+	case tokEq, tokNeq:
+		var eq bool
+		_, lbool := lhs.(bool)
+		_, rbool := rhs.(bool)
+		_, lnum := lhs.(float64)
+		_, rnum := rhs.(float64)
+		switch {
+		case lbool || rbool:
+			eq = toBool(lhs) == toBool(rhs)
+		case lnum || rnum:
+			eq = toNumber(lhs) == toNumber(rhs)
+		default:
+			eq = toString(lhs) == toString(rhs)
+		}
+		if op == tokEq {
+			return eq
+		}
+		return !eq
+	}
+
+	l := toNumber(lhs)
+	r := toNumber(rhs)
+	switch op {
+	case tokLt:
+		return l < r
+	case tokLe:
+		return l <= r
+	case tokGt:
+		return l > r
+	case tokGe:
+		return l >= r
+	}
+	return false
+}
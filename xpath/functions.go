@@ -0,0 +1,456 @@
+package xpath
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lestrrat/helium"
+)
+
+// function is the implementation of a function of the library. The
+// arguments have been evaluated, and are a NodeSet, a bool, a float64
+// or a string.
+type function func(ctx *evalContext, args []interface{}) (interface{}, error)
+
+// coreFunctions is the core function library of XPath 1.0
+var coreFunctions = map[string]function{
+	// node-set functions
+	"last":          fnLast,
+	"position":      fnPosition,
+	"count":         fnCount,
+	"id":            fnID,
+	"local-name":    fnLocalName,
+	"namespace-uri": fnNamespaceURI,
+	"name":          fnName,
+	// string functions
+	"string":           fnString,
+	"concat":           fnConcat,
+	"starts-with":      fnStartsWith,
+	"contains":         fnContains,
+	"substring-before": fnSubstringBefore,
+	"substring-after":  fnSubstringAfter,
+	"substring":        fnSubstring,
+	"string-length":    fnStringLength,
+	"normalize-space":  fnNormalizeSpace,
+	"translate":        fnTranslate,
+	// boolean functions
+	"boolean": fnBoolean,
+	"not":     fnNot,
+	"true":    fnTrue,
+	"false":   fnFalse,
+	"lang":    fnLang,
+	// number functions
+	"number":  fnNumber,
+	"sum":     fnSum,
+	"floor":   fnFloor,
+	"ceiling": fnCeiling,
+	"round":   fnRound,
+}
+
+// lookupFunction returns the core function or the extension function
+// that is called by the name prefix:local
+func (env *environment) lookupFunction(prefix, local string) (function, error) {
+	var uri string
+	if prefix == "" {
+		if fn, ok := coreFunctions[local]; ok {
+			return fn, nil
+		}
+	} else {
+		var err error
+		if uri, err = env.lookupNamespace(prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	ext, ok := env.ctx.Functions[expandName(uri, local)]
+	if !ok {
+		if prefix != "" {
+			local = prefix + ":" + local
+		}
+		return nil, fmt.Errorf("%w: %s()", ErrUnknownFunction, local)
+	}
+	return func(ctx *evalContext, args []interface{}) (interface{}, error) {
+		objs := make([]*Object, len(args))
+		for i, arg := range args {
+			objs[i] = &Object{value: arg}
+		}
+		v, err := ext(&FunctionContext{Context: env.ctx, Node: ctx.node, Position: ctx.pos, Size: ctx.size}, objs)
+		if err != nil {
+			return nil, err
+		}
+		return env.fromGo(v)
+	}, nil
+}
+
+func checkArity(args []interface{}, min, max int) error {
+	if len(args) < min || max > -1 && len(args) > max {
+		return fmt.Errorf("%w: %d", ErrInvalidArity, len(args))
+	}
+	return nil
+}
+
+func nodeSetArg(v interface{}) (NodeSet, error) {
+	nodes, ok := v.(NodeSet)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a node-set", ErrInvalidType)
+	}
+	return nodes, nil
+}
+
+// optionalNodeArg returns the first node of the argument, or the
+// context node if there is no argument
+func optionalNodeArg(ctx *evalContext, args []interface{}) (helium.Node, error) {
+	if err := checkArity(args, 0, 1); err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return ctx.node, nil
+	}
+	nodes, err := nodeSetArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	return nodes[0], nil
+}
+
+// optionalStringArg returns the argument as a string, or the
+// string-value of the context node if there is no argument
+func optionalStringArg(ctx *evalContext, args []interface{}) (string, error) {
+	if err := checkArity(args, 0, 1); err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return stringValue(ctx.node), nil
+	}
+	return toString(args[0]), nil
+}
+
+func stringArgs(args []interface{}, n int) ([]string, error) {
+	if err := checkArity(args, n, n); err != nil {
+		return nil, err
+	}
+	ret := make([]string, n)
+	for i, arg := range args {
+		ret[i] = toString(arg)
+	}
+	return ret, nil
+}
+
+func fnLast(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 0, 0); err != nil {
+		return nil, err
+	}
+	return float64(ctx.size), nil
+}
+
+func fnPosition(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 0, 0); err != nil {
+		return nil, err
+	}
+	return float64(ctx.pos), nil
+}
+
+func fnCount(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 1, 1); err != nil {
+		return nil, err
+	}
+	nodes, err := nodeSetArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return float64(len(nodes)), nil
+}
+
+func fnID(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 1, 1); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if nodes, ok := args[0].(NodeSet); ok {
+		for _, n := range nodes {
+			ids = append(ids, strings.Fields(stringValue(n))...)
+		}
+	} else {
+		ids = strings.Fields(toString(args[0]))
+	}
+
+	doc, ok := root(ctx.node).(*helium.Document)
+	if !ok {
+		return NodeSet{}, nil
+	}
+	ret := NodeSet{}
+	for _, id := range ids {
+		if e := doc.GetElementByID(id); e != nil {
+			ret = append(ret, e)
+		}
+	}
+	return ctx.env.sortNodes(ret), nil
+}
+
+func fnLocalName(ctx *evalContext, args []interface{}) (interface{}, error) {
+	n, err := optionalNodeArg(ctx, args)
+	if err != nil || n == nil {
+		return "", err
+	}
+	local, _ := expandedName(n)
+	return local, nil
+}
+
+func fnNamespaceURI(ctx *evalContext, args []interface{}) (interface{}, error) {
+	n, err := optionalNodeArg(ctx, args)
+	if err != nil || n == nil {
+		return "", err
+	}
+	_, uri := expandedName(n)
+	return uri, nil
+}
+
+func fnName(ctx *evalContext, args []interface{}) (interface{}, error) {
+	n, err := optionalNodeArg(ctx, args)
+	if err != nil || n == nil {
+		return "", err
+	}
+	switch n := n.(type) {
+	case *helium.Element:
+		return n.Name(), nil
+	case *helium.Attribute:
+		return n.Name(), nil
+	}
+	local, _ := expandedName(n)
+	return local, nil
+}
+
+func fnString(ctx *evalContext, args []interface{}) (interface{}, error) {
+	return optionalStringArg(ctx, args)
+}
+
+func fnConcat(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 2, -1); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for _, arg := range args {
+		b.WriteString(toString(arg))
+	}
+	return b.String(), nil
+}
+
+func fnStartsWith(ctx *evalContext, args []interface{}) (interface{}, error) {
+	s, err := stringArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	return strings.HasPrefix(s[0], s[1]), nil
+}
+
+func fnContains(ctx *evalContext, args []interface{}) (interface{}, error) {
+	s, err := stringArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Contains(s[0], s[1]), nil
+}
+
+func fnSubstringBefore(ctx *evalContext, args []interface{}) (interface{}, error) {
+	s, err := stringArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	if i := strings.Index(s[0], s[1]); i > -1 {
+		return s[0][:i], nil
+	}
+	return "", nil
+}
+
+func fnSubstringAfter(ctx *evalContext, args []interface{}) (interface{}, error) {
+	s, err := stringArgs(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	if i := strings.Index(s[0], s[1]); i > -1 {
+		return s[0][i+len(s[1]):], nil
+	}
+	return "", nil
+}
+
+// fnSubstring counts characters from 1, and includes the characters
+// whose position p is such that round(start) <= p < round(start) + round(length)
+func fnSubstring(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 2, 3); err != nil {
+		return nil, err
+	}
+	runes := []rune(toString(args[0]))
+	first := round(toNumber(args[1]))
+	last := math.Inf(1)
+	if len(args) == 3 {
+		last = first + round(toNumber(args[2]))
+	}
+
+	var b strings.Builder
+	for i, r := range runes {
+		p := float64(i + 1)
+		if p >= first && p < last {
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), nil
+}
+
+func fnStringLength(ctx *evalContext, args []interface{}) (interface{}, error) {
+	s, err := optionalStringArg(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return float64(utf8.RuneCountInString(s)), nil
+}
+
+func fnNormalizeSpace(ctx *evalContext, args []interface{}) (interface{}, error) {
+	s, err := optionalStringArg(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool {
+		return r < utf8.RuneSelf && isSpace(byte(r))
+	}), " "), nil
+}
+
+func fnTranslate(ctx *evalContext, args []interface{}) (interface{}, error) {
+	s, err := stringArgs(args, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	from := []rune(s[1])
+	to := []rune(s[2])
+	return strings.Map(func(r rune) rune {
+		for i, f := range from {
+			if f != r {
+				continue
+			}
+			if i < len(to) {
+				return to[i]
+			}
+			return -1
+		}
+		return r
+	}, s[0]), nil
+}
+
+func fnBoolean(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 1, 1); err != nil {
+		return nil, err
+	}
+	return toBool(args[0]), nil
+}
+
+func fnNot(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 1, 1); err != nil {
+		return nil, err
+	}
+	return !toBool(args[0]), nil
+}
+
+func fnTrue(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 0, 0); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+func fnFalse(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 0, 0); err != nil {
+		return nil, err
+	}
+	return false, nil
+}
+
+// fnLang compares the xml:lang attribute in scope with the argument,
+// ignoring case and any suffix that starts with '-'
+func fnLang(ctx *evalContext, args []interface{}) (interface{}, error) {
+	s, err := stringArgs(args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for n := ctx.node; n != nil; n = n.Parent() {
+		e, ok := n.(*helium.Element)
+		if !ok {
+			continue
+		}
+		for _, attr := range e.Attributes() {
+			if local, uri := expandedName(attr); local != "lang" || uri != helium.XMLNamespace {
+				continue
+			}
+			lang := attr.Value()
+			if i := strings.IndexByte(lang, '-'); i > -1 {
+				lang = lang[:i]
+			}
+			return strings.EqualFold(lang, s[0]), nil
+		}
+	}
+	return false, nil
+}
+
+func fnNumber(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 0, 1); err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return toNumber(stringValue(ctx.node)), nil
+	}
+	return toNumber(args[0]), nil
+}
+
+func fnSum(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 1, 1); err != nil {
+		return nil, err
+	}
+	nodes, err := nodeSetArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var sum float64
+	for _, n := range nodes {
+		sum += toNumber(stringValue(n))
+	}
+	return sum, nil
+}
+
+func fnFloor(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 1, 1); err != nil {
+		return nil, err
+	}
+	return math.Floor(toNumber(args[0])), nil
+}
+
+func fnCeiling(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 1, 1); err != nil {
+		return nil, err
+	}
+	return math.Ceil(toNumber(args[0])), nil
+}
+
+func fnRound(ctx *evalContext, args []interface{}) (interface{}, error) {
+	if err := checkArity(args, 1, 1); err != nil {
+		return nil, err
+	}
+	return round(toNumber(args[0])), nil
+}
+
+// round rounds to the closest integer, and halves towards positive
+// infinity
+func round(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return f
+	}
+	if f < 0 && f >= -0.5 {
+		return math.Copysign(0, -1)
+	}
+	return math.Floor(f + 0.5)
+}
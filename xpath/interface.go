@@ -0,0 +1,154 @@
+package xpath
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/lestrrat/helium"
+)
+
+var (
+	ErrInvalidArity       = errors.New("invalid number of arguments")
+	ErrInvalidType        = errors.New("invalid type")
+	ErrUndefinedNamespace = errors.New("undefined namespace prefix")
+	ErrUndefinedVariable  = errors.New("undefined variable")
+	ErrUnknownFunction    = errors.New("unregistered function")
+)
+
+// ErrSyntax is returned when an expression cannot be compiled. Pos is
+// the offset in Expr where the problem was found.
+type ErrSyntax struct {
+	Expr string
+	Pos  int
+	Msg  string
+}
+
+// ObjectType is the type of the value of an expression
+type ObjectType int
+
+const (
+	NodeSetType ObjectType = iota + 1
+	BooleanType
+	NumberType
+	StringType
+)
+
+// NodeSet is a set of nodes, in document order and without duplicates.
+// The namespace nodes are *helium.NamespaceDecl.
+type NodeSet []helium.Node
+
+// Object is the value of an expression: a NodeSet, a bool, a float64
+// or a string
+type Object struct {
+	value interface{}
+}
+
+// Context holds the bindings that expressions are evaluated with.
+// The zero value is ready to use. A Context may be shared by
+// concurrent evaluations, as long as it is not modified.
+type Context struct {
+	// Namespaces maps the prefixes used in expressions to namespace
+	// URIs. The xml prefix is always bound.
+	Namespaces map[string]string
+	// Variables holds the values of the variables. Variables with a
+	// prefixed name are looked up as "{uri}local". The values may be
+	// a NodeSet, a helium.Node, a bool, a string, any Go number, or
+	// an *Object.
+	Variables map[string]interface{}
+	// Functions holds the extension functions, keyed like Variables.
+	// Functions without a namespace are looked up after the core
+	// function library. See RegisterFunction.
+	Functions map[string]Function
+	// Position and Size are the context position and size that
+	// expressions are evaluated with. Both are 1 when they are 0.
+	Position int
+	Size     int
+}
+
+// Expr is a compiled expression. It can be evaluated any number of
+// times, including concurrently.
+type Expr struct {
+	src string
+	e   expr
+}
+
+// Function is an extension function. It returns the same kinds of
+// values as Context.Variables holds.
+type Function func(ctx *FunctionContext, args []*Object) (interface{}, error)
+
+// FunctionContext is the context that an extension function is
+// called in
+type FunctionContext struct {
+	Context  *Context
+	Node     helium.Node // the context node
+	Position int
+	Size     int
+}
+
+type axis int
+
+const (
+	axisAncestor axis = iota + 1
+	axisAncestorOrSelf
+	axisAttribute
+	axisChild
+	axisDescendant
+	axisDescendantOrSelf
+	axisFollowing
+	axisFollowingSibling
+	axisNamespace
+	axisParent
+	axisPreceding
+	axisPrecedingSibling
+	axisSelf
+)
+
+type nodeTestType int
+
+const (
+	testName    nodeTestType = iota + 1 // QName, prefix:* or *
+	testNode                            // node()
+	testText                            // text()
+	testComment                         // comment()
+	testPI                              // processing-instruction()
+)
+
+type nodeTest struct {
+	typ    nodeTestType
+	prefix string
+	local  string // "*" for any name, or the PI target, if any
+}
+
+type step struct {
+	axis  axis
+	test  nodeTest
+	preds []expr
+}
+
+// expr is a compiled expression
+type expr interface {
+	eval(ctx *evalContext) (interface{}, error)
+}
+
+// evalContext is the dynamic context of the evaluation
+type evalContext struct {
+	node helium.Node
+	pos  int
+	size int
+	env  *environment
+}
+
+// exprCache holds the expressions that were compiled by
+// Context.Evaluate and Context.Find, up to max of them
+type exprCache struct {
+	mu    sync.RWMutex
+	max   int
+	exprs map[string]*Expr
+}
+
+// environment is shared by all of the contexts of an evaluation
+type environment struct {
+	ctx   *Context
+	roots map[helium.Node]int // order of the trees that nodes come from
+	index map[helium.Node]int // position of the nodes among their siblings
+}
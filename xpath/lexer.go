@@ -0,0 +1,356 @@
+package xpath
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	// operators
+	tokSlash
+	tokDoubleSlash
+	tokPipe
+	tokPlus
+	tokMinus
+	tokEq
+	tokNeq
+	tokLt
+	tokLe
+	tokGt
+	tokGe
+	tokAnd
+	tokOr
+	tokMod
+	tokDiv
+	tokMultiply
+	// punctuation
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokDot
+	tokDotDot
+	tokAt
+	tokComma
+	tokColonColon
+	// the rest
+	tokNameTest     // QName, prefix:* or *
+	tokNodeType     // comment, text, processing-instruction or node, before '('
+	tokFunctionName // QName before '('
+	tokAxisName     // NCName before '::'
+	tokLiteral
+	tokNumber
+	tokVariable // QName, without the '$'
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) isOperator() bool {
+	return t.typ >= tokSlash && t.typ <= tokMultiply
+}
+
+var operatorNames = map[string]tokenType{
+	"and": tokAnd,
+	"or":  tokOr,
+	"mod": tokMod,
+	"div": tokDiv,
+}
+
+var nodeTypes = map[string]nodeTestType{
+	"comment":                testComment,
+	"text":                   testText,
+	"processing-instruction": testPI,
+	"node":                   testNode,
+}
+
+// lexer splits an expression in tokens, following the lexical
+// structure rules of section 3.7 of the XPath recommendation
+type lexer struct {
+	input  string
+	pos    int
+	tokens []token
+}
+
+func tokenize(s string) ([]token, error) {
+	l := &lexer{input: s}
+	for {
+		l.skipSpaces()
+		if l.pos >= len(l.input) {
+			l.tokens = append(l.tokens, token{typ: tokEOF, pos: l.pos})
+			return l.tokens, nil
+		}
+		if err := l.next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *lexer) error(pos int, msg string) error {
+	return ErrSyntax{Expr: l.input, Pos: pos, Msg: msg}
+}
+
+func (l *lexer) emit(typ tokenType, val string, pos int) {
+	l.tokens = append(l.tokens, token{typ: typ, val: val, pos: pos})
+}
+
+func (l *lexer) skipSpaces() {
+	for l.pos < len(l.input) && isSpace(l.input[l.pos]) {
+		l.pos++
+	}
+}
+
+func (l *lexer) peekByte(n int) byte {
+	if l.pos+n < len(l.input) {
+		return l.input[l.pos+n]
+	}
+	return 0
+}
+
+// operatorExpected reports if the next token must be an operator,
+// in which case '*' is a multiplication and names are operator names
+func (l *lexer) operatorExpected() bool {
+	if len(l.tokens) == 0 {
+		return false
+	}
+	prev := l.tokens[len(l.tokens)-1]
+	switch prev.typ {
+	case tokAt, tokColonColon, tokLParen, tokLBracket, tokComma:
+		return false
+	}
+	return !prev.isOperator()
+}
+
+func (l *lexer) next() error {
+	start := l.pos
+	c := l.input[l.pos]
+	switch c {
+	case '(':
+		l.pos++
+		l.emit(tokLParen, "(", start)
+	case ')':
+		l.pos++
+		l.emit(tokRParen, ")", start)
+	case '[':
+		l.pos++
+		l.emit(tokLBracket, "[", start)
+	case ']':
+		l.pos++
+		l.emit(tokRBracket, "]", start)
+	case '@':
+		l.pos++
+		l.emit(tokAt, "@", start)
+	case ',':
+		l.pos++
+		l.emit(tokComma, ",", start)
+	case '|':
+		l.pos++
+		l.emit(tokPipe, "|", start)
+	case '+':
+		l.pos++
+		l.emit(tokPlus, "+", start)
+	case '-':
+		l.pos++
+		l.emit(tokMinus, "-", start)
+	case '=':
+		l.pos++
+		l.emit(tokEq, "=", start)
+	case '!':
+		if l.peekByte(1) != '=' {
+			return l.error(start, "expected '!='")
+		}
+		l.pos += 2
+		l.emit(tokNeq, "!=", start)
+	case '<':
+		if l.peekByte(1) == '=' {
+			l.pos += 2
+			l.emit(tokLe, "<=", start)
+		} else {
+			l.pos++
+			l.emit(tokLt, "<", start)
+		}
+	case '>':
+		if l.peekByte(1) == '=' {
+			l.pos += 2
+			l.emit(tokGe, ">=", start)
+		} else {
+			l.pos++
+			l.emit(tokGt, ">", start)
+		}
+	case '/':
+		if l.peekByte(1) == '/' {
+			l.pos += 2
+			l.emit(tokDoubleSlash, "//", start)
+		} else {
+			l.pos++
+			l.emit(tokSlash, "/", start)
+		}
+	case ':':
+		if l.peekByte(1) != ':' {
+			return l.error(start, "unexpected ':'")
+		}
+		l.pos += 2
+		l.emit(tokColonColon, "::", start)
+	case '.':
+		switch {
+		case l.peekByte(1) == '.':
+			l.pos += 2
+			l.emit(tokDotDot, "..", start)
+		case isDigit(l.peekByte(1)):
+			l.number()
+		default:
+			l.pos++
+			l.emit(tokDot, ".", start)
+		}
+	case '"', '\'':
+		end := strings.IndexByte(l.input[l.pos+1:], c)
+		if end < 0 {
+			return l.error(start, "unfinished literal")
+		}
+		l.emit(tokLiteral, l.input[l.pos+1:l.pos+1+end], start)
+		l.pos += end + 2
+	case '$':
+		l.pos++
+		name := l.qname()
+		if name == "" {
+			return l.error(start, "expected a variable name")
+		}
+		l.emit(tokVariable, name, start)
+	case '*':
+		l.pos++
+		if l.operatorExpected() {
+			l.emit(tokMultiply, "*", start)
+		} else {
+			l.emit(tokNameTest, "*", start)
+		}
+	default:
+		if isDigit(c) {
+			l.number()
+			return nil
+		}
+		return l.name()
+	}
+	return nil
+}
+
+func (l *lexer) number() {
+	start := l.pos
+	for l.pos < len(l.input) && isDigit(l.input[l.pos]) {
+		l.pos++
+	}
+	if l.pos < len(l.input) && l.input[l.pos] == '.' {
+		l.pos++
+		for l.pos < len(l.input) && isDigit(l.input[l.pos]) {
+			l.pos++
+		}
+	}
+	l.emit(tokNumber, l.input[start:l.pos], start)
+}
+
+func (l *lexer) name() error {
+	start := l.pos
+	local := l.ncname()
+	if local == "" {
+		r, _ := utf8.DecodeRuneInString(l.input[l.pos:])
+		return l.error(start, "unexpected character '"+string(r)+"'")
+	}
+
+	if l.operatorExpected() {
+		typ, ok := operatorNames[local]
+		if !ok {
+			return l.error(start, "expected an operator, found '"+local+"'")
+		}
+		l.emit(typ, local, start)
+		return nil
+	}
+
+	// prefix:local or prefix:*
+	name := local
+	prefixed := false
+	if l.peekByte(0) == ':' && l.peekByte(1) != ':' {
+		save := l.pos
+		l.pos++
+		if l.peekByte(0) == '*' {
+			l.pos++
+			l.emit(tokNameTest, name+":*", start)
+			return nil
+		}
+		if local := l.ncname(); local != "" {
+			name += ":" + local
+			prefixed = true
+		} else {
+			l.pos = save
+		}
+	}
+
+	// look past the whitespace for '(' or '::'
+	save := l.pos
+	l.skipSpaces()
+	switch {
+	case l.peekByte(0) == '(':
+		if _, ok := nodeTypes[name]; ok {
+			l.emit(tokNodeType, name, start)
+		} else {
+			l.emit(tokFunctionName, name, start)
+		}
+		return nil
+	case !prefixed && l.peekByte(0) == ':' && l.peekByte(1) == ':':
+		l.emit(tokAxisName, name, start)
+		return nil
+	}
+	l.pos = save
+	l.emit(tokNameTest, name, start)
+	return nil
+}
+
+// qname scans a QName, and returns "" if there is none
+func (l *lexer) qname() string {
+	start := l.pos
+	if l.ncname() == "" {
+		return ""
+	}
+	if l.peekByte(0) == ':' && l.peekByte(1) != ':' {
+		save := l.pos
+		l.pos++
+		if l.ncname() == "" {
+			l.pos = save
+		}
+	}
+	return l.input[start:l.pos]
+}
+
+func (l *lexer) ncname() string {
+	start := l.pos
+	for l.pos < len(l.input) {
+		r, w := utf8.DecodeRuneInString(l.input[l.pos:])
+		if l.pos == start && !isNameStartChar(r) || l.pos > start && !isNameChar(r) {
+			break
+		}
+		l.pos += w
+	}
+	return l.input[start:l.pos]
+}
+
+func isSpace(c byte) bool {
+	return c == 0x20 || c == 0x9 || c == 0xD || c == 0xA
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isNameStartChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isNameChar(r rune) bool {
+	return isNameStartChar(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == 0xB7 ||
+		unicode.In(r, unicode.Mn, unicode.Mc, unicode.Nl, unicode.Lm)
+}
@@ -0,0 +1,235 @@
+package xpath
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/lestrrat/helium"
+)
+
+// stringValue returns the string-value of n, as defined by the data
+// model of XPath
+func stringValue(n helium.Node) string {
+	switch n := n.(type) {
+	case *helium.Document, *helium.Element:
+		var buf bytes.Buffer
+		collectText(&buf, n)
+		return buf.String()
+	case *helium.Attribute:
+		return n.Value()
+	case *helium.ProcessingInstruction:
+		return n.Data()
+	case *helium.NamespaceDecl:
+		return n.URI()
+	case *helium.EntityRef:
+		var buf bytes.Buffer
+		collectEntityText(&buf, n)
+		return buf.String()
+	}
+	return string(n.Content())
+}
+
+// collectText appends the content of the text descendants of n to buf
+func collectText(buf *bytes.Buffer, n helium.Node) {
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch c.Type() {
+		case helium.TextNode, helium.CDATASectionNode:
+			buf.Write(c.Content())
+		case helium.ElementNode:
+			collectText(buf, c)
+		case helium.EntityRefNode:
+			collectEntityText(buf, c)
+		}
+	}
+}
+
+// collectEntityText appends the text of the entity that ref references
+// to buf. The child of a reference is the entity, which holds the nodes
+// parsed from its content, if any.
+func collectEntityText(buf *bytes.Buffer, ref helium.Node) {
+	ent := ref.FirstChild()
+	if ent == nil || ent.FirstChild() == nil {
+		buf.Write(ref.Content())
+		return
+	}
+	collectText(buf, ent)
+}
+
+// sortNodes puts nodes in document order, and removes the duplicates
+func (env *environment) sortNodes(nodes NodeSet) NodeSet {
+	if len(nodes) < 2 {
+		return nodes
+	}
+
+	sorted := true
+	for i := 1; i < len(nodes); i++ {
+		if env.compareOrder(nodes[i-1], nodes[i]) >= 0 {
+			sorted = false
+			break
+		}
+	}
+	if sorted {
+		return nodes
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return env.compareOrder(nodes[i], nodes[j]) < 0
+	})
+
+	ret := nodes[:1]
+	for _, n := range nodes[1:] {
+		if !sameNode(ret[len(ret)-1], n) {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// sameNode reports if a and b are the same node. Namespace nodes are
+// created on demand, so they are compared by parent and prefix.
+func sameNode(a, b helium.Node) bool {
+	if a == b {
+		return true
+	}
+	nsa, ok := a.(*helium.NamespaceDecl)
+	if !ok {
+		return false
+	}
+	nsb, ok := b.(*helium.NamespaceDecl)
+	return ok && nsa.Parent() == nsb.Parent() && nsa.Prefix() == nsb.Prefix()
+}
+
+// compareOrder returns -1 if a comes before b in document order, 1 if
+// it comes after, and 0 if they are the same node. The namespace nodes
+// of an element come after it, followed by its attributes.
+func (env *environment) compareOrder(a, b helium.Node) int {
+	if sameNode(a, b) {
+		return 0
+	}
+
+	pa, ra := anchor(a)
+	pb, rb := anchor(b)
+	if pa != pb {
+		return env.compareTree(pa, pb)
+	}
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	switch a := a.(type) {
+	case *helium.NamespaceDecl:
+		// in the order that Element.NamespaceNodes returns them
+		for _, ns := range pa.(*helium.Element).NamespaceNodes() {
+			switch ns.Prefix() {
+			case a.Prefix():
+				return -1
+			case b.(*helium.NamespaceDecl).Prefix():
+				return 1
+			}
+		}
+	case *helium.Attribute:
+		for _, attr := range pa.(*helium.Element).Attributes() {
+			switch helium.Node(attr) {
+			case a:
+				return -1
+			case b:
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+// anchor returns the node of the tree that n is ordered by, and the
+// rank of n among the nodes with the same anchor
+func anchor(n helium.Node) (helium.Node, int) {
+	switch n.Type() {
+	case helium.NamespaceDeclNode:
+		if p := n.Parent(); p != nil {
+			return p, 1
+		}
+	case helium.AttributeNode:
+		if p := n.Parent(); p != nil {
+			return p, 2
+		}
+	}
+	return n, 0
+}
+
+// compareTree compares the position of two different nodes that are
+// children in their trees
+func (env *environment) compareTree(a, b helium.Node) int {
+	da, db := depth(a), depth(b)
+	ca, cb := a, b
+	for ; da > db; da-- {
+		ca = ca.Parent()
+	}
+	for ; db > da; db-- {
+		cb = cb.Parent()
+	}
+	// one is an ancestor of the other
+	if ca == cb {
+		if depth(a) < depth(b) {
+			return -1
+		}
+		return 1
+	}
+
+	for ca.Parent() != cb.Parent() {
+		ca = ca.Parent()
+		cb = cb.Parent()
+	}
+	if ca.Parent() == nil {
+		return env.compareRoots(ca, cb)
+	}
+	if env.siblingIndex(ca) < env.siblingIndex(cb) {
+		return -1
+	}
+	return 1
+}
+
+// siblingIndex returns the position of n among the children of its
+// parent. All of the children are numbered the first time that one of
+// them is looked up, as the tree does not change during an evaluation.
+func (env *environment) siblingIndex(n helium.Node) int {
+	if i, ok := env.index[n]; ok {
+		return i
+	}
+	if env.index == nil {
+		env.index = make(map[helium.Node]int)
+	}
+	i := 0
+	for c := n.Parent().FirstChild(); c != nil; c = c.NextSibling() {
+		env.index[c] = i
+		i++
+	}
+	return env.index[n]
+}
+
+// compareRoots orders the trees of a and b in the order that they
+// were first seen, which is stable during an evaluation
+func (env *environment) compareRoots(a, b helium.Node) int {
+	if env.roots == nil {
+		env.roots = make(map[helium.Node]int)
+	}
+	for _, r := range []helium.Node{a, b} {
+		if _, ok := env.roots[r]; !ok {
+			env.roots[r] = len(env.roots)
+		}
+	}
+	if env.roots[a] < env.roots[b] {
+		return -1
+	}
+	return 1
+}
+
+func depth(n helium.Node) int {
+	d := 0
+	for p := n.Parent(); p != nil; p = p.Parent() {
+		d++
+	}
+	return d
+}
@@ -0,0 +1,439 @@
+package xpath
+
+import (
+	"strconv"
+	"strings"
+)
+
+var axes = map[string]axis{
+	"ancestor":           axisAncestor,
+	"ancestor-or-self":   axisAncestorOrSelf,
+	"attribute":          axisAttribute,
+	"child":              axisChild,
+	"descendant":         axisDescendant,
+	"descendant-or-self": axisDescendantOrSelf,
+	"following":          axisFollowing,
+	"following-sibling":  axisFollowingSibling,
+	"namespace":          axisNamespace,
+	"parent":             axisParent,
+	"preceding":          axisPreceding,
+	"preceding-sibling":  axisPrecedingSibling,
+	"self":               axisSelf,
+}
+
+// parser builds the expression tree from the tokens, by recursive
+// descent over the grammar of the XPath recommendation
+type parser struct {
+	input  string
+	tokens []token
+	pos    int
+}
+
+// compile parses the expression s
+func compile(s string) (expr, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{input: s, tokens: tokens}
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokEOF {
+		return nil, p.error(t, "unexpected '"+t.val+"'")
+	}
+	return e, nil
+}
+
+func (p *parser) error(t token, msg string) error {
+	return ErrSyntax{Expr: p.input, Pos: t.pos, Msg: msg}
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) advance() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(typ tokenType, what string) (token, error) {
+	t := p.peek()
+	if t.typ != typ {
+		if t.typ == tokEOF {
+			return t, p.error(t, "expected "+what+" at end of expression")
+		}
+		return t, p.error(t, "expected "+what+", found '"+t.val+"'")
+	}
+	return p.advance(), nil
+}
+
+// [14] Expr ::= OrExpr
+func (p *parser) parseExpr() (expr, error) {
+	return p.parseBinary(0)
+}
+
+// the levels of binary operators, from the lowest precedence
+var binaryLevels = [][]tokenType{
+	{tokOr},
+	{tokAnd},
+	{tokEq, tokNeq},
+	{tokLt, tokLe, tokGt, tokGe},
+	{tokPlus, tokMinus},
+	{tokMultiply, tokDiv, tokMod},
+}
+
+// parseBinary parses OrExpr, AndExpr, EqualityExpr, RelationalExpr,
+// AdditiveExpr and MultiplicativeExpr, which are all left associative
+func (p *parser) parseBinary(level int) (expr, error) {
+	if level == len(binaryLevels) {
+		return p.parseUnary()
+	}
+
+	lhs, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		found := false
+		for _, typ := range binaryLevels[level] {
+			if t.typ == typ {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return lhs, nil
+		}
+		p.advance()
+
+		rhs, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &binaryExpr{op: t.typ, lhs: lhs, rhs: rhs}
+	}
+}
+
+// [27] UnaryExpr ::= UnionExpr | '-' UnaryExpr
+func (p *parser) parseUnary() (expr, error) {
+	if p.peek().typ == tokMinus {
+		p.advance()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negateExpr{e: e}, nil
+	}
+	return p.parseUnion()
+}
+
+// [18] UnionExpr ::= PathExpr | UnionExpr '|' PathExpr
+func (p *parser) parseUnion() (expr, error) {
+	lhs, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().typ == tokPipe {
+		p.advance()
+		rhs, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &unionExpr{lhs: lhs, rhs: rhs}
+	}
+	return lhs, nil
+}
+
+// [19] PathExpr ::= LocationPath
+//
+//	| FilterExpr
+//	| FilterExpr '/' RelativeLocationPath
+//	| FilterExpr '//' RelativeLocationPath
+func (p *parser) parsePath() (expr, error) {
+	switch p.peek().typ {
+	case tokVariable, tokLParen, tokLiteral, tokNumber, tokFunctionName:
+	default:
+		return p.parseLocationPath()
+	}
+
+	filter, err := p.parseFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.peek().typ {
+	case tokSlash, tokDoubleSlash:
+	default:
+		return filter, nil
+	}
+
+	path := &pathExpr{filter: filter}
+	if err := p.parseRelativeLocationPath(path); err != nil {
+		return nil, err
+	}
+	return path, nil
+}
+
+// [20] FilterExpr ::= PrimaryExpr | FilterExpr Predicate
+func (p *parser) parseFilter() (expr, error) {
+	primary, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	preds, err := p.parsePredicates()
+	if err != nil {
+		return nil, err
+	}
+	if len(preds) == 0 {
+		return primary, nil
+	}
+	return &filterExpr{e: primary, preds: preds}, nil
+}
+
+// [15] PrimaryExpr ::= VariableReference
+//
+//	| '(' Expr ')'
+//	| Literal
+//	| Number
+//	| FunctionCall
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.advance()
+	switch t.typ {
+	case tokVariable:
+		prefix, local := splitQName(t.val)
+		return &variableExpr{prefix: prefix, local: local}, nil
+	case tokLParen:
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case tokLiteral:
+		return literalExpr(t.val), nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, p.error(t, "invalid number '"+t.val+"'")
+		}
+		return numberExpr(f), nil
+	}
+	return p.parseFunctionCall(t)
+}
+
+// [16] FunctionCall ::= FunctionName '(' ( Argument ( ',' Argument )* )? ')'
+func (p *parser) parseFunctionCall(name token) (expr, error) {
+	if _, err := p.expect(tokLParen, "'('"); err != nil {
+		return nil, err
+	}
+
+	prefix, local := splitQName(name.val)
+	call := &functionCall{prefix: prefix, local: local}
+	if p.peek().typ == tokRParen {
+		p.advance()
+		return call, nil
+	}
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+
+		t := p.advance()
+		switch t.typ {
+		case tokRParen:
+			return call, nil
+		case tokComma:
+		default:
+			return nil, p.error(t, "expected ',' or ')' in the arguments of "+name.val+"()")
+		}
+	}
+}
+
+// [1] LocationPath ::= RelativeLocationPath | AbsoluteLocationPath
+// [2] AbsoluteLocationPath ::= '/' RelativeLocationPath?
+//
+//	| AbbreviatedAbsoluteLocationPath
+func (p *parser) parseLocationPath() (expr, error) {
+	path := &pathExpr{}
+	switch p.peek().typ {
+	case tokSlash:
+		path.absolute = true
+		p.advance()
+		// a lone '/' selects the root
+		if !p.startsStep() {
+			return path, nil
+		}
+	case tokDoubleSlash:
+		path.absolute = true
+		// handled like the '//' between steps
+		if err := p.parseRelativeLocationPath(path); err != nil {
+			return nil, err
+		}
+		return path, nil
+	}
+
+	if err := p.parseSteps(path); err != nil {
+		return nil, err
+	}
+	return path, nil
+}
+
+// parseRelativeLocationPath parses the steps that follow a '/' or a
+// '//', which is the next token
+func (p *parser) parseRelativeLocationPath(path *pathExpr) error {
+	p.pos++
+	return p.parseSteps(path)
+}
+
+// [3] RelativeLocationPath ::= Step
+//
+//	| RelativeLocationPath '/' Step
+//	| AbbreviatedRelativeLocationPath
+func (p *parser) parseSteps(path *pathExpr) error {
+	// a '//' that precedes the first step, if any
+	descendant := p.pos > 0 && p.tokens[p.pos-1].typ == tokDoubleSlash
+	for {
+		s, err := p.parseStep()
+		if err != nil {
+			return err
+		}
+		if descendant {
+			// '//child::x' is short for '/descendant::x' when there is
+			// no predicate that would count positions in the children
+			if s.axis == axisChild && len(s.preds) == 0 {
+				s.axis = axisDescendant
+			} else {
+				path.steps = append(path.steps, &step{axis: axisDescendantOrSelf, test: nodeTest{typ: testNode}})
+			}
+		}
+		path.steps = append(path.steps, s)
+
+		switch p.peek().typ {
+		case tokSlash:
+			descendant = false
+		case tokDoubleSlash:
+			descendant = true
+		default:
+			return nil
+		}
+		p.advance()
+	}
+}
+
+// startsStep reports if the next token can start a Step
+func (p *parser) startsStep() bool {
+	switch p.peek().typ {
+	case tokDot, tokDotDot, tokAt, tokAxisName, tokNameTest, tokNodeType:
+		return true
+	}
+	return false
+}
+
+// [4] Step ::= AxisSpecifier NodeTest Predicate* | AbbreviatedStep
+func (p *parser) parseStep() (*step, error) {
+	t := p.peek()
+	switch t.typ {
+	case tokDot:
+		p.advance()
+		return &step{axis: axisSelf, test: nodeTest{typ: testNode}}, nil
+	case tokDotDot:
+		p.advance()
+		return &step{axis: axisParent, test: nodeTest{typ: testNode}}, nil
+	}
+
+	s := &step{axis: axisChild}
+	switch t.typ {
+	case tokAt:
+		p.advance()
+		s.axis = axisAttribute
+	case tokAxisName:
+		p.advance()
+		a, ok := axes[t.val]
+		if !ok {
+			return nil, p.error(t, "unknown axis '"+t.val+"'")
+		}
+		s.axis = a
+		if _, err := p.expect(tokColonColon, "'::'"); err != nil {
+			return nil, err
+		}
+	}
+
+	test, err := p.parseNodeTest()
+	if err != nil {
+		return nil, err
+	}
+	s.test = test
+
+	if s.preds, err = p.parsePredicates(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// [7] NodeTest ::= NameTest
+//
+//	| NodeType '(' ')'
+//	| 'processing-instruction' '(' Literal ')'
+func (p *parser) parseNodeTest() (nodeTest, error) {
+	t := p.advance()
+	switch t.typ {
+	case tokNameTest:
+		if t.val == "*" {
+			return nodeTest{typ: testName, local: "*"}, nil
+		}
+		prefix, local := splitQName(t.val)
+		return nodeTest{typ: testName, prefix: prefix, local: local}, nil
+	case tokNodeType:
+		test := nodeTest{typ: nodeTypes[t.val]}
+		if _, err := p.expect(tokLParen, "'('"); err != nil {
+			return test, err
+		}
+		if test.typ == testPI && p.peek().typ == tokLiteral {
+			test.local = p.advance().val
+		}
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return test, err
+		}
+		return test, nil
+	case tokEOF:
+		return nodeTest{}, p.error(t, "expected a node test at end of expression")
+	}
+	return nodeTest{}, p.error(t, "expected a node test, found '"+t.val+"'")
+}
+
+// [8] Predicate ::= '[' PredicateExpr ']'
+func (p *parser) parsePredicates() ([]expr, error) {
+	var preds []expr
+	for p.peek().typ == tokLBracket {
+		p.advance()
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRBracket, "']'"); err != nil {
+			return nil, err
+		}
+		preds = append(preds, e)
+	}
+	return preds, nil
+}
+
+func splitQName(name string) (prefix, local string) {
+	if i := strings.IndexByte(name, ':'); i > -1 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
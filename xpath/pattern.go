@@ -0,0 +1,216 @@
+package xpath
+
+import (
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/internal/debug"
+)
+
+// Pattern is a compiled XSLT pattern, such as "item[@n > 1]" or
+// "/ | @*". Rather than selecting nodes, it tells if nodes match it.
+type Pattern struct {
+	src  string
+	alts []*pathExpr
+}
+
+// CompilePattern compiles the pattern s
+func CompilePattern(s string) (*Pattern, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START xpath.CompilePattern '%s'", s)
+		defer g.IRelease("END xpath.CompilePattern")
+	}
+
+	e, err := compile(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pattern{src: s}
+	if err := p.add(e); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// add adds the alternatives of e to the pattern, and checks that they
+// only use the child and attribute axes, and the id() or key() functions
+func (p *Pattern) add(e expr) error {
+	switch e := e.(type) {
+	case *unionExpr:
+		if err := p.add(e.lhs); err != nil {
+			return err
+		}
+		return p.add(e.rhs)
+	case *functionCall:
+		if !isPatternStart(e) {
+			break
+		}
+		p.alts = append(p.alts, &pathExpr{filter: e})
+		return nil
+	case *pathExpr:
+		if e.filter != nil && !isPatternStart(e.filter) {
+			break
+		}
+		for _, s := range e.steps {
+			switch s.axis {
+			case axisChild, axisAttribute, axisDescendant:
+				continue
+			case axisDescendantOrSelf:
+				// the step for '//'
+				if s.test.typ == testNode && len(s.preds) == 0 {
+					continue
+				}
+			}
+			return ErrSyntax{Expr: p.src, Msg: "only the child and attribute axes can be used in a pattern"}
+		}
+		p.alts = append(p.alts, e)
+		return nil
+	}
+	return ErrSyntax{Expr: p.src, Msg: "expression is not a pattern"}
+}
+
+func isPatternStart(e expr) bool {
+	call, ok := e.(*functionCall)
+	return ok && call.prefix == "" && (call.local == "id" || call.local == "key")
+}
+
+// String returns the source of the pattern
+func (p *Pattern) String() string {
+	return p.src
+}
+
+// Alternatives returns the patterns that were separated by '|' in p,
+// which XSLT handles as separate template rules. They keep the source
+// of p.
+func (p *Pattern) Alternatives() []*Pattern {
+	if len(p.alts) == 1 {
+		return []*Pattern{p}
+	}
+	ret := make([]*Pattern, len(p.alts))
+	for i, alt := range p.alts {
+		ret[i] = &Pattern{src: p.src, alts: []*pathExpr{alt}}
+	}
+	return ret
+}
+
+// DefaultPriority returns the priority of the template rules for p
+// that do not specify one, as defined by section 5.5 of XSLT 1.0. It
+// is 0.5 for patterns with alternatives.
+func (p *Pattern) DefaultPriority() float64 {
+	if len(p.alts) != 1 {
+		return 0.5
+	}
+
+	e := p.alts[0]
+	if e.filter != nil || e.absolute || len(e.steps) != 1 {
+		return 0.5
+	}
+	s := e.steps[0]
+	if len(s.preds) > 0 || s.axis != axisChild && s.axis != axisAttribute {
+		return 0.5
+	}
+
+	switch s.test.typ {
+	case testName:
+		switch {
+		case s.test.local != "*":
+			return 0
+		case s.test.prefix != "":
+			return -0.25
+		}
+	case testPI:
+		if s.test.local != "" {
+			return 0
+		}
+	}
+	return -0.5
+}
+
+// Match reports if node matches the pattern. ctx provides the bindings
+// of the expressions in the predicates, and may be nil.
+func (p *Pattern) Match(ctx *Context, node helium.Node) (bool, error) {
+	if ctx == nil {
+		ctx = &Context{}
+	}
+	env := &environment{ctx: ctx}
+	for _, alt := range p.alts {
+		ok, err := env.matchSteps(alt, len(alt.steps)-1, node)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// matchSteps reports if n can be selected by the steps of e up to i,
+// going from the last step to the first one
+func (env *environment) matchSteps(e *pathExpr, i int, n helium.Node) (bool, error) {
+	if i < 0 {
+		// n is the node that the path starts from
+		switch {
+		case e.filter != nil:
+			nodes, err := evalNodeSet(&evalContext{node: n, pos: 1, size: 1, env: env}, e.filter)
+			if err != nil {
+				return false, err
+			}
+			return containsNode(nodes, n), nil
+		case e.absolute:
+			return parentOf(n) == nil, nil
+		}
+		return true, nil
+	}
+
+	s := e.steps[i]
+	if s.axis == axisDescendantOrSelf {
+		for a := n; a != nil; a = parentOf(a) {
+			if ok, err := env.matchSteps(e, i-1, a); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+
+	if (s.axis == axisAttribute) != (n.Type() == helium.AttributeNode) || n.Type() == helium.NamespaceDeclNode {
+		return false, nil
+	}
+	parent := parentOf(n)
+	if parent == nil {
+		return false, nil
+	}
+
+	match, err := env.nodeMatcher(s)
+	if err != nil {
+		return false, err
+	}
+	if !match(n) {
+		return false, nil
+	}
+	if len(s.preds) > 0 {
+		// the predicates count the positions among the siblings
+		selected, err := env.applyStep(s, NodeSet{parent})
+		if err != nil {
+			return false, err
+		}
+		if !containsNode(selected, n) {
+			return false, nil
+		}
+	}
+
+	if s.axis != axisDescendant {
+		return env.matchSteps(e, i-1, parent)
+	}
+	for a := parent; a != nil; a = parentOf(a) {
+		if ok, err := env.matchSteps(e, i-1, a); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func containsNode(nodes NodeSet, n helium.Node) bool {
+	for _, c := range nodes {
+		if sameNode(c, n) {
+			return true
+		}
+	}
+	return false
+}
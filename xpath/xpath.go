@@ -0,0 +1,335 @@
+package xpath
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/internal/debug"
+)
+
+// Evaluate evaluates the expression s with node as the context node,
+// and an empty Context
+func Evaluate(node helium.Node, s string) (*Object, error) {
+	var ctx Context
+	return ctx.Evaluate(node, s)
+}
+
+// Find evaluates the expression s with node as the context node, and
+// returns the selected nodes. The expression must be a node-set.
+func Find(node helium.Node, s string) (NodeSet, error) {
+	var ctx Context
+	return ctx.Find(node, s)
+}
+
+// Compile compiles the expression s
+func Compile(s string) (*Expr, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START xpath.Compile '%s'", s)
+		defer g.IRelease("END xpath.Compile")
+	}
+
+	e, err := compile(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{src: s, e: e}, nil
+}
+
+// MustCompile is like Compile, but panics if the expression cannot
+// be compiled
+func MustCompile(s string) *Expr {
+	e, err := Compile(s)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Evaluate evaluates the expression with node as the context node. ctx
+// may be nil, which is the same as an empty Context.
+func (e *Expr) Evaluate(ctx *Context, node helium.Node) (*Object, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START xpath.Expr.Evaluate '%s'", e.src)
+		defer g.IRelease("END xpath.Expr.Evaluate")
+	}
+
+	if ctx == nil {
+		ctx = &Context{}
+	}
+	pos, size := ctx.Position, ctx.Size
+	if pos < 1 {
+		pos = 1
+	}
+	if size < pos {
+		size = pos
+	}
+	env := &environment{ctx: ctx}
+	v, err := e.e.eval(&evalContext{node: node, pos: pos, size: size, env: env})
+	if err != nil {
+		return nil, err
+	}
+	return &Object{value: v}, nil
+}
+
+// Find evaluates the expression with node as the context node, and
+// returns the selected nodes. The expression must be a node-set.
+func (e *Expr) Find(ctx *Context, node helium.Node) (NodeSet, error) {
+	o, err := e.Evaluate(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	if o.Type() != NodeSetType {
+		return nil, fmt.Errorf("%w: '%s' is not a node-set", ErrInvalidType, e.src)
+	}
+	return o.NodeSet(), nil
+}
+
+// Evaluate evaluates the expression s with node as the context node.
+// The compiled expression is cached, so that evaluating the same
+// expression again does not compile it again.
+func (c *Context) Evaluate(node helium.Node, s string) (*Object, error) {
+	e, err := defaultCache.get(s)
+	if err != nil {
+		return nil, err
+	}
+	return e.Evaluate(c, node)
+}
+
+// Find evaluates the expression s with node as the context node, and
+// returns the selected nodes. The expression must be a node-set. Like
+// Evaluate, it caches the compiled expression.
+func (c *Context) Find(node helium.Node, s string) (NodeSet, error) {
+	e, err := defaultCache.get(s)
+	if err != nil {
+		return nil, err
+	}
+	return e.Find(c, node)
+}
+
+// RegisterFunction adds the extension function fn, which expressions
+// call by the name local in the namespace uri
+func (c *Context) RegisterFunction(uri, local string, fn Function) {
+	if c.Functions == nil {
+		c.Functions = make(map[string]Function)
+	}
+	c.Functions[expandName(uri, local)] = fn
+}
+
+// HasFunction reports if expressions can call the function local in
+// the namespace uri, which is either a core function or an extension
+// function of c
+func (c *Context) HasFunction(uri, local string) bool {
+	if uri == "" {
+		if _, ok := coreFunctions[local]; ok {
+			return true
+		}
+	}
+	_, ok := c.Functions[expandName(uri, local)]
+	return ok
+}
+
+// StringValue returns the string-value of n, which is what string()
+// converts a node to
+func StringValue(n helium.Node) string {
+	return stringValue(n)
+}
+
+// ExpandedName returns the local name and the namespace URI of n, as
+// name tests compare them. Attributes created by the parser may carry
+// a prefixed name, whose prefix is looked up in the scope of n.
+func ExpandedName(n helium.Node) (local, uri string) {
+	return expandedName(n)
+}
+
+// expandName returns the key of a variable or a function in Context
+func expandName(uri, local string) string {
+	if uri == "" {
+		return local
+	}
+	return "{" + uri + "}" + local
+}
+
+// Type returns the type of the value
+func (o *Object) Type() ObjectType {
+	switch o.value.(type) {
+	case NodeSet:
+		return NodeSetType
+	case bool:
+		return BooleanType
+	case float64:
+		return NumberType
+	}
+	return StringType
+}
+
+// NodeSet returns the nodes if the value is a node-set, and nil otherwise
+func (o *Object) NodeSet() NodeSet {
+	nodes, _ := o.value.(NodeSet)
+	return nodes
+}
+
+// Bool returns the value converted as if by the boolean() function
+func (o *Object) Bool() bool {
+	return toBool(o.value)
+}
+
+// Number returns the value converted as if by the number() function
+func (o *Object) Number() float64 {
+	return toNumber(o.value)
+}
+
+// String returns the value converted as if by the string() function
+func (o *Object) String() string {
+	return toString(o.value)
+}
+
+func toBool(v interface{}) bool {
+	switch v := v.(type) {
+	case NodeSet:
+		return len(v) > 0
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+	return false
+}
+
+var numberRx = regexp.MustCompile(`^-?(\d+(\.\d*)?|\.\d+)$`)
+
+func toNumber(v interface{}) float64 {
+	switch v := v.(type) {
+	case NodeSet:
+		if len(v) == 0 {
+			return math.NaN()
+		}
+		return toNumber(stringValue(v[0]))
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case float64:
+		return v
+	case string:
+		s := strings.TrimFunc(v, func(r rune) bool {
+			return r < 0x80 && isSpace(byte(r))
+		})
+		if !numberRx.MatchString(s) {
+			return math.NaN()
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	return math.NaN()
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case NodeSet:
+		if len(v) == 0 {
+			return ""
+		}
+		return stringValue(v[0])
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return formatNumber(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// formatNumber formats f without exponent, as required by string()
+func formatNumber(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == 0:
+		// including negative zero
+		return "0"
+	case f == math.Trunc(f) && math.Abs(f) < 1e21:
+		return strconv.FormatFloat(f, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// lookupNamespace returns the namespace URI bound to prefix
+func (env *environment) lookupNamespace(prefix string) (string, error) {
+	if prefix == helium.XMLPrefix {
+		return helium.XMLNamespace, nil
+	}
+	if uri, ok := env.ctx.Namespaces[prefix]; ok {
+		return uri, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUndefinedNamespace, prefix)
+}
+
+// fromGo converts the value of a variable to the values that
+// expressions work with
+func (env *environment) fromGo(v interface{}) (interface{}, error) {
+	var nodes NodeSet
+	switch v := v.(type) {
+	case *Object:
+		return env.fromGo(v.value)
+	case NodeSet:
+		nodes = append(nodes, v...)
+	case []helium.Node:
+		nodes = append(nodes, v...)
+	case helium.Node:
+		nodes = NodeSet{v}
+	case bool, float64, string:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case int8:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrInvalidType, v)
+	}
+
+	if nodes == nil {
+		nodes = NodeSet{}
+	}
+	return env.sortNodes(nodes), nil
+}
@@ -0,0 +1,530 @@
+package xpath_test
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xpath"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDocument = `<?xml version="1.0"?>
+<!DOCTYPE root [
+<!ATTLIST item key ID #IMPLIED>
+]>
+<root xmlns:p="urn:p" xml:lang="en-US">
+  <!-- items -->
+  <item key="a" n="1">one</item>
+  <item key="b" n="2"><b>two</b></item>
+  <p:item n="3">three</p:item>
+  <?pi data?>
+  <last p:attr="x"><![CDATA[four]]></last>
+</root>`
+
+func parseTestDocument(t *testing.T) *helium.Document {
+	doc, err := helium.Parse([]byte(testDocument))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		t.FailNow()
+	}
+	return doc
+}
+
+// names returns the names of the nodes, or a description of the nodes
+// without a name
+func names(nodes xpath.NodeSet) string {
+	var l []string
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *helium.Document:
+			l = append(l, "/")
+		case *helium.Attribute:
+			l = append(l, "@"+n.Name())
+		case *helium.NamespaceDecl:
+			l = append(l, "ns:"+n.Prefix())
+		case *helium.Text, *helium.CDATASection:
+			l = append(l, "text:"+strings.TrimSpace(string(n.Content())))
+		case *helium.Comment:
+			l = append(l, "comment")
+		case *helium.ProcessingInstruction:
+			l = append(l, "pi:"+n.Target())
+		default:
+			l = append(l, n.Name())
+		}
+	}
+	return strings.Join(l, " ")
+}
+
+func TestFind(t *testing.T) {
+	doc := parseTestDocument(t)
+	ctx := xpath.Context{Namespaces: map[string]string{"q": "urn:p"}}
+
+	tests := map[string]string{
+		"/":                                        "/",
+		"/root/item":                               "item item",
+		"//item":                                   "item item",
+		"//q:item":                                 "p:item",
+		"/root/*":                                  "item item p:item last",
+		"/root/q:*":                                "p:item",
+		"//item[2]":                                "item",
+		"//item[@n='2']/b":                         "b",
+		"/root/*[last()]":                          "last",
+		"/root/*[position() < 3]":                  "item item",
+		"//b/ancestor::*":                          "root item",
+		"//b/ancestor::*[1]":                       "item",
+		"//b/ancestor-or-self::*[last()]":          "root",
+		"/root/last/preceding-sibling::*[1]":       "p:item",
+		"/root/item[1]/following-sibling::*":       "item p:item last",
+		"//b/following::*":                         "p:item last",
+		"//b/preceding::*":                         "item",
+		"(//b/preceding::*)[1]":                    "item",
+		"//item/@n":                                "@n @n",
+		"//@*[. = 'x']":                            "@p:attr",
+		"//@q:attr":                                "@p:attr",
+		"//last/@q:attr/..":                        "last",
+		"//@n/following::b":                        "b",
+		"/root/node()[not(self::text())]":          "comment item item p:item pi:pi last",
+		"/root/comment()":                          "comment",
+		"/root/processing-instruction('pi')":       "pi:pi",
+		"/root/processing-instruction('other')":    "",
+		"//last/text()":                            "text:four",
+		"//b/text() | //item[1]/text()":            "text:one text:two",
+		"//last | //item":                          "item item last",
+		"id('b a')":                                "item item",
+		"id('b')/b":                                "b",
+		"/root/item[1]/namespace::*":               "ns:p ns:xml",
+		"/root/item[1]/namespace::p/..":            "item",
+		"//*[lang('en')]":                          "root item item b p:item last",
+		"//*[count(*) = 1]":                        "item",
+		"//*[@key][@n > 1]":                        "item",
+		"/root/*[starts-with(name(), 'p:')]":       "p:item",
+		"/descendant::*[local-name() = 'item'][3]": "p:item",
+	}
+
+	for expr, expected := range tests {
+		nodes, err := ctx.Find(doc, expr)
+		if !assert.NoError(t, err, "Find should succeed for %s", expr) {
+			return
+		}
+		if !assert.Equal(t, expected, names(nodes), "nodes selected by %s", expr) {
+			return
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	doc := parseTestDocument(t)
+	ctx := xpath.Context{
+		Namespaces: map[string]string{"q": "urn:p"},
+		Variables: map[string]interface{}{
+			"n":        2,
+			"s":        "text",
+			"{urn:p}v": true,
+			"items":    doc.DocumentElement(),
+		},
+	}
+
+	tests := map[string]string{
+		"1 + 2 * 3":                              "7",
+		"(1 + 2) * 3":                            "9",
+		"7 mod 3":                                "1",
+		"-7 div 2":                               "-3.5",
+		"1 div 0":                                "Infinity",
+		"-1 div 0":                               "-Infinity",
+		"0 div 0":                                "NaN",
+		"1 = 1 and 2 > 1":                        "true",
+		"1 = 2 or 'a' = 'b'":                     "false",
+		"count(//item)":                          "2",
+		"sum(//@n)":                              "6",
+		"string(//item[2])":                      "two",
+		"string(/root/last)":                     "four",
+		"//item = 'one'":                         "true",
+		"//item != 'one'":                        "true",
+		"//@n > 2":                               "true",
+		"//@n > 3":                               "false",
+		"//item = //b":                           "true",
+		"name(//@q:attr)":                        "p:attr",
+		"local-name(//@q:attr)":                  "attr",
+		"namespace-uri(//@q:attr)":               "urn:p",
+		"namespace-uri(/root/q:item)":            "urn:p",
+		"name(/root/processing-instruction())":   "pi",
+		"string(/root/processing-instruction())": "data",
+		"string(/root/comment())":                " items ",
+		"string(/root/namespace::q)":             "",
+		"string(/root/namespace::p)":             "urn:p",
+		"concat('a', 1, true())":                 "a1true",
+		"substring('12345', 1.5, 2.6)":           "234",
+		"substring('12345', 0, 3)":               "12",
+		"substring('12345', 0 div 0, 3)":         "",
+		"substring('12345', -42, 1 div 0)":       "12345",
+		"substring-before('1999/04/01', '/')":    "1999",
+		"substring-after('1999/04/01', '/')":     "04/01",
+		"normalize-space('  a \n b  ')":          "a b",
+		"translate('--aaa--', 'abc-', 'ABC')":    "AAA",
+		"string-length('héllo')":                 "5",
+		"contains('abc', 'b')":                   "true",
+		"round(2.5)":                             "3",
+		"round(-2.5)":                            "-2",
+		"floor(-1.5)":                            "-2",
+		"ceiling(1.2)":                           "2",
+		"number(' 12.5 ')":                       "12.5",
+		"number('1e3')":                          "NaN",
+		"boolean(//nothing)":                     "false",
+		"not(0)":                                 "true",
+		"$n * 2":                                 "4",
+		"concat($s, '!')":                        "text!",
+		"$q:v":                                   "true",
+		"name($items)":                           "root",
+		"count($items/item)":                     "2",
+		"1000000 * 1000000":                      "1000000000000",
+		"0.1 + 0.2 > 0.3":                        "true",
+	}
+
+	for expr, expected := range tests {
+		o, err := ctx.Evaluate(doc, expr)
+		if !assert.NoError(t, err, "Evaluate should succeed for %s", expr) {
+			return
+		}
+		if !assert.Equal(t, expected, o.String(), "value of %s", expr) {
+			return
+		}
+	}
+
+	o, err := xpath.Evaluate(doc, "count(//item) = 2")
+	if !assert.NoError(t, err, "Evaluate should succeed") ||
+		!assert.Equal(t, xpath.BooleanType, o.Type(), "comparisons are booleans") ||
+		!assert.True(t, o.Bool(), "comparison should be true") {
+		return
+	}
+}
+
+func TestDocumentOrder(t *testing.T) {
+	var buf strings.Builder
+	buf.WriteString("<root>")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&buf, `<i n="%d"/>`, i)
+	}
+	buf.WriteString("</root>")
+
+	doc, err := helium.Parse([]byte(buf.String()))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	nodes, err := xpath.Find(doc, "//i[@n = 4999] | //i[@n = 0] | //i[@n = 2500] | //i/@n[. = 2500]")
+	if !assert.NoError(t, err, "Find should succeed") {
+		return
+	}
+	var order []string
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *helium.Element:
+			order = append(order, n.Attributes()[0].Value())
+		default:
+			order = append(order, "@"+xpath.StringValue(n))
+		}
+	}
+	if !assert.Equal(t, []string{"0", "2500", "@2500", "4999"}, order, "nodes are in document order") {
+		return
+	}
+
+	// sorting all of the siblings does not take quadratic time
+	nodes, err = xpath.Find(doc, "//i[last()] | //i | //i[1]")
+	if !assert.NoError(t, err, "Find should succeed") ||
+		!assert.Len(t, nodes, 5000, "duplicates are removed") {
+		return
+	}
+}
+
+func TestEntityReference(t *testing.T) {
+	const input = `<!DOCTYPE root [<!ENTITY ent "EV"><!ENTITY nested "<b>&ent;</b>!">]>
+<root xmlns:p="urn:p"><p:f>&ent;<![CDATA[cd]]></p:f><g>&nested;</g></root>`
+
+	doc, err := helium.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	ctx := xpath.Context{Namespaces: map[string]string{"p": "urn:p"}}
+
+	tests := map[string]string{
+		"string(//p:f)":           "EVcd",
+		"string(//p:f/node()[1])": "EV",
+		"string(//g)":             "EV!",
+	}
+	for expr, expected := range tests {
+		o, err := ctx.Evaluate(doc, expr)
+		if !assert.NoError(t, err, "Evaluate should succeed for %s", expr) {
+			return
+		}
+		if !assert.Equal(t, expected, o.String(), "value of %s", expr) {
+			return
+		}
+	}
+}
+
+func TestContextNode(t *testing.T) {
+	doc := parseTestDocument(t)
+	nodes, err := xpath.Find(doc, "//item[2]")
+	if !assert.NoError(t, err, "Find should succeed") || !assert.Len(t, nodes, 1, "item is found") {
+		return
+	}
+
+	tests := map[string]string{
+		".":                                   "item",
+		"..":                                  "root",
+		"b":                                   "b",
+		"../item":                             "item item",
+		"/root":                               "root",
+		"@*":                                  "@key @n",
+		"preceding::* | preceding::comment()": "comment item",
+		"ancestor::node()":                    "/ root",
+		"self::item[@n = 2]":                  "item",
+	}
+	for expr, expected := range tests {
+		found, err := xpath.Find(nodes[0], expr)
+		if !assert.NoError(t, err, "Find should succeed for %s", expr) {
+			return
+		}
+		if !assert.Equal(t, expected, names(found), "nodes selected by %s", expr) {
+			return
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	doc := parseTestDocument(t)
+
+	syntax := []string{
+		"",
+		"/root/",
+		"//item[",
+		"item[1",
+		"1 +",
+		"foo::bar",
+		"count(1, ",
+		"'unfinished",
+		"a ! b",
+		"child::",
+		"item item",
+	}
+	for _, expr := range syntax {
+		_, err := xpath.Evaluate(doc, expr)
+		var serr xpath.ErrSyntax
+		if !assert.True(t, errors.As(err, &serr), "'%s' is a syntax error, got %v", expr, err) {
+			return
+		}
+	}
+
+	others := map[string]error{
+		"count()":        xpath.ErrInvalidArity,
+		"count('a')":     xpath.ErrInvalidType,
+		"'a'/b":          xpath.ErrInvalidType,
+		"x:item":         xpath.ErrUndefinedNamespace,
+		"$x":             xpath.ErrUndefinedVariable,
+		"unknown()":      xpath.ErrUnknownFunction,
+		"string(foo(1))": xpath.ErrUnknownFunction,
+	}
+	for expr, expected := range others {
+		_, err := xpath.Evaluate(doc, expr)
+		if !assert.True(t, errors.Is(err, expected), "'%s' should fail with %v, got %v", expr, expected, err) {
+			return
+		}
+	}
+
+	_, err := xpath.Find(doc, "count(//item)")
+	if !assert.True(t, errors.Is(err, xpath.ErrInvalidType), "Find fails if the value is not a node-set") {
+		return
+	}
+}
+
+func TestCompile(t *testing.T) {
+	doc := parseTestDocument(t)
+
+	e, err := xpath.Compile("count(//item[@n > $min])")
+	if !assert.NoError(t, err, "Compile should succeed") ||
+		!assert.Equal(t, "count(//item[@n > $min])", e.String(), "String returns the source") {
+		return
+	}
+
+	var wg sync.WaitGroup
+	results := make([]float64, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := xpath.Context{Variables: map[string]interface{}{"min": i % 3}}
+			o, err := e.Evaluate(&ctx, doc)
+			if err == nil {
+				results[i] = o.Number()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, n := range results {
+		if !assert.Equal(t, float64(2-i%3), n, "evaluation %d", i) {
+			return
+		}
+	}
+
+	nodes, err := xpath.MustCompile("//b").Find(nil, doc)
+	if !assert.NoError(t, err, "Find should succeed") || !assert.Equal(t, "b", names(nodes), "b is found") {
+		return
+	}
+
+	_, err = xpath.Compile("//item[")
+	var serr xpath.ErrSyntax
+	if !assert.True(t, errors.As(err, &serr), "Compile fails on syntax errors") ||
+		!assert.Equal(t, 7, serr.Pos, "position of the syntax error") {
+		return
+	}
+}
+
+func TestExtensionFunctions(t *testing.T) {
+	const (
+		mathNS = "http://exslt.org/math"
+		setNS  = "http://exslt.org/sets"
+		strNS  = "http://exslt.org/strings"
+	)
+	doc := parseTestDocument(t)
+
+	ctx := xpath.Context{Namespaces: map[string]string{"math": mathNS, "set": setNS, "str": strNS}}
+	ctx.RegisterFunction(mathNS, "max", func(_ *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+		if len(args) != 1 || args[0].Type() != xpath.NodeSetType {
+			return nil, xpath.ErrInvalidType
+		}
+		max := math.NaN()
+		for i, n := range args[0].NodeSet() {
+			v, err := xpath.Evaluate(n, "number()")
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 || v.Number() > max {
+				max = v.Number()
+			}
+		}
+		return max, nil
+	})
+	ctx.RegisterFunction(setNS, "leading", func(_ *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, xpath.ErrInvalidArity
+		}
+		stop := args[1].NodeSet()
+		var ret []helium.Node
+		for _, n := range args[0].NodeSet() {
+			if len(stop) > 0 && n == stop[0] {
+				break
+			}
+			ret = append(ret, n)
+		}
+		return ret, nil
+	})
+	ctx.RegisterFunction(strNS, "padding", func(_ *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+		return strings.Repeat(args[1].String(), int(args[0].Number())), nil
+	})
+	ctx.RegisterFunction("", "context-name", func(fctx *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+		return fctx.Node.Name(), nil
+	})
+
+	tests := map[string]string{
+		"math:max(//@n)":                        "3",
+		"count(set:leading(//item, //item[2]))": "1",
+		"set:leading(//*, //b)[last()]/@n":      "2",
+		"str:padding(3, '-')":                   "---",
+		"//*[context-name() = 'last']/@q:attr":  "x",
+		"concat(str:padding(2, 'a'), 'b')":      "aab",
+	}
+	ctx.Namespaces["q"] = "urn:p"
+	for expr, expected := range tests {
+		o, err := ctx.Evaluate(doc, expr)
+		if !assert.NoError(t, err, "Evaluate should succeed for %s", expr) ||
+			!assert.Equal(t, expected, o.String(), "value of %s", expr) {
+			return
+		}
+	}
+
+	_, err := ctx.Evaluate(doc, "set:leading(//item)")
+	if !assert.True(t, errors.Is(err, xpath.ErrInvalidArity), "errors of extension functions are returned") {
+		return
+	}
+	_, err = ctx.Evaluate(doc, "str:unknown()")
+	if !assert.True(t, errors.Is(err, xpath.ErrUnknownFunction), "unregistered functions are unknown") {
+		return
+	}
+}
+
+func TestPattern(t *testing.T) {
+	doc := parseTestDocument(t)
+	ctx := xpath.Context{Namespaces: map[string]string{"q": "urn:p"}}
+
+	tests := []struct {
+		pattern  string
+		selected string // the nodes of the document that match
+		priority float64
+	}{
+		{"/", "/", 0.5},
+		{"item", "item item", 0},
+		{"q:*", "p:item", -0.25},
+		{"*", "root item item b p:item last", -0.5},
+		{"root/item[2]", "item", 0.5},
+		{"root//b", "b", 0.5},
+		{"//item[@n = 1]", "item", 0.5},
+		{"/root/*[last()]", "last", 0.5},
+		{"@n", "@n @n @n", 0},
+		{"item/@*", "@key @n @key @n", 0.5},
+		{"text()", "text:one text:two text:three text:four", -0.5},
+		{"processing-instruction('pi')", "pi:pi", 0},
+		{"id('b')/b", "b", 0.5},
+		{"b | last", "b last", 0.5},
+	}
+
+	for _, test := range tests {
+		p, err := xpath.CompilePattern(test.pattern)
+		if !assert.NoError(t, err, "CompilePattern should succeed for %s", test.pattern) {
+			return
+		}
+		if !assert.Equal(t, test.priority, p.DefaultPriority(), "default priority of %s", test.pattern) {
+			return
+		}
+
+		all, err := xpath.Find(doc, "/ | //node() | //@*")
+		if !assert.NoError(t, err, "Find should succeed") {
+			return
+		}
+		var matched xpath.NodeSet
+		for _, n := range all {
+			// whitespace is left out for brevity
+			if n.Type() == helium.TextNode && strings.TrimSpace(string(n.Content())) == "" {
+				continue
+			}
+			ok, err := p.Match(&ctx, n)
+			if !assert.NoError(t, err, "Match should succeed for %s", test.pattern) {
+				return
+			}
+			if ok {
+				matched = append(matched, n)
+			}
+		}
+		if !assert.Equal(t, test.selected, names(matched), "nodes matched by %s", test.pattern) {
+			return
+		}
+	}
+
+	p, err := xpath.CompilePattern("a | @b | c")
+	if !assert.NoError(t, err, "CompilePattern should succeed") ||
+		!assert.Len(t, p.Alternatives(), 3, "alternatives are separated") ||
+		!assert.Equal(t, float64(0), p.Alternatives()[1].DefaultPriority(), "priority of an alternative") {
+		return
+	}
+
+	for _, s := range []string{"1 + 1", "../a", "ancestor::a", "$x", "count(a)"} {
+		_, err := xpath.CompilePattern(s)
+		var serr xpath.ErrSyntax
+		if !assert.True(t, errors.As(err, &serr), "'%s' is not a pattern", s) {
+			return
+		}
+	}
+}
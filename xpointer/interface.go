@@ -0,0 +1,8 @@
+package xpointer
+
+import "github.com/lestrrat/helium"
+
+var (
+	ErrInvalidPointer = helium.ErrInvalidXPointer
+	ErrNotFound       = helium.ErrXPointerNotFound
+)
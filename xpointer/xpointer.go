@@ -0,0 +1,77 @@
+package xpointer
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/xpath"
+)
+
+// Evaluate returns the nodes of doc that are identified by the XPointer
+// ptr. ptr is either a shorthand pointer, which is the value of an ID
+// attribute, or a sequence of pointer parts that are tried in order
+// until one of them identifies nodes. The supported schemes are
+// element(), xmlns() and xpointer(), whose data is an XPath 1.0
+// expression; parts with other schemes are skipped.
+//
+// Evaluate can be passed to (*helium.Parser).SetXPointerResolver.
+func Evaluate(doc *helium.Document, ptr string) ([]helium.Node, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START xpointer.Evaluate '%s'", ptr)
+		defer g.IRelease("END xpointer.Evaluate")
+	}
+
+	parts, err := helium.ParseXPointer(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the bindings of xmlns() parts apply to the parts that follow them
+	ctx := xpath.Context{Namespaces: map[string]string{}}
+	for _, p := range parts {
+		switch p.Scheme {
+		case "":
+			if e := doc.GetElementByID(p.Data); e != nil {
+				return []helium.Node{e}, nil
+			}
+		case "xmlns":
+			prefix, uri, ok := strings.Cut(p.Data, "=")
+			prefix = strings.TrimSpace(prefix)
+			if !ok || !isNCName(prefix) {
+				return nil, fmt.Errorf("%w: xmlns(%s)", ErrInvalidPointer, p.Data)
+			}
+			ctx.Namespaces[prefix] = strings.TrimSpace(uri)
+		case "element":
+			if e := helium.XPointerElement(doc, p.Data); e != nil {
+				return []helium.Node{e}, nil
+			}
+		case "xpointer":
+			o, err := ctx.Evaluate(doc, p.Data)
+			if err != nil {
+				return nil, fmt.Errorf("xpointer(%s): %w", p.Data, err)
+			}
+			if nodes := o.NodeSet(); len(nodes) > 0 {
+				return nodes, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: #%s", ErrNotFound, strings.TrimSpace(ptr))
+}
+
+func isNCName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r) || unicode.In(r, unicode.Mn, unicode.Mc)):
+		default:
+			return false
+		}
+	}
+	return true
+}
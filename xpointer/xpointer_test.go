@@ -0,0 +1,98 @@
+package xpointer_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xpath"
+	"github.com/lestrrat/helium/xpointer"
+	"github.com/stretchr/testify/assert"
+)
+
+const testDocument = `<!DOCTYPE doc [
+<!ATTLIST section id ID #IMPLIED>
+]>
+<doc xmlns:x="urn:x">
+  <section id="intro"><p>a</p><p>(b)</p></section>
+  <section xml:id="body"><x:item>c</x:item><x:item>d</x:item></section>
+</doc>`
+
+// contents returns the content of the nodes
+func contents(nodes []helium.Node) string {
+	var l []string
+	for _, n := range nodes {
+		l = append(l, string(n.Content()))
+	}
+	return strings.Join(l, " ")
+}
+
+func TestEvaluate(t *testing.T) {
+	doc, err := helium.Parse([]byte(testDocument))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	tests := map[string]string{
+		"intro":                                    "a(b)",
+		"body":                                     "cd",
+		"element(intro)":                           "a(b)",
+		"element(intro/2)":                         "(b)",
+		"element(/1/2/1)":                          "c",
+		"element(/1/3) element(body/2)":            "d",
+		"unknown(x) element(/1/1/1)":               "a",
+		"xmlns(y=urn:x)xpointer(//y:item)":         "c d",
+		"xmlns(y = urn:x) xpointer(//y:item[2])":   "d",
+		"xpointer(//p[. = '^(b^)'])":               "(b)",
+		"xpointer(//nothing)element(/1/1/1)":       "a",
+		"xpointer(count(//p))xpointer(id('body'))": "cd",
+	}
+	for ptr, expected := range tests {
+		nodes, err := xpointer.Evaluate(doc, ptr)
+		if !assert.NoError(t, err, "Evaluate should succeed for %s", ptr) ||
+			!assert.Equal(t, expected, contents(nodes), "nodes identified by %s", ptr) {
+			return
+		}
+	}
+
+	errs := map[string]error{
+		"missing":             xpointer.ErrNotFound,
+		"element(/1/3)":       xpointer.ErrNotFound,
+		"element(/0)":         xpointer.ErrNotFound,
+		"xmlns(y=urn:x)":      xpointer.ErrNotFound,
+		"1st":                 xpointer.ErrInvalidPointer,
+		"element(/1":          xpointer.ErrInvalidPointer,
+		"(/1)":                xpointer.ErrInvalidPointer,
+		"xpointer(^x)":        xpointer.ErrInvalidPointer,
+		"xmlns(y)element(/1)": xpointer.ErrInvalidPointer,
+		"xpointer(//y:item)":  xpath.ErrUndefinedNamespace,
+	}
+	for ptr, expected := range errs {
+		_, err := xpointer.Evaluate(doc, ptr)
+		if !assert.True(t, errors.Is(err, expected), "%s should fail with %v, got %v", ptr, expected, err) {
+			return
+		}
+	}
+}
+
+func TestXInclude(t *testing.T) {
+	doc, err := helium.Parse([]byte(`<doc xmlns:xi="http://www.w3.org/2001/XInclude"><p>a</p><p>b</p><xi:include xpointer="xpointer(//p)"/></doc>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	if !assert.Error(t, helium.NewParser().ProcessXInclude(doc), "the default resolver does not support xpointer()") {
+		return
+	}
+
+	p := helium.NewParser()
+	p.SetXPointerResolver(xpointer.Evaluate)
+	if !assert.NoError(t, p.ProcessXInclude(doc), "ProcessXInclude should succeed") {
+		return
+	}
+	nodes, err := xpath.Find(doc, "/doc/p")
+	if !assert.NoError(t, err, "Find should succeed") ||
+		!assert.Equal(t, "a b a b", contents(nodes), "all of the selected nodes are included") {
+		return
+	}
+}
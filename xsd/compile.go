@@ -0,0 +1,1467 @@
+package xsd
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/xpath"
+)
+
+// compiler holds the state of the compilation of a schema
+type compiler struct {
+	schema *Schema
+	loader DocumentLoader
+	loaded map[string]*helium.Document
+	docs   map[string]*document
+
+	// the global declarations and definitions, by expanded name
+	types           map[string]*declaration
+	elements        map[string]*declaration
+	attributes      map[string]*declaration
+	groups          map[string]*declaration
+	attributeGroups map[string]*declaration
+	constraints     map[string]*constraint
+
+	components map[*helium.Element]interface{} // compiled, by schema node
+	active     map[*helium.Element]bool        // the definitions being compiled
+	pending    []*pendingElement
+	declared   map[*element]*pendingElement
+	keyrefs    []*pendingKeyref
+}
+
+// pendingElement is an element declaration whose type is resolved
+// once all of the type definitions are known, as types may contain
+// elements of types that are derived from them
+type pendingElement struct {
+	elem   *element
+	doc    *document
+	done   bool
+	active bool
+}
+
+// pendingKeyref is a keyref whose key is resolved once all of the
+// identity constraints are known
+type pendingKeyref struct {
+	keyref *constraint
+	refer  string
+	doc    *document
+}
+
+// xmlAttributes are the attributes of the xml namespace, which are
+// declared without importing a schema for it
+var xmlAttributes = newXMLAttributes()
+
+func newXMLAttributes() map[string]*attribute {
+	space := *builtins[expandName(Namespace, "NCName")].(*simpleType)
+	space.name = ""
+	space.base = builtins[expandName(Namespace, "NCName")].(*simpleType)
+	space.facets.enumeration = []string{"default", "preserve"}
+
+	ret := map[string]*attribute{}
+	for local, typ := range map[string]*simpleType{
+		"lang":  builtins[expandName(Namespace, "string")].(*simpleType),
+		"space": &space,
+		"base":  builtins[expandName(Namespace, "anyURI")].(*simpleType),
+		"id":    builtins[expandName(Namespace, "ID")].(*simpleType),
+	} {
+		ret[expandName(helium.XMLNamespace, local)] = &attribute{name: local, uri: helium.XMLNamespace, typ: typ}
+	}
+	return ret
+}
+
+// DefaultLoader parses the document at uri with a new helium.Parser
+func DefaultLoader(uri string) (*helium.Document, error) {
+	return helium.NewParser().ParseURI(uri)
+}
+
+// NewCompiler creates a Compiler that loads schema documents with
+// DefaultLoader
+func NewCompiler() *Compiler {
+	return &Compiler{loader: DefaultLoader}
+}
+
+// SetLoader sets the DocumentLoader that the schema documents of
+// xs:include and xs:import are loaded with. nil restores DefaultLoader.
+func (c *Compiler) SetLoader(l DocumentLoader) {
+	if l == nil {
+		l = DefaultLoader
+	}
+	c.loader = l
+}
+
+// Compile compiles the schema doc with a new Compiler
+func Compile(doc *helium.Document) (*Schema, error) {
+	return NewCompiler().Compile(doc)
+}
+
+// Compile compiles the schema doc, along with the schema documents
+// that it includes or imports. xs:redefine is not supported.
+func (c *Compiler) Compile(doc *helium.Document) (*Schema, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START xsd.Compiler.Compile '%s'", doc.URL())
+		defer g.IRelease("END xsd.Compiler.Compile")
+	}
+
+	root := doc.DocumentElement()
+	if root == nil || !isXSD(root, "schema") {
+		return nil, &Error{Node: doc, Err: ErrNotSchema}
+	}
+
+	s := &Schema{
+		elements:   make(map[string]*element),
+		attributes: make(map[string]*attribute),
+		types:      make(map[string]typeDefinition),
+	}
+	s.targetNamespace, _ = attr(root, "targetNamespace")
+	cc := &compiler{
+		schema:          s,
+		loader:          c.loader,
+		loaded:          make(map[string]*helium.Document),
+		docs:            make(map[string]*document),
+		types:           make(map[string]*declaration),
+		elements:        make(map[string]*declaration),
+		attributes:      make(map[string]*declaration),
+		groups:          make(map[string]*declaration),
+		attributeGroups: make(map[string]*declaration),
+		constraints:     make(map[string]*constraint),
+		components:      make(map[*helium.Element]interface{}),
+		active:          make(map[*helium.Element]bool),
+		declared:        make(map[*element]*pendingElement),
+	}
+	if err := cc.addDocument(root, doc.URL(), nil); err != nil {
+		return nil, err
+	}
+	if err := cc.compileGlobals(); err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(cc.pending); i++ {
+		if err := cc.resolveElement(cc.pending[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := cc.resolveKeyrefs(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// TargetNamespace returns the target namespace of the schema
+func (s *Schema) TargetNamespace() string {
+	return s.targetNamespace
+}
+
+// addDocument records the global declarations of the schema document
+// root, and of the documents that it includes or imports. The
+// documents that includer includes without a target namespace take
+// its target namespace.
+func (c *compiler) addDocument(root *helium.Element, uri string, includer *document) error {
+	tns, hasTNS := attr(root, "targetNamespace")
+	d := &document{doc: root.OwnerDocument(), uri: uri, tns: tns}
+	if includer != nil && !hasTNS {
+		d.tns = includer.tns
+		d.chameleon = includer.tns != ""
+	}
+	if uri != "" {
+		key := uri + " " + d.tns
+		if _, ok := c.docs[key]; ok {
+			return nil
+		}
+		c.docs[key] = d
+	}
+	if v, _ := attr(root, "elementFormDefault"); v == "qualified" {
+		d.elementQualified = true
+	}
+	if v, _ := attr(root, "attributeFormDefault"); v == "qualified" {
+		d.attributeQualified = true
+	}
+
+	for _, n := range schemaChildren(root) {
+		local, _ := xpath.ExpandedName(n)
+		switch local {
+		case "include":
+			sub, ref, err := c.load(n, d)
+			if err != nil {
+				return err
+			}
+			if v, ok := attr(sub, "targetNamespace"); ok && v != d.tns {
+				return errorf(n, ErrInvalidSchema, "'%s' has the target namespace '%s' instead of '%s'", ref, v, d.tns)
+			}
+			if err := c.addDocument(sub, ref, d); err != nil {
+				return err
+			}
+		case "import":
+			ns, _ := attr(n, "namespace")
+			if ns == d.tns {
+				return errorf(n, ErrInvalidSchema, "cannot import the target namespace")
+			}
+			if _, ok := attr(n, "schemaLocation"); !ok {
+				continue
+			}
+			sub, ref, err := c.load(n, d)
+			if err != nil {
+				return err
+			}
+			if v, _ := attr(sub, "targetNamespace"); v != ns {
+				return errorf(n, ErrInvalidSchema, "'%s' has the target namespace '%s' instead of '%s'", ref, v, ns)
+			}
+			if err := c.addDocument(sub, ref, nil); err != nil {
+				return err
+			}
+		case "redefine":
+			return errorf(n, ErrUnsupported, "xs:redefine")
+		case "notation":
+		case "simpleType", "complexType", "element", "attribute", "group", "attributeGroup":
+			name, err := requiredAttribute(n, "name")
+			if err != nil {
+				return err
+			}
+			table := c.types
+			switch local {
+			case "element":
+				table = c.elements
+			case "attribute":
+				table = c.attributes
+			case "group":
+				table = c.groups
+			case "attributeGroup":
+				table = c.attributeGroups
+			}
+			key := expandName(d.tns, name)
+			if _, ok := table[key]; ok {
+				return errorf(n, ErrInvalidSchema, "duplicate definition of '%s'", key)
+			}
+			table[key] = &declaration{node: n, doc: d}
+		default:
+			return errorf(n, ErrInvalidSchema, "unexpected element")
+		}
+	}
+	return nil
+}
+
+// load loads the document of the schemaLocation of n
+func (c *compiler) load(n *helium.Element, d *document) (*helium.Element, string, error) {
+	loc, err := requiredAttribute(n, "schemaLocation")
+	if err != nil {
+		return nil, "", err
+	}
+	ref := resolveURI(loc, d.uri)
+	doc, ok := c.loaded[ref]
+	if !ok {
+		if doc, err = c.loader(ref); err != nil {
+			return nil, "", wrapError(n, err)
+		}
+		c.loaded[ref] = doc
+	}
+	root := doc.DocumentElement()
+	if root == nil || !isXSD(root, "schema") {
+		return nil, "", errorf(n, ErrNotSchema, "'%s'", ref)
+	}
+	return root, ref, nil
+}
+
+// compileGlobals compiles the global declarations and definitions,
+// including the ones that are not referred to
+func (c *compiler) compileGlobals() error {
+	for _, name := range sortedKeys(c.types) {
+		t, err := c.compileType(c.types[name], name)
+		if err != nil {
+			return err
+		}
+		c.schema.types[name] = t
+	}
+	for _, name := range sortedKeys(c.elements) {
+		decl := c.elements[name]
+		e, err := c.compileElement(decl.node, decl.doc, true)
+		if err != nil {
+			return err
+		}
+		c.schema.elements[name] = e
+	}
+	for _, name := range sortedKeys(c.attributes) {
+		decl := c.attributes[name]
+		a, err := c.compileAttribute(decl.node, decl.doc, true)
+		if err != nil {
+			return err
+		}
+		c.schema.attributes[name] = a
+	}
+	for _, name := range sortedKeys(c.groups) {
+		if _, err := c.compileGroup(c.groups[name]); err != nil {
+			return err
+		}
+	}
+	for _, name := range sortedKeys(c.attributeGroups) {
+		if _, err := c.compileAttributeGroup(c.attributeGroups[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]*declaration) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lookup returns the global declaration of kind named by the QName
+// qname, which is used by n
+func (c *compiler) lookup(n *helium.Element, d *document, table map[string]*declaration, kind, qname string) (*declaration, string, error) {
+	name, err := resolveQName(n, d, qname)
+	if err != nil {
+		return nil, "", err
+	}
+	decl, ok := table[name]
+	if !ok {
+		return nil, name, errorf(n, ErrUnknownComponent, "%s '%s'", kind, qname)
+	}
+	if c.active[decl.node] {
+		return nil, name, errorf(n, ErrCircularDefinition, "%s '%s'", kind, qname)
+	}
+	return decl, name, nil
+}
+
+// lookupType returns the type definition named by qname
+func (c *compiler) lookupType(n *helium.Element, d *document, qname string) (typeDefinition, error) {
+	name, err := resolveQName(n, d, qname)
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := builtins[name]; ok {
+		return t, nil
+	}
+	decl, _, err := c.lookup(n, d, c.types, "type", qname)
+	if err != nil {
+		return nil, err
+	}
+	return c.compileType(decl, name)
+}
+
+// lookupSimpleType returns the simple type definition named by qname
+func (c *compiler) lookupSimpleType(n *helium.Element, d *document, qname string) (*simpleType, error) {
+	t, err := c.lookupType(n, d, qname)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := t.(*simpleType)
+	if !ok {
+		return nil, errorf(n, ErrInvalidSchema, "'%s' is not a simple type", qname)
+	}
+	return st, nil
+}
+
+func (c *compiler) compileType(decl *declaration, name string) (typeDefinition, error) {
+	if isXSD(decl.node, "simpleType") {
+		return c.compileSimpleType(decl.node, decl.doc, name)
+	}
+	return c.compileComplexType(decl.node, decl.doc, name)
+}
+
+// compileSimpleType compiles the simple type definition n. name is
+// empty for anonymous types.
+func (c *compiler) compileSimpleType(n *helium.Element, d *document, name string) (*simpleType, error) {
+	if st, ok := c.components[n]; ok {
+		return st.(*simpleType), nil
+	}
+	c.active[n] = true
+	defer delete(c.active, n)
+
+	children := schemaChildren(n)
+	if len(children) == 0 {
+		return nil, errorf(n, ErrInvalidSchema, "missing restriction, list or union")
+	}
+	der := children[0]
+	local, _ := xpath.ExpandedName(der)
+
+	var st *simpleType
+	var err error
+	switch local {
+	case "restriction":
+		var base *simpleType
+		facets := schemaChildren(der)
+		if qname, ok := attr(der, "base"); ok {
+			base, err = c.lookupSimpleType(der, d, qname)
+		} else if len(facets) > 0 && isXSD(facets[0], "simpleType") {
+			base, err = c.compileSimpleType(facets[0], d, "")
+			facets = facets[1:]
+		} else {
+			err = errorf(der, ErrInvalidSchema, "missing base type")
+		}
+		if err != nil {
+			return nil, err
+		}
+		st, err = c.restrictSimpleType(der, name, base, facets)
+	case "list":
+		st = &simpleType{name: name, base: anySimpleType, variety: listVariety, facets: noFacets(wsCollapse)}
+		inline := schemaChildren(der)
+		if qname, ok := attr(der, "itemType"); ok {
+			st.item, err = c.lookupSimpleType(der, d, qname)
+		} else if len(inline) > 0 && isXSD(inline[0], "simpleType") {
+			st.item, err = c.compileSimpleType(inline[0], d, "")
+		} else {
+			err = errorf(der, ErrInvalidSchema, "missing item type")
+		}
+		if err == nil && st.item.variety == listVariety {
+			err = errorf(der, ErrInvalidSchema, "the item type cannot be a list")
+		}
+	case "union":
+		st = &simpleType{name: name, base: anySimpleType, variety: unionVariety, facets: noFacets(wsPreserve)}
+		if qnames, ok := attr(der, "memberTypes"); ok {
+			for _, qname := range strings.Fields(qnames) {
+				m, err := c.lookupSimpleType(der, d, qname)
+				if err != nil {
+					return nil, err
+				}
+				st.members = append(st.members, m)
+			}
+		}
+		for _, inline := range schemaChildren(der) {
+			if !isXSD(inline, "simpleType") {
+				return nil, errorf(inline, ErrInvalidSchema, "unexpected element")
+			}
+			m, err := c.compileSimpleType(inline, d, "")
+			if err != nil {
+				return nil, err
+			}
+			st.members = append(st.members, m)
+		}
+		if len(st.members) == 0 {
+			err = errorf(der, ErrInvalidSchema, "missing member types")
+		}
+	default:
+		err = errorf(der, ErrInvalidSchema, "unexpected element")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.components[n] = st
+	return st, nil
+}
+
+// restrictSimpleType returns the restriction of base by the facets
+func (c *compiler) restrictSimpleType(n *helium.Element, name string, base *simpleType, facets []*helium.Element) (*simpleType, error) {
+	st := *base
+	st.name = name
+	st.base = base
+
+	var patterns []*pattern
+	var enumeration []string
+	for _, f := range facets {
+		local, _ := xpath.ExpandedName(f)
+		if !isXSD(f, local) {
+			return nil, errorf(f, ErrInvalidSchema, "unexpected element")
+		}
+		v, err := requiredAttribute(f, "value")
+		if err != nil {
+			return nil, err
+		}
+
+		switch local {
+		case "length", "minLength", "maxLength", "totalDigits", "fractionDigits":
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				return nil, errorf(f, ErrInvalidSchema, "'%s' is not a non-negative integer", v)
+			}
+			switch local {
+			case "length":
+				st.facets.length = i
+			case "minLength":
+				st.facets.minLength = i
+			case "maxLength":
+				st.facets.maxLength = i
+			case "totalDigits":
+				st.facets.totalDigits = i
+			case "fractionDigits":
+				st.facets.fractionDigits = i
+			}
+		case "whiteSpace":
+			ws, ok := map[string]whiteSpace{"preserve": wsPreserve, "replace": wsReplace, "collapse": wsCollapse}[v]
+			if !ok || ws < base.facets.whiteSpace {
+				return nil, errorf(f, ErrInvalidSchema, "invalid whiteSpace '%s'", v)
+			}
+			st.facets.whiteSpace = ws
+		case "pattern":
+			p, err := compilePattern(v)
+			if err != nil {
+				return nil, wrapError(f, err)
+			}
+			patterns = append(patterns, p)
+		case "enumeration":
+			value, err := base.validate(v, f)
+			if err != nil {
+				return nil, wrapError(f, err)
+			}
+			enumeration = append(enumeration, value)
+		case "minInclusive", "minExclusive", "maxInclusive", "maxExclusive":
+			if base.variety != atomicVariety || base.primitive == nil || !base.primitive.ordered {
+				return nil, errorf(f, ErrInvalidSchema, "%s does not apply to %s", local, describe(base))
+			}
+			value, err := base.validate(v, f)
+			if err != nil {
+				return nil, wrapError(f, err)
+			}
+			switch local {
+			case "minInclusive":
+				st.facets.minInclusive = &value
+			case "minExclusive":
+				st.facets.minExclusive = &value
+			case "maxInclusive":
+				st.facets.maxInclusive = &value
+			case "maxExclusive":
+				st.facets.maxExclusive = &value
+			}
+		default:
+			return nil, errorf(f, ErrInvalidSchema, "unknown facet")
+		}
+	}
+
+	if len(patterns) > 0 {
+		st.facets.patterns = append(append([][]*pattern(nil), base.facets.patterns...), patterns)
+	}
+	if enumeration != nil {
+		st.facets.enumeration = enumeration
+	}
+	return &st, nil
+}
+
+// compileComplexType compiles the complex type definition n. name is
+// empty for anonymous types.
+func (c *compiler) compileComplexType(n *helium.Element, d *document, name string) (*complexType, error) {
+	if ct, ok := c.components[n]; ok {
+		return ct.(*complexType), nil
+	}
+	ct := &complexType{name: name, base: anyType, node: n}
+	c.components[n] = ct
+	c.active[n] = true
+	defer delete(c.active, n)
+
+	ct.abstract = yes(n, "abstract")
+	mixed := yes(n, "mixed")
+	children := schemaChildren(n)
+	if len(children) > 0 {
+		switch local, _ := xpath.ExpandedName(children[0]); local {
+		case "simpleContent":
+			return ct, c.compileSimpleContent(ct, children[0], d)
+		case "complexContent":
+			if _, ok := attr(children[0], "mixed"); ok {
+				mixed = yes(children[0], "mixed")
+			}
+			return ct, c.compileComplexContent(ct, children[0], d, mixed)
+		}
+	}
+
+	// a restriction of anyType
+	p, rest, err := c.compileContentParticle(children, d)
+	if err != nil {
+		return nil, err
+	}
+	if ct.attributes, ct.wildcard, err = c.compileAttributeUses(rest, d); err != nil {
+		return nil, err
+	}
+	ct.particle = p
+	ct.content = contentKind(p, mixed)
+	return ct, nil
+}
+
+// derivation returns the restriction or extension element of a
+// simpleContent or complexContent element, and its base type
+func (c *compiler) derivation(n *helium.Element, d *document) (*helium.Element, typeDefinition, error) {
+	children := schemaChildren(n)
+	if len(children) != 1 || !isXSD(children[0], "restriction") && !isXSD(children[0], "extension") {
+		return nil, nil, errorf(n, ErrInvalidSchema, "expected a restriction or an extension")
+	}
+	qname, err := requiredAttribute(children[0], "base")
+	if err != nil {
+		return nil, nil, err
+	}
+	base, err := c.lookupType(children[0], d, qname)
+	if err != nil {
+		return nil, nil, err
+	}
+	return children[0], base, nil
+}
+
+func (c *compiler) compileComplexContent(ct *complexType, n *helium.Element, d *document, mixed bool) error {
+	der, base, err := c.derivation(n, d)
+	if err != nil {
+		return err
+	}
+	b, ok := base.(*complexType)
+	if !ok || b.content == contentSimple {
+		return errorf(der, ErrInvalidSchema, "%s is not a complex type with complex content", describe(base))
+	}
+	ct.base = b
+
+	p, rest, err := c.compileContentParticle(schemaChildren(der), d)
+	if err != nil {
+		return err
+	}
+	uses, wc, err := c.compileAttributeUses(rest, d)
+	if err != nil {
+		return err
+	}
+
+	if isXSD(der, "restriction") {
+		ct.derivation = derivationRestriction
+		ct.particle = p
+		ct.content = contentKind(p, mixed)
+		ct.attributes = mergeAttributes(b.attributes, uses)
+		ct.wildcard = wc
+		return nil
+	}
+
+	ct.derivation = derivationExtension
+	switch {
+	case contentKind(b.particle, false) == contentEmpty:
+		ct.particle = p
+	case contentKind(p, false) == contentEmpty:
+		ct.particle = b.particle
+	default:
+		ct.particle = &particle{min: 1, max: 1, term: &modelGroup{
+			compositor: sequenceCompositor,
+			particles:  []*particle{b.particle, p},
+		}}
+	}
+	ct.content = contentKind(ct.particle, mixed || b.content == contentMixed)
+	ct.attributes = mergeAttributes(b.attributes, uses)
+	ct.wildcard = unionWildcards(b.wildcard, wc)
+	return nil
+}
+
+func (c *compiler) compileSimpleContent(ct *complexType, n *helium.Element, d *document) error {
+	der, base, err := c.derivation(n, d)
+	if err != nil {
+		return err
+	}
+	ct.base = base
+	ct.content = contentSimple
+	rest := schemaChildren(der)
+
+	var baseUses []*attributeUse
+	var baseWildcard *wildcard
+	switch b := base.(type) {
+	case *simpleType:
+		if isXSD(der, "restriction") {
+			return errorf(der, ErrInvalidSchema, "a simple type can only be extended")
+		}
+		ct.simple = b
+	case *complexType:
+		if b.content != contentSimple {
+			return errorf(der, ErrInvalidSchema, "%s does not have simple content", describe(base))
+		}
+		baseUses, baseWildcard = b.attributes, b.wildcard
+		ct.simple = b.simple
+	}
+
+	if isXSD(der, "restriction") {
+		ct.derivation = derivationRestriction
+		simple := ct.simple
+		if len(rest) > 0 && isXSD(rest[0], "simpleType") {
+			if simple, err = c.compileSimpleType(rest[0], d, ""); err != nil {
+				return err
+			}
+			rest = rest[1:]
+		}
+		i := 0
+		for i < len(rest) && !isAttributeDecl(rest[i]) {
+			i++
+		}
+		if ct.simple, err = c.restrictSimpleType(der, "", simple, rest[:i]); err != nil {
+			return err
+		}
+		rest = rest[i:]
+	} else {
+		ct.derivation = derivationExtension
+	}
+
+	uses, wc, err := c.compileAttributeUses(rest, d)
+	if err != nil {
+		return err
+	}
+	ct.attributes = mergeAttributes(baseUses, uses)
+	if ct.derivation == derivationExtension {
+		wc = unionWildcards(baseWildcard, wc)
+	}
+	ct.wildcard = wc
+	return nil
+}
+
+func isAttributeDecl(n *helium.Element) bool {
+	return isXSD(n, "attribute") || isXSD(n, "attributeGroup") || isXSD(n, "anyAttribute")
+}
+
+// contentKind returns the content type of a complex type with the
+// particle p
+func contentKind(p *particle, mixed bool) contentType {
+	switch {
+	case mixed:
+		return contentMixed
+	case p == nil || p.max == 0:
+		return contentEmpty
+	}
+	if g, ok := p.term.(*modelGroup); ok && len(g.particles) == 0 && g.compositor != choiceCompositor {
+		return contentEmpty
+	}
+	return contentElementOnly
+}
+
+// mergeAttributes returns the attribute uses of base, replaced or
+// removed by the ones of uses
+func mergeAttributes(base, uses []*attributeUse) []*attributeUse {
+	ret := append([]*attributeUse(nil), base...)
+	for _, u := range uses {
+		found := false
+		for i, b := range ret {
+			if b.decl.name == u.decl.name && b.decl.uri == u.decl.uri {
+				ret[i] = u
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, u)
+		}
+	}
+
+	var kept []*attributeUse
+	for _, u := range ret {
+		if !u.prohibited {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
+// unionWildcards returns a wildcard that accepts the namespaces of a
+// and b
+func unionWildcards(a, b *wildcard) *wildcard {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.any || b.any:
+		return &wildcard{any: true, process: b.process}
+	case a.not != nil || b.not != nil:
+		// ##other united with a list: only the lists that do not
+		// mention the excluded namespace are exact
+		ret := *a
+		if a.not == nil {
+			ret = *b
+		}
+		return &ret
+	}
+	ret := &wildcard{namespaces: map[string]struct{}{}, process: b.process}
+	for _, w := range []*wildcard{a, b} {
+		for ns := range w.namespaces {
+			ret.namespaces[ns] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// compileContentParticle compiles the model group that starts the
+// content of a complex type, if any, and returns the other children
+func (c *compiler) compileContentParticle(children []*helium.Element, d *document) (*particle, []*helium.Element, error) {
+	if len(children) == 0 {
+		return nil, nil, nil
+	}
+	switch local, _ := xpath.ExpandedName(children[0]); local {
+	case "group", "all", "choice", "sequence":
+		p, err := c.compileParticle(children[0], d)
+		if err != nil {
+			return nil, nil, err
+		}
+		return p, children[1:], nil
+	}
+	return nil, children, nil
+}
+
+// compileParticle compiles an element, a wildcard, a group reference
+// or a model group
+func (c *compiler) compileParticle(n *helium.Element, d *document) (*particle, error) {
+	p := &particle{min: 1, max: 1}
+	if v, ok := attr(n, "minOccurs"); ok {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			return nil, errorf(n, ErrInvalidSchema, "invalid minOccurs '%s'", v)
+		}
+		p.min = i
+	}
+	if v, ok := attr(n, "maxOccurs"); ok {
+		if v == "unbounded" {
+			p.max = unbounded
+		} else {
+			i, err := strconv.Atoi(v)
+			if err != nil || i < 0 {
+				return nil, errorf(n, ErrInvalidSchema, "invalid maxOccurs '%s'", v)
+			}
+			p.max = i
+		}
+	}
+	if p.max != unbounded && p.max < p.min {
+		return nil, errorf(n, ErrInvalidSchema, "maxOccurs is less than minOccurs")
+	}
+
+	var err error
+	switch local, _ := xpath.ExpandedName(n); local {
+	case "element":
+		p.term, err = c.compileElement(n, d, false)
+	case "any":
+		p.term, err = c.compileWildcard(n, d)
+	case "group":
+		var qname string
+		if qname, err = requiredAttribute(n, "ref"); err != nil {
+			return nil, err
+		}
+		var decl *declaration
+		if decl, _, err = c.lookup(n, d, c.groups, "group", qname); err != nil {
+			return nil, err
+		}
+		p.term, err = c.compileGroup(decl)
+	case "all", "choice", "sequence":
+		p.term, err = c.compileModelGroup(n, d)
+	default:
+		err = errorf(n, ErrInvalidSchema, "unexpected element")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if g, ok := p.term.(*modelGroup); ok && g.compositor == allCompositor && p.max != 1 {
+		return nil, errorf(n, ErrInvalidSchema, "the maxOccurs of xs:all must be 1")
+	}
+	return p, nil
+}
+
+func (c *compiler) compileModelGroup(n *helium.Element, d *document) (*modelGroup, error) {
+	g := &modelGroup{}
+	switch local, _ := xpath.ExpandedName(n); local {
+	case "choice":
+		g.compositor = choiceCompositor
+	case "all":
+		g.compositor = allCompositor
+	}
+	for _, child := range schemaChildren(n) {
+		if g.compositor == allCompositor && !isXSD(child, "element") {
+			return nil, errorf(child, ErrInvalidSchema, "xs:all can only contain elements")
+		}
+		p, err := c.compileParticle(child, d)
+		if err != nil {
+			return nil, err
+		}
+		if g.compositor == allCompositor && p.max > 1 {
+			return nil, errorf(child, ErrInvalidSchema, "the elements of xs:all cannot occur more than once")
+		}
+		if inner, ok := p.term.(*modelGroup); ok && inner.compositor == allCompositor {
+			return nil, errorf(child, ErrInvalidSchema, "xs:all must be the whole content model")
+		}
+		g.particles = append(g.particles, p)
+	}
+	return g, nil
+}
+
+// compileGroup compiles a global model group definition
+func (c *compiler) compileGroup(decl *declaration) (*modelGroup, error) {
+	if g, ok := c.components[decl.node]; ok {
+		return g.(*modelGroup), nil
+	}
+	c.active[decl.node] = true
+	defer delete(c.active, decl.node)
+
+	children := schemaChildren(decl.node)
+	if len(children) != 1 || !isXSD(children[0], "all") && !isXSD(children[0], "choice") && !isXSD(children[0], "sequence") {
+		return nil, errorf(decl.node, ErrInvalidSchema, "expected one of xs:all, xs:choice or xs:sequence")
+	}
+	g, err := c.compileModelGroup(children[0], decl.doc)
+	if err != nil {
+		return nil, err
+	}
+	c.components[decl.node] = g
+	return g, nil
+}
+
+func (c *compiler) compileWildcard(n *helium.Element, d *document) (*wildcard, error) {
+	w := &wildcard{namespaces: map[string]struct{}{}}
+	switch v, _ := attr(n, "processContents"); v {
+	case "", "strict":
+	case "lax":
+		w.process = processLax
+	case "skip":
+		w.process = processSkip
+	default:
+		return nil, errorf(n, ErrInvalidSchema, "invalid processContents '%s'", v)
+	}
+
+	v, ok := attr(n, "namespace")
+	switch {
+	case !ok || v == "##any":
+		w.any = true
+	case v == "##other":
+		tns := d.tns
+		w.not = &tns
+	default:
+		for _, ns := range strings.Fields(v) {
+			switch ns {
+			case "##targetNamespace":
+				ns = d.tns
+			case "##local":
+				ns = ""
+			}
+			w.namespaces[ns] = struct{}{}
+		}
+	}
+	return w, nil
+}
+
+// allows reports if w accepts the namespace uri
+func (w *wildcard) allows(uri string) bool {
+	switch {
+	case w.any:
+		return true
+	case w.not != nil:
+		return uri != "" && uri != *w.not
+	}
+	_, ok := w.namespaces[uri]
+	return ok
+}
+
+// compileElement compiles an element declaration. The particles that
+// refer to a global declaration return it. The type is resolved later
+// by resolveElement.
+func (c *compiler) compileElement(n *helium.Element, d *document, global bool) (*element, error) {
+	if e, ok := c.components[n]; ok {
+		return e.(*element), nil
+	}
+	if qname, ok := attr(n, "ref"); ok && !global {
+		decl, name, err := c.lookup(n, d, c.elements, "element", qname)
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := c.components[decl.node]; ok {
+			return e.(*element), nil
+		}
+		e, err := c.compileElement(decl.node, decl.doc, true)
+		if err != nil {
+			return nil, err
+		}
+		c.schema.elements[name] = e
+		return e, nil
+	}
+
+	name, err := requiredAttribute(n, "name")
+	if err != nil {
+		return nil, err
+	}
+	e := &element{name: name, node: n}
+	if global || form(n, d.elementQualified) {
+		e.uri = d.tns
+	}
+	c.components[n] = e
+
+	e.nillable = yes(n, "nillable")
+	e.abstract = yes(n, "abstract")
+	if v, ok := attr(n, "default"); ok {
+		e.def = &v
+	}
+	if v, ok := attr(n, "fixed"); ok {
+		if e.def != nil {
+			return nil, errorf(n, ErrInvalidSchema, "default and fixed are mutually exclusive")
+		}
+		e.fixed = &v
+	}
+
+	for _, child := range schemaChildren(n) {
+		local, _ := xpath.ExpandedName(child)
+		switch local {
+		case "unique", "key", "keyref":
+			con, err := c.compileConstraint(child, d)
+			if err != nil {
+				return nil, err
+			}
+			e.constraints = append(e.constraints, con)
+		case "simpleType", "complexType":
+		default:
+			return nil, errorf(child, ErrInvalidSchema, "unexpected element")
+		}
+	}
+
+	p := &pendingElement{elem: e, doc: d}
+	c.pending = append(c.pending, p)
+	c.declared[e] = p
+	return e, nil
+}
+
+// resolveElement resolves the type of a declaration, and adds it to
+// its substitution group
+func (c *compiler) resolveElement(p *pendingElement) error {
+	if p.done {
+		return nil
+	}
+	e, n := p.elem, p.elem.node
+	if p.active {
+		return errorf(n, ErrCircularDefinition, "substitution group of '%s'", e.name)
+	}
+	p.active = true
+	defer func() { p.active = false }()
+
+	var err error
+	if qname, ok := attr(n, "substitutionGroup"); ok {
+		decl, _, err := c.lookup(n, p.doc, c.elements, "element", qname)
+		if err != nil {
+			return err
+		}
+		head := c.components[decl.node].(*element)
+		if err := c.resolveElement(c.declared[head]); err != nil {
+			return err
+		}
+		head.members = append(head.members, e)
+		e.typ = head.typ
+	}
+
+	if qname, ok := attr(n, "type"); ok {
+		e.typ, err = c.lookupType(n, p.doc, qname)
+	} else {
+		for _, child := range schemaChildren(n) {
+			switch {
+			case isXSD(child, "simpleType"):
+				e.typ, err = c.compileSimpleType(child, p.doc, "")
+			case isXSD(child, "complexType"):
+				e.typ, err = c.compileComplexType(child, p.doc, "")
+			default:
+				continue
+			}
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if e.typ == nil {
+		e.typ = anyType
+	}
+
+	for _, v := range []*string{e.def, e.fixed} {
+		if v == nil {
+			continue
+		}
+		st := simpleTypeOf(e.typ)
+		if st == nil {
+			if ct, ok := e.typ.(*complexType); ok && ct.content == contentMixed {
+				continue
+			}
+			return errorf(n, ErrInvalidSchema, "a value constraint requires simple or mixed content")
+		}
+		if _, err := st.validate(*v, n); err != nil {
+			return wrapError(n, err)
+		}
+	}
+	p.done = true
+	return nil
+}
+
+// simpleTypeOf returns the simple type of the values of t, or nil if
+// they are not simple
+func simpleTypeOf(t typeDefinition) *simpleType {
+	switch t := t.(type) {
+	case *simpleType:
+		return t
+	case *complexType:
+		if t.content == contentSimple {
+			return t.simple
+		}
+	}
+	return nil
+}
+
+// compileAttributeUses compiles the attributes, the attribute group
+// references and the attribute wildcard of a complex type
+func (c *compiler) compileAttributeUses(children []*helium.Element, d *document) ([]*attributeUse, *wildcard, error) {
+	var uses []*attributeUse
+	var wc *wildcard
+	add := func(n *helium.Element, u *attributeUse) error {
+		for _, cur := range uses {
+			if cur.decl.name == u.decl.name && cur.decl.uri == u.decl.uri {
+				return errorf(n, ErrInvalidSchema, "duplicate attribute '%s'", u.decl.name)
+			}
+		}
+		uses = append(uses, u)
+		return nil
+	}
+
+	for _, n := range children {
+		local, _ := xpath.ExpandedName(n)
+		switch local {
+		case "attribute":
+			u, err := c.compileAttributeUse(n, d)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := add(n, u); err != nil {
+				return nil, nil, err
+			}
+		case "attributeGroup":
+			qname, err := requiredAttribute(n, "ref")
+			if err != nil {
+				return nil, nil, err
+			}
+			decl, _, err := c.lookup(n, d, c.attributeGroups, "attribute group", qname)
+			if err != nil {
+				return nil, nil, err
+			}
+			g, err := c.compileAttributeGroup(decl)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, u := range g.attributes {
+				if err := add(n, u); err != nil {
+					return nil, nil, err
+				}
+			}
+			if wc == nil {
+				wc = g.wildcard
+			}
+		case "anyAttribute":
+			w, err := c.compileWildcard(n, d)
+			if err != nil {
+				return nil, nil, err
+			}
+			wc = w
+		default:
+			return nil, nil, errorf(n, ErrInvalidSchema, "unexpected element")
+		}
+	}
+	return uses, wc, nil
+}
+
+// compileAttributeGroup compiles a global attribute group definition
+func (c *compiler) compileAttributeGroup(decl *declaration) (*attributeGroup, error) {
+	if g, ok := c.components[decl.node]; ok {
+		return g.(*attributeGroup), nil
+	}
+	c.active[decl.node] = true
+	defer delete(c.active, decl.node)
+
+	uses, wc, err := c.compileAttributeUses(schemaChildren(decl.node), decl.doc)
+	if err != nil {
+		return nil, err
+	}
+	g := &attributeGroup{attributes: uses, wildcard: wc}
+	c.components[decl.node] = g
+	return g, nil
+}
+
+func (c *compiler) compileAttributeUse(n *helium.Element, d *document) (*attributeUse, error) {
+	u := &attributeUse{}
+	switch v, _ := attr(n, "use"); v {
+	case "", "optional":
+	case "required":
+		u.required = true
+	case "prohibited":
+		u.prohibited = true
+	default:
+		return nil, errorf(n, ErrInvalidSchema, "invalid use '%s'", v)
+	}
+
+	var err error
+	if qname, ok := attr(n, "ref"); ok {
+		u.decl, err = c.lookupAttribute(n, d, qname)
+	} else {
+		u.decl, err = c.compileAttribute(n, d, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u.def, u.fixed = u.decl.def, u.decl.fixed
+	if v, ok := attr(n, "default"); ok {
+		u.def, u.fixed = &v, nil
+	}
+	if v, ok := attr(n, "fixed"); ok {
+		u.def, u.fixed = nil, &v
+	}
+	if u.required && u.def != nil {
+		return nil, errorf(n, ErrInvalidSchema, "a required attribute cannot have a default")
+	}
+	for _, v := range []*string{u.def, u.fixed} {
+		if v == nil {
+			continue
+		}
+		if _, err := u.decl.typ.validate(*v, n); err != nil {
+			return nil, wrapError(n, err)
+		}
+	}
+	return u, nil
+}
+
+// lookupAttribute returns the global attribute declaration named by
+// qname
+func (c *compiler) lookupAttribute(n *helium.Element, d *document, qname string) (*attribute, error) {
+	name, err := resolveQName(n, d, qname)
+	if err != nil {
+		return nil, err
+	}
+	if a, ok := xmlAttributes[name]; ok {
+		return a, nil
+	}
+	decl, _, err := c.lookup(n, d, c.attributes, "attribute", qname)
+	if err != nil {
+		return nil, err
+	}
+	return c.compileAttribute(decl.node, decl.doc, true)
+}
+
+func (c *compiler) compileAttribute(n *helium.Element, d *document, global bool) (*attribute, error) {
+	if a, ok := c.components[n]; ok {
+		return a.(*attribute), nil
+	}
+	name, err := requiredAttribute(n, "name")
+	if err != nil {
+		return nil, err
+	}
+	if name == "xmlns" {
+		return nil, errorf(n, ErrInvalidSchema, "attributes cannot be named xmlns")
+	}
+	a := &attribute{name: name, node: n}
+	if global || form(n, d.attributeQualified) {
+		a.uri = d.tns
+	}
+	if a.uri == InstanceNamespace {
+		return nil, errorf(n, ErrInvalidSchema, "attributes cannot be declared in the xsi namespace")
+	}
+
+	a.typ = anySimpleType
+	if qname, ok := attr(n, "type"); ok {
+		a.typ, err = c.lookupSimpleType(n, d, qname)
+	} else if children := schemaChildren(n); len(children) > 0 {
+		if !isXSD(children[0], "simpleType") {
+			return nil, errorf(children[0], ErrInvalidSchema, "unexpected element")
+		}
+		a.typ, err = c.compileSimpleType(children[0], d, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := attr(n, "default"); ok && global {
+		a.def = &v
+	}
+	if v, ok := attr(n, "fixed"); ok && global {
+		a.fixed = &v
+	}
+	if a.def != nil && a.fixed != nil {
+		return nil, errorf(n, ErrInvalidSchema, "default and fixed are mutually exclusive")
+	}
+	c.components[n] = a
+	return a, nil
+}
+
+// compileConstraint compiles a xs:unique, xs:key or xs:keyref
+func (c *compiler) compileConstraint(n *helium.Element, d *document) (*constraint, error) {
+	name, err := requiredAttribute(n, "name")
+	if err != nil {
+		return nil, err
+	}
+	con := &constraint{name: expandName(d.tns, name), node: n}
+	if _, ok := c.constraints[con.name]; ok {
+		return nil, errorf(n, ErrInvalidSchema, "duplicate identity constraint '%s'", name)
+	}
+	c.constraints[con.name] = con
+
+	switch local, _ := xpath.ExpandedName(n); local {
+	case "key":
+		con.kind = keyConstraint
+	case "keyref":
+		con.kind = keyrefConstraint
+		refer, err := requiredAttribute(n, "refer")
+		if err != nil {
+			return nil, err
+		}
+		c.keyrefs = append(c.keyrefs, &pendingKeyref{keyref: con, refer: refer, doc: d})
+	}
+
+	for _, child := range schemaChildren(n) {
+		expr, err := requiredAttribute(child, "xpath")
+		if err != nil {
+			return nil, err
+		}
+		x, err := xpath.Compile(expr)
+		if err != nil {
+			return nil, wrapError(child, err)
+		}
+		switch {
+		case isXSD(child, "selector") && con.selector == nil:
+			con.selector = x
+			con.ns = namespaces(child)
+		case isXSD(child, "field") && con.selector != nil:
+			con.fields = append(con.fields, x)
+		default:
+			return nil, errorf(child, ErrInvalidSchema, "unexpected element")
+		}
+	}
+	if con.selector == nil || len(con.fields) == 0 {
+		return nil, errorf(n, ErrInvalidSchema, "missing selector or field")
+	}
+	return con, nil
+}
+
+// resolveKeyrefs resolves the keys that the keyrefs refer to
+func (c *compiler) resolveKeyrefs() error {
+	for _, p := range c.keyrefs {
+		n := p.keyref.node
+		name, err := resolveQName(n, p.doc, p.refer)
+		if err != nil {
+			return err
+		}
+		key, ok := c.constraints[name]
+		if !ok || key.kind == keyrefConstraint {
+			return errorf(n, ErrUnknownComponent, "key '%s'", p.refer)
+		}
+		if len(key.fields) != len(p.keyref.fields) {
+			return errorf(n, ErrInvalidSchema, "the number of fields differs from the one of '%s'", p.refer)
+		}
+		p.keyref.refer = key
+	}
+	return nil
+}
+
+// namespaces returns the namespaces in scope on n, for the XPath
+// expressions of identity constraints. The default namespace does not
+// apply to them.
+func namespaces(n *helium.Element) map[string]string {
+	ret := make(map[string]string)
+	for _, ns := range n.NamespaceNodes() {
+		if ns.Prefix() != "" {
+			ret[ns.Prefix()] = ns.URI()
+		}
+	}
+	return ret
+}
+
+// lookupPrefix returns the namespace URI that prefix is bound to in
+// the scope of e
+func lookupPrefix(e *helium.Element, prefix string) (string, bool) {
+	if prefix == helium.XMLPrefix {
+		return helium.XMLNamespace, true
+	}
+	for _, ns := range e.NamespaceNodes() {
+		if ns.Prefix() == prefix {
+			return ns.URI(), true
+		}
+	}
+	return "", false
+}
+
+// resolveQName returns the expanded name of the QName qname, which is
+// used by n. The default namespace applies to it. In the documents
+// included without a target namespace, the names without a namespace
+// refer to the components of the including schema.
+func resolveQName(n *helium.Element, d *document, qname string) (string, error) {
+	prefix, local, found := strings.Cut(qname, ":")
+	if !found {
+		prefix, local = "", qname
+	}
+	if !isNCName(local) || found && !isNCName(prefix) {
+		return "", errorf(n, ErrInvalidSchema, "invalid QName '%s'", qname)
+	}
+	uri, ok := lookupPrefix(n, prefix)
+	if !ok && prefix != "" {
+		return "", errorf(n, ErrInvalidSchema, "undeclared prefix '%s'", prefix)
+	}
+	if uri == "" && d.chameleon {
+		uri = d.tns
+	}
+	return expandName(uri, local), nil
+}
+
+// expandName returns the key of a component, as "local" or
+// "{uri}local"
+func expandName(uri, local string) string {
+	if uri == "" {
+		return local
+	}
+	return "{" + uri + "}" + local
+}
+
+func isXSD(n helium.Node, local string) bool {
+	e, ok := n.(*helium.Element)
+	if !ok {
+		return false
+	}
+	elocal, uri := xpath.ExpandedName(e)
+	return uri == Namespace && elocal == local
+}
+
+// schemaChildren returns the child elements of n, but xs:annotation
+func schemaChildren(n *helium.Element) []*helium.Element {
+	var ret []*helium.Element
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if e, ok := c.(*helium.Element); ok && !isXSD(e, "annotation") {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// attr returns the value of the unqualified attribute name of e
+func attr(e *helium.Element, name string) (string, bool) {
+	for _, a := range e.Attributes() {
+		if a.Name() == name {
+			return a.Value(), true
+		}
+	}
+	return "", false
+}
+
+func requiredAttribute(e *helium.Element, name string) (string, error) {
+	v, ok := attr(e, name)
+	if !ok {
+		return "", errorf(e, ErrInvalidSchema, "missing %s attribute", name)
+	}
+	return v, nil
+}
+
+// yes reports if the boolean attribute name of e is true
+func yes(e *helium.Element, name string) bool {
+	v, _ := attr(e, name)
+	v = strings.TrimSpace(v)
+	return v == "true" || v == "1"
+}
+
+// form reports if a local declaration is qualified
+func form(e *helium.Element, qualified bool) bool {
+	if v, ok := attr(e, "form"); ok {
+		return v == "qualified"
+	}
+	return qualified
+}
+
+// resolveURI resolves the URI reference ref against base
+func resolveURI(ref, base string) string {
+	if base == "" {
+		return ref
+	}
+	r, err := url.Parse(ref)
+	if err != nil || r.IsAbs() {
+		return ref
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	if !b.IsAbs() && !path.IsAbs(b.Path) {
+		// a relative file name, like the ones that ParseFile records
+		if r.Path == "" || path.IsAbs(r.Path) {
+			return ref
+		}
+		return path.Join(path.Dir(b.Path), r.Path)
+	}
+	return b.ResolveReference(r).String()
+}
@@ -0,0 +1,400 @@
+package xsd
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xpath"
+)
+
+// contentModel returns the automaton of the content model of ct. It is
+// compiled on first use.
+func (ct *complexType) contentModel() *automaton {
+	ct.once.Do(func() {
+		m := &automaton{}
+		m.final = m.compile(ct.particle, m.newState())
+		ct.model = m
+	})
+	return ct.model
+}
+
+func (m *automaton) newState() int {
+	m.states = append(m.states, state{next: -1})
+	return len(m.states) - 1
+}
+
+func (m *automaton) epsilon(from, to int) {
+	m.states[from].eps = append(m.states[from].eps, to)
+}
+
+func (m *automaton) counted(from, to, counter int, op counterOp) {
+	m.states[from].counted = append(m.states[from].counted, counted{to: to, counter: counter, op: op})
+}
+
+// compile adds the transitions that match p from the state `from`, and
+// returns the state that is reached once p has been matched. Particles
+// that can occur more than once are counted, unless they are unbounded
+// with at most one required occurrence.
+func (m *automaton) compile(p *particle, from int) int {
+	if p == nil {
+		return from
+	}
+	if p.min > 1 || p.max > 1 {
+		return m.repeat(p, from)
+	}
+	for i := 0; i < p.min; i++ {
+		from = m.term(p.term, from)
+	}
+
+	final := m.newState()
+	if p.max == unbounded {
+		loop := m.newState()
+		m.epsilon(from, loop)
+		m.epsilon(m.term(p.term, loop), loop)
+		m.epsilon(loop, final)
+		return final
+	}
+	for i := p.min; i < p.max; i++ {
+		m.epsilon(from, final)
+		from = m.term(p.term, from)
+	}
+	m.epsilon(from, final)
+	return final
+}
+
+// repeat adds the transitions that match p by counting its occurrences,
+// rather than by unrolling them
+func (m *automaton) repeat(p *particle, from int) int {
+	c := len(m.counters)
+	m.counters = append(m.counters, counter{min: p.min, max: p.max, emptiable: emptiable(p.term)})
+
+	loop := m.newState()
+	m.counted(from, loop, c, counterEnter)
+	start := m.newState()
+	m.counted(loop, start, c, counterStart)
+	m.counted(m.term(p.term, start), loop, c, counterIncrement)
+	final := m.newState()
+	m.counted(loop, final, c, counterExit)
+	return final
+}
+
+// emptiable reports whether one occurrence of term can match no element
+func emptiable(term interface{}) bool {
+	g, ok := term.(*modelGroup)
+	if !ok {
+		return false
+	}
+	for _, p := range g.particles {
+		ok := p.min == 0 || emptiable(p.term)
+		if g.compositor == choiceCompositor && ok {
+			return true
+		}
+		if g.compositor != choiceCompositor && !ok {
+			return false
+		}
+	}
+	return g.compositor != choiceCompositor
+}
+
+// term adds the transitions that match one occurrence of term
+func (m *automaton) term(term interface{}, from int) int {
+	start := m.newState()
+	m.epsilon(from, start)
+
+	switch t := term.(type) {
+	case *modelGroup:
+		if t.compositor == choiceCompositor {
+			end := m.newState()
+			for _, p := range t.particles {
+				m.epsilon(m.compile(p, start), end)
+			}
+			return end
+		}
+		for _, p := range t.particles {
+			start = m.compile(p, start)
+		}
+		return start
+	}
+
+	end := m.newState()
+	m.states[start].term = term
+	m.states[start].next = end
+	return end
+}
+
+// config is a state of the automaton along with the values of the
+// counters: the number of occurrences that were matched, and the index
+// of the child at which the current occurrence started
+type config struct {
+	state  int
+	counts []int
+	starts []int
+}
+
+// dominates reports whether the configuration c matches every sequence
+// of children, from the one at pos, that d matches: they are in the same
+// state, and each counter of c has matched as many occurrences as that
+// of d, or fewer but at least min, and has not started an occurrence at
+// pos unless that of d has too
+func (m *automaton) dominates(c, d config, pos int) bool {
+	if c.state != d.state {
+		return false
+	}
+	for i, ctr := range m.counters {
+		if c.starts[i] == pos && d.starts[i] != pos {
+			return false
+		}
+		if n := c.counts[i]; n != d.counts[i] && (n > d.counts[i] || n < ctr.min) {
+			return false
+		}
+	}
+	return true
+}
+
+// step returns the configuration that t moves c to, when the next
+// child is at pos, and false if t cannot be taken
+func (m *automaton) step(c config, t counted, pos int) (config, bool) {
+	ctr := m.counters[t.counter]
+	n, start := c.counts[t.counter], c.starts[t.counter]
+	switch t.op {
+	case counterEnter:
+		n, start = 0, -1
+	case counterStart:
+		if ctr.max != unbounded && n >= ctr.max {
+			return c, false
+		}
+		start = pos
+	case counterIncrement:
+		// empty occurrences are only needed to reach min, which
+		// counterExit allows for when the term is emptiable
+		if start == pos {
+			return c, false
+		}
+		// past min, the occurrences of an unbounded particle need
+		// not be told apart
+		if ctr.max != unbounded || n < ctr.min {
+			n++
+		}
+	case counterExit:
+		if n < ctr.min && !ctr.emptiable {
+			return c, false
+		}
+		n, start = 0, -1
+	}
+
+	ret := config{state: t.to, counts: make([]int, len(c.counts)), starts: make([]int, len(c.starts))}
+	copy(ret.counts, c.counts)
+	copy(ret.starts, c.starts)
+	ret.counts[t.counter], ret.starts[t.counter] = n, start
+	return ret, true
+}
+
+// closure adds the configurations that can be reached from set without
+// consuming the child at pos. The configurations that are dominated by
+// another one are dropped, which keeps the counters from multiplying
+// them.
+func (m *automaton) closure(set []config, pos int) []config {
+	var all []config
+	var dropped []bool
+	states := map[int][]int{}
+	add := func(c config) {
+		for _, i := range states[c.state] {
+			if !dropped[i] && m.dominates(all[i], c, pos) {
+				return
+			}
+		}
+		for _, i := range states[c.state] {
+			if m.dominates(c, all[i], pos) {
+				dropped[i] = true
+			}
+		}
+		states[c.state] = append(states[c.state], len(all))
+		all = append(all, c)
+		dropped = append(dropped, false)
+	}
+	for _, c := range set {
+		add(c)
+	}
+	// the transitions preserve the domination, so that those of the
+	// dropped configurations need not be followed
+	for i := 0; i < len(all); i++ {
+		if dropped[i] {
+			continue
+		}
+		c := all[i]
+		for _, s := range m.states[c.state].eps {
+			add(config{state: s, counts: c.counts, starts: c.starts})
+		}
+		for _, t := range m.states[c.state].counted {
+			if next, ok := m.step(c, t, pos); ok {
+				add(next)
+			}
+		}
+	}
+
+	var ret []config
+	for i, c := range all {
+		if !dropped[i] {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// match matches the child elements against the automaton. It returns
+// the declaration or the wildcard that each of the matched children
+// corresponds to. When a child is not accepted, its index is returned
+// along with the terms that were expected instead; -1 means that the
+// content is not complete.
+func (m *automaton) match(children []*helium.Element) (terms []interface{}, failed int, expected []interface{}) {
+	initial := config{counts: make([]int, len(m.counters)), starts: make([]int, len(m.counters))}
+	for i := range initial.starts {
+		initial.starts[i] = -1
+	}
+	cur := m.closure([]config{initial}, 0)
+	for i, child := range children {
+		var next []config
+		var matched interface{}
+		for _, c := range cur {
+			st := m.states[c.state]
+			if st.term == nil {
+				continue
+			}
+			if t := matchTerm(st.term, child); t != nil {
+				if matched == nil {
+					matched = t
+				}
+				next = append(next, config{state: st.next, counts: c.counts, starts: c.starts})
+			}
+		}
+		if len(next) == 0 {
+			return terms, i, m.expected(cur)
+		}
+		terms = append(terms, matched)
+		cur = m.closure(next, i+1)
+	}
+
+	for _, c := range cur {
+		if c.state == m.final {
+			return terms, len(children), nil
+		}
+	}
+	return terms, -1, m.expected(cur)
+}
+
+// expected returns the terms that can be matched from the states of
+// cur
+func (m *automaton) expected(cur []config) []interface{} {
+	var ret []interface{}
+	seen := map[interface{}]bool{}
+	for _, c := range cur {
+		if t := m.states[c.state].term; t != nil && !seen[t] {
+			seen[t] = true
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+// matchTerm returns the declaration of the child element that term
+// accepts: the element of term or of its substitution group, or the
+// wildcard. It returns nil if term does not accept child.
+func matchTerm(term interface{}, child *helium.Element) interface{} {
+	local, uri := xpath.ExpandedName(child)
+	switch t := term.(type) {
+	case *element:
+		if e := t.substitute(local, uri); e != nil {
+			return e
+		}
+	case *wildcard:
+		if t.allows(uri) {
+			return t
+		}
+	}
+	return nil
+}
+
+// substitute returns the element named local in the namespace uri
+// among e and its substitution group, that can appear in its place
+func (e *element) substitute(local, uri string) *element {
+	if e.name == local && e.uri == uri {
+		return e
+	}
+	for _, m := range e.members {
+		if ret := m.substitute(local, uri); ret != nil && !ret.abstract {
+			return ret
+		}
+	}
+	return nil
+}
+
+// matchAll matches the child elements against a xs:all group, whose
+// particles each match at most one element
+func matchAll(g *modelGroup, emptiable bool, children []*helium.Element) (terms []interface{}, failed int, expected []interface{}) {
+	seen := make([]bool, len(g.particles))
+	for i, child := range children {
+		var matched interface{}
+		for j, p := range g.particles {
+			if seen[j] || p.max == 0 {
+				continue
+			}
+			if matched = matchTerm(p.term, child); matched != nil {
+				seen[j] = true
+				break
+			}
+		}
+		if matched == nil {
+			for j, p := range g.particles {
+				if !seen[j] && p.max > 0 {
+					expected = append(expected, p.term)
+				}
+			}
+			return terms, i, expected
+		}
+		terms = append(terms, matched)
+	}
+
+	if len(children) == 0 && emptiable {
+		return terms, 0, nil
+	}
+	for j, p := range g.particles {
+		if !seen[j] && p.min > 0 {
+			expected = append(expected, p.term)
+		}
+	}
+	if len(expected) > 0 {
+		return terms, -1, expected
+	}
+	return terms, len(children), nil
+}
+
+// describeTerms returns the names of the elements that terms accept,
+// for the messages
+func describeTerms(terms []interface{}) string {
+	var names []string
+	for _, t := range terms {
+		switch t := t.(type) {
+		case *element:
+			names = append(names, expandName(t.uri, t.name))
+		case *wildcard:
+			switch {
+			case t.any:
+				names = append(names, "##any")
+			case t.not != nil:
+				names = append(names, "##other")
+			default:
+				var l []string
+				for ns := range t.namespaces {
+					if ns == "" {
+						ns = "##local"
+					}
+					l = append(l, ns)
+				}
+				sort.Strings(l)
+				names = append(names, strings.Join(l, " "))
+			}
+		}
+	}
+	return strings.Join(names, ", ")
+}
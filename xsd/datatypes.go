@@ -0,0 +1,531 @@
+package xsd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lestrrat/helium"
+)
+
+var (
+	anyType       = newAnyType()
+	anySimpleType = &simpleType{name: expandName(Namespace, "anySimpleType"), facets: noFacets(wsPreserve)}
+	builtins      = newBuiltins()
+)
+
+// builtinPrimitives are the primitive types, along with whether their
+// values are ordered
+var builtinPrimitives = []*primitive{
+	{name: "string", check: anyValue, compare: equalStrings, length: characters},
+	{name: "boolean", check: isBoolean, compare: compareBooleans, canonical: canonicalBoolean},
+	{name: "decimal", check: isDecimal, compare: compareDecimals, canonical: canonicalDecimal, ordered: true},
+	{name: "float", check: isFloat, compare: compareFloats, canonical: canonicalFloat, ordered: true},
+	{name: "double", check: isFloat, compare: compareFloats, canonical: canonicalFloat, ordered: true},
+	{name: "duration", check: isDuration, compare: compareDurations, canonical: canonicalDuration, ordered: true},
+	{name: "dateTime", check: dateChecker("dateTime"), compare: dateComparer("dateTime"), canonical: dateCanonical("dateTime"), ordered: true},
+	{name: "time", check: dateChecker("time"), compare: dateComparer("time"), canonical: dateCanonical("time"), ordered: true},
+	{name: "date", check: dateChecker("date"), compare: dateComparer("date"), canonical: dateCanonical("date"), ordered: true},
+	{name: "gYearMonth", check: dateChecker("gYearMonth"), compare: dateComparer("gYearMonth"), canonical: dateCanonical("gYearMonth"), ordered: true},
+	{name: "gYear", check: dateChecker("gYear"), compare: dateComparer("gYear"), canonical: dateCanonical("gYear"), ordered: true},
+	{name: "gMonthDay", check: dateChecker("gMonthDay"), compare: dateComparer("gMonthDay"), canonical: dateCanonical("gMonthDay"), ordered: true},
+	{name: "gDay", check: dateChecker("gDay"), compare: dateComparer("gDay"), canonical: dateCanonical("gDay"), ordered: true},
+	{name: "gMonth", check: dateChecker("gMonth"), compare: dateComparer("gMonth"), canonical: dateCanonical("gMonth"), ordered: true},
+	{name: "hexBinary", check: isHexBinary, compare: compareHexBinary, canonical: strings.ToUpper, length: hexOctets},
+	{name: "base64Binary", check: isBase64Binary, compare: compareBase64Binary, canonical: canonicalBase64Binary, length: base64Octets},
+	{name: "anyURI", check: anyValue, compare: equalStrings, length: characters},
+	{name: "QName", check: isQName, compare: equalStrings},
+	{name: "NOTATION", check: isQName, compare: equalStrings},
+}
+
+func noFacets(ws whiteSpace) facets {
+	return facets{
+		whiteSpace:     ws,
+		length:         -1,
+		minLength:      -1,
+		maxLength:      -1,
+		totalDigits:    -1,
+		fractionDigits: -1,
+	}
+}
+
+// newAnyType returns the ur-type, which accepts any attribute and any
+// content
+func newAnyType() *complexType {
+	any := &wildcard{any: true, process: processLax}
+	return &complexType{
+		name:     expandName(Namespace, "anyType"),
+		content:  contentMixed,
+		particle: &particle{min: 0, max: unbounded, term: any},
+		wildcard: any,
+	}
+}
+
+// newBuiltins returns the built-in types, by expanded name
+func newBuiltins() map[string]typeDefinition {
+	types := map[string]typeDefinition{}
+	add := func(st *simpleType) *simpleType {
+		types[st.name] = st
+		return st
+	}
+	restrict := func(base *simpleType, local string, f func(*simpleType)) *simpleType {
+		st := *base
+		st.name = expandName(Namespace, local)
+		st.base = base
+		f(&st)
+		return add(&st)
+	}
+	list := func(item *simpleType, local string) *simpleType {
+		st := &simpleType{
+			name:    expandName(Namespace, local),
+			base:    anySimpleType,
+			variety: listVariety,
+			item:    item,
+			facets:  noFacets(wsCollapse),
+		}
+		st.facets.minLength = 1
+		return add(st)
+	}
+	bounds := func(min, max string) func(*simpleType) {
+		return func(st *simpleType) {
+			if min != "" {
+				st.facets.minInclusive = &min
+			}
+			if max != "" {
+				st.facets.maxInclusive = &max
+			}
+		}
+	}
+
+	types[anyType.name] = anyType
+	add(anySimpleType)
+	prims := map[string]*simpleType{}
+	for _, p := range builtinPrimitives {
+		ws := wsCollapse
+		if p.name == "string" {
+			ws = wsPreserve
+		}
+		prims[p.name] = add(&simpleType{
+			name:      expandName(Namespace, p.name),
+			base:      anySimpleType,
+			primitive: p,
+			facets:    noFacets(ws),
+		})
+	}
+
+	normalizedString := restrict(prims["string"], "normalizedString", func(st *simpleType) { st.facets.whiteSpace = wsReplace })
+	token := restrict(normalizedString, "token", func(st *simpleType) { st.facets.whiteSpace = wsCollapse })
+	restrict(token, "language", func(st *simpleType) { st.lexical = languagePattern.MatchString })
+	nmtoken := restrict(token, "NMTOKEN", func(st *simpleType) { st.lexical = isNmtoken })
+	list(nmtoken, "NMTOKENS")
+	name := restrict(token, "Name", func(st *simpleType) { st.lexical = isName })
+	ncname := restrict(name, "NCName", func(st *simpleType) { st.lexical = isNCName })
+	restrict(ncname, "ID", func(st *simpleType) { st.special = specialID })
+	idref := restrict(ncname, "IDREF", func(st *simpleType) { st.special = specialIDREF })
+	list(idref, "IDREFS")
+	entity := restrict(ncname, "ENTITY", func(*simpleType) {})
+	list(entity, "ENTITIES")
+
+	integer := restrict(prims["decimal"], "integer", func(st *simpleType) {
+		st.lexical = integerPattern.MatchString
+		st.facets.fractionDigits = 0
+	})
+	nonPositive := restrict(integer, "nonPositiveInteger", bounds("", "0"))
+	restrict(nonPositive, "negativeInteger", bounds("", "-1"))
+	long := restrict(integer, "long", bounds("-9223372036854775808", "9223372036854775807"))
+	intType := restrict(long, "int", bounds("-2147483648", "2147483647"))
+	short := restrict(intType, "short", bounds("-32768", "32767"))
+	restrict(short, "byte", bounds("-128", "127"))
+	nonNegative := restrict(integer, "nonNegativeInteger", bounds("0", ""))
+	unsignedLong := restrict(nonNegative, "unsignedLong", bounds("", "18446744073709551615"))
+	unsignedInt := restrict(unsignedLong, "unsignedInt", bounds("", "4294967295"))
+	unsignedShort := restrict(unsignedInt, "unsignedShort", bounds("", "65535"))
+	restrict(unsignedShort, "unsignedByte", bounds("", "255"))
+	restrict(nonNegative, "positiveInteger", bounds("1", ""))
+	return types
+}
+
+var (
+	languagePattern = regexp.MustCompile(`^[a-zA-Z]{1,8}(-[a-zA-Z0-9]{1,8})*$`)
+	integerPattern  = regexp.MustCompile(`^[+-]?[0-9]+$`)
+	decimalPattern  = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)
+	floatPattern    = regexp.MustCompile(`^([+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?|INF|-INF|NaN)$`)
+	hexPattern      = regexp.MustCompile(`^([0-9a-fA-F]{2})*$`)
+	durationPattern = regexp.MustCompile(`^(-)?P(?:([0-9]+)Y)?(?:([0-9]+)M)?(?:([0-9]+)D)?(?:T(?:([0-9]+)H)?(?:([0-9]+)M)?(?:([0-9]+(?:\.[0-9]+)?)S)?)?$`)
+)
+
+func anyValue(string, *helium.Element) bool {
+	return true
+}
+
+func equalStrings(a, b string) (int, bool) {
+	return 0, a == b
+}
+
+func characters(s string) (int, bool) {
+	return utf8.RuneCountInString(s), true
+}
+
+func isNameStart(r rune) bool {
+	return r == '_' || r == ':' || unicode.IsLetter(r) || unicode.Is(unicode.Nl, r)
+}
+
+func isNameChar(r rune) bool {
+	return isNameStart(r) || r == '.' || r == '-' || r == 0xB7 || unicode.IsDigit(r) ||
+		unicode.In(r, unicode.Mn, unicode.Mc, unicode.Lm)
+}
+
+func isName(s string) bool {
+	for i, r := range s {
+		if i == 0 && !isNameStart(r) || !isNameChar(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isNCName(s string) bool {
+	return isName(s) && !strings.ContainsRune(s, ':')
+}
+
+func isNmtoken(s string) bool {
+	for _, r := range s {
+		if !isNameChar(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isQName checks a QName, and that its prefix is declared in the scope
+// of ctx
+func isQName(s string, ctx *helium.Element) bool {
+	prefix, local, found := strings.Cut(s, ":")
+	if !found {
+		return isNCName(s)
+	}
+	if !isNCName(prefix) || !isNCName(local) {
+		return false
+	}
+	if ctx == nil {
+		return true
+	}
+	_, ok := lookupPrefix(ctx, prefix)
+	return ok
+}
+
+func isBoolean(s string, _ *helium.Element) bool {
+	switch s {
+	case "true", "false", "1", "0":
+		return true
+	}
+	return false
+}
+
+func compareBooleans(a, b string) (int, bool) {
+	truth := func(s string) bool { return s == "true" || s == "1" }
+	return 0, truth(a) == truth(b)
+}
+
+func canonicalBoolean(s string) string {
+	switch s {
+	case "1":
+		return "true"
+	case "0":
+		return "false"
+	}
+	return s
+}
+
+func isDecimal(s string, _ *helium.Element) bool {
+	return decimalPattern.MatchString(s)
+}
+
+// decimalValue returns the value of a decimal or of an integer
+func decimalValue(s string) (*big.Rat, bool) {
+	s = strings.TrimPrefix(s, "+")
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	if strings.HasPrefix(s, ".") {
+		s = "0" + s
+	}
+	s = strings.TrimSuffix(s, ".")
+	return new(big.Rat).SetString(sign + s)
+}
+
+func compareDecimals(a, b string) (int, bool) {
+	x, ok := decimalValue(a)
+	if !ok {
+		return 0, false
+	}
+	y, ok := decimalValue(b)
+	if !ok {
+		return 0, false
+	}
+	return x.Cmp(y), true
+}
+
+func canonicalDecimal(s string) string {
+	x, ok := decimalValue(s)
+	if !ok {
+		return s
+	}
+	return x.RatString()
+}
+
+func isFloat(s string, _ *helium.Element) bool {
+	return floatPattern.MatchString(s)
+}
+
+func floatValue(s string) float64 {
+	switch s {
+	case "INF":
+		return math.Inf(1)
+	case "-INF":
+		return math.Inf(-1)
+	case "NaN":
+		return math.NaN()
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+func compareFloats(a, b string) (int, bool) {
+	x, y := floatValue(a), floatValue(b)
+	switch {
+	case math.IsNaN(x) || math.IsNaN(y):
+		// NaN is only equal to itself
+		return 0, math.IsNaN(x) && math.IsNaN(y)
+	case x < y:
+		return -1, true
+	case x > y:
+		return 1, true
+	}
+	return 0, true
+}
+
+func canonicalFloat(s string) string {
+	return formatFloat(floatValue(s))
+}
+
+// formatFloat formats f, -0 being the same as 0
+func formatFloat(f float64) string {
+	if f == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func isDuration(s string, _ *helium.Element) bool {
+	m := durationPattern.FindStringSubmatch(s)
+	if m == nil || strings.HasSuffix(s, "T") {
+		return false
+	}
+	for _, part := range m[2:] {
+		if part != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// durationValue returns the months and the seconds of a duration
+func durationValue(s string) (months, seconds float64) {
+	m := durationPattern.FindStringSubmatch(s)
+	num := func(i int) float64 {
+		f, _ := strconv.ParseFloat(m[i], 64)
+		return f
+	}
+	months = num(2)*12 + num(3)
+	seconds = ((num(4)*24+num(5))*60+num(6))*60 + num(7)
+	if m[1] == "-" {
+		months, seconds = -months, -seconds
+	}
+	return months, seconds
+}
+
+// compareDurations orders durations when their months and their
+// seconds agree, the order of the others being indeterminate
+func compareDurations(a, b string) (int, bool) {
+	m1, s1 := durationValue(a)
+	m2, s2 := durationValue(b)
+	sign := func(f float64) int {
+		switch {
+		case f < 0:
+			return -1
+		case f > 0:
+			return 1
+		}
+		return 0
+	}
+	dm, ds := sign(m1-m2), sign(s1-s2)
+	switch {
+	case dm == 0:
+		return ds, true
+	case ds == 0 || ds == dm:
+		return dm, true
+	}
+	return 0, false
+}
+
+func canonicalDuration(s string) string {
+	months, seconds := durationValue(s)
+	return formatFloat(months) + "M" + formatFloat(seconds) + "S"
+}
+
+const timezonePattern = `(?P<tz>Z|[+-][0-9]{2}:[0-9]{2})?$`
+
+var datePatterns = map[string]*regexp.Regexp{
+	"dateTime":   regexp.MustCompile(`^(?P<year>-?[0-9]{4,})-(?P<month>[0-9]{2})-(?P<day>[0-9]{2})T(?P<hour>[0-9]{2}):(?P<minute>[0-9]{2}):(?P<second>[0-9]{2})(?P<frac>\.[0-9]+)?` + timezonePattern),
+	"time":       regexp.MustCompile(`^(?P<hour>[0-9]{2}):(?P<minute>[0-9]{2}):(?P<second>[0-9]{2})(?P<frac>\.[0-9]+)?` + timezonePattern),
+	"date":       regexp.MustCompile(`^(?P<year>-?[0-9]{4,})-(?P<month>[0-9]{2})-(?P<day>[0-9]{2})` + timezonePattern),
+	"gYearMonth": regexp.MustCompile(`^(?P<year>-?[0-9]{4,})-(?P<month>[0-9]{2})` + timezonePattern),
+	"gYear":      regexp.MustCompile(`^(?P<year>-?[0-9]{4,})` + timezonePattern),
+	"gMonthDay":  regexp.MustCompile(`^--(?P<month>[0-9]{2})-(?P<day>[0-9]{2})` + timezonePattern),
+	"gDay":       regexp.MustCompile(`^---(?P<day>[0-9]{2})` + timezonePattern),
+	"gMonth":     regexp.MustCompile(`^--(?P<month>[0-9]{2})` + timezonePattern),
+}
+
+// dateValue returns the instant of a date or time value of the
+// primitive type name. The missing fields are taken from
+// 2000-01-01T00:00:00Z, 2000 being a leap year.
+func dateValue(name, s string) (time.Time, bool) {
+	re := datePatterns[name]
+	m := re.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, false
+	}
+
+	fields := map[string]int{"year": 2000, "month": 1, "day": 1}
+	var nanos int
+	loc := time.UTC
+	for i, group := range re.SubexpNames() {
+		v := m[i]
+		if group == "" || v == "" {
+			continue
+		}
+		switch group {
+		case "frac":
+			digits := (v[1:] + "000000000")[:9]
+			nanos, _ = strconv.Atoi(digits)
+		case "tz":
+			if v == "Z" {
+				continue
+			}
+			h, _ := strconv.Atoi(v[1:3])
+			min, _ := strconv.Atoi(v[4:6])
+			if h > 14 || min > 59 || h == 14 && min != 0 {
+				return time.Time{}, false
+			}
+			offset := (h*60 + min) * 60
+			if v[0] == '-' {
+				offset = -offset
+			}
+			loc = time.FixedZone(v, offset)
+		case "year":
+			digits := strings.TrimPrefix(v, "-")
+			if len(digits) > 9 || len(digits) > 4 && digits[0] == '0' {
+				return time.Time{}, false
+			}
+			fallthrough
+		default:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return time.Time{}, false
+			}
+			fields[group] = n
+		}
+	}
+
+	year, month, day := fields["year"], fields["month"], fields["day"]
+	hour, minute, second := fields["hour"], fields["minute"], fields["second"]
+	switch {
+	case year == 0, month < 1, month > 12, day < 1, day > daysIn(year, month):
+		return time.Time{}, false
+	case minute > 59, second > 59, hour > 24:
+		return time.Time{}, false
+	case hour == 24 && (minute != 0 || second != 0 || nanos != 0):
+		return time.Time{}, false
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, second, nanos, loc).UTC(), true
+}
+
+func daysIn(year, month int) int {
+	return time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func dateChecker(name string) func(string, *helium.Element) bool {
+	return func(s string, _ *helium.Element) bool {
+		_, ok := dateValue(name, s)
+		return ok
+	}
+}
+
+func dateComparer(name string) func(a, b string) (int, bool) {
+	return func(a, b string) (int, bool) {
+		x, _ := dateValue(name, a)
+		y, _ := dateValue(name, b)
+		switch {
+		case x.Before(y):
+			return -1, true
+		case x.After(y):
+			return 1, true
+		}
+		return 0, true
+	}
+}
+
+func dateCanonical(name string) func(string) string {
+	return func(s string) string {
+		t, _ := dateValue(name, s)
+		return t.Format(time.RFC3339Nano)
+	}
+}
+
+func isHexBinary(s string, _ *helium.Element) bool {
+	return hexPattern.MatchString(s)
+}
+
+func compareHexBinary(a, b string) (int, bool) {
+	return 0, strings.EqualFold(a, b)
+}
+
+func hexOctets(s string) (int, bool) {
+	b, err := hex.DecodeString(s)
+	return len(b), err == nil
+}
+
+func base64Value(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+func isBase64Binary(s string, _ *helium.Element) bool {
+	_, err := base64Value(s)
+	return err == nil
+}
+
+func compareBase64Binary(a, b string) (int, bool) {
+	x, _ := base64Value(a)
+	y, _ := base64Value(b)
+	return 0, bytes.Equal(x, y)
+}
+
+func canonicalBase64Binary(s string) string {
+	b, _ := base64Value(s)
+	return hex.EncodeToString(b)
+}
+
+func base64Octets(s string) (int, bool) {
+	b, err := base64Value(s)
+	return len(b), err == nil
+}
@@ -0,0 +1,85 @@
+package xsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/lestrrat/helium"
+)
+
+func (e *Error) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("xsd: ")
+	if e.Node != nil {
+		if doc := e.Node.OwnerDocument(); doc != nil && doc.URL() != "" {
+			buf.WriteString(doc.URL())
+			buf.WriteString(": ")
+		}
+		fmt.Fprintf(&buf, "%s: ", e.Node.Name())
+	}
+	buf.WriteString(e.Err.Error())
+	if p, ok := e.Node.(helium.Positioned); ok && p.Line() > 0 {
+		fmt.Fprintf(&buf, " at line %d", p.Line())
+	}
+	return buf.String()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrapError reports err at the node n of the schema, unless it was
+// already reported at a more specific node
+func wrapError(n helium.Node, err error) error {
+	if err == nil {
+		return nil
+	}
+	var xerr *Error
+	if errors.As(err, &xerr) {
+		return err
+	}
+	return &Error{Node: n, Err: err}
+}
+
+// errorf reports a problem at the node n of the schema
+func errorf(n helium.Node, err error, format string, args ...interface{}) error {
+	return &Error{Node: n, Err: fmt.Errorf("%w: "+format, append([]interface{}{err}, args...)...)}
+}
+
+func (e *ValidationError) Error() string {
+	var buf bytes.Buffer
+	switch e.Node.(type) {
+	case *helium.Element:
+		fmt.Fprintf(&buf, "element %s: ", e.Node.Name())
+	case *helium.Attribute:
+		fmt.Fprintf(&buf, "attribute %s: ", e.Node.Name())
+	}
+	buf.WriteString(e.Err.Error())
+	if e.Line > 0 {
+		fmt.Fprintf(&buf, " at line %d", e.Line)
+	}
+	return buf.String()
+}
+
+// Unwrap returns the underlying error
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func (e ValidationErrors) Error() string {
+	var buf bytes.Buffer
+	for i, err := range e {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(err.Error())
+	}
+	return buf.String()
+}
+
+// Unwrap returns the individual violations
+func (e ValidationErrors) Unwrap() []error {
+	return e
+}
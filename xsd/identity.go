@@ -0,0 +1,118 @@
+package xsd
+
+import (
+	"strings"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xpath"
+)
+
+// checkConstraint checks the identity constraint con of e. The values
+// of the fields are compared in the value spaces of their types, and
+// the values without a type as strings, with their whitespace collapsed.
+func (v *validator) checkConstraint(e *helium.Element, con *constraint) {
+	ctx := &xpath.Context{Namespaces: con.ns}
+	nodes, err := con.selector.Find(ctx, e)
+	if err != nil {
+		v.errorf(e, ErrInvalidValue, "selector of '%s': %s", con.name, err)
+		return
+	}
+
+	var keys map[string]helium.Node
+	switch con.kind {
+	case keyrefConstraint:
+		keys = v.keysWithin(e, con.refer)
+	default:
+		keys = make(map[string]helium.Node)
+		v.tables[con] = append(v.tables[con], keyTable{owner: e, values: keys})
+	}
+
+	for _, n := range nodes {
+		key, value, complete := v.keyValue(ctx, n, con)
+		if !complete {
+			if con.kind == keyConstraint {
+				v.errorf(n, ErrIncompleteKey, "a field of the key '%s' has no value", con.name)
+			}
+			continue
+		}
+
+		switch con.kind {
+		case keyrefConstraint:
+			if _, ok := keys[key]; !ok {
+				v.errorf(n, ErrKeyNotFound, "'%s' does not match a value of '%s'", displayKey(value), con.refer.name)
+			}
+		default:
+			if _, ok := keys[key]; ok {
+				v.errorf(n, ErrDuplicateKey, "'%s' is a duplicate value of '%s'", displayKey(value), con.name)
+				continue
+			}
+			keys[key] = n
+		}
+	}
+}
+
+// keyValue returns the key that the values of the fields of con for n
+// are compared by, and the values, which are not complete if a field
+// does not select a node
+func (v *validator) keyValue(ctx *xpath.Context, n helium.Node, con *constraint) (string, string, bool) {
+	keys := make([]string, 0, len(con.fields))
+	values := make([]string, 0, len(con.fields))
+	for _, f := range con.fields {
+		o, err := f.Evaluate(ctx, n)
+		if err != nil {
+			v.errorf(n, ErrInvalidValue, "field of '%s': %s", con.name, err)
+			return "", "", false
+		}
+		if o.Type() != xpath.NodeSetType {
+			value := normalize(o.String(), wsCollapse)
+			keys = append(keys, anySimpleType.key(value, nil))
+			values = append(values, value)
+			continue
+		}
+		switch selected := o.NodeSet(); len(selected) {
+		case 0:
+			return "", "", false
+		case 1:
+			value := normalize(xpath.StringValue(selected[0]), wsCollapse)
+			key, ok := v.keys[selected[0]]
+			if !ok {
+				key = anySimpleType.key(value, nil)
+			}
+			keys = append(keys, key)
+			values = append(values, value)
+		default:
+			v.errorf(n, ErrInvalidValue, "a field of '%s' selects more than one node", con.name)
+			return "", "", false
+		}
+	}
+	return strings.Join(keys, "\x00"), strings.Join(values, "\x00"), true
+}
+
+// keysWithin returns the values of key for e, and for the descendants
+// of e that it is declared on
+func (v *validator) keysWithin(e *helium.Element, key *constraint) map[string]helium.Node {
+	ret := make(map[string]helium.Node)
+	for _, table := range v.tables[key] {
+		if !within(table.owner, e) {
+			continue
+		}
+		for k, n := range table.values {
+			ret[k] = n
+		}
+	}
+	return ret
+}
+
+// within reports if n is e, or one of its descendants
+func within(n helium.Node, e *helium.Element) bool {
+	for ; n != nil; n = n.Parent() {
+		if n == helium.Node(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func displayKey(value string) string {
+	return strings.ReplaceAll(value, "\x00", "', '")
+}
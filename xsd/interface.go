@@ -0,0 +1,387 @@
+package xsd
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xpath"
+)
+
+// Namespace is the namespace URI of the schema elements and of the
+// built-in types
+const Namespace = "http://www.w3.org/2001/XMLSchema"
+
+// InstanceNamespace is the namespace URI of the xsi:type and xsi:nil
+// attributes of instance documents
+const InstanceNamespace = "http://www.w3.org/2001/XMLSchema-instance"
+
+var (
+	ErrCircularDefinition = errors.New("circular definition")
+	ErrInvalidSchema      = errors.New("invalid schema")
+	ErrNotSchema          = errors.New("document is not a schema")
+	ErrUnknownComponent   = errors.New("unknown schema component")
+	ErrUnsupported        = errors.New("unsupported schema construct")
+)
+
+var (
+	ErrAbstract            = errors.New("abstract declaration or type")
+	ErrDuplicateID         = errors.New("duplicate ID")
+	ErrDuplicateKey        = errors.New("duplicate key")
+	ErrIncompleteKey       = errors.New("incomplete key")
+	ErrInvalidContent      = errors.New("invalid content")
+	ErrInvalidNil          = errors.New("invalid xsi:nil")
+	ErrInvalidType         = errors.New("invalid xsi:type")
+	ErrInvalidValue        = errors.New("invalid value")
+	ErrKeyNotFound         = errors.New("key not found")
+	ErrMissingAttribute    = errors.New("missing attribute")
+	ErrMissingElement      = errors.New("missing element")
+	ErrUnexpectedAttribute = errors.New("unexpected attribute")
+	ErrUnexpectedElement   = errors.New("unexpected element")
+	ErrUnknownElement      = errors.New("no declaration for element")
+	ErrUnknownID           = errors.New("unknown ID")
+)
+
+// Error is returned when a schema cannot be compiled. Node is the node
+// of the schema that the problem was found at.
+type Error struct {
+	Node helium.Node
+	Err  error
+}
+
+// ValidationError is a violation of the schema by a node of an
+// instance document. Line and Column are where the node starts, or
+// where its element starts for attributes, if known.
+type ValidationError struct {
+	Node   helium.Node
+	Line   int
+	Column int
+	Err    error
+}
+
+// ValidationErrors is returned by Schema.Validate and
+// Schema.ValidateElement, and holds all of the violations that were
+// found
+type ValidationErrors []error
+
+// DocumentLoader loads the schema documents of xs:include and xs:import.
+// uri is absolute, unless the including schema has no URI.
+type DocumentLoader func(uri string) (*helium.Document, error)
+
+// Compiler compiles schemas. The zero value is not usable, use
+// NewCompiler.
+type Compiler struct {
+	loader DocumentLoader
+}
+
+// Schema is a compiled schema. It is not modified by validations, so
+// it may be used to validate several documents concurrently.
+type Schema struct {
+	targetNamespace string
+	elements        map[string]*element
+	attributes      map[string]*attribute
+	types           map[string]typeDefinition
+}
+
+// document is a schema document, along with the properties that its
+// declarations inherit
+type document struct {
+	doc                *helium.Document
+	uri                string
+	tns                string
+	chameleon          bool // included without a targetNamespace
+	elementQualified   bool
+	attributeQualified bool
+}
+
+// declaration is a global declaration or definition that is not
+// compiled yet
+type declaration struct {
+	node *helium.Element
+	doc  *document
+}
+
+// typeDefinition is either a *simpleType or a *complexType
+type typeDefinition interface {
+	typeName() string
+	baseType() typeDefinition
+}
+
+type variety int
+
+const (
+	atomicVariety variety = iota
+	listVariety
+	unionVariety
+)
+
+type whiteSpace int
+
+const (
+	wsPreserve whiteSpace = iota
+	wsReplace
+	wsCollapse
+)
+
+// special marks the types whose values are IDs or references to IDs
+type special int
+
+const (
+	specialNone special = iota
+	specialID
+	specialIDREF
+)
+
+// simpleType is a simple type definition. A restriction starts as a
+// copy of its base type, so the facets and the lexical checks of the
+// base types all apply.
+type simpleType struct {
+	name      string
+	base      *simpleType
+	variety   variety
+	primitive *primitive
+	lexical   func(string) bool // additional lexical check of some built-in types
+	item      *simpleType
+	members   []*simpleType
+	special   special
+	facets    facets
+}
+
+// facets holds the constraining facets of a simple type. The lengths
+// and the digits are -1 when absent.
+type facets struct {
+	whiteSpace     whiteSpace
+	length         int
+	minLength      int
+	maxLength      int
+	totalDigits    int
+	fractionDigits int
+	// patterns holds one group per derivation step, a value has to
+	// match one pattern of each group
+	patterns     [][]*pattern
+	enumeration  []string
+	minInclusive *string
+	minExclusive *string
+	maxInclusive *string
+	maxExclusive *string
+}
+
+// pattern is a pattern facet, translated to a regexp.Regexp
+type pattern struct {
+	src string
+	re  *regexp.Regexp
+}
+
+// primitive is a primitive built-in type
+type primitive struct {
+	name  string
+	check func(s string, ctx *helium.Element) bool
+	// compare returns the order of the values a and b, which are
+	// valid. ok is false when they are not comparable, or for the
+	// types without an order, when they are not equal.
+	compare func(a, b string) (cmp int, ok bool)
+	// canonical returns the representation of a valid value that the
+	// values equal to it share. It is nil when each value has a single
+	// representation.
+	canonical func(s string) string
+	ordered   bool
+	// length returns the length of a value for the length facets, in
+	// characters or octets. ok is false when they do not apply.
+	length func(s string) (n int, ok bool)
+}
+
+type derivation int
+
+const (
+	derivationRestriction derivation = iota
+	derivationExtension
+)
+
+type contentType int
+
+const (
+	contentEmpty contentType = iota
+	contentSimple
+	contentElementOnly
+	contentMixed
+)
+
+// complexType is a complex type definition, with the attributes and
+// the content model inherited from its base type
+type complexType struct {
+	name       string
+	base       typeDefinition
+	derivation derivation
+	abstract   bool
+	content    contentType
+	simple     *simpleType // the type of simple content
+	particle   *particle
+	attributes []*attributeUse
+	wildcard   *wildcard // the attribute wildcard
+	node       helium.Node
+
+	once  sync.Once
+	model *automaton
+}
+
+// element is an element declaration
+type element struct {
+	name        string
+	uri         string
+	typ         typeDefinition
+	nillable    bool
+	abstract    bool
+	def         *string
+	fixed       *string
+	members     []*element // the elements of its substitution group
+	constraints []*constraint
+	node        *helium.Element
+}
+
+// attribute is an attribute declaration
+type attribute struct {
+	name  string
+	uri   string
+	typ   *simpleType
+	def   *string
+	fixed *string
+	node  *helium.Element
+}
+
+// attributeUse is an attribute of a complex type. Its value
+// constraint overrides the one of the declaration.
+type attributeUse struct {
+	decl       *attribute
+	required   bool
+	prohibited bool
+	def        *string
+	fixed      *string
+}
+
+// attributeGroup is an attribute group definition
+type attributeGroup struct {
+	attributes []*attributeUse
+	wildcard   *wildcard
+}
+
+const unbounded = -1
+
+// particle is an element declaration, a wildcard or a model group,
+// along with its number of occurrences
+type particle struct {
+	min  int
+	max  int
+	term interface{} // *element, *wildcard or *modelGroup
+}
+
+type compositor int
+
+const (
+	sequenceCompositor compositor = iota
+	choiceCompositor
+	allCompositor
+)
+
+type modelGroup struct {
+	compositor compositor
+	particles  []*particle
+}
+
+type processContents int
+
+const (
+	processStrict processContents = iota
+	processLax
+	processSkip
+)
+
+// wildcard is a xs:any or xs:anyAttribute. The namespaces are keyed by
+// URI, "" standing for the elements and attributes without namespace.
+type wildcard struct {
+	any        bool
+	not        *string // ##other: any namespace but this one, and ""
+	namespaces map[string]struct{}
+	process    processContents
+}
+
+type constraintKind int
+
+const (
+	uniqueConstraint constraintKind = iota
+	keyConstraint
+	keyrefConstraint
+)
+
+// constraint is an identity constraint definition
+type constraint struct {
+	name     string
+	kind     constraintKind
+	selector *xpath.Expr
+	fields   []*xpath.Expr
+	ns       map[string]string
+	refer    *constraint
+	node     *helium.Element
+}
+
+// automaton is a content model compiled into a nondeterministic
+// automaton over the child elements, with counters for the bounded
+// repetitions. State 0 is the initial state.
+type automaton struct {
+	states   []state
+	counters []counter
+	final    int
+}
+
+type state struct {
+	term    interface{} // *element or *wildcard that moves to next, if any
+	next    int
+	eps     []int     // transitions that do not consume an element
+	counted []counted // transitions that do not consume an element, but check or update a counter
+}
+
+// counter counts the occurrences of a repeated particle
+type counter struct {
+	min       int
+	max       int
+	emptiable bool // an occurrence of the term can be empty
+}
+
+type counterOp int
+
+const (
+	counterEnter     counterOp = iota // resets the counter
+	counterStart                      // starts an occurrence, if fewer than max were matched
+	counterIncrement                  // ends an occurrence, which must have matched an element
+	counterExit                       // leaves the repetition, if at least min were matched
+)
+
+type counted struct {
+	to      int
+	counter int
+	op      counterOp
+}
+
+// validator holds the state of the validation of a tree
+type validator struct {
+	schema *Schema
+	errors []error
+	ids    map[string]helium.Node
+	refs   []idref
+	tables map[*constraint][]keyTable
+	keys   map[helium.Node]string // typed values of the validated nodes, see simpleType.key
+}
+
+// idref is a reference to an ID, which is checked once the whole tree
+// has been seen
+type idref struct {
+	node  helium.Node
+	value string
+}
+
+// keyTable holds the values of an identity constraint within the
+// element that it is declared on, by key
+type keyTable struct {
+	owner  *helium.Element
+	values map[string]helium.Node
+}
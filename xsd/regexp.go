@@ -0,0 +1,174 @@
+package xsd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The multi-character escapes of XML Schema regular expressions, as
+// RE2 character classes and as the contents of one
+var (
+	classEscapes = map[byte]string{
+		'd': `\p{Nd}`,
+		'D': `\P{Nd}`,
+		's': `[ \t\n\r]`,
+		'S': `[^ \t\n\r]`,
+		'i': `[\p{L}\p{Nl}_:]`,
+		'I': `[^\p{L}\p{Nl}_:]`,
+		'c': `[\p{L}\p{Nl}\p{Nd}\p{Mn}\p{Mc}\p{Lm}._:\x{B7}\-]`,
+		'C': `[^\p{L}\p{Nl}\p{Nd}\p{Mn}\p{Mc}\p{Lm}._:\x{B7}\-]`,
+		'w': `[^\p{P}\p{Z}\p{C}]`,
+		'W': `[\p{P}\p{Z}\p{C}]`,
+	}
+	inClassEscapes = map[byte]string{
+		'd': `\p{Nd}`,
+		'D': `\P{Nd}`,
+		's': ` \t\n\r`,
+		'i': `\p{L}\p{Nl}_:`,
+		'c': `\p{L}\p{Nl}\p{Nd}\p{Mn}\p{Mc}\p{Lm}._:\x{B7}\-`,
+		'W': `\p{P}\p{Z}\p{C}`,
+	}
+)
+
+// blocks are the Unicode blocks of \p{IsBlock} that are supported
+var blocks = map[string]string{
+	"BasicLatin":           `\x{0}-\x{7F}`,
+	"Latin-1Supplement":    `\x{80}-\x{FF}`,
+	"LatinExtended-A":      `\x{100}-\x{17F}`,
+	"LatinExtended-B":      `\x{180}-\x{24F}`,
+	"IPAExtensions":        `\x{250}-\x{2AF}`,
+	"Greek":                `\x{370}-\x{3FF}`,
+	"Cyrillic":             `\x{400}-\x{4FF}`,
+	"Hebrew":               `\x{590}-\x{5FF}`,
+	"Arabic":               `\x{600}-\x{6FF}`,
+	"Hiragana":             `\x{3040}-\x{309F}`,
+	"Katakana":             `\x{30A0}-\x{30FF}`,
+	"CJKUnifiedIdeographs": `\x{4E00}-\x{9FFF}`,
+}
+
+// compilePattern compiles the regular expression of a pattern facet.
+// The expression matches whole values. Character class subtraction is
+// not supported.
+func compilePattern(src string) (*pattern, error) {
+	re, err := translatePattern(src)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := regexp.Compile(`^(?:` + re + `)$`)
+	if err != nil {
+		return nil, fmt.Errorf("%w: pattern '%s': %s", ErrInvalidSchema, src, err)
+	}
+	return &pattern{src: src, re: compiled}, nil
+}
+
+// patternSource returns the expression of the patterns of a group
+func patternSource(group []*pattern) string {
+	var l []string
+	for _, p := range group {
+		l = append(l, p.src)
+	}
+	return strings.Join(l, "|")
+}
+
+// translatePattern translates an XML Schema regular expression to the
+// RE2 syntax
+func translatePattern(src string) (string, error) {
+	var buf strings.Builder
+	inClass := false
+	classStart := false
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '\\':
+			if i+1 == len(src) {
+				return "", fmt.Errorf("%w: pattern '%s' ends with '\\'", ErrInvalidSchema, src)
+			}
+			i++
+			c = src[i]
+			switch c {
+			case 'p', 'P':
+				end := strings.IndexByte(src[i:], '}')
+				if i+1 == len(src) || src[i+1] != '{' || end < 0 {
+					return "", fmt.Errorf("%w: invalid category escape in pattern '%s'", ErrInvalidSchema, src)
+				}
+				name := src[i+2 : i+end]
+				i += end
+				if block, ok := strings.CutPrefix(name, "Is"); ok {
+					r, ok := blocks[block]
+					if !ok {
+						return "", fmt.Errorf("%w: block escape '%s' in pattern '%s'", ErrUnsupported, name, src)
+					}
+					switch {
+					case inClass && c == 'p':
+						buf.WriteString(r)
+					case inClass:
+						return "", fmt.Errorf("%w: negated block escape in a character class in pattern '%s'", ErrUnsupported, src)
+					case c == 'p':
+						buf.WriteString("[" + r + "]")
+					default:
+						buf.WriteString("[^" + r + "]")
+					}
+					break
+				}
+				fmt.Fprintf(&buf, `\%c{%s}`, c, name)
+			case 'n', 'r', 't':
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			default:
+				var r string
+				var ok bool
+				if inClass {
+					if r, ok = inClassEscapes[c]; !ok {
+						if _, ok = classEscapes[c]; ok {
+							return "", fmt.Errorf("%w: escape '\\%c' in a character class in pattern '%s'", ErrUnsupported, c, src)
+						}
+					}
+				} else {
+					r, ok = classEscapes[c]
+				}
+				if ok {
+					buf.WriteString(r)
+					break
+				}
+				if strings.IndexByte(`\|.-^?*+{}()[]$`, c) < 0 {
+					return "", fmt.Errorf("%w: invalid escape '\\%c' in pattern '%s'", ErrInvalidSchema, c, src)
+				}
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+			}
+		case inClass:
+			switch {
+			case c == ']' && !classStart:
+				inClass = false
+				buf.WriteByte(c)
+			case c == '-' && i+1 < len(src) && src[i+1] == '[':
+				return "", fmt.Errorf("%w: character class subtraction in pattern '%s'", ErrUnsupported, src)
+			case c == '[':
+				buf.WriteString(`\[`)
+			case c == '^' && classStart:
+				buf.WriteByte(c)
+				continue
+			default:
+				buf.WriteByte(c)
+			}
+		case c == '[':
+			inClass = true
+			buf.WriteByte(c)
+			classStart = true
+			continue
+		case c == '.':
+			buf.WriteString(`[^\n\r]`)
+		case c == '^' || c == '$':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+		classStart = false
+	}
+	if inClass {
+		return "", fmt.Errorf("%w: unterminated character class in pattern '%s'", ErrInvalidSchema, src)
+	}
+	return buf.String(), nil
+}
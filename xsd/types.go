@@ -0,0 +1,240 @@
+package xsd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lestrrat/helium"
+)
+
+func (st *simpleType) typeName() string {
+	return st.name
+}
+
+func (st *simpleType) baseType() typeDefinition {
+	if st.base == nil {
+		return anyType
+	}
+	return st.base
+}
+
+func (ct *complexType) typeName() string {
+	return ct.name
+}
+
+func (ct *complexType) baseType() typeDefinition {
+	return ct.base
+}
+
+// describe returns the name of t for the messages
+func describe(t typeDefinition) string {
+	if name := t.typeName(); name != "" {
+		return "'" + name + "'"
+	}
+	return "an anonymous type"
+}
+
+// derivedFrom reports if t is base, or is derived from it. The member
+// types of a union are also derived from it.
+func derivedFrom(t, base typeDefinition) bool {
+	if u, ok := base.(*simpleType); ok && u.variety == unionVariety {
+		for _, m := range u.members {
+			if derivedFrom(t, m) {
+				return true
+			}
+		}
+	}
+	for t != nil {
+		if t == base {
+			return true
+		}
+		if t == anyType {
+			return false
+		}
+		t = t.baseType()
+	}
+	return false
+}
+
+// normalize applies the whiteSpace facet ws to s
+func normalize(s string, ws whiteSpace) string {
+	switch ws {
+	case wsReplace:
+		return strings.Map(func(r rune) rune {
+			switch r {
+			case '\t', '\n', '\r':
+				return ' '
+			}
+			return r
+		}, s)
+	case wsCollapse:
+		return strings.Join(strings.Fields(s), " ")
+	}
+	return s
+}
+
+// validate checks the value s, and returns it normalized. The prefixes
+// of QNames are looked up in the scope of ctx.
+func (st *simpleType) validate(s string, ctx *helium.Element) (string, error) {
+	s = normalize(s, st.facets.whiteSpace)
+	switch st.variety {
+	case atomicVariety:
+		if st.primitive != nil && !st.primitive.check(s, ctx) || st.lexical != nil && !st.lexical(s) {
+			return s, fmt.Errorf("%w: '%s' is not a valid value of %s", ErrInvalidValue, s, describe(st))
+		}
+	case listVariety:
+		for _, item := range strings.Fields(s) {
+			if _, err := st.item.validate(item, ctx); err != nil {
+				return s, err
+			}
+		}
+	case unionVariety:
+		ok := false
+		for _, m := range st.members {
+			if v, err := m.validate(s, ctx); err == nil {
+				s, ok = v, true
+				break
+			}
+		}
+		if !ok {
+			return s, fmt.Errorf("%w: '%s' is not a valid value of any member type of %s", ErrInvalidValue, s, describe(st))
+		}
+	}
+	if err := st.checkFacets(s); err != nil {
+		return s, fmt.Errorf("%w: '%s' %s", ErrInvalidValue, s, err)
+	}
+	return s, nil
+}
+
+// checkFacets checks the normalized value s against the facets of st
+func (st *simpleType) checkFacets(s string) error {
+	f := &st.facets
+	if f.length > -1 || f.minLength > -1 || f.maxLength > -1 {
+		if n, ok := st.length(s); ok {
+			switch {
+			case f.length > -1 && n != f.length:
+				return fmt.Errorf("does not have the length %d", f.length)
+			case f.minLength > -1 && n < f.minLength:
+				return fmt.Errorf("is shorter than the minimum length %d", f.minLength)
+			case f.maxLength > -1 && n > f.maxLength:
+				return fmt.Errorf("is longer than the maximum length %d", f.maxLength)
+			}
+		}
+	}
+
+	for _, group := range f.patterns {
+		ok := false
+		for _, re := range group {
+			if re.re.MatchString(s) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("does not match the pattern '%s'", patternSource(group))
+		}
+	}
+
+	if f.enumeration != nil {
+		ok := false
+		for _, v := range f.enumeration {
+			if st.equal(s, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("is not one of '%s'", strings.Join(f.enumeration, "', '"))
+		}
+	}
+
+	bounds := []struct {
+		bound *string
+		valid func(int) bool
+		what  string
+	}{
+		{f.minInclusive, func(c int) bool { return c >= 0 }, "less than"},
+		{f.minExclusive, func(c int) bool { return c > 0 }, "less than or equal to"},
+		{f.maxInclusive, func(c int) bool { return c <= 0 }, "greater than"},
+		{f.maxExclusive, func(c int) bool { return c < 0 }, "greater than or equal to"},
+	}
+	for _, b := range bounds {
+		if b.bound == nil || st.primitive == nil {
+			continue
+		}
+		if c, ok := st.primitive.compare(s, *b.bound); !ok || !b.valid(c) {
+			return fmt.Errorf("is %s %s", b.what, *b.bound)
+		}
+	}
+
+	if f.totalDigits > -1 || f.fractionDigits > -1 {
+		total, fraction := digits(s)
+		switch {
+		case f.totalDigits > -1 && total > f.totalDigits:
+			return fmt.Errorf("has more than %d digits", f.totalDigits)
+		case f.fractionDigits > -1 && fraction > f.fractionDigits:
+			return fmt.Errorf("has more than %d fraction digits", f.fractionDigits)
+		}
+	}
+	return nil
+}
+
+// length returns the length of s for the length facets
+func (st *simpleType) length(s string) (int, bool) {
+	switch {
+	case st.variety == listVariety:
+		return len(strings.Fields(s)), true
+	case st.variety == atomicVariety && st.primitive != nil && st.primitive.length != nil:
+		return st.primitive.length(s)
+	}
+	return 0, false
+}
+
+// equal reports if the normalized values a and b are equal
+func (st *simpleType) equal(a, b string) bool {
+	if st.variety == atomicVariety && st.primitive != nil {
+		c, ok := st.primitive.compare(a, b)
+		return ok && c == 0
+	}
+	return a == b
+}
+
+// key returns a representation of the normalized value s that is the
+// same for the values that are equal, and differs for the values of
+// different primitive types. It is used to compare the values of the
+// identity constraints. The values without a primitive type are
+// compared as strings.
+func (st *simpleType) key(s string, ctx *helium.Element) string {
+	switch st.variety {
+	case listVariety:
+		items := strings.Fields(s)
+		for i, item := range items {
+			items[i] = st.item.key(item, ctx)
+		}
+		return strings.Join(items, " ")
+	case unionVariety:
+		for _, m := range st.members {
+			if v, err := m.validate(s, ctx); err == nil {
+				return m.key(v, ctx)
+			}
+		}
+	}
+	p := st.primitive
+	if p == nil {
+		return "string:" + s
+	}
+	if p.canonical != nil {
+		s = p.canonical(s)
+	}
+	return p.name + ":" + s
+}
+
+// digits returns the number of significant digits of a decimal value,
+// and the number of its fraction digits
+func digits(s string) (total, fraction int) {
+	s = strings.TrimLeft(s, "+-")
+	integer, frac, _ := strings.Cut(s, ".")
+	integer = strings.TrimLeft(integer, "0")
+	frac = strings.TrimRight(frac, "0")
+	return len(integer) + len(frac), len(frac)
+}
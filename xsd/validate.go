@@ -0,0 +1,438 @@
+package xsd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/xpath"
+)
+
+// Validate checks doc against the schema. Its document element has to
+// match a global element declaration. All of the violations are
+// returned in ValidationErrors.
+func (s *Schema) Validate(doc *helium.Document) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START xsd.Schema.Validate '%s'", doc.URL())
+		defer g.IRelease("END xsd.Schema.Validate")
+	}
+
+	v := newValidator(s)
+	if root := doc.DocumentElement(); root != nil {
+		v.validateRoot(root)
+	} else {
+		v.errorf(doc, ErrMissingElement, "no document element")
+	}
+	return v.finish()
+}
+
+// ValidateElement checks the subtree of e against the schema, as if e
+// was a document element. IDREFs have to refer to IDs of the subtree.
+func (s *Schema) ValidateElement(e *helium.Element) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START xsd.Schema.ValidateElement '%s'", e.Name())
+		defer g.IRelease("END xsd.Schema.ValidateElement")
+	}
+
+	v := newValidator(s)
+	v.validateRoot(e)
+	return v.finish()
+}
+
+func newValidator(s *Schema) *validator {
+	return &validator{
+		schema: s,
+		ids:    make(map[string]helium.Node),
+		tables: make(map[*constraint][]keyTable),
+		keys:   make(map[helium.Node]string),
+	}
+}
+
+// finish checks the references to IDs, and returns the violations
+func (v *validator) finish() error {
+	for _, ref := range v.refs {
+		if _, ok := v.ids[ref.value]; !ok {
+			v.errorf(ref.node, ErrUnknownID, "'%s'", ref.value)
+		}
+	}
+	if len(v.errors) > 0 {
+		return ValidationErrors(v.errors)
+	}
+	return nil
+}
+
+func (v *validator) errorf(n helium.Node, err error, format string, args ...interface{}) {
+	v.report(n, fmt.Errorf("%w: "+format, append([]interface{}{err}, args...)...))
+}
+
+// report records the violation err at n
+func (v *validator) report(n helium.Node, err error) {
+	verr := &ValidationError{Node: n, Err: err}
+	p := n
+	if attr, ok := n.(*helium.Attribute); ok && attr.Parent() != nil {
+		p = attr.Parent()
+	}
+	if pos, ok := p.(helium.Positioned); ok {
+		verr.Line, verr.Column = pos.Line(), pos.Column()
+	}
+	v.errors = append(v.errors, verr)
+}
+
+func (v *validator) validateRoot(e *helium.Element) {
+	local, uri := xpath.ExpandedName(e)
+	decl, ok := v.schema.elements[expandName(uri, local)]
+	if !ok {
+		if _, ok := instanceAttribute(e, "type"); ok {
+			// the type of an undeclared element may be given by xsi:type
+			v.validateElement(e, &element{name: local, uri: uri, typ: anyType})
+			return
+		}
+		v.errorf(e, ErrUnknownElement, "'%s'", expandName(uri, local))
+		return
+	}
+	v.validateElement(e, decl)
+}
+
+// instanceAttribute returns the attribute local of the xsi namespace
+// of e
+func instanceAttribute(e *helium.Element, local string) (*helium.Attribute, bool) {
+	for _, a := range e.Attributes() {
+		if alocal, uri := xpath.ExpandedName(a); uri == InstanceNamespace && alocal == local {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// validateElement checks e and its subtree against decl
+func (v *validator) validateElement(e *helium.Element, decl *element) {
+	if decl.abstract {
+		v.errorf(e, ErrAbstract, "the declaration of '%s' is abstract", e.Name())
+		return
+	}
+
+	typ := decl.typ
+	if a, ok := instanceAttribute(e, "type"); ok {
+		t, err := v.instanceType(e, a.Value())
+		if err != nil {
+			v.report(a, err)
+			return
+		}
+		if !derivedFrom(t, typ) {
+			v.errorf(a, ErrInvalidType, "%s is not derived from %s", describe(t), describe(typ))
+			return
+		}
+		typ = t
+	}
+	if ct, ok := typ.(*complexType); ok && ct.abstract {
+		v.errorf(e, ErrAbstract, "%s is abstract", describe(typ))
+		return
+	}
+
+	nilled := false
+	if a, ok := instanceAttribute(e, "nil"); ok {
+		switch strings.TrimSpace(a.Value()) {
+		case "true", "1":
+			nilled = true
+		case "false", "0":
+		default:
+			v.errorf(a, ErrInvalidValue, "'%s' is not a boolean", a.Value())
+		}
+		switch {
+		case !decl.nillable:
+			v.errorf(a, ErrInvalidNil, "the element is not nillable")
+			nilled = false
+		case nilled && decl.fixed != nil:
+			v.errorf(a, ErrInvalidNil, "the element has a fixed value")
+		}
+	}
+
+	children, text := content(e)
+	if nilled && (len(children) > 0 || text != "") {
+		v.errorf(e, ErrInvalidNil, "a nil element must be empty")
+		nilled = false
+	}
+
+	switch t := typ.(type) {
+	case *simpleType:
+		v.validateAttributes(e, nil)
+		if len(children) > 0 {
+			v.errorf(children[0], ErrInvalidContent, "the element '%s' has a simple type", e.Name())
+			break
+		}
+		if !nilled {
+			v.validateValue(e, t, decl, text)
+		}
+	case *complexType:
+		v.validateAttributes(e, t)
+		if !nilled {
+			v.validateContent(e, t, decl, children, text)
+		}
+	}
+
+	for _, con := range decl.constraints {
+		if con.kind != keyrefConstraint {
+			v.checkConstraint(e, con)
+		}
+	}
+	for _, con := range decl.constraints {
+		if con.kind == keyrefConstraint {
+			v.checkConstraint(e, con)
+		}
+	}
+}
+
+// instanceType returns the type that the xsi:type value qname names
+func (v *validator) instanceType(e *helium.Element, qname string) (typeDefinition, error) {
+	qname = strings.TrimSpace(qname)
+	prefix, local, found := strings.Cut(qname, ":")
+	if !found {
+		prefix, local = "", qname
+	}
+	uri, ok := lookupPrefix(e, prefix)
+	if !ok && prefix != "" {
+		return nil, fmt.Errorf("%w: undeclared prefix '%s'", ErrInvalidType, prefix)
+	}
+	name := expandName(uri, local)
+	if t, ok := builtins[name]; ok {
+		return t, nil
+	}
+	if t, ok := v.schema.types[name]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("%w: unknown type '%s'", ErrInvalidType, qname)
+}
+
+// content returns the child elements of e, and its text. The content
+// of entity references is included: the child of a reference is the
+// entity, which holds the nodes parsed from its content, if any.
+func content(e helium.Node) ([]*helium.Element, string) {
+	var children []*helium.Element
+	var text strings.Builder
+	var walk func(n helium.Node)
+	walk = func(n helium.Node) {
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			switch c := c.(type) {
+			case *helium.Element:
+				children = append(children, c)
+			case *helium.Text, *helium.CDATASection:
+				text.Write(c.Content())
+			case *helium.EntityRef:
+				if ent := c.FirstChild(); ent != nil && ent.FirstChild() != nil {
+					walk(ent)
+				} else {
+					text.Write(c.Content())
+				}
+			}
+		}
+	}
+	walk(e)
+	return children, text.String()
+}
+
+// validateValue checks the simple content text of e, or its default
+func (v *validator) validateValue(e *helium.Element, st *simpleType, decl *element, text string) {
+	if text == "" && decl.def != nil {
+		text = *decl.def
+	}
+	if text == "" && decl.fixed != nil {
+		text = *decl.fixed
+	}
+	value, err := st.validate(text, e)
+	if err != nil {
+		v.report(e, err)
+		return
+	}
+	if decl.fixed != nil {
+		fixed, _ := st.validate(*decl.fixed, decl.node)
+		if !st.equal(value, fixed) {
+			v.errorf(e, ErrInvalidValue, "'%s' is not the fixed value '%s'", value, fixed)
+		}
+	}
+	v.keys[e] = st.key(value, e)
+	v.checkID(e, st, value)
+}
+
+// checkID records the IDs and the references to IDs of the value of n
+func (v *validator) checkID(n helium.Node, st *simpleType, value string) {
+	switch {
+	case st.variety == listVariety:
+		for _, item := range strings.Fields(value) {
+			v.checkID(n, st.item, item)
+		}
+	case st.special == specialID:
+		if _, ok := v.ids[value]; ok {
+			v.errorf(n, ErrDuplicateID, "'%s'", value)
+			return
+		}
+		v.ids[value] = n
+	case st.special == specialIDREF:
+		v.refs = append(v.refs, idref{node: n, value: value})
+	}
+}
+
+// validateAttributes checks the attributes of e against the ones of
+// ct, or only allows the xsi attributes if ct is nil
+func (v *validator) validateAttributes(e *helium.Element, ct *complexType) {
+	seen := map[*attributeUse]bool{}
+	for _, a := range e.Attributes() {
+		local, uri := xpath.ExpandedName(a)
+		if uri == InstanceNamespace {
+			switch local {
+			case "type", "nil", "schemaLocation", "noNamespaceSchemaLocation":
+				continue
+			}
+		}
+
+		var use *attributeUse
+		if ct != nil {
+			for _, u := range ct.attributes {
+				if u.decl.name == local && u.decl.uri == uri {
+					use = u
+					break
+				}
+			}
+		}
+		if use != nil {
+			seen[use] = true
+			v.validateAttribute(a, use.decl, use.fixed)
+			continue
+		}
+
+		if ct == nil || ct.wildcard == nil || !ct.wildcard.allows(uri) {
+			v.errorf(a, ErrUnexpectedAttribute, "the attribute '%s' is not allowed", expandName(uri, local))
+			continue
+		}
+		if ct.wildcard.process == processSkip {
+			continue
+		}
+		name := expandName(uri, local)
+		decl, ok := v.schema.attributes[name]
+		if !ok {
+			decl, ok = xmlAttributes[name]
+		}
+		switch {
+		case ok:
+			v.validateAttribute(a, decl, decl.fixed)
+		case ct.wildcard.process == processStrict:
+			v.errorf(a, ErrUnexpectedAttribute, "no declaration for the attribute '%s'", name)
+		}
+	}
+
+	if ct == nil {
+		return
+	}
+	for _, u := range ct.attributes {
+		if u.required && !seen[u] {
+			v.errorf(e, ErrMissingAttribute, "the attribute '%s' is required", expandName(u.decl.uri, u.decl.name))
+		}
+	}
+}
+
+func (v *validator) validateAttribute(a *helium.Attribute, decl *attribute, fixed *string) {
+	ctx, _ := a.Parent().(*helium.Element)
+	value, err := decl.typ.validate(a.Value(), ctx)
+	if err != nil {
+		v.report(a, err)
+		return
+	}
+	if fixed != nil {
+		want, _ := decl.typ.validate(*fixed, decl.node)
+		if !decl.typ.equal(value, want) {
+			v.errorf(a, ErrInvalidValue, "'%s' is not the fixed value '%s'", value, want)
+		}
+	}
+	v.keys[a] = decl.typ.key(value, ctx)
+	v.checkID(a, decl.typ, value)
+}
+
+// validateContent checks the children of e against the content of ct
+func (v *validator) validateContent(e *helium.Element, ct *complexType, decl *element, children []*helium.Element, text string) {
+	switch ct.content {
+	case contentEmpty:
+		if len(children) > 0 {
+			v.errorf(children[0], ErrUnexpectedElement, "the element '%s' must be empty", e.Name())
+		} else if strings.TrimSpace(text) != "" {
+			v.errorf(e, ErrInvalidContent, "the element '%s' must be empty", e.Name())
+		}
+		return
+	case contentSimple:
+		if len(children) > 0 {
+			v.errorf(children[0], ErrInvalidContent, "the element '%s' has simple content", e.Name())
+			return
+		}
+		v.validateValue(e, ct.simple, decl, text)
+		return
+	case contentElementOnly:
+		if strings.TrimSpace(text) != "" {
+			v.errorf(e, ErrInvalidContent, "the element '%s' cannot contain text", e.Name())
+		}
+	}
+
+	var terms []interface{}
+	var failed int
+	var expected []interface{}
+	if g, ok := termOf(ct.particle).(*modelGroup); ok && g.compositor == allCompositor {
+		terms, failed, expected = matchAll(g, ct.particle.min == 0, children)
+	} else {
+		terms, failed, expected = ct.contentModel().match(children)
+	}
+
+	for i, t := range terms {
+		v.validateChild(children[i], t)
+	}
+	switch {
+	case failed == -1:
+		if len(expected) > 0 {
+			v.errorf(e, ErrMissingElement, "expected %s", describeTerms(expected))
+		} else {
+			v.errorf(e, ErrMissingElement, "the content of '%s' is incomplete", e.Name())
+		}
+	case failed < len(children):
+		name := expandName(nameOf(children[failed]))
+		if len(expected) > 0 {
+			v.errorf(children[failed], ErrUnexpectedElement, "'%s', expected %s", name, describeTerms(expected))
+		} else {
+			v.errorf(children[failed], ErrUnexpectedElement, "'%s'", name)
+		}
+	}
+}
+
+func termOf(p *particle) interface{} {
+	if p == nil {
+		return nil
+	}
+	return p.term
+}
+
+func nameOf(e *helium.Element) (uri, local string) {
+	local, uri = xpath.ExpandedName(e)
+	return uri, local
+}
+
+// validateChild checks a child element against the declaration or the
+// wildcard that it matched
+func (v *validator) validateChild(child *helium.Element, term interface{}) {
+	switch t := term.(type) {
+	case *element:
+		v.validateElement(child, t)
+	case *wildcard:
+		if t.process == processSkip {
+			return
+		}
+		decl, ok := v.schema.elements[expandName(nameOf(child))]
+		switch {
+		case ok:
+			v.validateElement(child, decl)
+		case t.process == processStrict:
+			v.errorf(child, ErrUnknownElement, "'%s'", expandName(nameOf(child)))
+		default:
+			// lax: the declared descendants are still checked
+			children, _ := content(child)
+			for _, c := range children {
+				v.validateChild(c, t)
+			}
+		}
+	}
+}
@@ -0,0 +1,555 @@
+package xsd_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xsd"
+	"github.com/stretchr/testify/assert"
+)
+
+// compile compiles the schema src
+func compile(t *testing.T, src string) (*xsd.Schema, error) {
+	t.Helper()
+	doc, err := helium.Parse([]byte(src))
+	if !assert.NoError(t, err, "Parse (schema) should succeed") {
+		return nil, err
+	}
+	return xsd.Compile(doc)
+}
+
+// validate validates the document input against s, and returns the
+// messages of the violations
+func validate(t *testing.T, s *xsd.Schema, input string) []string {
+	t.Helper()
+	doc, err := helium.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse (instance) should succeed") {
+		return nil
+	}
+	err = s.Validate(doc)
+	if err == nil {
+		return nil
+	}
+	var verrs xsd.ValidationErrors
+	if !assert.True(t, errors.As(err, &verrs), "error should be ValidationErrors") {
+		return nil
+	}
+	var messages []string
+	for _, e := range verrs {
+		messages = append(messages, e.Error())
+	}
+	return messages
+}
+
+const schemaHeader = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">`
+
+func TestSimpleTypes(t *testing.T) {
+	s, err := compile(t, schemaHeader+`
+<xs:simpleType name="code">
+  <xs:restriction base="xs:token">
+    <xs:pattern value="[a-z]+\d?"/>
+    <xs:maxLength value="4"/>
+  </xs:restriction>
+</xs:simpleType>
+<xs:simpleType name="price">
+  <xs:restriction base="xs:decimal">
+    <xs:minExclusive value="0"/>
+    <xs:maxInclusive value="999.99"/>
+    <xs:fractionDigits value="2"/>
+  </xs:restriction>
+</xs:simpleType>
+<xs:simpleType name="color">
+  <xs:restriction base="xs:string">
+    <xs:enumeration value="red"/>
+    <xs:enumeration value="green"/>
+  </xs:restriction>
+</xs:simpleType>
+<xs:simpleType name="sizes">
+  <xs:restriction>
+    <xs:simpleType><xs:list itemType="xs:unsignedByte"/></xs:simpleType>
+    <xs:length value="2"/>
+  </xs:restriction>
+</xs:simpleType>
+<xs:simpleType name="limit">
+  <xs:union memberTypes="xs:date">
+    <xs:simpleType>
+      <xs:restriction base="xs:token"><xs:enumeration value="never"/></xs:restriction>
+    </xs:simpleType>
+  </xs:union>
+</xs:simpleType>
+<xs:element name="v">
+  <xs:complexType>
+    <xs:attribute name="code" type="code"/>
+    <xs:attribute name="price" type="price"/>
+    <xs:attribute name="color" type="color"/>
+    <xs:attribute name="sizes" type="sizes"/>
+    <xs:attribute name="limit" type="limit"/>
+    <xs:attribute name="bool" type="xs:boolean"/>
+    <xs:attribute name="byte" type="xs:byte"/>
+    <xs:attribute name="double" type="xs:double"/>
+    <xs:attribute name="dateTime" type="xs:dateTime"/>
+    <xs:attribute name="gMonthDay" type="xs:gMonthDay"/>
+    <xs:attribute name="duration" type="xs:duration"/>
+    <xs:attribute name="hex" type="xs:hexBinary"/>
+    <xs:attribute name="base64" type="xs:base64Binary"/>
+    <xs:attribute name="qname" type="xs:QName"/>
+    <xs:attribute name="ncname" type="xs:NCName"/>
+    <xs:attribute name="tokens" type="xs:NMTOKENS"/>
+  </xs:complexType>
+</xs:element>
+</xs:schema>`)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+
+	tests := []struct {
+		attr  string
+		value string
+		valid bool
+	}{
+		{"code", " ab1 ", true},
+		{"code", "abcd1", false},
+		{"code", "AB", false},
+		{"price", "12.50", true},
+		{"price", "0", false},
+		{"price", "1000", false},
+		{"price", "1.005", false},
+		{"color", "green", true},
+		{"color", "blue", false},
+		{"sizes", "1 255", true},
+		{"sizes", "1", false},
+		{"sizes", "1 256", false},
+		{"limit", "2024-02-29", true},
+		{"limit", "never", true},
+		{"limit", "2023-02-29", false},
+		{"bool", "1", true},
+		{"bool", "yes", false},
+		{"byte", "-128", true},
+		{"byte", "128", false},
+		{"double", "-1.5E3", true},
+		{"double", "INF", true},
+		{"double", "1e", false},
+		{"dateTime", "2024-01-31T24:00:00Z", true},
+		{"dateTime", "2024-01-31T10:00:00+15:00", false},
+		{"gMonthDay", "--02-29", true},
+		{"gMonthDay", "--02-30", false},
+		{"duration", "P1Y2MT3.5S", true},
+		{"duration", "P1YT", false},
+		{"hex", "0aFF", true},
+		{"hex", "0aF", false},
+		{"base64", "aGVs bG8=", true},
+		{"base64", "aGVsbG8", false},
+		{"qname", "xs:string", true},
+		{"qname", "nope:string", false},
+		{"ncname", "a.b-c", true},
+		{"ncname", "a:b", false},
+		{"tokens", "a b:c", true},
+		{"tokens", "", false},
+	}
+	for _, tc := range tests {
+		input := `<v xmlns:xs="http://www.w3.org/2001/XMLSchema" ` + tc.attr + `="` + tc.value + `"/>`
+		messages := validate(t, s, input)
+		if tc.valid {
+			assert.Empty(t, messages, "%s='%s' should be valid", tc.attr, tc.value)
+		} else {
+			assert.Len(t, messages, 1, "%s='%s' should be invalid", tc.attr, tc.value)
+		}
+	}
+}
+
+func TestContentModels(t *testing.T) {
+	s, err := compile(t, schemaHeader+`
+<xs:complexType name="base">
+  <xs:sequence>
+    <xs:element name="a" type="xs:int"/>
+    <xs:choice minOccurs="0" maxOccurs="2">
+      <xs:element name="b"/>
+      <xs:element name="c"/>
+    </xs:choice>
+  </xs:sequence>
+  <xs:attribute name="x" type="xs:string" use="required"/>
+</xs:complexType>
+<xs:complexType name="extended">
+  <xs:complexContent>
+    <xs:extension base="base">
+      <xs:sequence><xs:element name="d" type="xs:string"/></xs:sequence>
+      <xs:anyAttribute namespace="##other" processContents="skip"/>
+    </xs:extension>
+  </xs:complexContent>
+</xs:complexType>
+<xs:complexType name="price">
+  <xs:simpleContent>
+    <xs:extension base="xs:decimal">
+      <xs:attribute name="currency" type="xs:string" fixed="EUR"/>
+    </xs:extension>
+  </xs:simpleContent>
+</xs:complexType>
+<xs:element name="doc">
+  <xs:complexType>
+    <xs:sequence>
+      <xs:element name="item" type="extended" maxOccurs="unbounded"/>
+      <xs:element name="set" minOccurs="0">
+        <xs:complexType>
+          <xs:all>
+            <xs:element name="p" type="price"/>
+            <xs:element name="q" minOccurs="0"/>
+          </xs:all>
+        </xs:complexType>
+      </xs:element>
+      <xs:element name="note" minOccurs="0">
+        <xs:complexType mixed="true">
+          <xs:sequence><xs:any namespace="##other" processContents="lax" minOccurs="0" maxOccurs="unbounded"/></xs:sequence>
+        </xs:complexType>
+      </xs:element>
+    </xs:sequence>
+  </xs:complexType>
+</xs:element>
+</xs:schema>`)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+
+	const valid = `<doc xmlns:o="urn:other">
+  <item x="1" o:y="2"><a>1</a><c/><b/><d>text</d></item>
+  <item x="2"><a>2</a><d/></item>
+  <set><q/><p currency="EUR">1.50</p></set>
+  <note>some <o:b>bold</o:b> text</note>
+</doc>`
+	assert.Empty(t, validate(t, s, valid), "document should be valid")
+
+	const invalid = `<doc xmlns:o="urn:other">
+  <item><a>x</a><b/><b/><b/><d/></item>
+  <item x="1" y="2">text<a>1</a></item>
+  <set><p currency="USD">1</p><p>2</p></set>
+  <note><plain/></note>
+</doc>`
+	expected := []string{
+		"element item: missing attribute: the attribute 'x' is required at line 2",
+		"element a: invalid value: 'x' is not a valid value of '{http://www.w3.org/2001/XMLSchema}int' at line 2",
+		"element b: unexpected element: 'b', expected d at line 2",
+		"attribute y: unexpected attribute: the attribute 'y' is not allowed at line 3",
+		"element item: invalid content: the element 'item' cannot contain text at line 3",
+		"element item: missing element: expected b, c, d at line 3",
+		"attribute currency: invalid value: 'USD' is not the fixed value 'EUR' at line 4",
+		"element p: unexpected element: 'p', expected q at line 4",
+		"element plain: unexpected element: 'plain', expected ##other at line 5",
+	}
+	assert.Equal(t, expected, validate(t, s, invalid), "all violations are reported")
+}
+
+func TestRepetitions(t *testing.T) {
+	s, err := compile(t, schemaHeader+`
+<xs:element name="counted">
+  <xs:complexType>
+    <xs:sequence>
+      <xs:element name="a" minOccurs="2" maxOccurs="3"/>
+      <xs:sequence minOccurs="0" maxOccurs="2">
+        <xs:element name="b"/>
+        <xs:element name="c" minOccurs="0"/>
+      </xs:sequence>
+      <xs:sequence minOccurs="2" maxOccurs="2">
+        <xs:element name="d" minOccurs="2" maxOccurs="2"/>
+      </xs:sequence>
+      <xs:sequence minOccurs="3" maxOccurs="3">
+        <xs:element name="e" minOccurs="0"/>
+      </xs:sequence>
+    </xs:sequence>
+  </xs:complexType>
+</xs:element>
+<xs:element name="large">
+  <xs:complexType>
+    <xs:sequence>
+      <xs:sequence minOccurs="0" maxOccurs="2000">
+        <xs:sequence minOccurs="0" maxOccurs="2000"><xs:element name="a"/></xs:sequence>
+      </xs:sequence>
+      <xs:element name="b" minOccurs="2" maxOccurs="10000000"/>
+    </xs:sequence>
+  </xs:complexType>
+</xs:element>
+</xs:schema>`)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+
+	valid := []string{
+		`<counted><a/><a/><d/><d/><d/><d/></counted>`,
+		`<counted><a/><a/><a/><b/><c/><b/><d/><d/><d/><d/><e/><e/><e/></counted>`,
+		`<counted><a/><a/><b/><b/><c/><d/><d/><d/><d/><e/></counted>`,
+		`<large><b/><b/></large>`,
+		`<large>` + strings.Repeat(`<a/>`, 5000) + strings.Repeat(`<b/>`, 5000) + `</large>`,
+	}
+	for _, input := range valid {
+		if !assert.Empty(t, validate(t, s, input), "%s should be valid", input) {
+			return
+		}
+	}
+
+	invalid := map[string]string{
+		`<counted><a/><d/><d/><d/><d/></counted>`:                         "element d: unexpected element: 'd', expected a at line 1",
+		`<counted><a/><a/><a/><a/><d/><d/><d/><d/></counted>`:             "element a: unexpected element: 'a', expected b, d at line 1",
+		`<counted><a/><a/><b/><b/><b/><d/><d/><d/><d/></counted>`:         "element b: unexpected element: 'b', expected c, d at line 1",
+		`<counted><a/><a/><d/><d/><d/></counted>`:                         "element counted: missing element: expected d at line 1",
+		`<counted><a/><a/><d/><d/><d/><d/><e/><e/><e/><e/></counted>`:     "element e: unexpected element: 'e' at line 1",
+		`<large>` + strings.Repeat(`<a/>`, 5000) + `<b/></large>`:         "element large: missing element: expected b at line 1",
+		`<large>` + strings.Repeat(`<a/>`, 5000) + `<b/><b/><a/></large>`: "element a: unexpected element: 'a', expected b at line 1",
+	}
+	for input, expected := range invalid {
+		if !assert.Equal(t, []string{expected}, validate(t, s, input), "violations of %s", input) {
+			return
+		}
+	}
+}
+
+func TestInstanceAttributes(t *testing.T) {
+	s, err := compile(t, schemaHeader+`
+<xs:complexType name="shape" abstract="true">
+  <xs:attribute name="id" type="xs:ID"/>
+</xs:complexType>
+<xs:complexType name="circle">
+  <xs:complexContent>
+    <xs:extension base="shape"><xs:attribute name="r" type="xs:float" use="required"/></xs:extension>
+  </xs:complexContent>
+</xs:complexType>
+<xs:element name="shapes">
+  <xs:complexType>
+    <xs:sequence>
+      <xs:element name="shape" type="shape" maxOccurs="unbounded"/>
+      <xs:element name="size" type="xs:int" nillable="true" minOccurs="0"/>
+      <xs:element name="ref" type="xs:IDREF" minOccurs="0"/>
+    </xs:sequence>
+  </xs:complexType>
+</xs:element>
+</xs:schema>`)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+
+	const valid = `<shapes xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <shape xsi:type="circle" id="c1" r="1.5"/>
+  <size xsi:nil="true"/>
+  <ref>c1</ref>
+</shapes>`
+	assert.Empty(t, validate(t, s, valid), "document should be valid")
+
+	const invalid = `<shapes xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <shape xsi:type="circle" id="c1" r="1"/>
+  <shape xsi:type="circle" id="c1" r="2"/>
+  <shape id="c3"/>
+  <shape xsi:type="xsi:string"/>
+  <size xsi:nil="true">1</size>
+  <ref>c2</ref>
+</shapes>`
+	expected := []string{
+		"attribute id: duplicate ID: 'c1' at line 3",
+		"element shape: abstract declaration or type: 'shape' is abstract at line 4",
+		"attribute xsi:type: invalid xsi:type: unknown type 'xsi:string' at line 5",
+		"element size: invalid xsi:nil: a nil element must be empty at line 6",
+		"element ref: unknown ID: 'c2' at line 7",
+	}
+	assert.Equal(t, expected, validate(t, s, invalid), "all violations are reported")
+}
+
+func TestEntityReference(t *testing.T) {
+	s, err := compile(t, schemaHeader+`
+<xs:element name="a">
+  <xs:simpleType>
+    <xs:restriction base="xs:string"><xs:length value="3"/></xs:restriction>
+  </xs:simpleType>
+</xs:element>
+</xs:schema>`)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+
+	const dtd = `<!DOCTYPE a [<!ENTITY e "abc"><!ENTITY f "abcd">]>`
+	assert.Empty(t, validate(t, s, dtd+`<a>&e;</a>`), "the text of the entity should be validated")
+	assert.Len(t, validate(t, s, dtd+`<a>&f;</a>`), 1, "the text of the entity should be validated")
+}
+
+func TestIdentityConstraints(t *testing.T) {
+	s, err := compile(t, schemaHeader+`
+<xs:element name="library">
+  <xs:complexType>
+    <xs:sequence>
+      <xs:element name="book" maxOccurs="unbounded">
+        <xs:complexType>
+          <xs:attribute name="isbn" type="xs:string"/>
+          <xs:attribute name="title" type="xs:string"/>
+        </xs:complexType>
+      </xs:element>
+      <xs:element name="loan" minOccurs="0" maxOccurs="unbounded">
+        <xs:complexType><xs:attribute name="isbn" type="xs:string"/></xs:complexType>
+      </xs:element>
+    </xs:sequence>
+  </xs:complexType>
+  <xs:key name="bookKey">
+    <xs:selector xpath="book"/>
+    <xs:field xpath="@isbn"/>
+  </xs:key>
+  <xs:unique name="titles">
+    <xs:selector xpath="book"/>
+    <xs:field xpath="@title"/>
+  </xs:unique>
+  <xs:keyref name="loanRef" refer="bookKey">
+    <xs:selector xpath="loan"/>
+    <xs:field xpath="@isbn"/>
+  </xs:keyref>
+</xs:element>
+</xs:schema>`)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+
+	const valid = `<library><book isbn="1" title="a"/><book isbn="2"/><book isbn="3"/><loan isbn="2"/></library>`
+	assert.Empty(t, validate(t, s, valid), "document should be valid")
+
+	const invalid = `<library>
+<book isbn="1" title="a"/>
+<book isbn="1" title="a"/>
+<book title="b"/>
+<loan isbn="9"/>
+</library>`
+	expected := []string{
+		"element book: duplicate key: '1' is a duplicate value of 'bookKey' at line 3",
+		"element book: incomplete key: a field of the key 'bookKey' has no value at line 4",
+		"element book: duplicate key: 'a' is a duplicate value of 'titles' at line 3",
+		"element loan: key not found: '9' does not match a value of 'bookKey' at line 5",
+	}
+	assert.Equal(t, expected, validate(t, s, invalid), "all violations are reported")
+}
+
+func TestTypedIdentityConstraints(t *testing.T) {
+	s, err := compile(t, schemaHeader+`
+<xs:element name="list">
+  <xs:complexType>
+    <xs:sequence>
+      <xs:element name="i" maxOccurs="unbounded">
+        <xs:complexType>
+          <xs:attribute name="id" type="xs:int"/>
+          <xs:attribute name="name" type="xs:string"/>
+        </xs:complexType>
+      </xs:element>
+      <xs:element name="ref" minOccurs="0" maxOccurs="unbounded">
+        <xs:complexType><xs:attribute name="id" type="xs:long"/></xs:complexType>
+      </xs:element>
+    </xs:sequence>
+  </xs:complexType>
+  <xs:unique name="ids">
+    <xs:selector xpath="i"/>
+    <xs:field xpath="@id"/>
+  </xs:unique>
+  <xs:unique name="names">
+    <xs:selector xpath="i"/>
+    <xs:field xpath="@name"/>
+  </xs:unique>
+  <xs:keyref name="refs" refer="ids">
+    <xs:selector xpath="ref"/>
+    <xs:field xpath="@id"/>
+  </xs:keyref>
+</xs:element>
+</xs:schema>`)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+
+	const valid = `<list><i id="1" name="1"/><i id="2" name="01"/><ref id="+02"/></list>`
+	assert.Empty(t, validate(t, s, valid), "values of xs:string are compared as strings, and keyrefs match equal values")
+
+	const invalid = `<list><i id="1"/><i id="01"/></list>`
+	expected := []string{
+		"element i: duplicate key: '01' is a duplicate value of 'ids' at line 1",
+	}
+	assert.Equal(t, expected, validate(t, s, invalid), "values of xs:int are compared as integers")
+}
+
+func TestIncludeImport(t *testing.T) {
+	doc, err := helium.NewParser().ParseFile(filepath.Join("testdata", "order.xsd"))
+	if !assert.NoError(t, err, "ParseFile should succeed") {
+		return
+	}
+	s, err := xsd.Compile(doc)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+	assert.Equal(t, "urn:order", s.TargetNamespace(), "TargetNamespace should match")
+
+	in, err := helium.NewParser().ParseFile(filepath.Join("testdata", "order.xml"))
+	if !assert.NoError(t, err, "ParseFile should succeed") {
+		return
+	}
+	err = s.Validate(in)
+	var verrs xsd.ValidationErrors
+	if !assert.True(t, errors.As(err, &verrs), "error should be ValidationErrors") {
+		return
+	}
+	if !assert.Len(t, verrs, 2, "the sku and the quantity of the second line are invalid") {
+		return
+	}
+	var verr *xsd.ValidationError
+	if !assert.True(t, errors.As(verrs[0], &verr), "error should be a ValidationError") {
+		return
+	}
+	assert.True(t, errors.Is(verr, xsd.ErrInvalidValue), "error should be ErrInvalidValue")
+	assert.Equal(t, "sku", verr.Node.Name(), "error should refer to the attribute")
+	assert.Equal(t, 8, verr.Line, "error should have the line of the element")
+	assert.Equal(t, 3, verr.Column, "error should have the column of the element")
+
+	// the address alone
+	address := in.DocumentElement().FirstChild().NextSibling().(*helium.Element)
+	assert.NoError(t, s.ValidateElement(address), "ValidateElement should succeed")
+}
+
+func TestLoader(t *testing.T) {
+	const module = `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+<xs:simpleType name="small"><xs:restriction base="xs:int"><xs:maxInclusive value="9"/></xs:restriction></xs:simpleType>
+</xs:schema>`
+
+	var loaded []string
+	c := xsd.NewCompiler()
+	c.SetLoader(func(uri string) (*helium.Document, error) {
+		loaded = append(loaded, uri)
+		return helium.Parse([]byte(module))
+	})
+
+	doc, err := helium.Parse([]byte(schemaHeader + `<xs:include schemaLocation="small.xsd"/><xs:element name="n" type="small"/></xs:schema>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	s, err := c.Compile(doc)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+	assert.Equal(t, []string{"small.xsd"}, loaded, "the loader should be called")
+	assert.Empty(t, validate(t, s, `<n>9</n>`), "document should be valid")
+	assert.Len(t, validate(t, s, `<n>10</n>`), 1, "document should be invalid")
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  error
+	}{
+		{"not a schema", `<doc/>`, xsd.ErrNotSchema},
+		{"unknown type", schemaHeader + `<xs:element name="a" type="nope"/></xs:schema>`, xsd.ErrUnknownComponent},
+		{"circular", schemaHeader + `
+<xs:complexType name="a"><xs:complexContent><xs:extension base="b"/></xs:complexContent></xs:complexType>
+<xs:complexType name="b"><xs:complexContent><xs:extension base="a"/></xs:complexContent></xs:complexType>
+</xs:schema>`, xsd.ErrCircularDefinition},
+		{"redefine", schemaHeader + `<xs:redefine schemaLocation="a.xsd"/></xs:schema>`, xsd.ErrUnsupported},
+		{"invalid facet", schemaHeader + `
+<xs:simpleType name="a"><xs:restriction base="xs:int"><xs:enumeration value="x"/></xs:restriction></xs:simpleType>
+</xs:schema>`, xsd.ErrInvalidValue},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := compile(t, tc.src)
+			assert.True(t, errors.Is(err, tc.err), "error should be %s, got %v", tc.err, err)
+			var xerr *xsd.Error
+			assert.True(t, errors.As(err, &xerr), "error should be an *xsd.Error")
+		})
+	}
+}
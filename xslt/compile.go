@@ -0,0 +1,1425 @@
+package xslt
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/xpath"
+)
+
+// compiler holds the state of the compilation of a stylesheet
+type compiler struct {
+	ss     *Stylesheet
+	loader DocumentLoader
+	docs   map[string]*helium.Document
+	active map[string]bool // the modules being imported or included
+	prec   int
+	pos    int
+}
+
+// DefaultLoader parses the document at uri with a new helium.Parser
+func DefaultLoader(uri string) (*helium.Document, error) {
+	return helium.NewParser().ParseURI(uri)
+}
+
+// NewCompiler creates a Compiler that loads documents with
+// DefaultLoader
+func NewCompiler() *Compiler {
+	return &Compiler{loader: DefaultLoader}
+}
+
+// SetLoader sets the DocumentLoader that the stylesheets compiled by c
+// load documents with. nil restores DefaultLoader.
+func (c *Compiler) SetLoader(l DocumentLoader) {
+	if l == nil {
+		l = DefaultLoader
+	}
+	c.loader = l
+}
+
+// Compile compiles the stylesheet doc with a new Compiler
+func Compile(doc *helium.Document) (*Stylesheet, error) {
+	return NewCompiler().Compile(doc)
+}
+
+// Compile compiles the stylesheet doc, along with the modules that it
+// imports or includes. doc is either a xsl:stylesheet (or
+// xsl:transform) element, or a literal result element with a
+// xsl:version attribute, which is the template for the root node.
+func (c *Compiler) Compile(doc *helium.Document) (*Stylesheet, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START xslt.Compiler.Compile '%s'", doc.URL())
+		defer g.IRelease("END xslt.Compiler.Compile")
+	}
+
+	ss := &Stylesheet{
+		doc:            doc,
+		loader:         c.loader,
+		messages:       defaultMessageHandler,
+		cdata:          make(map[string]struct{}),
+		modes:          make(map[string][]*template),
+		named:          make(map[string]*template),
+		keys:           make(map[string][]*key),
+		decimalFormats: map[string]*DecimalFormat{"": defaultDecimalFormat()},
+		aliases:        make(map[string]alias),
+		attributeSets:  make(map[string][]*attributeSet),
+	}
+	cc := &compiler{
+		ss:     ss,
+		loader: c.loader,
+		docs:   make(map[string]*helium.Document),
+		active: make(map[string]bool),
+	}
+
+	root := doc.DocumentElement()
+	if root == nil {
+		return nil, ErrNotStylesheet
+	}
+	if isXSL(root, "stylesheet") || isXSL(root, "transform") {
+		cc.active[doc.URL()] = true
+		if err := cc.compileModule(root); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := cc.compileSimplified(root); err != nil {
+			return nil, err
+		}
+	}
+
+	cc.finish()
+	return ss, nil
+}
+
+// SetMessageHandler sets the function that receives the messages of
+// xsl:message. They are written to os.Stderr by default. It must not
+// be called while s is applied.
+func (s *Stylesheet) SetMessageHandler(h MessageHandler) {
+	if h == nil {
+		h = defaultMessageHandler
+	}
+	s.messages = h
+}
+
+func defaultMessageHandler(msg string, _ bool) {
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// Output returns the output options of the stylesheet
+func (s *Stylesheet) Output() Output {
+	o := s.output
+	o.CDATASectionElements = append([]string(nil), o.CDATASectionElements...)
+	return o
+}
+
+// compileSimplified compiles a stylesheet that is a literal result
+// element, which is the body of the template rule for "/"
+func (c *compiler) compileSimplified(root *helium.Element) error {
+	st, err := c.static(root, nil)
+	if err != nil {
+		return err
+	}
+	if _, ok := xslAttribute(root, st, "version"); !ok {
+		return ErrNotStylesheet
+	}
+
+	body, err := c.compileInstruction(root, st)
+	if err != nil {
+		return err
+	}
+	p, err := xpath.CompilePattern("/")
+	if err != nil {
+		return err
+	}
+	m := &module{}
+	c.ss.templates = append(c.ss.templates, &template{
+		match:    &pattern{p: p, node: root, st: st},
+		priority: p.DefaultPriority(),
+		module:   m,
+		body:     []instruction{body},
+		node:     root,
+	})
+	return nil
+}
+
+// compileModule compiles the stylesheet module root. The modules that
+// it imports are compiled first, as they have lower precedences.
+func (c *compiler) compileModule(root *helium.Element) error {
+	st, err := c.static(root, nil)
+	if err != nil {
+		return err
+	}
+
+	minPrec := c.prec
+	if err := c.compileImports(root, st); err != nil {
+		return err
+	}
+	m := &module{prec: c.prec, minPrec: minPrec}
+	c.prec++
+	return c.compileDecls(root, st, m)
+}
+
+// compileImports compiles the modules imported by root, and by the
+// modules that root includes
+func (c *compiler) compileImports(root *helium.Element, st *static) error {
+	for n := root.FirstChild(); n != nil; n = n.NextSibling() {
+		e, ok := n.(*helium.Element)
+		if !ok || !isXSL(e, "import") && !isXSL(e, "include") {
+			continue
+		}
+
+		doc, uri, err := c.load(e, st)
+		if err != nil {
+			return err
+		}
+		if c.active[uri] {
+			return errorf(e, ErrInvalidStylesheet, "'%s' imports or includes itself", uri)
+		}
+		sub, err := moduleRoot(e, doc)
+		if err != nil {
+			return err
+		}
+
+		c.active[uri] = true
+		if isXSL(e, "import") {
+			err = c.compileModule(sub)
+		} else {
+			var subst *static
+			if subst, err = c.static(sub, nil); err == nil {
+				err = c.compileImports(sub, subst)
+			}
+		}
+		delete(c.active, uri)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load loads the module that e imports or includes, and returns it
+// along with its URI
+func (c *compiler) load(e *helium.Element, st *static) (*helium.Document, string, error) {
+	href, err := requiredAttribute(e, "href")
+	if err != nil {
+		return nil, "", err
+	}
+
+	uri := resolveURI(href, st.doc.URL())
+	if doc, ok := c.docs[uri]; ok {
+		return doc, uri, nil
+	}
+	doc, err := c.loader(uri)
+	if err != nil {
+		return nil, "", &Error{Node: e, Err: err}
+	}
+	c.docs[uri] = doc
+	return doc, uri, nil
+}
+
+func moduleRoot(e *helium.Element, doc *helium.Document) (*helium.Element, error) {
+	root := doc.DocumentElement()
+	if root == nil || !isXSL(root, "stylesheet") && !isXSL(root, "transform") {
+		return nil, &Error{Node: e, Err: ErrNotStylesheet}
+	}
+	return root, nil
+}
+
+// compileDecls compiles the top-level elements of the module root
+func (c *compiler) compileDecls(root *helium.Element, st *static, m *module) error {
+	for n := root.FirstChild(); n != nil; n = n.NextSibling() {
+		e, ok := n.(*helium.Element)
+		if !ok {
+			continue
+		}
+		local, uri := xpath.ExpandedName(e)
+		if uri != Namespace {
+			// top-level elements in other namespaces are ignored
+			continue
+		}
+
+		est, err := c.static(e, st)
+		if err != nil {
+			return err
+		}
+
+		switch local {
+		case "import":
+		case "include":
+			doc, _, err := c.load(e, est)
+			if err != nil {
+				return err
+			}
+			sub, err := moduleRoot(e, doc)
+			if err != nil {
+				return err
+			}
+			subst, err := c.static(sub, nil)
+			if err != nil {
+				return err
+			}
+			if err := c.compileDecls(sub, subst, m); err != nil {
+				return err
+			}
+		case "output":
+			err = c.compileOutput(e, est)
+		case "strip-space", "preserve-space":
+			err = c.compileSpace(e, est, m, local == "strip-space")
+		case "key":
+			err = c.compileKey(e, est)
+		case "decimal-format":
+			err = c.compileDecimalFormat(e, est)
+		case "namespace-alias":
+			err = c.compileNamespaceAlias(e, est)
+		case "attribute-set":
+			err = c.compileAttributeSet(e, est)
+		case "variable", "param":
+			var v *variable
+			if v, err = c.compileVariable(e, est, local == "param"); err == nil {
+				v.prec = m.prec
+				c.ss.globals = append(c.ss.globals, v)
+			}
+		case "template":
+			err = c.compileTemplate(e, est, m)
+		default:
+			// unknown declarations are ignored in forwards-compatible mode
+			if !est.forwards {
+				err = errorf(e, ErrInvalidStylesheet, "unknown declaration xsl:%s", local)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish orders the template rules, and drops the global variables that
+// are overridden by ones with a higher import precedence
+func (c *compiler) finish() {
+	ss := c.ss
+	sort.SliceStable(ss.templates, func(i, j int) bool {
+		a, b := ss.templates[i], ss.templates[j]
+		if a.module.prec != b.module.prec {
+			return a.module.prec > b.module.prec
+		}
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return a.pos > b.pos
+	})
+	for _, tmpl := range ss.templates {
+		ss.modes[tmpl.mode] = append(ss.modes[tmpl.mode], tmpl)
+	}
+
+	best := make(map[string]*variable)
+	for _, v := range ss.globals {
+		if cur, ok := best[v.name]; !ok || v.prec >= cur.prec {
+			best[v.name] = v
+		}
+	}
+	globals := ss.globals[:0]
+	for _, v := range ss.globals {
+		if best[v.name] == v {
+			globals = append(globals, v)
+		}
+	}
+	ss.globals = globals
+}
+
+// static returns the static context of e, given the one of its parent
+func (c *compiler) static(e *helium.Element, parent *static) (*static, error) {
+	st := parent
+	if st == nil {
+		st = &static{
+			doc:       e.OwnerDocument(),
+			ns:        map[string]string{},
+			excluded:  map[string]struct{}{Namespace: {}},
+			extension: map[string]struct{}{},
+		}
+		// the declarations on the ancestors of the module root
+		for p := e.Parent(); p != nil; p = p.Parent() {
+			if pe, ok := p.(*helium.Element); ok {
+				for _, ns := range pe.Namespaces() {
+					if _, ok := st.ns[ns.Prefix()]; !ok {
+						st.ns[ns.Prefix()] = ns.URI()
+					}
+				}
+			}
+		}
+	}
+
+	clone := func() {
+		if st != parent {
+			return
+		}
+		cp := *st
+		cp.ns = make(map[string]string, len(st.ns))
+		for k, v := range st.ns {
+			cp.ns[k] = v
+		}
+		st = &cp
+	}
+
+	if decls := e.Namespaces(); len(decls) > 0 {
+		clone()
+		for _, ns := range decls {
+			st.ns[ns.Prefix()] = ns.URI()
+		}
+	}
+
+	if v, ok := attribute(e, "xml:space"); ok {
+		clone()
+		st.preserve = v == "preserve"
+	}
+
+	// on xsl:stylesheet these are unprefixed, and prefixed on the
+	// literal result elements
+	isXSLElement := isXSL(e, "stylesheet") || isXSL(e, "transform")
+	_, euri := xpath.ExpandedName(e)
+
+	// a version other than 1.0 enables forwards-compatible processing
+	// (section 2.5 of XSLT 1.0)
+	var version string
+	var hasVersion bool
+	if isXSLElement {
+		version, hasVersion = attribute(e, "version")
+	} else if euri != Namespace {
+		version, hasVersion = xslAttribute(e, st, "version")
+	}
+	if hasVersion {
+		clone()
+		st.forwards = strings.TrimSpace(version) != "1.0"
+	}
+
+	for _, name := range []string{"exclude-result-prefixes", "extension-element-prefixes"} {
+		var v string
+		var ok bool
+		if isXSLElement {
+			v, ok = attribute(e, name)
+		} else if euri != Namespace {
+			v, ok = xslAttribute(e, st, name)
+		}
+		if !ok {
+			continue
+		}
+
+		clone()
+		set := make(map[string]struct{})
+		old := st.excluded
+		if name == "extension-element-prefixes" {
+			old = st.extension
+		}
+		for k := range old {
+			set[k] = struct{}{}
+		}
+		for _, prefix := range strings.Fields(v) {
+			if prefix == "#default" {
+				prefix = ""
+			}
+			uri, ok := st.ns[prefix]
+			if !ok {
+				return nil, errorf(e, xpath.ErrUndefinedNamespace, "'%s'", prefix)
+			}
+			set[uri] = struct{}{}
+		}
+		if name == "extension-element-prefixes" {
+			st.extension = set
+		} else {
+			st.excluded = set
+		}
+	}
+	return st, nil
+}
+
+// expand returns the expanded name of the QName qname, as "local" or
+// "{uri}local". The default namespace only applies if useDefault is
+// true.
+func (st *static) expand(qname string, useDefault bool) (string, error) {
+	_, local, uri, err := resolveQName(st.ns, qname, useDefault)
+	if err != nil {
+		return "", err
+	}
+	return expandName(uri, local), nil
+}
+
+// resolveQName splits qname, and looks up its prefix in ns
+func resolveQName(ns map[string]string, qname string, useDefault bool) (prefix, local, uri string, err error) {
+	if prefix, local, err = splitQName(qname); err != nil {
+		return "", "", "", err
+	}
+
+	switch {
+	case prefix == helium.XMLPrefix:
+		uri = helium.XMLNamespace
+	case prefix != "":
+		var ok bool
+		if uri, ok = ns[prefix]; !ok {
+			return "", "", "", fmt.Errorf("%w: '%s'", xpath.ErrUndefinedNamespace, prefix)
+		}
+	case useDefault:
+		uri = ns[""]
+	}
+	return prefix, local, uri, nil
+}
+
+// splitQName returns the prefix and the local part of qname
+func splitQName(qname string) (prefix, local string, err error) {
+	local = qname
+	if i := strings.IndexByte(qname, ':'); i > -1 {
+		prefix, local = qname[:i], qname[i+1:]
+		if prefix == "" {
+			local = ""
+		}
+	}
+	if local == "" || strings.ContainsAny(local, ": \t\r\n") || strings.ContainsAny(prefix, " \t\r\n") {
+		return "", "", fmt.Errorf("%w: invalid QName '%s'", ErrInvalidStylesheet, qname)
+	}
+	return prefix, local, nil
+}
+
+// expandName returns the key of a variable or a function, like
+// xpath.Context does
+func expandName(uri, local string) string {
+	if uri == "" {
+		return local
+	}
+	return "{" + uri + "}" + local
+}
+
+func isXSL(n helium.Node, local string) bool {
+	e, ok := n.(*helium.Element)
+	if !ok {
+		return false
+	}
+	elocal, uri := xpath.ExpandedName(e)
+	return uri == Namespace && elocal == local
+}
+
+// attribute returns the value of the attribute name of e
+func attribute(e *helium.Element, name string) (string, bool) {
+	for _, attr := range e.Attributes() {
+		if attr.Name() == name {
+			return attr.Value(), true
+		}
+	}
+	return "", false
+}
+
+// xslAttribute returns the value of the attribute local in the XSLT
+// namespace of e, whatever its prefix is
+func xslAttribute(e *helium.Element, st *static, local string) (string, bool) {
+	for _, attr := range e.Attributes() {
+		prefix, alocal, uri := attributeName(attr, st)
+		if prefix != "" && uri == Namespace && alocal == local {
+			return attr.Value(), true
+		}
+	}
+	return "", false
+}
+
+// attributeName returns the name of an attribute of the stylesheet
+func attributeName(attr *helium.Attribute, st *static) (prefix, local, uri string) {
+	local = attr.Name()
+	if i := strings.IndexByte(local, ':'); i > -1 {
+		prefix, local = local[:i], local[i+1:]
+	}
+	if uri = attr.URI(); uri == "" && prefix != "" {
+		if prefix == helium.XMLPrefix {
+			uri = helium.XMLNamespace
+		} else {
+			uri = st.ns[prefix]
+		}
+	}
+	return prefix, local, uri
+}
+
+func requiredAttribute(e *helium.Element, name string) (string, error) {
+	v, ok := attribute(e, name)
+	if !ok {
+		return "", errorf(e, ErrInvalidStylesheet, "missing attribute '%s'", name)
+	}
+	return v, nil
+}
+
+// yesNo returns the value of the yes/no attribute name of e
+func yesNo(e *helium.Element, name string) (bool, error) {
+	v, ok := attribute(e, name)
+	switch {
+	case !ok, v == "no":
+		return false, nil
+	case v == "yes":
+		return true, nil
+	}
+	return false, errorf(e, ErrInvalidStylesheet, "'%s' must be yes or no", name)
+}
+
+func (c *compiler) compileExpr(e helium.Node, st *static, s string) (*expression, error) {
+	x, err := xpath.Compile(s)
+	if err != nil {
+		return nil, &Error{Node: e, Err: err}
+	}
+	return &expression{x: x, node: e, st: st}, nil
+}
+
+// compileSelect compiles the attribute name of e, which is required
+func (c *compiler) compileSelect(e *helium.Element, st *static, name string) (*expression, error) {
+	v, err := requiredAttribute(e, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.compileExpr(e, st, v)
+}
+
+func (c *compiler) compilePattern(e helium.Node, st *static, s string) ([]*pattern, error) {
+	p, err := xpath.CompilePattern(s)
+	if err != nil {
+		return nil, &Error{Node: e, Err: err}
+	}
+	var ret []*pattern
+	for _, alt := range p.Alternatives() {
+		ret = append(ret, &pattern{p: alt, node: e, st: st})
+	}
+	return ret, nil
+}
+
+// compileAVT compiles the attribute value template s, such as
+// "item-{@n}". Braces are doubled to be literal.
+func (c *compiler) compileAVT(e helium.Node, st *static, s string) (*avt, error) {
+	ret := &avt{node: e}
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			ret.parts = append(ret.parts, avtPart{text: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch {
+		case (ch == '{' || ch == '}') && i+1 < len(s) && s[i+1] == ch:
+			lit.WriteByte(ch)
+			i += 2
+		case ch == '}':
+			return nil, errorf(e, ErrInvalidStylesheet, "unmatched '}' in '%s'", s)
+		case ch == '{':
+			end := -1
+			var quote byte
+			for j := i + 1; j < len(s) && end < 0; j++ {
+				switch {
+				case quote != 0:
+					if s[j] == quote {
+						quote = 0
+					}
+				case s[j] == '"' || s[j] == '\'':
+					quote = s[j]
+				case s[j] == '}':
+					end = j
+				}
+			}
+			if end < 0 {
+				return nil, errorf(e, ErrInvalidStylesheet, "unmatched '{' in '%s'", s)
+			}
+			expr, err := c.compileExpr(e, st, s[i+1:end])
+			if err != nil {
+				return nil, err
+			}
+			flush()
+			ret.parts = append(ret.parts, avtPart{expr: expr})
+			i = end + 1
+		default:
+			lit.WriteByte(ch)
+			i++
+		}
+	}
+	flush()
+	return ret, nil
+}
+
+// compileAttributeAVT compiles the attribute name of e if it is present
+func (c *compiler) compileAttributeAVT(e *helium.Element, st *static, name string) (*avt, error) {
+	v, ok := attribute(e, name)
+	if !ok {
+		return nil, nil
+	}
+	return c.compileAVT(e, st, v)
+}
+
+func (c *compiler) compileOutput(e *helium.Element, st *static) error {
+	o := &c.ss.output
+	for _, attr := range e.Attributes() {
+		v := attr.Value()
+		switch attr.Name() {
+		case "method":
+			switch v {
+			case "xml", "html", "text":
+			default:
+				return errorf(e, ErrInvalidStylesheet, "unsupported output method '%s'", v)
+			}
+			o.Method = v
+		case "version":
+			o.Version = v
+		case "encoding":
+			o.Encoding = v
+		case "omit-xml-declaration":
+			b, err := yesNo(e, attr.Name())
+			if err != nil {
+				return err
+			}
+			o.OmitXMLDeclaration = b
+		case "standalone":
+			if _, err := yesNo(e, attr.Name()); err != nil {
+				return err
+			}
+			o.Standalone = v
+		case "doctype-public":
+			o.DoctypePublic = v
+		case "doctype-system":
+			o.DoctypeSystem = v
+		case "cdata-section-elements":
+			for _, qname := range strings.Fields(v) {
+				name, err := st.expand(qname, true)
+				if err != nil {
+					return &Error{Node: e, Err: err}
+				}
+				if _, ok := c.ss.cdata[name]; !ok {
+					c.ss.cdata[name] = struct{}{}
+					o.CDATASectionElements = append(o.CDATASectionElements, name)
+				}
+			}
+		case "indent":
+			if _, err := yesNo(e, attr.Name()); err != nil {
+				return err
+			}
+			o.Indent = v
+		case "media-type":
+			o.MediaType = v
+		}
+	}
+	return nil
+}
+
+func (c *compiler) compileSpace(e *helium.Element, st *static, m *module, strip bool) error {
+	v, err := requiredAttribute(e, "elements")
+	if err != nil {
+		return err
+	}
+	for _, test := range strings.Fields(v) {
+		r := &spaceRule{strip: strip, prec: m.prec}
+		switch {
+		case test == "*":
+			r.local = "*"
+			r.anyNS = true
+			r.priority = -0.5
+		case strings.HasSuffix(test, ":*"):
+			uri, ok := st.ns[strings.TrimSuffix(test, ":*")]
+			if !ok {
+				return errorf(e, xpath.ErrUndefinedNamespace, "'%s'", test)
+			}
+			r.local = "*"
+			r.uri = uri
+			r.priority = -0.25
+		default:
+			_, local, uri, err := resolveQName(st.ns, test, false)
+			if err != nil {
+				return &Error{Node: e, Err: err}
+			}
+			r.local = local
+			r.uri = uri
+		}
+		c.ss.spaces = append(c.ss.spaces, r)
+	}
+	return nil
+}
+
+func (c *compiler) compileKey(e *helium.Element, st *static) error {
+	v, err := requiredAttribute(e, "name")
+	if err != nil {
+		return err
+	}
+	name, err := st.expand(v, false)
+	if err != nil {
+		return &Error{Node: e, Err: err}
+	}
+	v, err = requiredAttribute(e, "match")
+	if err != nil {
+		return err
+	}
+	patterns, err := c.compilePattern(e, st, v)
+	if err != nil {
+		return err
+	}
+	use, err := c.compileSelect(e, st, "use")
+	if err != nil {
+		return err
+	}
+	for _, p := range patterns {
+		c.ss.keys[name] = append(c.ss.keys[name], &key{match: p, use: use})
+	}
+	return nil
+}
+
+func defaultDecimalFormat() *DecimalFormat {
+	return &DecimalFormat{
+		DecimalSeparator:  '.',
+		GroupingSeparator: ',',
+		Infinity:          "Infinity",
+		MinusSign:         '-',
+		NaN:               "NaN",
+		Percent:           '%',
+		PerMille:          '‰',
+		ZeroDigit:         '0',
+		Digit:             '#',
+		PatternSeparator:  ';',
+	}
+}
+
+func (c *compiler) compileDecimalFormat(e *helium.Element, st *static) error {
+	var name string
+	if v, ok := attribute(e, "name"); ok {
+		var err error
+		if name, err = st.expand(v, false); err != nil {
+			return &Error{Node: e, Err: err}
+		}
+	}
+
+	df := defaultDecimalFormat()
+	for _, attr := range e.Attributes() {
+		v := attr.Value()
+		var r *rune
+		switch attr.Name() {
+		case "infinity":
+			df.Infinity = v
+		case "NaN":
+			df.NaN = v
+		case "decimal-separator":
+			r = &df.DecimalSeparator
+		case "grouping-separator":
+			r = &df.GroupingSeparator
+		case "minus-sign":
+			r = &df.MinusSign
+		case "percent":
+			r = &df.Percent
+		case "per-mille":
+			r = &df.PerMille
+		case "zero-digit":
+			r = &df.ZeroDigit
+		case "digit":
+			r = &df.Digit
+		case "pattern-separator":
+			r = &df.PatternSeparator
+		}
+		if r == nil {
+			continue
+		}
+		runes := []rune(v)
+		if len(runes) != 1 {
+			return errorf(e, ErrInvalidStylesheet, "'%s' must be a single character", attr.Name())
+		}
+		*r = runes[0]
+	}
+	c.ss.decimalFormats[name] = df
+	return nil
+}
+
+func (c *compiler) compileNamespaceAlias(e *helium.Element, st *static) error {
+	var uris [2]string
+	var prefixes [2]string
+	for i, name := range []string{"stylesheet-prefix", "result-prefix"} {
+		prefix, err := requiredAttribute(e, name)
+		if err != nil {
+			return err
+		}
+		if prefix == "#default" {
+			prefix = ""
+		}
+		uri, ok := st.ns[prefix]
+		if !ok && prefix != "" {
+			return errorf(e, xpath.ErrUndefinedNamespace, "'%s'", prefix)
+		}
+		uris[i] = uri
+		prefixes[i] = prefix
+	}
+	c.ss.aliases[uris[0]] = alias{prefix: prefixes[1], uri: uris[1]}
+	return nil
+}
+
+func (c *compiler) compileAttributeSet(e *helium.Element, st *static) error {
+	v, err := requiredAttribute(e, "name")
+	if err != nil {
+		return err
+	}
+	name, err := st.expand(v, false)
+	if err != nil {
+		return &Error{Node: e, Err: err}
+	}
+
+	set := &attributeSet{}
+	if set.useSets, err = c.useAttributeSets(e, st, false); err != nil {
+		return err
+	}
+	for n := e.FirstChild(); n != nil; n = n.NextSibling() {
+		if n.Type() != helium.ElementNode {
+			continue
+		}
+		if !isXSL(n, "attribute") {
+			return errorf(n, ErrInvalidStylesheet, "xsl:attribute-set can only contain xsl:attribute")
+		}
+		est, err := c.static(n.(*helium.Element), st)
+		if err != nil {
+			return err
+		}
+		ins, err := c.compileXSLAttribute(n.(*helium.Element), est)
+		if err != nil {
+			return err
+		}
+		set.attrs = append(set.attrs, ins)
+	}
+	c.ss.attributeSets[name] = append(c.ss.attributeSets[name], set)
+	return nil
+}
+
+// useAttributeSets returns the expanded names of the attribute sets
+// that e uses. literal is true for literal result elements, where the
+// attribute is in the XSLT namespace.
+func (c *compiler) useAttributeSets(e *helium.Element, st *static, literal bool) ([]string, error) {
+	var v string
+	var ok bool
+	if literal {
+		v, ok = xslAttribute(e, st, "use-attribute-sets")
+	} else {
+		v, ok = attribute(e, "use-attribute-sets")
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	var names []string
+	for _, qname := range strings.Fields(v) {
+		name, err := st.expand(qname, false)
+		if err != nil {
+			return nil, &Error{Node: e, Err: err}
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (c *compiler) compileVariable(e *helium.Element, st *static, param bool) (*variable, error) {
+	v, err := requiredAttribute(e, "name")
+	if err != nil {
+		return nil, err
+	}
+	name, err := st.expand(v, false)
+	if err != nil {
+		return nil, &Error{Node: e, Err: err}
+	}
+
+	ret := &variable{name: name, param: param, node: e}
+	if s, ok := attribute(e, "select"); ok {
+		if ret.sel, err = c.compileExpr(e, st, s); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+	if ret.body, err = c.compileBody(e.FirstChild(), st); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *compiler) compileTemplate(e *helium.Element, st *static, m *module) error {
+	tmpl := &template{module: m, pos: c.pos, node: e}
+	c.pos++
+
+	if v, ok := attribute(e, "name"); ok {
+		name, err := st.expand(v, false)
+		if err != nil {
+			return &Error{Node: e, Err: err}
+		}
+		tmpl.name = name
+	}
+	if v, ok := attribute(e, "mode"); ok {
+		mode, err := st.expand(v, false)
+		if err != nil {
+			return &Error{Node: e, Err: err}
+		}
+		tmpl.mode = mode
+	}
+
+	match, hasMatch := attribute(e, "match")
+	if !hasMatch && tmpl.name == "" {
+		return errorf(e, ErrInvalidStylesheet, "xsl:template needs a match or a name attribute")
+	}
+
+	// the parameters come first
+	n := e.FirstChild()
+	for ; n != nil; n = n.NextSibling() {
+		if n.Type() != helium.ElementNode {
+			if isWhitespace(n) || n.Type() == helium.CommentNode || n.Type() == helium.ProcessingInstructionNode {
+				continue
+			}
+			break
+		}
+		if !isXSL(n, "param") {
+			break
+		}
+		pst, err := c.static(n.(*helium.Element), st)
+		if err != nil {
+			return err
+		}
+		p, err := c.compileVariable(n.(*helium.Element), pst, true)
+		if err != nil {
+			return err
+		}
+		tmpl.params = append(tmpl.params, p)
+	}
+	body, err := c.compileBody(n, st)
+	if err != nil {
+		return err
+	}
+	tmpl.body = body
+
+	if tmpl.name != "" {
+		if cur, ok := c.ss.named[tmpl.name]; !ok || cur.module.prec <= m.prec {
+			c.ss.named[tmpl.name] = tmpl
+		}
+	}
+	if !hasMatch {
+		return nil
+	}
+
+	patterns, err := c.compilePattern(e, st, match)
+	if err != nil {
+		return err
+	}
+	var priority float64
+	v, hasPriority := attribute(e, "priority")
+	if hasPriority {
+		if priority, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+			return errorf(e, ErrInvalidStylesheet, "invalid priority '%s'", v)
+		}
+	}
+	for _, p := range patterns {
+		rule := *tmpl
+		rule.match = p
+		rule.priority = priority
+		if !hasPriority {
+			rule.priority = p.p.DefaultPriority()
+		}
+		c.ss.templates = append(c.ss.templates, &rule)
+	}
+	return nil
+}
+
+// isWhitespace reports if n is a text node made of whitespace only
+func isWhitespace(n helium.Node) bool {
+	switch n.Type() {
+	case helium.TextNode, helium.CDATASectionNode:
+		return strings.Trim(string(n.Content()), " \t\r\n") == ""
+	}
+	return false
+}
+
+// compileBody compiles the nodes from first to the last sibling
+func (c *compiler) compileBody(first helium.Node, st *static) ([]instruction, error) {
+	var body []instruction
+	for n := first; n != nil; n = n.NextSibling() {
+		switch n.Type() {
+		case helium.TextNode, helium.CDATASectionNode:
+			if !st.preserve && isWhitespace(n) {
+				continue
+			}
+			body = append(body, &literalText{text: string(n.Content())})
+		case helium.ElementNode:
+			ins, err := c.compileInstruction(n.(*helium.Element), st)
+			if err != nil {
+				return nil, err
+			}
+			if ins != nil {
+				body = append(body, ins)
+			}
+		}
+	}
+	return body, nil
+}
+
+// compileInstruction compiles the element e of a template body
+func (c *compiler) compileInstruction(e *helium.Element, parent *static) (instruction, error) {
+	st, err := c.static(e, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	local, uri := xpath.ExpandedName(e)
+	if uri != Namespace {
+		if _, ok := st.extension[uri]; ok {
+			return c.compileFallback(e, st)
+		}
+		return c.compileLiteral(e, st)
+	}
+
+	switch local {
+	case "apply-templates":
+		return c.compileApplyTemplates(e, st)
+	case "call-template":
+		return c.compileCallTemplate(e, st)
+	case "apply-imports":
+		return &applyImports{node: e}, nil
+	case "for-each":
+		return c.compileForEach(e, st)
+	case "value-of":
+		sel, err := c.compileSelect(e, st, "select")
+		if err != nil {
+			return nil, err
+		}
+		return &valueOf{sel: sel}, nil
+	case "copy-of":
+		sel, err := c.compileSelect(e, st, "select")
+		if err != nil {
+			return nil, err
+		}
+		return &copyOf{sel: sel}, nil
+	case "copy":
+		return c.compileCopy(e, st)
+	case "if":
+		return c.compileIf(e, st)
+	case "choose":
+		return c.compileChoose(e, st)
+	case "element":
+		return c.compileXSLElement(e, st)
+	case "attribute":
+		return c.compileXSLAttribute(e, st)
+	case "comment":
+		body, err := c.compileBody(e.FirstChild(), st)
+		if err != nil {
+			return nil, err
+		}
+		return &comment{body: body}, nil
+	case "processing-instruction":
+		return c.compilePI(e, st)
+	case "variable":
+		return c.compileVariable(e, st, false)
+	case "number":
+		return c.compileNumber(e, st)
+	case "message":
+		return c.compileMessage(e, st)
+	case "text":
+		var buf strings.Builder
+		for n := e.FirstChild(); n != nil; n = n.NextSibling() {
+			switch n.Type() {
+			case helium.TextNode, helium.CDATASectionNode:
+				buf.Write(n.Content())
+			}
+		}
+		return &literalText{text: buf.String()}, nil
+	case "fallback":
+		// only used by the instructions that are not supported
+		return nil, nil
+	}
+	if st.forwards {
+		return c.compileFallback(e, st)
+	}
+	return nil, errorf(e, ErrInvalidStylesheet, "unknown instruction xsl:%s", local)
+}
+
+// compileFallback compiles an instruction that is not supported, such
+// as an extension element or an XSL instruction of a later version in
+// forwards-compatible mode, as its xsl:fallback children. Without any,
+// executing the instruction is an error.
+func (c *compiler) compileFallback(e *helium.Element, st *static) (instruction, error) {
+	var body []instruction
+	var found bool
+	for n := e.FirstChild(); n != nil; n = n.NextSibling() {
+		if !isXSL(n, "fallback") {
+			continue
+		}
+		found = true
+		fallback, err := c.compileBody(n.FirstChild(), st)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, fallback...)
+	}
+	if !found {
+		return &unsupported{node: e}, nil
+	}
+	return &sequence{body: body}, nil
+}
+
+func (c *compiler) compileLiteral(e *helium.Element, st *static) (instruction, error) {
+	prefix, local, uri := qname(e)
+	ret := &literalElement{prefix: prefix, local: local, uri: uri, node: e}
+
+	prefixes := make([]string, 0, len(st.ns))
+	for prefix := range st.ns {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		nsuri := st.ns[prefix]
+		if _, ok := st.excluded[nsuri]; ok || prefix == helium.XMLPrefix || nsuri == "" {
+			continue
+		}
+		if _, ok := st.extension[nsuri]; ok {
+			continue
+		}
+		ret.namespaces = append(ret.namespaces, alias{prefix: prefix, uri: nsuri})
+	}
+
+	for _, attr := range e.Attributes() {
+		prefix, local, uri := attributeName(attr, st)
+		if uri == Namespace {
+			continue
+		}
+		value, err := c.compileAVT(e, st, attr.Value())
+		if err != nil {
+			return nil, err
+		}
+		ret.attrs = append(ret.attrs, &literalAttribute{prefix: prefix, local: local, uri: uri, value: value})
+	}
+
+	var err error
+	if ret.useSets, err = c.useAttributeSets(e, st, true); err != nil {
+		return nil, err
+	}
+	if ret.body, err = c.compileBody(e.FirstChild(), st); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// compileParams compiles the xsl:with-param children of e, and the
+// xsl:sort children when sorts is not nil
+func (c *compiler) compileParams(e *helium.Element, st *static, sorts *[]*sortKey) ([]*variable, error) {
+	var params []*variable
+	for n := e.FirstChild(); n != nil; n = n.NextSibling() {
+		switch {
+		case isXSL(n, "with-param"):
+			pst, err := c.static(n.(*helium.Element), st)
+			if err != nil {
+				return nil, err
+			}
+			p, err := c.compileVariable(n.(*helium.Element), pst, true)
+			if err != nil {
+				return nil, err
+			}
+			params = append(params, p)
+		case sorts != nil && isXSL(n, "sort"):
+			s, err := c.compileSort(n.(*helium.Element), st)
+			if err != nil {
+				return nil, err
+			}
+			*sorts = append(*sorts, s)
+		}
+	}
+	return params, nil
+}
+
+func (c *compiler) compileSort(e *helium.Element, st *static) (*sortKey, error) {
+	sel := "."
+	if v, ok := attribute(e, "select"); ok {
+		sel = v
+	}
+	expr, err := c.compileExpr(e, st, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &sortKey{sel: expr}
+	if ret.order, err = c.compileAttributeAVT(e, st, "order"); err != nil {
+		return nil, err
+	}
+	if ret.dataType, err = c.compileAttributeAVT(e, st, "data-type"); err != nil {
+		return nil, err
+	}
+	if ret.caseOrder, err = c.compileAttributeAVT(e, st, "case-order"); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *compiler) compileApplyTemplates(e *helium.Element, st *static) (instruction, error) {
+	ret := &applyTemplates{node: e}
+	var err error
+	if v, ok := attribute(e, "select"); ok {
+		if ret.sel, err = c.compileExpr(e, st, v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := attribute(e, "mode"); ok {
+		if ret.mode, err = st.expand(v, false); err != nil {
+			return nil, &Error{Node: e, Err: err}
+		}
+	}
+	if ret.params, err = c.compileParams(e, st, &ret.sorts); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *compiler) compileCallTemplate(e *helium.Element, st *static) (instruction, error) {
+	v, err := requiredAttribute(e, "name")
+	if err != nil {
+		return nil, err
+	}
+	ret := &callTemplate{node: e}
+	if ret.name, err = st.expand(v, false); err != nil {
+		return nil, &Error{Node: e, Err: err}
+	}
+	if ret.params, err = c.compileParams(e, st, nil); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *compiler) compileForEach(e *helium.Element, st *static) (instruction, error) {
+	sel, err := c.compileSelect(e, st, "select")
+	if err != nil {
+		return nil, err
+	}
+	ret := &forEach{sel: sel}
+
+	// the xsl:sort children come first
+	n := e.FirstChild()
+	for ; n != nil; n = n.NextSibling() {
+		if isWhitespace(n) || n.Type() == helium.CommentNode {
+			continue
+		}
+		if !isXSL(n, "sort") {
+			break
+		}
+		s, err := c.compileSort(n.(*helium.Element), st)
+		if err != nil {
+			return nil, err
+		}
+		ret.sorts = append(ret.sorts, s)
+	}
+	if ret.body, err = c.compileBody(n, st); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *compiler) compileCopy(e *helium.Element, st *static) (instruction, error) {
+	ret := &copyInstr{}
+	var err error
+	if ret.useSets, err = c.useAttributeSets(e, st, false); err != nil {
+		return nil, err
+	}
+	if ret.body, err = c.compileBody(e.FirstChild(), st); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *compiler) compileIf(e *helium.Element, st *static) (*ifInstr, error) {
+	test, err := c.compileSelect(e, st, "test")
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.compileBody(e.FirstChild(), st)
+	if err != nil {
+		return nil, err
+	}
+	return &ifInstr{test: test, body: body}, nil
+}
+
+func (c *compiler) compileChoose(e *helium.Element, st *static) (instruction, error) {
+	ret := &choose{}
+	for n := e.FirstChild(); n != nil; n = n.NextSibling() {
+		if n.Type() != helium.ElementNode {
+			continue
+		}
+		cst, err := c.static(n.(*helium.Element), st)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case isXSL(n, "when"):
+			when, err := c.compileIf(n.(*helium.Element), cst)
+			if err != nil {
+				return nil, err
+			}
+			ret.whens = append(ret.whens, when)
+		case isXSL(n, "otherwise"):
+			if ret.otherwise, err = c.compileBody(n.FirstChild(), cst); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errorf(n, ErrInvalidStylesheet, "xsl:choose can only contain xsl:when and xsl:otherwise")
+		}
+	}
+	return ret, nil
+}
+
+func (c *compiler) compileXSLElement(e *helium.Element, st *static) (instruction, error) {
+	v, err := requiredAttribute(e, "name")
+	if err != nil {
+		return nil, err
+	}
+	ret := &element{st: st, node: e}
+	if ret.name, err = c.compileAVT(e, st, v); err != nil {
+		return nil, err
+	}
+	if ret.namespace, err = c.compileAttributeAVT(e, st, "namespace"); err != nil {
+		return nil, err
+	}
+	if ret.useSets, err = c.useAttributeSets(e, st, false); err != nil {
+		return nil, err
+	}
+	if ret.body, err = c.compileBody(e.FirstChild(), st); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *compiler) compileXSLAttribute(e *helium.Element, st *static) (instruction, error) {
+	v, err := requiredAttribute(e, "name")
+	if err != nil {
+		return nil, err
+	}
+	ret := &attributeInstr{st: st, node: e}
+	if ret.name, err = c.compileAVT(e, st, v); err != nil {
+		return nil, err
+	}
+	if ret.namespace, err = c.compileAttributeAVT(e, st, "namespace"); err != nil {
+		return nil, err
+	}
+	if ret.body, err = c.compileBody(e.FirstChild(), st); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *compiler) compilePI(e *helium.Element, st *static) (instruction, error) {
+	v, err := requiredAttribute(e, "name")
+	if err != nil {
+		return nil, err
+	}
+	ret := &processingInstruction{node: e}
+	if ret.name, err = c.compileAVT(e, st, v); err != nil {
+		return nil, err
+	}
+	if ret.body, err = c.compileBody(e.FirstChild(), st); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *compiler) compileMessage(e *helium.Element, st *static) (instruction, error) {
+	terminate, err := yesNo(e, "terminate")
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.compileBody(e.FirstChild(), st)
+	if err != nil {
+		return nil, err
+	}
+	return &message{body: body, terminate: terminate, node: e}, nil
+}
@@ -0,0 +1,49 @@
+package xslt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/lestrrat/helium"
+)
+
+func (e *Error) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("xslt: ")
+	if e.Node != nil {
+		if doc := e.Node.OwnerDocument(); doc != nil && doc.URL() != "" {
+			buf.WriteString(doc.URL())
+			buf.WriteString(": ")
+		}
+		fmt.Fprintf(&buf, "%s: ", e.Node.Name())
+	}
+	buf.WriteString(e.Err.Error())
+	if p, ok := e.Node.(helium.Positioned); ok && p.Line() > 0 {
+		fmt.Fprintf(&buf, " at line %d", p.Line())
+	}
+	return buf.String()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrapError reports err at the node n of the stylesheet, unless it
+// was already reported at a more specific node
+func wrapError(n helium.Node, err error) error {
+	if err == nil {
+		return nil
+	}
+	var xerr *Error
+	if errors.As(err, &xerr) {
+		return err
+	}
+	return &Error{Node: n, Err: err}
+}
+
+// errorf reports a problem at the node n of the stylesheet
+func errorf(n helium.Node, err error, format string, args ...interface{}) error {
+	return &Error{Node: n, Err: fmt.Errorf("%w: "+format, append([]interface{}{err}, args...)...)}
+}
@@ -0,0 +1,335 @@
+package xslt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xpath"
+	"github.com/lestrrat/helium/xpointer"
+)
+
+// instructionNames are the instructions that element-available()
+// reports as available
+var instructionNames = map[string]struct{}{
+	"apply-imports": {}, "apply-templates": {}, "attribute": {}, "call-template": {},
+	"choose": {}, "comment": {}, "copy": {}, "copy-of": {}, "element": {},
+	"fallback": {}, "for-each": {}, "if": {}, "message": {}, "number": {},
+	"processing-instruction": {}, "text": {}, "value-of": {}, "variable": {},
+}
+
+// functionLibrary returns the functions that XSLT adds to XPath
+func (t *transformer) functionLibrary() map[string]xpath.Function {
+	return map[string]xpath.Function{
+		"current":             t.fnCurrent,
+		"document":            t.fnDocument,
+		"element-available":   t.fnElementAvailable,
+		"format-number":       t.fnFormatNumber,
+		"function-available":  t.fnFunctionAvailable,
+		"generate-id":         t.fnGenerateID,
+		"key":                 t.fnKey,
+		"system-property":     t.fnSystemProperty,
+		"unparsed-entity-uri": t.fnUnparsedEntityURI,
+	}
+}
+
+func checkArity(name string, args []*xpath.Object, min, max int) error {
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("%w: %s()", xpath.ErrInvalidArity, name)
+	}
+	return nil
+}
+
+func (t *transformer) fnCurrent(ctx *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+	if err := checkArity("current", args, 0, 0); err != nil {
+		return nil, err
+	}
+	return t.current, nil
+}
+
+func (t *transformer) fnKey(ctx *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+	if err := checkArity("key", args, 2, 2); err != nil {
+		return nil, err
+	}
+	_, local, uri, err := resolveQName(ctx.Context.Namespaces, strings.TrimSpace(args[0].String()), false)
+	if err != nil {
+		return nil, err
+	}
+	name := expandName(uri, local)
+	index, err := t.keyIndex(name, rootOf(ctx.Node))
+	if err != nil {
+		return nil, err
+	}
+
+	if args[1].Type() != xpath.NodeSetType {
+		return index[args[1].String()], nil
+	}
+	var ret xpath.NodeSet
+	for _, n := range args[1].NodeSet() {
+		ret = append(ret, index[xpath.StringValue(n)]...)
+	}
+	return ret, nil
+}
+
+// rootOf returns the root of the tree that n belongs to
+func rootOf(n helium.Node) helium.Node {
+	for p := n.Parent(); p != nil; p = p.Parent() {
+		n = p
+	}
+	return n
+}
+
+// keyIndex returns the nodes of the tree root that the key name
+// applies to, by value. It is built on first use.
+func (t *transformer) keyIndex(name string, root helium.Node) (map[string]xpath.NodeSet, error) {
+	ki := keyIndex{name: name, root: root}
+	if index, ok := t.keys[ki]; ok {
+		return index, nil
+	}
+	keys, ok := t.ss.keys[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownKey, name)
+	}
+
+	index := make(map[string]xpath.NodeSet)
+	add := func(v string, n helium.Node) {
+		// a node matching several definitions is only added once
+		if nodes := index[v]; len(nodes) == 0 || nodes[len(nodes)-1] != n {
+			index[v] = append(nodes, n)
+		}
+	}
+	err := walkTree(root, func(n helium.Node) error {
+		for _, k := range keys {
+			ok, err := t.match(k.match, n)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			o, err := t.eval(k.use, &frame{node: n, pos: 1, size: 1})
+			if err != nil {
+				return err
+			}
+			if o.Type() != xpath.NodeSetType {
+				add(o.String(), n)
+				continue
+			}
+			for _, v := range o.NodeSet() {
+				add(xpath.StringValue(v), n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.keys[ki] = index
+	return index, nil
+}
+
+// walkTree calls f with n and the nodes below it, including the
+// attributes, in document order
+func walkTree(n helium.Node, f func(helium.Node) error) error {
+	if err := f(n); err != nil {
+		return err
+	}
+	if e, ok := n.(*helium.Element); ok {
+		for _, attr := range e.Attributes() {
+			if err := f(attr); err != nil {
+				return err
+			}
+		}
+	}
+	switch n.Type() {
+	case helium.DocumentNode, helium.ElementNode:
+	default:
+		return nil
+	}
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch c.Type() {
+		case helium.ElementNode, helium.TextNode, helium.CDATASectionNode, helium.CommentNode, helium.ProcessingInstructionNode:
+			if err := walkTree(c, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *transformer) fnDocument(ctx *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+	if err := checkArity("document", args, 1, 2); err != nil {
+		return nil, err
+	}
+
+	var base string
+	if len(args) == 2 {
+		nodes := args[1].NodeSet()
+		if len(nodes) == 0 {
+			return xpath.NodeSet{}, nil
+		}
+		base = baseURI(nodes[0])
+	}
+
+	if args[0].Type() != xpath.NodeSetType {
+		if len(args) == 1 {
+			base = t.st.doc.URL()
+		}
+		return t.document(args[0].String(), base), nil
+	}
+	var ret xpath.NodeSet
+	for _, n := range args[0].NodeSet() {
+		b := base
+		if len(args) == 1 {
+			b = baseURI(n)
+		}
+		ret = append(ret, t.document(xpath.StringValue(n), b)...)
+	}
+	return ret, nil
+}
+
+func baseURI(n helium.Node) string {
+	if doc := docOf(n); doc != nil {
+		return doc.URL()
+	}
+	return ""
+}
+
+// document returns the nodes identified by the URI reference ref. An
+// empty reference is the stylesheet module, and a fragment identifier
+// is an XPointer. Documents that cannot be loaded are empty node-sets.
+func (t *transformer) document(ref, base string) xpath.NodeSet {
+	ref, fragment, _ := strings.Cut(ref, "#")
+
+	var doc *helium.Document
+	if ref == "" && (base == "" || base == t.st.doc.URL()) {
+		doc = t.st.doc
+	} else {
+		uri := resolveURI(ref, base)
+		var ok bool
+		if doc, ok = t.docs[uri]; !ok {
+			var err error
+			if doc, err = t.ss.loader(uri); err != nil {
+				return xpath.NodeSet{}
+			}
+			if doc, err = t.stripSpace(doc); err != nil {
+				return xpath.NodeSet{}
+			}
+			t.docs[uri] = doc
+		}
+	}
+
+	if fragment == "" {
+		return xpath.NodeSet{doc}
+	}
+	nodes, err := xpointer.Evaluate(doc, fragment)
+	if err != nil {
+		return xpath.NodeSet{}
+	}
+	return nodes
+}
+
+func (t *transformer) fnGenerateID(ctx *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+	if err := checkArity("generate-id", args, 0, 1); err != nil {
+		return nil, err
+	}
+	n := ctx.Node
+	if len(args) == 1 {
+		nodes := args[0].NodeSet()
+		if len(nodes) == 0 {
+			return "", nil
+		}
+		n = nodes[0]
+	}
+
+	id, ok := t.ids[n]
+	if !ok {
+		id = len(t.ids) + 1
+		t.ids[n] = id
+	}
+	return fmt.Sprintf("id%d", id), nil
+}
+
+func (t *transformer) fnFormatNumber(ctx *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+	if err := checkArity("format-number", args, 2, 3); err != nil {
+		return nil, err
+	}
+	var name string
+	if len(args) == 3 {
+		_, local, uri, err := resolveQName(ctx.Context.Namespaces, strings.TrimSpace(args[2].String()), false)
+		if err != nil {
+			return nil, err
+		}
+		name = expandName(uri, local)
+	}
+	df, ok := t.ss.decimalFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown decimal format '%s'", ErrInvalidStylesheet, name)
+	}
+	return formatNumber(args[0].Number(), args[1].String(), df)
+}
+
+func (t *transformer) fnSystemProperty(ctx *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+	if err := checkArity("system-property", args, 1, 1); err != nil {
+		return nil, err
+	}
+	_, local, uri, err := resolveQName(ctx.Context.Namespaces, strings.TrimSpace(args[0].String()), false)
+	if err != nil {
+		return nil, err
+	}
+	if uri != Namespace {
+		return "", nil
+	}
+	switch local {
+	case "version":
+		return 1.0, nil
+	case "vendor":
+		return "helium", nil
+	case "vendor-url":
+		return "https://github.com/lestrrat/helium", nil
+	}
+	return "", nil
+}
+
+func (t *transformer) fnElementAvailable(ctx *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+	if err := checkArity("element-available", args, 1, 1); err != nil {
+		return nil, err
+	}
+	_, local, uri, err := resolveQName(ctx.Context.Namespaces, strings.TrimSpace(args[0].String()), true)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := instructionNames[local]
+	return ok && uri == Namespace, nil
+}
+
+func (t *transformer) fnFunctionAvailable(ctx *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+	if err := checkArity("function-available", args, 1, 1); err != nil {
+		return nil, err
+	}
+	_, local, uri, err := resolveQName(ctx.Context.Namespaces, strings.TrimSpace(args[0].String()), false)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.Context.HasFunction(uri, local), nil
+}
+
+func (t *transformer) fnUnparsedEntityURI(ctx *xpath.FunctionContext, args []*xpath.Object) (interface{}, error) {
+	if err := checkArity("unparsed-entity-uri", args, 1, 1); err != nil {
+		return nil, err
+	}
+	doc := docOf(ctx.Node)
+	if doc == nil {
+		return "", nil
+	}
+	for _, dtd := range []*helium.DTD{doc.IntSubset(), doc.ExtSubset()} {
+		if dtd == nil {
+			continue
+		}
+		ent, ok := dtd.LookupEntity(args[0].String())
+		if ok && ent.EntityType() == int(helium.ExternalGeneralUnparsedEntity) {
+			return ent.URI(), nil
+		}
+	}
+	return "", nil
+}
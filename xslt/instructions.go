@@ -0,0 +1,643 @@
+package xslt
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xpath"
+)
+
+type literalText struct {
+	text string
+}
+
+type literalElement struct {
+	prefix     string
+	local      string
+	uri        string
+	namespaces []alias // the namespace nodes, minus the excluded ones
+	attrs      []*literalAttribute
+	useSets    []string
+	body       []instruction
+	node       helium.Node
+}
+
+type literalAttribute struct {
+	prefix string
+	local  string
+	uri    string
+	value  *avt
+}
+
+type applyTemplates struct {
+	sel    *expression // nil selects the children
+	mode   string
+	sorts  []*sortKey
+	params []*variable
+	node   helium.Node
+}
+
+type callTemplate struct {
+	name   string
+	params []*variable
+	node   helium.Node
+}
+
+type applyImports struct {
+	node helium.Node
+}
+
+type forEach struct {
+	sel   *expression
+	sorts []*sortKey
+	body  []instruction
+}
+
+type sortKey struct {
+	sel       *expression
+	order     *avt
+	dataType  *avt
+	caseOrder *avt
+}
+
+type valueOf struct {
+	sel *expression
+}
+
+type copyOf struct {
+	sel *expression
+}
+
+type copyInstr struct {
+	useSets []string
+	body    []instruction
+}
+
+type ifInstr struct {
+	test *expression
+	body []instruction
+}
+
+type choose struct {
+	whens     []*ifInstr
+	otherwise []instruction
+}
+
+// element is xsl:element
+type element struct {
+	name      *avt
+	namespace *avt
+	useSets   []string
+	body      []instruction
+	st        *static
+	node      helium.Node
+}
+
+// attributeInstr is xsl:attribute
+type attributeInstr struct {
+	name      *avt
+	namespace *avt
+	body      []instruction
+	st        *static
+	node      helium.Node
+}
+
+type comment struct {
+	body []instruction
+}
+
+type processingInstruction struct {
+	name *avt
+	body []instruction
+	node helium.Node
+}
+
+type message struct {
+	body      []instruction
+	terminate bool
+	node      helium.Node
+}
+
+// unsupported is an instruction that is not supported, without
+// xsl:fallback
+type unsupported struct {
+	node helium.Node
+}
+
+// sequence is the fallback of an instruction that is not supported
+type sequence struct {
+	body []instruction
+}
+
+func (ins *literalText) execute(t *transformer, f *frame) error {
+	return t.addText(f.out, ins.text)
+}
+
+func (ins *literalElement) execute(t *transformer, f *frame) error {
+	prefix, uri := ins.prefix, ins.uri
+	if a, ok := t.ss.aliases[uri]; ok {
+		prefix, uri = a.prefix, a.uri
+	}
+	e, err := t.addElement(f.out, prefix, ins.local, uri)
+	if err != nil {
+		return wrapError(ins.node, err)
+	}
+	for _, ns := range ins.namespaces {
+		prefix, uri := ns.prefix, ns.uri
+		if a, ok := t.ss.aliases[uri]; ok {
+			uri = a.uri
+			if prefix != "" {
+				prefix = a.prefix
+			}
+		}
+		if err := t.declare(e, prefix, uri); err != nil {
+			return wrapError(ins.node, err)
+		}
+	}
+
+	local := *f
+	local.out = e
+	if err := t.useAttributeSets(ins.useSets, &local, ins.node); err != nil {
+		return err
+	}
+	for _, attr := range ins.attrs {
+		v, err := attr.value.eval(t, f)
+		if err != nil {
+			return err
+		}
+		prefix, uri := attr.prefix, attr.uri
+		if a, ok := t.ss.aliases[uri]; ok && uri != "" {
+			prefix, uri = a.prefix, a.uri
+		}
+		if err := t.addAttribute(e, prefix, attr.local, uri, v); err != nil {
+			return wrapError(ins.node, err)
+		}
+	}
+	return t.run(ins.body, &local)
+}
+
+// useAttributeSets adds the attributes of the attribute sets names to
+// f.out. They only see the global variables.
+func (t *transformer) useAttributeSets(names []string, f *frame, n helium.Node) error {
+	if len(names) == 0 {
+		return nil
+	}
+	t.depth++
+	defer func() { t.depth-- }()
+	if t.depth > maxDepth {
+		return errorf(n, ErrRecursion, "in attribute sets")
+	}
+
+	local := *f
+	local.vars = nil
+	for _, name := range names {
+		sets, ok := t.ss.attributeSets[name]
+		if !ok {
+			return errorf(n, ErrInvalidStylesheet, "unknown attribute set '%s'", name)
+		}
+		for _, set := range sets {
+			if err := t.useAttributeSets(set.useSets, &local, n); err != nil {
+				return err
+			}
+			if err := t.run(set.attrs, &local); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ins *applyTemplates) execute(t *transformer, f *frame) error {
+	var nodes xpath.NodeSet
+	var err error
+	if ins.sel == nil {
+		nodes, err = childNodes.Find(nil, f.node)
+	} else {
+		nodes, err = t.evalNodes(ins.sel, f)
+	}
+	if err != nil {
+		return wrapError(ins.node, err)
+	}
+	if nodes, err = t.sort(nodes, ins.sorts, f); err != nil {
+		return err
+	}
+	params, err := t.withParams(ins.params, f)
+	if err != nil {
+		return err
+	}
+	return t.applyTemplates(nodes, ins.mode, params, f)
+}
+
+// withParams evaluates the xsl:with-param of an instruction
+func (t *transformer) withParams(vars []*variable, f *frame) (map[string]interface{}, error) {
+	if len(vars) == 0 {
+		return nil, nil
+	}
+	ret := make(map[string]interface{}, len(vars))
+	for _, v := range vars {
+		value, err := t.value(v, f)
+		if err != nil {
+			return nil, err
+		}
+		ret[v.name] = value
+	}
+	return ret, nil
+}
+
+func (ins *callTemplate) execute(t *transformer, f *frame) error {
+	tmpl, ok := t.ss.named[ins.name]
+	if !ok {
+		return errorf(ins.node, ErrUnknownTemplate, "'%s'", ins.name)
+	}
+	params, err := t.withParams(ins.params, f)
+	if err != nil {
+		return err
+	}
+	// the current template rule does not change
+	return t.callTemplate(tmpl, f, f.template, params)
+}
+
+func (ins *applyImports) execute(t *transformer, f *frame) error {
+	cur := f.template
+	if cur == nil || cur.match == nil {
+		return errorf(ins.node, ErrInvalidStylesheet, "xsl:apply-imports is used without a current template rule")
+	}
+
+	m := cur.module
+	tmpl, err := t.findTemplate(f.node, cur.mode, func(tmpl *template) bool {
+		return tmpl.module.prec >= m.minPrec && tmpl.module.prec < m.prec
+	})
+	if err != nil {
+		return err
+	}
+	if tmpl == nil {
+		return t.builtin(cur.mode, f)
+	}
+	return t.callTemplate(tmpl, f, tmpl, nil)
+}
+
+func (ins *forEach) execute(t *transformer, f *frame) error {
+	nodes, err := t.evalNodes(ins.sel, f)
+	if err != nil {
+		return err
+	}
+	if nodes, err = t.sort(nodes, ins.sorts, f); err != nil {
+		return err
+	}
+
+	local := *f
+	local.template = nil
+	local.size = len(nodes)
+	for i, n := range nodes {
+		local.node = n
+		local.pos = i + 1
+		if err := t.run(ins.body, &local); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sort sorts nodes with the keys of xsl:sort elements. The keys are
+// evaluated with the nodes in document order as the context.
+func (t *transformer) sort(nodes xpath.NodeSet, keys []*sortKey, f *frame) (xpath.NodeSet, error) {
+	if len(keys) == 0 || len(nodes) < 2 {
+		return nodes, nil
+	}
+
+	type sortValue struct {
+		s string
+		n float64
+	}
+	type sortSpec struct {
+		descending bool
+		number     bool
+		upperFirst bool
+	}
+
+	specs := make([]sortSpec, len(keys))
+	values := make([][]sortValue, len(keys))
+	local := *f
+	local.size = len(nodes)
+	for i, k := range keys {
+		for _, a := range []*avt{k.order, k.dataType, k.caseOrder} {
+			if a == nil {
+				continue
+			}
+			v, err := a.eval(t, f)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case a == k.order:
+				specs[i].descending = v == "descending"
+			case a == k.dataType:
+				specs[i].number = v == "number"
+			default:
+				specs[i].upperFirst = v == "upper-first"
+			}
+		}
+
+		values[i] = make([]sortValue, len(nodes))
+		for j, n := range nodes {
+			local.node = n
+			local.pos = j + 1
+			o, err := t.eval(k.sel, &local)
+			if err != nil {
+				return nil, err
+			}
+			values[i][j] = sortValue{s: o.String(), n: o.Number()}
+		}
+	}
+
+	idx := make([]int, len(nodes))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		for i, spec := range specs {
+			va, vb := values[i][idx[a]], values[i][idx[b]]
+			var c int
+			if spec.number {
+				c = compareNumbers(va.n, vb.n)
+			} else {
+				c = compareStrings(va.s, vb.s, spec.upperFirst)
+			}
+			if spec.descending {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	ret := make(xpath.NodeSet, len(nodes))
+	for i, j := range idx {
+		ret[i] = nodes[j]
+	}
+	return ret, nil
+}
+
+// compareNumbers orders NaN before the other numbers
+func compareNumbers(a, b float64) int {
+	switch an, bn := math.IsNaN(a), math.IsNaN(b); {
+	case an && bn:
+		return 0
+	case an:
+		return -1
+	case bn:
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareStrings compares a and b regardless of case first, and then
+// puts lowercase letters first, unless upperFirst is true
+func compareStrings(a, b string, upperFirst bool) int {
+	if c := strings.Compare(strings.ToLower(a), strings.ToLower(b)); c != 0 {
+		return c
+	}
+	c := strings.Compare(a, b)
+	if !upperFirst {
+		c = -c
+	}
+	return c
+}
+
+func (ins *valueOf) execute(t *transformer, f *frame) error {
+	o, err := t.eval(ins.sel, f)
+	if err != nil {
+		return err
+	}
+	return t.addText(f.out, o.String())
+}
+
+func (ins *copyOf) execute(t *transformer, f *frame) error {
+	o, err := t.eval(ins.sel, f)
+	if err != nil {
+		return err
+	}
+	if o.Type() != xpath.NodeSetType {
+		return t.addText(f.out, o.String())
+	}
+	for _, n := range o.NodeSet() {
+		if err := t.copyNode(f.out, n); err != nil {
+			return wrapError(ins.sel.node, err)
+		}
+	}
+	return nil
+}
+
+func (ins *copyInstr) execute(t *transformer, f *frame) error {
+	switch n := f.node.(type) {
+	case *helium.Document:
+		return t.run(ins.body, f)
+	case *helium.Element:
+		e, err := t.copyElement(f.out, n)
+		if err != nil {
+			return err
+		}
+		local := *f
+		local.out = e
+		if err := t.useAttributeSets(ins.useSets, &local, nil); err != nil {
+			return err
+		}
+		return t.run(ins.body, &local)
+	}
+	return t.copyNode(f.out, f.node)
+}
+
+func (ins *ifInstr) execute(t *transformer, f *frame) error {
+	o, err := t.eval(ins.test, f)
+	if err != nil {
+		return err
+	}
+	if !o.Bool() {
+		return nil
+	}
+	return t.run(ins.body, f)
+}
+
+func (ins *choose) execute(t *transformer, f *frame) error {
+	for _, when := range ins.whens {
+		o, err := t.eval(when.test, f)
+		if err != nil {
+			return err
+		}
+		if o.Bool() {
+			return t.run(when.body, f)
+		}
+	}
+	return t.run(ins.otherwise, f)
+}
+
+// evalName evaluates the name and namespace AVTs of xsl:element and
+// xsl:attribute
+func evalName(t *transformer, f *frame, name, namespace *avt, st *static, useDefault bool) (prefix, local, uri string, err error) {
+	qname, err := name.eval(t, f)
+	if err != nil {
+		return "", "", "", err
+	}
+	if namespace == nil {
+		prefix, local, uri, err = resolveQName(st.ns, strings.TrimSpace(qname), useDefault)
+		if err != nil {
+			return "", "", "", &Error{Node: name.node, Err: err}
+		}
+		return prefix, local, uri, nil
+	}
+
+	if uri, err = namespace.eval(t, f); err != nil {
+		return "", "", "", err
+	}
+	// only the syntax of the name matters
+	if prefix, local, err = splitQName(strings.TrimSpace(qname)); err != nil {
+		return "", "", "", &Error{Node: name.node, Err: err}
+	}
+	if uri == "" {
+		prefix = ""
+	}
+	return prefix, local, uri, nil
+}
+
+func (ins *element) execute(t *transformer, f *frame) error {
+	prefix, local, uri, err := evalName(t, f, ins.name, ins.namespace, ins.st, true)
+	if err != nil {
+		return err
+	}
+	e, err := t.addElement(f.out, prefix, local, uri)
+	if err != nil {
+		return wrapError(ins.node, err)
+	}
+
+	inner := *f
+	inner.out = e
+	if err := t.useAttributeSets(ins.useSets, &inner, ins.node); err != nil {
+		return err
+	}
+	return t.run(ins.body, &inner)
+}
+
+func (ins *attributeInstr) execute(t *transformer, f *frame) error {
+	prefix, local, uri, err := evalName(t, f, ins.name, ins.namespace, ins.st, false)
+	if err != nil {
+		return err
+	}
+	if prefix == "" && local == "xmlns" {
+		return errorf(ins.node, ErrInvalidStylesheet, "xsl:attribute cannot create namespace declarations")
+	}
+	if prefix == "xmlns" {
+		prefix = ""
+	}
+
+	value, err := t.runString(ins.body, f)
+	if err != nil {
+		return err
+	}
+	if err := t.addAttribute(f.out, prefix, local, uri, value); err != nil {
+		return wrapError(ins.node, err)
+	}
+	return nil
+}
+
+func (ins *comment) execute(t *transformer, f *frame) error {
+	value, err := t.runString(ins.body, f)
+	if err != nil {
+		return err
+	}
+	// "--" cannot appear in comments, nor can they end with "-"
+	value = strings.Replace(value, "--", "- -", -1)
+	if strings.HasSuffix(value, "-") {
+		value += " "
+	}
+	c, err := docOf(f.out).CreateComment([]byte(value))
+	if err != nil {
+		return err
+	}
+	return f.out.AddChild(c)
+}
+
+func (ins *processingInstruction) execute(t *transformer, f *frame) error {
+	target, err := ins.name.eval(t, f)
+	if err != nil {
+		return err
+	}
+	target = strings.TrimSpace(target)
+	if target == "" || strings.ContainsAny(target, ": \t\r\n") || strings.EqualFold(target, "xml") {
+		return errorf(ins.node, ErrInvalidStylesheet, "invalid processing instruction target '%s'", target)
+	}
+
+	value, err := t.runString(ins.body, f)
+	if err != nil {
+		return err
+	}
+	value = strings.Replace(value, "?>", "? >", -1)
+	pi, err := docOf(f.out).CreatePI(target, strings.TrimLeft(value, " \t\r\n"))
+	if err != nil {
+		return err
+	}
+	return f.out.AddChild(pi)
+}
+
+// execute binds the variable in f, which holds the bindings of the
+// rest of the template body
+func (v *variable) execute(t *transformer, f *frame) error {
+	value, err := t.value(v, f)
+	if err != nil {
+		return err
+	}
+	f.vars = &scope{name: v.name, value: value, parent: f.vars}
+	return nil
+}
+
+func (ins *message) execute(t *transformer, f *frame) error {
+	msg, err := t.runString(ins.body, f)
+	if err != nil {
+		return err
+	}
+	t.ss.messages(msg, ins.terminate)
+	if ins.terminate {
+		return &Error{Node: ins.node, Err: fmt.Errorf("%w: %s", ErrTerminated, msg)}
+	}
+	return nil
+}
+
+func (ins *unsupported) execute(t *transformer, f *frame) error {
+	if _, uri := xpath.ExpandedName(ins.node); uri == Namespace {
+		return errorf(ins.node, ErrInvalidStylesheet, "instruction %s is not supported", ins.node.Name())
+	}
+	return errorf(ins.node, ErrInvalidStylesheet, "extension element %s is not supported", ins.node.Name())
+}
+
+func (ins *sequence) execute(t *transformer, f *frame) error {
+	return t.run(ins.body, f)
+}
+
+// eval returns the value of the attribute value template
+func (a *avt) eval(t *transformer, f *frame) (string, error) {
+	if len(a.parts) == 1 && a.parts[0].expr == nil {
+		return a.parts[0].text, nil
+	}
+
+	var buf strings.Builder
+	for _, part := range a.parts {
+		if part.expr == nil {
+			buf.WriteString(part.text)
+			continue
+		}
+		o, err := t.eval(part.expr, f)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(o.String())
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,233 @@
+package xslt
+
+import (
+	"errors"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xpath"
+)
+
+// Namespace is the namespace URI of the XSLT elements
+const Namespace = "http://www.w3.org/1999/XSL/Transform"
+
+var (
+	ErrInvalidStylesheet = errors.New("invalid stylesheet")
+	ErrNotStylesheet     = errors.New("document is not a stylesheet")
+	ErrRecursion         = errors.New("template recursion is too deep")
+	ErrTerminated        = errors.New("transformation terminated by xsl:message")
+	ErrUnknownKey        = errors.New("unknown key")
+	ErrUnknownTemplate   = errors.New("unknown named template")
+)
+
+// Error is returned when a stylesheet cannot be compiled or applied.
+// Node is the node of the stylesheet that the problem was found at.
+type Error struct {
+	Node helium.Node
+	Err  error
+}
+
+// DocumentLoader loads the stylesheet modules of xsl:import and
+// xsl:include, and the documents of the document() function. uri is
+// absolute, unless the stylesheet itself has no URI.
+type DocumentLoader func(uri string) (*helium.Document, error)
+
+// MessageHandler receives the text of the xsl:message instructions.
+// terminate is true when the transformation stops after the message.
+type MessageHandler func(msg string, terminate bool)
+
+// Output holds the options of the xsl:output elements of a stylesheet
+type Output struct {
+	// Method is "xml", "html", "text", or "" when the stylesheet does
+	// not specify one, in which case results whose document element is
+	// an html element without a namespace are written as HTML
+	Method             string
+	Version            string
+	Encoding           string
+	OmitXMLDeclaration bool
+	Standalone         string // "yes", "no" or ""
+	DoctypePublic      string
+	DoctypeSystem      string
+	// CDATASectionElements holds the expanded names of the elements
+	// whose text is written as CDATA sections, as "local" or
+	// "{uri}local"
+	CDATASectionElements []string
+	Indent               string // "yes", "no" or ""
+	MediaType            string
+}
+
+// DecimalFormat holds the symbols that format-number() uses, as
+// declared by xsl:decimal-format
+type DecimalFormat struct {
+	DecimalSeparator  rune
+	GroupingSeparator rune
+	Infinity          string
+	MinusSign         rune
+	NaN               string
+	Percent           rune
+	PerMille          rune
+	ZeroDigit         rune
+	Digit             rune
+	PatternSeparator  rune
+}
+
+// Compiler compiles stylesheets. The zero value is not usable, use
+// NewCompiler.
+type Compiler struct {
+	loader DocumentLoader
+}
+
+// Stylesheet is a compiled stylesheet. It is not modified by
+// transformations, so it may be applied to several documents
+// concurrently.
+type Stylesheet struct {
+	doc            *helium.Document
+	loader         DocumentLoader
+	messages       MessageHandler
+	output         Output
+	cdata          map[string]struct{}
+	templates      []*template
+	modes          map[string][]*template
+	named          map[string]*template
+	keys           map[string][]*key
+	decimalFormats map[string]*DecimalFormat
+	aliases        map[string]alias
+	attributeSets  map[string][]*attributeSet
+	globals        []*variable
+	spaces         []*spaceRule
+}
+
+// static is the static context of the instructions compiled from an
+// element of a stylesheet
+type static struct {
+	doc       *helium.Document  // the stylesheet module
+	ns        map[string]string // in-scope namespaces, "" being the default one
+	excluded  map[string]struct{}
+	extension map[string]struct{}
+	preserve  bool // xml:space="preserve" is in effect
+	forwards  bool // forwards-compatible processing is enabled
+}
+
+// module is a stylesheet module and the modules that it includes. Its
+// imports have lower precedences, starting at minPrec.
+type module struct {
+	prec    int
+	minPrec int
+}
+
+// expression is an XPath expression of a stylesheet
+type expression struct {
+	x    *xpath.Expr
+	node helium.Node
+	st   *static
+}
+
+// pattern is a single alternative of a match pattern
+type pattern struct {
+	p    *xpath.Pattern
+	node helium.Node
+	st   *static
+}
+
+// avt is an attribute value template. Parts that are not expressions
+// are literal text.
+type avt struct {
+	parts []avtPart
+	node  helium.Node
+}
+
+type avtPart struct {
+	text string
+	expr *expression
+}
+
+// instruction is a compiled node of a template body
+type instruction interface {
+	execute(t *transformer, f *frame) error
+}
+
+type template struct {
+	match    *pattern
+	name     string
+	mode     string
+	priority float64
+	module   *module
+	pos      int
+	params   []*variable
+	body     []instruction
+	node     helium.Node
+}
+
+type key struct {
+	match *pattern
+	use   *expression
+}
+
+type alias struct {
+	prefix string
+	uri    string
+}
+
+type attributeSet struct {
+	useSets []string
+	attrs   []instruction
+}
+
+// spaceRule is a name test of xsl:strip-space or xsl:preserve-space
+type spaceRule struct {
+	uri      string
+	local    string // "*" matches any name
+	anyNS    bool   // for "*", which matches names in any namespace
+	strip    bool
+	prec     int
+	priority float64
+}
+
+// variable is xsl:variable, xsl:param or xsl:with-param
+type variable struct {
+	name  string
+	sel   *expression
+	body  []instruction
+	param bool
+	prec  int
+	node  helium.Node
+}
+
+// transformer holds the state of a transformation
+type transformer struct {
+	ss        *Stylesheet
+	src       *helium.Document
+	result    *helium.Document
+	params    map[string]interface{}
+	globals   map[string]interface{}
+	functions map[string]xpath.Function
+	current   helium.Node // the node that current() returns
+	st        *static     // the static context of the expression being evaluated
+	keys      map[keyIndex]map[string]xpath.NodeSet
+	docs      map[string]*helium.Document
+	ids       map[helium.Node]int
+	depth     int
+}
+
+type keyIndex struct {
+	name string
+	root helium.Node
+}
+
+// frame is the dynamic context that instructions are executed in
+type frame struct {
+	node     helium.Node // the current node
+	pos      int
+	size     int
+	template *template // the current template rule
+	vars     *scope
+	out      helium.Node // where the results are added
+}
+
+// scope is a variable binding. It caches the variables that are
+// visible in it, which expressions are evaluated with.
+type scope struct {
+	name   string
+	value  interface{}
+	parent *scope
+	vars   map[string]interface{}
+}
@@ -0,0 +1,481 @@
+package xslt
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xpath"
+)
+
+// number is xsl:number
+type number struct {
+	level        string // single, multiple or any
+	count        []*pattern
+	from         []*pattern
+	value        *expression
+	format       *avt
+	groupingSep  *avt
+	groupingSize *avt
+	node         helium.Node
+}
+
+func (c *compiler) compileNumber(e *helium.Element, st *static) (instruction, error) {
+	ret := &number{level: "single", node: e}
+	if v, ok := attribute(e, "level"); ok {
+		switch v {
+		case "single", "multiple", "any":
+			ret.level = v
+		default:
+			return nil, errorf(e, ErrInvalidStylesheet, "invalid level '%s'", v)
+		}
+	}
+
+	var err error
+	if v, ok := attribute(e, "count"); ok {
+		if ret.count, err = c.compilePattern(e, st, v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := attribute(e, "from"); ok {
+		if ret.from, err = c.compilePattern(e, st, v); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := attribute(e, "value"); ok {
+		if ret.value, err = c.compileExpr(e, st, v); err != nil {
+			return nil, err
+		}
+	}
+	if ret.format, err = c.compileAttributeAVT(e, st, "format"); err != nil {
+		return nil, err
+	}
+	if ret.groupingSep, err = c.compileAttributeAVT(e, st, "grouping-separator"); err != nil {
+		return nil, err
+	}
+	if ret.groupingSize, err = c.compileAttributeAVT(e, st, "grouping-size"); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (ins *number) execute(t *transformer, f *frame) error {
+	var numbers []int
+	if ins.value != nil {
+		o, err := t.eval(ins.value, f)
+		if err != nil {
+			return err
+		}
+		v := o.Number()
+		switch {
+		case math.IsNaN(v):
+			return t.addText(f.out, "NaN")
+		case math.IsInf(v, 0) || v < 0.5:
+			// numbers that cannot be formatted are output as strings
+			return t.addText(f.out, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		numbers = []int{int(math.Floor(v + 0.5))}
+	} else {
+		var err error
+		if numbers, err = ins.numbers(t, f.node); err != nil {
+			return err
+		}
+	}
+
+	format := "1"
+	if ins.format != nil {
+		v, err := ins.format.eval(t, f)
+		if err != nil {
+			return err
+		}
+		format = v
+	}
+	var sep string
+	var size int
+	if ins.groupingSep != nil && ins.groupingSize != nil {
+		v, err := ins.groupingSep.eval(t, f)
+		if err != nil {
+			return err
+		}
+		s, err := ins.groupingSize.eval(t, f)
+		if err != nil {
+			return err
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && n > 0 {
+			sep, size = v, n
+		}
+	}
+	return t.addText(f.out, formatNumbers(numbers, format, sep, size))
+}
+
+// matches reports if n matches one of patterns. Without patterns, the
+// nodes of the same type and name as the current node match.
+func (ins *number) matches(t *transformer, patterns []*pattern, n, current helium.Node) (bool, error) {
+	if patterns == nil {
+		if n.Type() != current.Type() {
+			return false, nil
+		}
+		switch n.Type() {
+		case helium.ElementNode, helium.AttributeNode, helium.ProcessingInstructionNode:
+			local, uri := xpath.ExpandedName(n)
+			clocal, curi := xpath.ExpandedName(current)
+			return local == clocal && uri == curi, nil
+		}
+		return true, nil
+	}
+	for _, p := range patterns {
+		ok, err := t.match(p, n)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// isFrom reports if n matches the from pattern
+func (ins *number) isFrom(t *transformer, n helium.Node) (bool, error) {
+	if ins.from == nil {
+		return false, nil
+	}
+	return ins.matches(t, ins.from, n, nil)
+}
+
+// numbers returns the numbers of node, following the level of ins
+func (ins *number) numbers(t *transformer, node helium.Node) ([]int, error) {
+	if ins.level == "any" {
+		return ins.countAny(t, node)
+	}
+
+	// the ancestors-or-self that match count, up to the from node
+	var matched []helium.Node
+	for n := node; n != nil; n = n.Parent() {
+		ok, err := ins.matches(t, ins.count, n, node)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, n)
+			if ins.level == "single" {
+				break
+			}
+		}
+		from, err := ins.isFrom(t, n)
+		if err != nil {
+			return nil, err
+		}
+		if from {
+			break
+		}
+	}
+
+	numbers := make([]int, len(matched))
+	for i, n := range matched {
+		pos := 1
+		for s := n.PrevSibling(); s != nil; s = s.PrevSibling() {
+			ok, err := ins.matches(t, ins.count, s, node)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				pos++
+			}
+		}
+		numbers[len(matched)-1-i] = pos
+	}
+	return numbers, nil
+}
+
+// countAny counts the nodes that match count before node in document
+// order, including its ancestors and itself, after the last from node
+func (ins *number) countAny(t *transformer, node helium.Node) ([]int, error) {
+	count := 0
+	for n := node; n != nil; n = precedingOrAncestor(n) {
+		ok, err := ins.matches(t, ins.count, n, node)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			count++
+		}
+		from, err := ins.isFrom(t, n)
+		if err != nil {
+			return nil, err
+		}
+		if from {
+			break
+		}
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	return []int{count}, nil
+}
+
+// precedingOrAncestor returns the node before n in document order
+func precedingOrAncestor(n helium.Node) helium.Node {
+	if n.Type() == helium.AttributeNode {
+		return n.Parent()
+	}
+	prev := n.PrevSibling()
+	if prev == nil {
+		return n.Parent()
+	}
+	for {
+		last := prev.LastChild()
+		if last == nil || prev.Type() != helium.ElementNode {
+			return prev
+		}
+		prev = last
+	}
+}
+
+// formatNumbers formats numbers with the format of xsl:number, such as
+// "1.a" or "(i)"
+func formatNumbers(numbers []int, format, groupingSep string, groupingSize int) string {
+	// split format in its prefix, its tokens and their separators, and
+	// its suffix
+	var tokens, seps []string
+	var prefix, suffix string
+	rs := []rune(format)
+	i := 0
+	for i < len(rs) && !isAlnum(rs[i]) {
+		i++
+	}
+	prefix = string(rs[:i])
+	for i < len(rs) {
+		start := i
+		for i < len(rs) && isAlnum(rs[i]) {
+			i++
+		}
+		tokens = append(tokens, string(rs[start:i]))
+		start = i
+		for i < len(rs) && !isAlnum(rs[i]) {
+			i++
+		}
+		if i < len(rs) {
+			seps = append(seps, string(rs[start:i]))
+		} else {
+			suffix = string(rs[start:i])
+		}
+	}
+	if len(tokens) == 0 {
+		tokens = []string{"1"}
+	}
+
+	var buf strings.Builder
+	buf.WriteString(prefix)
+	for i, n := range numbers {
+		if i > 0 {
+			sep := "."
+			if len(seps) > 0 {
+				sep = seps[len(seps)-1]
+				if i-1 < len(seps) {
+					sep = seps[i-1]
+				}
+			}
+			buf.WriteString(sep)
+		}
+		token := tokens[len(tokens)-1]
+		if i < len(tokens) {
+			token = tokens[i]
+		}
+		buf.WriteString(formatToken(n, token, groupingSep, groupingSize))
+	}
+	buf.WriteString(suffix)
+	return buf.String()
+}
+
+func isAlnum(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// formatToken formats n with a format token, which is "1", "01", "a",
+// "A", "i" or "I". Other tokens are handled as "1".
+func formatToken(n int, token, groupingSep string, groupingSize int) string {
+	switch token {
+	case "a", "A":
+		if n > 0 {
+			s := alphabetic(n)
+			if token == "A" {
+				s = strings.ToUpper(s)
+			}
+			return s
+		}
+	case "i", "I":
+		if n > 0 && n < 4000 {
+			s := roman(n)
+			if token == "i" {
+				s = strings.ToLower(s)
+			}
+			return s
+		}
+	}
+
+	width := 1
+	if strings.Trim(token, "0") == "1" && strings.HasSuffix(token, "1") {
+		width = len(token)
+	}
+	s := fmt.Sprintf("%0*d", width, n)
+	if groupingSize <= 0 || groupingSep == "" {
+		return s
+	}
+
+	var buf strings.Builder
+	for i, r := range s {
+		if i > 0 && (len(s)-i)%groupingSize == 0 {
+			buf.WriteString(groupingSep)
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// alphabetic returns a, b, ..., z, aa, ab...
+func alphabetic(n int) string {
+	var b []byte
+	for n > 0 {
+		n--
+		b = append([]byte{byte('a' + n%26)}, b...)
+		n /= 26
+	}
+	return string(b)
+}
+
+func roman(n int) string {
+	values := []int{1000, 900, 500, 400, 100, 90, 50, 40, 10, 9, 5, 4, 1}
+	symbols := []string{"M", "CM", "D", "CD", "C", "XC", "L", "XL", "X", "IX", "V", "IV", "I"}
+	var buf strings.Builder
+	for i, v := range values {
+		for n >= v {
+			buf.WriteString(symbols[i])
+			n -= v
+		}
+	}
+	return buf.String()
+}
+
+// formatNumber implements format-number(), with the pattern syntax of
+// java.text.DecimalFormat that XSLT uses
+func formatNumber(v float64, pattern string, df *DecimalFormat) (string, error) {
+	positive, negativePattern, hasNegative := strings.Cut(pattern, string(df.PatternSeparator))
+
+	if math.IsNaN(v) {
+		return df.NaN, nil
+	}
+	negative := v < 0
+	sub := positive
+	if negative {
+		v = -v
+		if hasNegative {
+			sub = negativePattern
+		}
+	}
+
+	p, err := parsePicture(sub, df)
+	if err != nil {
+		return "", err
+	}
+	if negative && !hasNegative {
+		// the negative sub-pattern defaults to the positive one with
+		// a minus sign
+		p.prefix = string(df.MinusSign) + p.prefix
+	}
+	if math.IsInf(v, 0) {
+		return p.prefix + df.Infinity + p.suffix, nil
+	}
+
+	v *= p.multiplier
+	s := strconv.FormatFloat(v, 'f', p.maxFrac, 64)
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	fracPart = strings.TrimRight(fracPart, "0")
+	for len(fracPart) < p.minFrac {
+		fracPart += "0"
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	for len(intPart) < p.minInt {
+		intPart = "0" + intPart
+	}
+
+	var buf strings.Builder
+	buf.WriteString(p.prefix)
+	for i, r := range intPart {
+		if i > 0 && p.grouping > 0 && (len(intPart)-i)%p.grouping == 0 {
+			buf.WriteRune(df.GroupingSeparator)
+		}
+		buf.WriteRune(df.ZeroDigit + (r - '0'))
+	}
+	if fracPart != "" {
+		buf.WriteRune(df.DecimalSeparator)
+		for _, r := range fracPart {
+			buf.WriteRune(df.ZeroDigit + (r - '0'))
+		}
+	}
+	buf.WriteString(p.suffix)
+	return buf.String(), nil
+}
+
+type picture struct {
+	prefix     string
+	suffix     string
+	minInt     int
+	minFrac    int
+	maxFrac    int
+	grouping   int
+	multiplier float64
+}
+
+// parsePicture parses a sub-pattern of format-number()
+func parsePicture(s string, df *DecimalFormat) (*picture, error) {
+	p := &picture{multiplier: 1}
+	rs := []rune(s)
+	isPattern := func(r rune) bool {
+		return r == df.Digit || r == df.ZeroDigit || r == df.DecimalSeparator || r == df.GroupingSeparator
+	}
+
+	i := 0
+	for ; i < len(rs) && !isPattern(rs[i]); i++ {
+		p.prefix += string(rs[i])
+	}
+	lastGroup := -1
+	inFrac := false
+	for ; i < len(rs) && isPattern(rs[i]); i++ {
+		switch r := rs[i]; {
+		case r == df.DecimalSeparator:
+			if inFrac {
+				return nil, fmt.Errorf("%w: invalid format-number() pattern '%s'", ErrInvalidStylesheet, s)
+			}
+			inFrac = true
+			if lastGroup >= 0 {
+				p.grouping = i - lastGroup - 1
+			}
+		case r == df.GroupingSeparator:
+			lastGroup = i
+		case inFrac && r == df.ZeroDigit:
+			p.minFrac++
+			p.maxFrac++
+		case inFrac:
+			p.maxFrac++
+		case r == df.ZeroDigit:
+			p.minInt++
+		}
+	}
+	if !inFrac && lastGroup >= 0 {
+		p.grouping = i - lastGroup - 1
+	}
+	for ; i < len(rs); i++ {
+		p.suffix += string(rs[i])
+	}
+
+	for _, r := range p.prefix + p.suffix {
+		switch r {
+		case df.Percent:
+			p.multiplier = 100
+		case df.PerMille:
+			p.multiplier = 1000
+		}
+	}
+	return p, nil
+}
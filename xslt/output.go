@@ -0,0 +1,353 @@
+package xslt
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/encoding"
+	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/xpath"
+	enc "golang.org/x/text/encoding"
+)
+
+// Write serializes result, which was returned by Transform, with the
+// output options of the stylesheet
+func (s *Stylesheet) Write(out io.Writer, result *helium.Document) error {
+	if debug.Enabled {
+		g := debug.IPrintf("START xslt.Stylesheet.Write")
+		defer g.IRelease("END xslt.Stylesheet.Write")
+	}
+
+	o := s.output
+	method := s.method(result)
+	if name := o.Encoding; name != "" && !strings.EqualFold(name, "utf-8") {
+		e := encoding.Load(name)
+		if e == nil {
+			return fmt.Errorf("xslt: unsupported output encoding '%s'", name)
+		}
+		var encoder *enc.Encoder
+		if method == "text" {
+			encoder = enc.ReplaceUnsupported(e.NewEncoder())
+		} else {
+			// characters that the encoding cannot represent are
+			// written as character references
+			encoder = enc.HTMLEscapeUnsupported(e.NewEncoder())
+		}
+		w := encoder.Writer(out)
+		if c, ok := w.(io.Closer); ok {
+			defer c.Close()
+		}
+		out = w
+	}
+
+	switch method {
+	case "text":
+		return writeText(out, result)
+	case "html":
+		d := helium.Dumper{HTML: true, OmitXMLDeclaration: true, Format: o.Indent != "no"}
+		return d.DumpDoc(out, result)
+	}
+	d := helium.Dumper{OmitXMLDeclaration: o.OmitXMLDeclaration, Format: o.Indent == "yes"}
+	return d.DumpDoc(out, result)
+}
+
+// method returns the output method of result. Without xsl:output, it
+// is html when the document element is html, and xml otherwise.
+func (s *Stylesheet) method(result *helium.Document) string {
+	if s.output.Method != "" {
+		return s.output.Method
+	}
+	for n := result.FirstChild(); n != nil; n = n.NextSibling() {
+		switch n.Type() {
+		case helium.ElementNode:
+			local, uri := xpath.ExpandedName(n)
+			if uri == "" && strings.EqualFold(local, "html") {
+				return "html"
+			}
+			return "xml"
+		case helium.TextNode:
+			if !isWhitespace(n) {
+				return "xml"
+			}
+		}
+	}
+	return "xml"
+}
+
+// writeText writes the text nodes of n
+func writeText(out io.Writer, n helium.Node) error {
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch c.Type() {
+		case helium.TextNode, helium.CDATASectionNode:
+			if _, err := out.Write(c.Content()); err != nil {
+				return err
+			}
+		case helium.ElementNode:
+			if err := writeText(out, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func docOf(n helium.Node) *helium.Document {
+	if doc, ok := n.(*helium.Document); ok {
+		return doc
+	}
+	return n.OwnerDocument()
+}
+
+// addText adds s to out, merging it with the preceding text. In the
+// elements of cdata-section-elements, it is added as a CDATA section.
+func (t *transformer) addText(out helium.Node, s string) error {
+	if s == "" {
+		return nil
+	}
+
+	doc := docOf(out)
+	if e, ok := out.(*helium.Element); ok && doc == t.result && len(t.ss.cdata) > 0 {
+		if _, ok := t.ss.cdata[expandName(nameOf(e))]; ok {
+			if last, ok := e.LastChild().(*helium.CDATASection); ok {
+				return last.AddContent([]byte(s))
+			}
+			c, err := doc.CreateCDATASection([]byte(s))
+			if err != nil {
+				return err
+			}
+			return e.AddChild(c)
+		}
+	}
+
+	text, err := doc.CreateText([]byte(s))
+	if err != nil {
+		return err
+	}
+	return out.AddChild(text)
+}
+
+func nameOf(n helium.Node) (uri, local string) {
+	local, uri = xpath.ExpandedName(n)
+	return uri, local
+}
+
+// addElement adds an element to out, and declares its namespace if it
+// is not in scope
+func (t *transformer) addElement(out helium.Node, prefix, local, uri string) (*helium.Element, error) {
+	e, err := docOf(out).CreateElement(local)
+	if err != nil {
+		return nil, err
+	}
+	if err := out.AddChild(e); err != nil {
+		return nil, err
+	}
+	if uri != "" {
+		if err := e.SetNamespace(prefix, uri, true); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.declare(e, prefix, uri); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// declare declares the namespace uri with prefix on e, unless it is
+// already in scope
+func (t *transformer) declare(e *helium.Element, prefix, uri string) error {
+	if prefix == helium.XMLPrefix {
+		return nil
+	}
+	cur, ok := lookupNamespace(e, prefix)
+	switch {
+	case ok && cur == uri:
+		return nil
+	case uri == "" && (!ok || prefix != ""):
+		// prefixes cannot be undeclared
+		return nil
+	}
+	return e.SetNamespace(prefix, uri)
+}
+
+// lookupNamespace returns the namespace URI that prefix is bound to in
+// the scope of n, in the result tree
+func lookupNamespace(n helium.Node, prefix string) (string, bool) {
+	for ; n != nil; n = n.Parent() {
+		e, ok := n.(*helium.Element)
+		if !ok {
+			continue
+		}
+		for _, ns := range e.Namespaces() {
+			if ns.Prefix() == prefix {
+				return ns.URI(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// addAttribute sets an attribute of out. It is ignored if out is not an
+// element, or if children were already added to it.
+func (t *transformer) addAttribute(out helium.Node, prefix, local, uri, value string) error {
+	e, ok := out.(*helium.Element)
+	if !ok || e.FirstChild() != nil {
+		return nil
+	}
+	if uri == "" {
+		return e.SetAttributeNS(local, value, nil)
+	}
+
+	prefix, err := t.attributePrefix(e, prefix, uri)
+	if err != nil {
+		return err
+	}
+	ns, err := docOf(e).CreateNamespace(prefix, uri)
+	if err != nil {
+		return err
+	}
+	return e.SetAttributeNS(local, value, ns)
+}
+
+// attributePrefix returns a prefix for the namespace uri of an
+// attribute of e, which needs one even if it is the default namespace
+func (t *transformer) attributePrefix(e *helium.Element, prefix, uri string) (string, error) {
+	if uri == helium.XMLNamespace {
+		return helium.XMLPrefix, nil
+	}
+	if prefix != "" {
+		cur, ok := lookupNamespace(e, prefix)
+		if ok && cur == uri {
+			return prefix, nil
+		}
+		if !ok {
+			return prefix, e.SetNamespace(prefix, uri)
+		}
+	}
+
+	// a prefix that is already bound to uri
+	for n := helium.Node(e); n != nil; n = n.Parent() {
+		pe, ok := n.(*helium.Element)
+		if !ok {
+			continue
+		}
+		for _, ns := range pe.Namespaces() {
+			if p := ns.Prefix(); p != "" && ns.URI() == uri {
+				if cur, _ := lookupNamespace(e, p); cur == uri {
+					return p, nil
+				}
+			}
+		}
+	}
+
+	if prefix == "" {
+		prefix = "ns"
+	}
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s%d", prefix, i)
+		if _, ok := lookupNamespace(e, candidate); !ok {
+			return candidate, e.SetNamespace(candidate, uri)
+		}
+	}
+}
+
+// qname returns the prefix, the local name and the namespace URI of an
+// element or an attribute of a source tree
+func qname(n helium.Node) (prefix, local, uri string) {
+	local, uri = xpath.ExpandedName(n)
+	if i := strings.IndexByte(n.Name(), ':'); i > -1 {
+		prefix = n.Name()[:i]
+	}
+	return prefix, local, uri
+}
+
+// copyElement adds a copy of e to out, with its namespace nodes but
+// without its attributes and children
+func (t *transformer) copyElement(out helium.Node, e *helium.Element) (*helium.Element, error) {
+	prefix, local, uri := qname(e)
+	ret, err := t.addElement(out, prefix, local, uri)
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range e.NamespaceNodes() {
+		if err := t.declare(ret, ns.Prefix(), ns.URI()); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// copyNode adds a deep copy of n to out
+func (t *transformer) copyNode(out, n helium.Node) error {
+	switch n := n.(type) {
+	case *helium.Document:
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			if err := t.copyNode(out, c); err != nil {
+				return err
+			}
+		}
+	case *helium.Element:
+		e, err := t.copyElement(out, n)
+		if err != nil {
+			return err
+		}
+		for _, attr := range n.Attributes() {
+			if err := t.copyNode(e, attr); err != nil {
+				return err
+			}
+		}
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			if err := t.copyNode(e, c); err != nil {
+				return err
+			}
+		}
+	case *helium.Attribute:
+		prefix, local, uri := qname(n)
+		return t.addAttribute(out, prefix, local, uri, n.Value())
+	case *helium.Text, *helium.CDATASection:
+		return t.addText(out, string(n.Content()))
+	case *helium.Comment:
+		c, err := docOf(out).CreateComment(n.Content())
+		if err != nil {
+			return err
+		}
+		return out.AddChild(c)
+	case *helium.ProcessingInstruction:
+		pi, err := docOf(out).CreatePI(n.Target(), n.Data())
+		if err != nil {
+			return err
+		}
+		return out.AddChild(pi)
+	case *helium.NamespaceDecl:
+		if e, ok := out.(*helium.Element); ok {
+			return t.declare(e, n.Prefix(), n.URI())
+		}
+	case *helium.EntityRef:
+		content := entityContent(n)
+		if content == nil {
+			return t.addText(out, string(n.Content()))
+		}
+		for _, c := range content {
+			if err := t.copyNode(out, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// entityContent returns the nodes parsed from the content of the entity
+// that ref references, which stand in for the reference as they do in
+// the data model of XPath. It is nil if the content was not parsed.
+func entityContent(ref *helium.EntityRef) xpath.NodeSet {
+	ent := ref.FirstChild()
+	if ent == nil {
+		return nil
+	}
+	var ret xpath.NodeSet
+	for c := ent.FirstChild(); c != nil; c = c.NextSibling() {
+		ret = append(ret, c)
+	}
+	return ret
+}
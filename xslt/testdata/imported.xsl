@@ -0,0 +1,10 @@
+<?xml version="1.0"?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+  <xsl:template match="item">
+    <imported><xsl:value-of select="."/></imported>
+  </xsl:template>
+
+  <xsl:template name="footer">
+    <footer>imported</footer>
+  </xsl:template>
+</xsl:stylesheet>
@@ -0,0 +1,22 @@
+<?xml version="1.0"?>
+<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+  <xsl:import href="imported.xsl"/>
+  <xsl:include href="included.xsl"/>
+  <xsl:output method="xml" omit-xml-declaration="yes"/>
+
+  <xsl:template match="item">
+    <main><xsl:apply-imports/></main>
+  </xsl:template>
+
+  <xsl:template match="/">
+    <result>
+      <xsl:apply-templates select="doc/item"/>
+      <xsl:call-template name="footer"/>
+      <xsl:value-of select="document('data.xml')/data/@title"/>
+      <xsl:text>|</xsl:text>
+      <xsl:value-of select="count(document('')/xsl:stylesheet/xsl:template)"/>
+      <xsl:text>|</xsl:text>
+      <xsl:value-of select="document('data.xml#element(/1/2)')"/>
+    </result>
+  </xsl:template>
+</xsl:stylesheet>
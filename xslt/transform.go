@@ -0,0 +1,407 @@
+package xslt
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/internal/debug"
+	"github.com/lestrrat/helium/xpath"
+)
+
+// maxDepth is the maximum nesting of template calls
+const maxDepth = 3000
+
+var childNodes = xpath.MustCompile("node()")
+
+// Transform applies the stylesheet to doc, and returns the result
+// tree. params holds the values of the global parameters, keyed and
+// typed like the variables of xpath.Context.
+//
+// The whitespace-only text nodes that xsl:strip-space applies to are
+// left out of a copy of doc, which is not modified.
+func (s *Stylesheet) Transform(doc *helium.Document, params map[string]interface{}) (*helium.Document, error) {
+	if debug.Enabled {
+		g := debug.IPrintf("START xslt.Stylesheet.Transform '%s'", doc.URL())
+		defer g.IRelease("END xslt.Stylesheet.Transform")
+	}
+
+	var standalone helium.DocumentStandaloneType = helium.StandaloneImplicitNo
+	switch s.output.Standalone {
+	case "yes":
+		standalone = helium.StandaloneExplicitYes
+	case "no":
+		standalone = helium.StandaloneExplicitNo
+	}
+	version := s.output.Version
+	if version == "" || s.output.Method == "html" {
+		version = "1.0"
+	}
+
+	t := &transformer{
+		ss:      s,
+		result:  helium.NewDocument(version, s.output.Encoding, standalone),
+		params:  params,
+		globals: make(map[string]interface{}),
+		keys:    make(map[keyIndex]map[string]xpath.NodeSet),
+		docs:    make(map[string]*helium.Document),
+		ids:     make(map[helium.Node]int),
+	}
+	t.functions = t.functionLibrary()
+	src, err := t.stripSpace(doc)
+	if err != nil {
+		return nil, err
+	}
+	t.src = src
+	if src.URL() != "" {
+		t.docs[src.URL()] = src
+	}
+
+	f := &frame{node: src, pos: 1, size: 1, out: t.result}
+	if err := t.evalGlobals(f); err != nil {
+		return nil, err
+	}
+	if err := t.applyTemplates(xpath.NodeSet{src}, "", nil, f); err != nil {
+		return nil, err
+	}
+
+	if o := s.output; o.DoctypeSystem != "" || o.DoctypePublic != "" && s.method(t.result) == "html" {
+		if root := t.result.DocumentElement(); root != nil {
+			if _, err := t.result.CreateInternalSubset(root.Name(), o.DoctypePublic, o.DoctypeSystem); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t.result, nil
+}
+
+// TransformTo applies the stylesheet to doc like Transform, and writes
+// the result to out like Write
+func (s *Stylesheet) TransformTo(out io.Writer, doc *helium.Document, params map[string]interface{}) error {
+	result, err := s.Transform(doc, params)
+	if err != nil {
+		return err
+	}
+	return s.Write(out, result)
+}
+
+// evalGlobals evaluates the global variables and parameters. They may
+// refer to each other regardless of their order, so the ones that use
+// variables that are not evaluated yet are tried again.
+func (t *transformer) evalGlobals(f *frame) error {
+	pending := t.ss.globals
+	for len(pending) > 0 {
+		var next []*variable
+		var lastErr error
+		for _, v := range pending {
+			if value, ok := t.params[v.name]; ok && v.param {
+				t.globals[v.name] = value
+				continue
+			}
+			value, err := t.value(v, f)
+			if errors.Is(err, xpath.ErrUndefinedVariable) {
+				next = append(next, v)
+				lastErr = err
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			t.globals[v.name] = value
+		}
+		if len(next) == len(pending) {
+			return lastErr
+		}
+		pending = next
+	}
+	return nil
+}
+
+// run executes the instructions of body. The variables that they bind
+// are not visible to the caller.
+func (t *transformer) run(body []instruction, f *frame) error {
+	local := *f
+	for _, ins := range body {
+		if err := ins.execute(t, &local); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runString executes body, and returns the string-value of the
+// results, for the instructions whose content is text
+func (t *transformer) runString(body []instruction, f *frame) (string, error) {
+	if len(body) == 0 {
+		return "", nil
+	}
+	tmp := helium.CreateDocument()
+	local := *f
+	local.out = tmp
+	if err := t.run(body, &local); err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	for n := tmp.FirstChild(); n != nil; n = n.NextSibling() {
+		if n.Type() == helium.TextNode {
+			buf.Write(n.Content())
+		}
+	}
+	return buf.String(), nil
+}
+
+// variables returns the variables that are visible in s
+func (t *transformer) variables(s *scope) map[string]interface{} {
+	if s == nil {
+		return t.globals
+	}
+	if s.vars == nil {
+		parent := t.variables(s.parent)
+		s.vars = make(map[string]interface{}, len(parent)+1)
+		for k, v := range parent {
+			s.vars[k] = v
+		}
+		s.vars[s.name] = s.value
+	}
+	return s.vars
+}
+
+// eval evaluates e in the context f
+func (t *transformer) eval(e *expression, f *frame) (*xpath.Object, error) {
+	ctx := xpath.Context{
+		Namespaces: e.st.ns,
+		Variables:  t.variables(f.vars),
+		Functions:  t.functions,
+		Position:   f.pos,
+		Size:       f.size,
+	}
+
+	current, st := t.current, t.st
+	t.current, t.st = f.node, e.st
+	o, err := e.x.Evaluate(&ctx, f.node)
+	t.current, t.st = current, st
+	if err != nil {
+		return nil, wrapError(e.node, err)
+	}
+	return o, nil
+}
+
+func (t *transformer) evalNodes(e *expression, f *frame) (xpath.NodeSet, error) {
+	o, err := t.eval(e, f)
+	if err != nil {
+		return nil, err
+	}
+	if o.Type() != xpath.NodeSetType {
+		return nil, errorf(e.node, xpath.ErrInvalidType, "'%s' is not a node-set", e.x)
+	}
+	return o.NodeSet(), nil
+}
+
+// match reports if n matches p
+func (t *transformer) match(p *pattern, n helium.Node) (bool, error) {
+	ctx := xpath.Context{
+		Namespaces: p.st.ns,
+		Variables:  t.globals,
+		Functions:  t.functions,
+	}
+
+	current, st := t.current, t.st
+	t.current, t.st = n, p.st
+	ok, err := p.p.Match(&ctx, n)
+	t.current, t.st = current, st
+	if err != nil {
+		return false, wrapError(p.node, err)
+	}
+	return ok, nil
+}
+
+// value returns the value of a variable or a parameter: the value of
+// its select expression, or the result tree fragment of its content
+func (t *transformer) value(v *variable, f *frame) (interface{}, error) {
+	if v.sel != nil {
+		return t.eval(v.sel, f)
+	}
+	if len(v.body) == 0 {
+		return "", nil
+	}
+
+	rtf := helium.CreateDocument()
+	local := *f
+	local.out = rtf
+	if err := t.run(v.body, &local); err != nil {
+		return nil, err
+	}
+	return rtf, nil
+}
+
+// applyTemplates applies the template rules of mode to each of nodes
+func (t *transformer) applyTemplates(nodes xpath.NodeSet, mode string, params map[string]interface{}, f *frame) error {
+	local := *f
+	local.size = len(nodes)
+	for i, n := range nodes {
+		local.node = n
+		local.pos = i + 1
+		tmpl, err := t.findTemplate(n, mode, nil)
+		if err != nil {
+			return err
+		}
+		if tmpl == nil {
+			err = t.builtin(mode, &local)
+		} else {
+			err = t.callTemplate(tmpl, &local, tmpl, params)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findTemplate returns the template rule of mode for n, among the ones
+// that filter accepts if it is not nil
+func (t *transformer) findTemplate(n helium.Node, mode string, filter func(*template) bool) (*template, error) {
+	for _, tmpl := range t.ss.modes[mode] {
+		if filter != nil && !filter(tmpl) {
+			continue
+		}
+		ok, err := t.match(tmpl.match, n)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return tmpl, nil
+		}
+	}
+	return nil, nil
+}
+
+// callTemplate instantiates tmpl in the context of f. rule becomes the
+// current template rule.
+func (t *transformer) callTemplate(tmpl *template, f *frame, rule *template, params map[string]interface{}) error {
+	t.depth++
+	defer func() { t.depth-- }()
+	if t.depth > maxDepth {
+		return errorf(tmpl.node, ErrRecursion, "more than %d nested calls", maxDepth)
+	}
+
+	local := *f
+	local.template = rule
+	local.vars = nil
+	for _, p := range tmpl.params {
+		value, ok := params[p.name]
+		if !ok {
+			var err error
+			if value, err = t.value(p, &local); err != nil {
+				return err
+			}
+		}
+		local.vars = &scope{name: p.name, value: value, parent: local.vars}
+	}
+	return t.run(tmpl.body, &local)
+}
+
+// builtin applies the built-in template rules to the current node
+func (t *transformer) builtin(mode string, f *frame) error {
+	switch n := f.node.(type) {
+	case *helium.Document, *helium.Element:
+		children, err := childNodes.Find(nil, n)
+		if err != nil {
+			return err
+		}
+		return t.applyTemplates(children, mode, nil, f)
+	case *helium.Text, *helium.CDATASection:
+		return t.addText(f.out, string(n.Content()))
+	case *helium.Attribute:
+		return t.addText(f.out, n.Value())
+	case *helium.EntityRef:
+		// the nodes of the entity are not part of the tree that the
+		// patterns match against, so only their text is output
+		return t.addText(f.out, xpath.StringValue(n))
+	}
+	return nil
+}
+
+// stripSpace returns a copy of doc without the whitespace-only text
+// nodes that xsl:strip-space applies to, or doc itself if there are
+// none. doc is not modified.
+func (t *transformer) stripSpace(doc *helium.Document) (*helium.Document, error) {
+	if len(t.ss.spaces) == 0 {
+		return doc, nil
+	}
+	root := doc.DocumentElement()
+	if root == nil {
+		return doc, nil
+	}
+
+	stripped := make(map[helium.Node]bool)
+	t.stripElement(root, false, stripped)
+	if len(stripped) == 0 {
+		return doc, nil
+	}
+	return doc.Copy(func(n helium.Node) bool {
+		return stripped[n]
+	})
+}
+
+// stripElement adds the whitespace-only text nodes below e that are
+// stripped to stripped
+func (t *transformer) stripElement(e *helium.Element, preserve bool, stripped map[helium.Node]bool) {
+	if v, ok := attribute(e, "xml:space"); ok {
+		preserve = v == "preserve"
+	}
+	strip := !preserve && t.stripped(e)
+
+	for n := e.FirstChild(); n != nil; n = n.NextSibling() {
+		switch n := n.(type) {
+		case *helium.Element:
+			t.stripElement(n, preserve, stripped)
+		case *helium.Text:
+			if strip && isWhitespace(n) {
+				stripped[n] = true
+			}
+		}
+	}
+}
+
+// stripped reports if the whitespace-only children of e are stripped,
+// after the rule that matches e best
+func (t *transformer) stripped(e *helium.Element) bool {
+	local, uri := xpath.ExpandedName(e)
+	var best *spaceRule
+	for _, r := range t.ss.spaces {
+		if !r.anyNS && r.uri != uri || r.local != "*" && r.local != local {
+			continue
+		}
+		if best == nil || r.prec > best.prec || r.prec == best.prec && r.priority >= best.priority {
+			best = r
+		}
+	}
+	return best != nil && best.strip
+}
+
+// resolveURI resolves the URI reference ref against base
+func resolveURI(ref, base string) string {
+	if base == "" {
+		return ref
+	}
+	r, err := url.Parse(ref)
+	if err != nil || r.IsAbs() {
+		return ref
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	if !b.IsAbs() && !path.IsAbs(b.Path) {
+		// a relative file name, like the ones that ParseFile records
+		if r.Path == "" || path.IsAbs(r.Path) {
+			return ref
+		}
+		return path.Join(path.Dir(b.Path), r.Path)
+	}
+	return b.ResolveReference(r).String()
+}
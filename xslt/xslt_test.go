@@ -0,0 +1,407 @@
+package xslt_test
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/helium"
+	"github.com/lestrrat/helium/xslt"
+	"github.com/stretchr/testify/assert"
+)
+
+const stylesheetHeader = `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output omit-xml-declaration="yes"/>
+`
+
+// transform compiles the stylesheet src, applies it to the document
+// input, and returns the serialized result
+func transform(t *testing.T, src, input string, params map[string]interface{}) (string, error) {
+	t.Helper()
+	doc, err := helium.Parse([]byte(src))
+	if !assert.NoError(t, err, "Parse (stylesheet) should succeed") {
+		return "", err
+	}
+	ss, err := xslt.Compile(doc)
+	if err != nil {
+		return "", err
+	}
+	in, err := helium.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse (input) should succeed") {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := ss.TransformTo(&buf, in, params); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func TestTransform(t *testing.T) {
+	const input = `<list><item n="3">c</item><item n="1">a</item><item n="2">b</item></list>`
+	tests := []struct {
+		name     string
+		body     string
+		params   map[string]interface{}
+		expected string
+	}{
+		{
+			name: "sort and position",
+			body: `<xsl:template match="/list">
+  <out><xsl:for-each select="item"><xsl:sort select="@n" data-type="number" order="descending"/><i pos="{position()}"><xsl:value-of select="."/></i></xsl:for-each></out>
+</xsl:template>`,
+			expected: `<out><i pos="1">c</i><i pos="2">b</i><i pos="3">a</i></out>`,
+		},
+		{
+			name: "modes and priorities",
+			body: `<xsl:template match="/"><out><xsl:apply-templates select="list/item" mode="m"/></out></xsl:template>
+<xsl:template match="item" mode="m"><x><xsl:value-of select="."/></x></xsl:template>
+<xsl:template match="item[@n = 1]" mode="m"><first/></xsl:template>
+<xsl:template match="item"><wrong/></xsl:template>`,
+			expected: `<out><x>c</x><first/><x>b</x></out>`,
+		},
+		{
+			name: "params and variables",
+			body: `<xsl:param name="greeting" select="'hello'"/>
+<xsl:variable name="total" select="sum(//@n)"/>
+<xsl:template match="/">
+  <out total="{$total}"><xsl:call-template name="say"><xsl:with-param name="who" select="'world'"/></xsl:call-template></out>
+</xsl:template>
+<xsl:template name="say"><xsl:param name="who">nobody</xsl:param><xsl:value-of select="concat($greeting, ' ', $who)"/></xsl:template>`,
+			params:   map[string]interface{}{"greeting": "bye"},
+			expected: `<out total="6">bye world</out>`,
+		},
+		{
+			name: "result tree fragments",
+			body: `<xsl:template match="/">
+  <xsl:variable name="rtf"><a>1</a><a>2</a></xsl:variable>
+  <out><xsl:value-of select="$rtf"/>|<xsl:copy-of select="$rtf"/></out>
+</xsl:template>`,
+			expected: `<out>12|<a>1</a><a>2</a></out>`,
+		},
+		{
+			name: "keys",
+			body: `<xsl:key name="byN" match="item" use="@n"/>
+<xsl:template match="/"><out><xsl:value-of select="key('byN', '2')"/><xsl:value-of select="count(key('byN', //@n))"/></out></xsl:template>`,
+			expected: `<out>b3</out>`,
+		},
+		{
+			name: "choose, if and copy",
+			body: `<xsl:template match="item">
+  <xsl:choose>
+    <xsl:when test="@n = 1"><xsl:copy><xsl:copy-of select="@n"/>one</xsl:copy></xsl:when>
+    <xsl:otherwise><xsl:if test=". = 'c'"><c/></xsl:if></xsl:otherwise>
+  </xsl:choose>
+</xsl:template>
+<xsl:template match="/list"><out><xsl:apply-templates/></out></xsl:template>`,
+			expected: `<out><c/><item n="1">one</item></out>`,
+		},
+		{
+			name: "computed nodes",
+			body: `<xsl:template match="/">
+  <xsl:element name="{name(*)}" namespace="urn:x"><xsl:attribute name="p:a" namespace="urn:p">v</xsl:attribute><xsl:comment>c</xsl:comment><xsl:processing-instruction name="pi">d</xsl:processing-instruction></xsl:element>
+</xsl:template>`,
+			expected: `<list xmlns="urn:x" xmlns:p="urn:p" p:a="v"><!--c--><?pi d?></list>`,
+		},
+		{
+			name: "numbering",
+			body: `<xsl:template match="item"><xsl:number/>.<xsl:number value="position()" format="a"/>.<xsl:number value="position() * 1000 + 4" format="I" grouping-separator="," grouping-size="3"/>.<xsl:number value="position()" format="01"/><xsl:text> </xsl:text></xsl:template>
+<xsl:template match="/list"><out><xsl:apply-templates/></out></xsl:template>`,
+			expected: `<out>1.a.MIV.01 2.b.MMIV.02 3.c.MMMIV.03 </out>`,
+		},
+		{
+			name: "format-number",
+			body: `<xsl:decimal-format name="eu" decimal-separator="," grouping-separator="."/>
+<xsl:template match="/"><out><xsl:value-of select="format-number(1234.5, '#,##0.00')"/>|<xsl:value-of select="format-number(1234.5, '#.##0,0', 'eu')"/>|<xsl:value-of select="format-number(0.25, '0%')"/>|<xsl:value-of select="format-number(-3, '0;(0)')"/></out></xsl:template>`,
+			expected: `<out>1,234.50|1.234,5|25%|(3)</out>`,
+		},
+		{
+			name: "strip space and literal namespaces",
+			body: `<xsl:strip-space elements="*"/>
+<xsl:template match="/"><x:out xmlns:x="urn:x" xmlns:unused="urn:unused" xsl:exclude-result-prefixes="unused"><xsl:copy-of select="/"/></x:out></xsl:template>`,
+			expected: `<x:out xmlns:x="urn:x"><list><item n="3">c</item><item n="1">a</item><item n="2">b</item></list></x:out>`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := transform(t, stylesheetHeader+tc.body+`</xsl:stylesheet>`, input, tc.params)
+			if !assert.NoError(t, err, "transform should succeed") {
+				return
+			}
+			assert.Equal(t, tc.expected, out, "output should match")
+		})
+	}
+}
+
+func TestEntityReference(t *testing.T) {
+	const input = `<!DOCTYPE a [<!ENTITY e "ENT"><!ENTITY m "<b>&e;</b>">]><a>x&e;y<c>&m;</c></a>`
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name:     "built-in templates",
+			body:     `<xsl:template match="/"><out><xsl:apply-templates/></out></xsl:template>`,
+			expected: `<out>xENTyENT</out>`,
+		},
+		{
+			name:     "copy-of",
+			body:     `<xsl:template match="/"><xsl:copy-of select="a"/></xsl:template>`,
+			expected: `<a>xENTy<c><b>ENT</b></c></a>`,
+		},
+		{
+			name:     "value-of",
+			body:     `<xsl:template match="/"><out><xsl:value-of select="a"/></out></xsl:template>`,
+			expected: `<out>xENTyENT</out>`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := transform(t, stylesheetHeader+tc.body+`</xsl:stylesheet>`, input, nil)
+			if !assert.NoError(t, err, "transform should succeed") {
+				return
+			}
+			assert.Equal(t, tc.expected, out, "output should match")
+		})
+	}
+}
+
+func TestImports(t *testing.T) {
+	doc, err := helium.NewParser().ParseFile(filepath.Join("testdata", "main.xsl"))
+	if !assert.NoError(t, err, "ParseFile should succeed") {
+		return
+	}
+	ss, err := xslt.Compile(doc)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+	in, err := helium.Parse([]byte(`<doc><item>x</item><item>y</item></doc>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, ss.TransformTo(&buf, in, nil), "TransformTo should succeed") {
+		return
+	}
+	const expected = `<result><main><imported>x</imported></main><main><imported>y</imported></main><footer>included</footer>external|2|second</result>`
+	assert.Equal(t, expected, strings.TrimSpace(buf.String()), "output should match")
+}
+
+func TestLoader(t *testing.T) {
+	const module = `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:template match="/"><loaded/></xsl:template>
+</xsl:stylesheet>`
+
+	var loaded []string
+	c := xslt.NewCompiler()
+	c.SetLoader(func(uri string) (*helium.Document, error) {
+		loaded = append(loaded, uri)
+		return helium.Parse([]byte(module))
+	})
+
+	doc, err := helium.Parse([]byte(stylesheetHeader + `<xsl:include href="module.xsl"/></xsl:stylesheet>`))
+	if !assert.NoError(t, err, "Parse should succeed") {
+		return
+	}
+	ss, err := c.Compile(doc)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+	assert.Equal(t, []string{"module.xsl"}, loaded, "the loader should be called")
+
+	result, err := ss.Transform(doc, nil)
+	if !assert.NoError(t, err, "Transform should succeed") {
+		return
+	}
+	assert.Equal(t, "loaded", result.DocumentElement().Name(), "the included template should apply")
+}
+
+func TestOutput(t *testing.T) {
+	const input = `<doc><p>a &amp; b</p></doc>`
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			name: "xml",
+			body: `<xsl:output method="xml" encoding="ISO-8859-1" cdata-section-elements="p"/>
+<xsl:template match="/"><r><p><xsl:value-of select="doc/p"/></p><q>&#233;&#19968;</q></r></xsl:template>`,
+			expected: "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<r><p><![CDATA[a & b]]></p><q>\xe9&#19968;</q></r>",
+		},
+		{
+			name: "indent",
+			body: `<xsl:output indent="yes" omit-xml-declaration="yes"/>
+<xsl:template match="/"><r><a/><b/></r></xsl:template>`,
+			expected: "<r>\n  <a/>\n  <b/>\n</r>",
+		},
+		{
+			name:     "html",
+			body:     `<xsl:template match="/"><html><body><br/><p><xsl:value-of select="doc/p"/></p></body></html></xsl:template>`,
+			expected: "<html>\n  <body>\n    <br>\n    <p>a &amp; b</p>\n  </body>\n</html>",
+		},
+		{
+			name: "text",
+			body: `<xsl:output method="text"/>
+<xsl:template match="/">value: <xsl:value-of select="doc/p"/></xsl:template>`,
+			expected: "value: a & b",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			src := `<xsl:stylesheet version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">` + tc.body + `</xsl:stylesheet>`
+			out, err := transform(t, src, input, nil)
+			if !assert.NoError(t, err, "transform should succeed") {
+				return
+			}
+			assert.Equal(t, tc.expected, out, "output should match")
+		})
+	}
+}
+
+func TestStripSpace(t *testing.T) {
+	const input = `<!DOCTYPE doc [<!ATTLIST item key ID #IMPLIED>]>
+<doc>
+  <item key="a"> </item>
+  <pre xml:space="preserve"> <item key="b"/> </pre>
+</doc>`
+	const src = stylesheetHeader + `<xsl:strip-space elements="*"/>
+<xsl:template match="/"><out n="{count(//text())}"><xsl:copy-of select="id('b')"/></out></xsl:template>
+</xsl:stylesheet>`
+
+	sdoc, err := helium.Parse([]byte(src))
+	if !assert.NoError(t, err, "Parse (stylesheet) should succeed") {
+		return
+	}
+	ss, err := xslt.Compile(sdoc)
+	if !assert.NoError(t, err, "Compile should succeed") {
+		return
+	}
+	doc, err := helium.Parse([]byte(input))
+	if !assert.NoError(t, err, "Parse (input) should succeed") {
+		return
+	}
+	before, err := doc.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, ss.TransformTo(&buf, doc, nil), "TransformTo should succeed") {
+		return
+	}
+	if !assert.Equal(t, `<out n="2"><item key="b"/></out>`, strings.TrimSpace(buf.String()), "whitespace is stripped, except where it is preserved") {
+		return
+	}
+
+	after, err := doc.XMLString()
+	if !assert.NoError(t, err, "XMLString should succeed") {
+		return
+	}
+	if !assert.Equal(t, before, after, "the input is not modified") {
+		return
+	}
+}
+
+func TestSimplified(t *testing.T) {
+	const src = `<html xsl:version="1.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform"><p><xsl:value-of select="/doc"/></p></html>`
+	out, err := transform(t, src, `<doc>text</doc>`, nil)
+	if !assert.NoError(t, err, "transform should succeed") {
+		return
+	}
+	assert.Equal(t, "<html>\n  <p>text</p>\n</html>", out, "output should match")
+}
+
+func TestForwardsCompatible(t *testing.T) {
+	const header = `<xsl:stylesheet version="2.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform">
+<xsl:output omit-xml-declaration="yes"/>
+`
+	t.Run("fallback", func(t *testing.T) {
+		out, err := transform(t, header+`<xsl:unknown-declaration/>
+<xsl:template match="/"><out><xsl:unknown select="x"><xsl:fallback>fallback</xsl:fallback></xsl:unknown></out></xsl:template></xsl:stylesheet>`, `<doc/>`, nil)
+		if !assert.NoError(t, err, "transform should succeed") {
+			return
+		}
+		assert.Equal(t, `<out>fallback</out>`, out, "the fallback should be instantiated")
+	})
+	t.Run("no fallback", func(t *testing.T) {
+		const src = header + `<xsl:template match="/"><out><xsl:apply-templates/></out></xsl:template>
+<xsl:template match="other"><xsl:unknown/></xsl:template></xsl:stylesheet>`
+		out, err := transform(t, src, `<doc/>`, nil)
+		if !assert.NoError(t, err, "an instruction that is not executed is not an error") {
+			return
+		}
+		assert.Equal(t, `<out/>`, out, "the output should be produced")
+
+		_, err = transform(t, src, `<other/>`, nil)
+		assert.True(t, errors.Is(err, xslt.ErrInvalidStylesheet), "error should be ErrInvalidStylesheet")
+	})
+	t.Run("literal result element", func(t *testing.T) {
+		out, err := transform(t, `<out xsl:version="1.1" xmlns:xsl="http://www.w3.org/1999/XSL/Transform"><xsl:unknown><xsl:fallback>fallback</xsl:fallback></xsl:unknown></out>`, `<doc/>`, nil)
+		if !assert.NoError(t, err, "transform should succeed") {
+			return
+		}
+		assert.Contains(t, out, `<out>fallback</out>`, "the fallback should be instantiated")
+	})
+	t.Run("version 1.0", func(t *testing.T) {
+		_, err := transform(t, stylesheetHeader+`<xsl:template match="/"><xsl:unknown><xsl:fallback/></xsl:unknown></xsl:template></xsl:stylesheet>`, `<doc/>`, nil)
+		assert.True(t, errors.Is(err, xslt.ErrInvalidStylesheet), "error should be ErrInvalidStylesheet")
+
+		_, err = transform(t, stylesheetHeader+`<xsl:unknown/></xsl:stylesheet>`, `<doc/>`, nil)
+		assert.True(t, errors.Is(err, xslt.ErrInvalidStylesheet), "error should be ErrInvalidStylesheet")
+	})
+}
+
+func TestErrors(t *testing.T) {
+	t.Run("not a stylesheet", func(t *testing.T) {
+		_, err := transform(t, `<doc/>`, `<doc/>`, nil)
+		assert.True(t, errors.Is(err, xslt.ErrNotStylesheet), "error should be ErrNotStylesheet")
+	})
+	t.Run("unknown template", func(t *testing.T) {
+		_, err := transform(t, stylesheetHeader+`<xsl:template match="/"><xsl:call-template name="nothing"/></xsl:template></xsl:stylesheet>`, `<doc/>`, nil)
+		assert.True(t, errors.Is(err, xslt.ErrUnknownTemplate), "error should be ErrUnknownTemplate")
+	})
+	t.Run("invalid expression", func(t *testing.T) {
+		_, err := transform(t, stylesheetHeader+`
+<xsl:template match="/"><xsl:value-of select="1 +"/></xsl:template></xsl:stylesheet>`, `<doc/>`, nil)
+		var xerr *xslt.Error
+		if !assert.True(t, errors.As(err, &xerr), "error should be an *xslt.Error") {
+			return
+		}
+		assert.Equal(t, "xsl:value-of", xerr.Node.Name(), "error should refer to the instruction")
+		assert.Equal(t, 4, xerr.Node.(helium.Positioned).Line(), "error should have the line of the instruction")
+	})
+	t.Run("recursion", func(t *testing.T) {
+		_, err := transform(t, stylesheetHeader+`<xsl:template match="/"><xsl:apply-templates select="."/></xsl:template></xsl:stylesheet>`, `<doc/>`, nil)
+		assert.True(t, errors.Is(err, xslt.ErrRecursion), "error should be ErrRecursion")
+	})
+	t.Run("terminate", func(t *testing.T) {
+		doc, err := helium.Parse([]byte(stylesheetHeader + `<xsl:template match="/"><xsl:message>note</xsl:message><xsl:message terminate="yes">stop <xsl:value-of select="name(*)"/></xsl:message></xsl:template></xsl:stylesheet>`))
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+		ss, err := xslt.Compile(doc)
+		if !assert.NoError(t, err, "Compile should succeed") {
+			return
+		}
+		var messages []string
+		ss.SetMessageHandler(func(msg string, terminate bool) {
+			messages = append(messages, msg)
+		})
+		in, err := helium.Parse([]byte(`<doc/>`))
+		if !assert.NoError(t, err, "Parse should succeed") {
+			return
+		}
+		_, err = ss.Transform(in, nil)
+		assert.True(t, errors.Is(err, xslt.ErrTerminated), "error should be ErrTerminated")
+		assert.Equal(t, []string{"note", "stop doc"}, messages, "messages should be received")
+	})
+}